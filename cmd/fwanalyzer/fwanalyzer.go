@@ -50,19 +50,21 @@ func readFileWithCfgPath(filepath string, cfgpath []string) (string, error) {
 
 // read config file and parse Include statement reading all config files that are included
 func readConfig(filepath string, cfgpath []string) (string, error) {
-	cfg := ""
-	cfgBytes, err := readFileWithCfgPath(filepath, cfgpath)
-	cfg = string(cfgBytes)
+	cfg, err := readFileWithCfgPath(filepath, cfgpath)
 	if err != nil {
 		return cfg, err
 	}
+	return includeConfig(cfg, cfgpath)
+}
 
+// parse Include statement and append all config files that are included
+func includeConfig(cfg string, cfgpath []string) (string, error) {
 	type includeCfg struct {
 		Include map[string]interface{}
 	}
 
 	var include includeCfg
-	_, err = toml.Decode(cfg, &include)
+	_, err := toml.Decode(cfg, &include)
 	if err != nil {
 		return cfg, err
 	}
@@ -76,6 +78,31 @@ func readConfig(filepath string, cfgpath []string) (string, error) {
 	return cfg, nil
 }
 
+// runAnalyzer adds all plugins and runs them, returns false if the FsType is not supported
+func runAnalyzer(a *analyzer.Analyzer, cfgdata string, extra string, invertMatch bool, jobs int, verbose bool) bool {
+	supported, msg := a.FsTypeSupported()
+	if !supported {
+		fmt.Fprintf(os.Stderr, "%s\n", msg)
+		return false
+	}
+
+	a.AddAnalyzerPlugin(globalfilechecks.New(cfgdata, a))
+	a.AddAnalyzerPlugin(filecontent.New(cfgdata, a, invertMatch))
+	a.AddAnalyzerPlugin(filecmp.New(cfgdata, a, extra))
+	a.AddAnalyzerPlugin(dataextract.New(cfgdata, a))
+	a.AddAnalyzerPlugin(dircontent.New(cfgdata, a))
+	a.AddAnalyzerPlugin(filestatcheck.New(cfgdata, a))
+	a.AddAnalyzerPlugin(filepathowner.New(cfgdata, a))
+	a.AddAnalyzerPlugin(filetree.New(cfgdata, a, extra))
+
+	a.SetJobs(jobs)
+	a.RunPlugins()
+	if verbose {
+		fmt.Fprintln(os.Stderr, a.CacheStats())
+	}
+	return true
+}
+
 type arrayFlags []string
 
 func (af *arrayFlags) String() string {
@@ -96,6 +123,8 @@ func main() {
 	flag.Var(&cfgpath, "cfgpath", "path to config file and included files (can be repated)")
 	var errorExit = flag.Bool("ee", false, "exit with error if offenders are present")
 	var invertMatch = flag.Bool("invertMatch", false, "invert RegEx Match")
+	var jobs = flag.Int("j", 1, "number of checks that run in parallel (FileContent, FileCmp, FileTreeCheck)")
+	var verbose = flag.Bool("v", false, "print statistics (e.g. of the content cache) to stderr")
 	flag.Parse()
 
 	if *in == "" || *cfg == "" {
@@ -115,26 +144,40 @@ func main() {
 		*extra = path.Dir(*cfg)
 	}
 
-	analyzer := analyzer.NewFromConfig(*in, string(cfgdata))
-
-	supported, msg := analyzer.FsTypeSupported()
-	if !supported {
-		fmt.Fprintf(os.Stderr, "%s\n", msg)
-		os.Exit(1)
+	var report string
+	var hasOffenders bool
+	if analyzer.IsDiskConfig(cfgdata) {
+		// whole-disk image: every partition with a config section is analyzed separately
+		disk := analyzer.NewDiskFromConfig(*in, cfgdata)
+		for _, p := range disk.Partitions {
+			if p.CfgData == "" {
+				continue
+			}
+			pcfgdata, err := includeConfig(p.CfgData, cfgpath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not read config for partition: %s, error: %s\n", p.Name(), err)
+				_ = disk.CleanUp()
+				os.Exit(1)
+			}
+			if !runAnalyzer(disk.NewAnalyzer(p, pcfgdata), pcfgdata, *extra, *invertMatch, *jobs, *verbose) {
+				_ = disk.CleanUp()
+				os.Exit(1)
+			}
+		}
+		report = disk.JsonReport()
+		hasOffenders = disk.HasOffenders()
+		_ = disk.CleanUp()
+	} else {
+		analyzer := analyzer.NewFromConfig(*in, cfgdata)
+		if !runAnalyzer(analyzer, cfgdata, *extra, *invertMatch, *jobs, *verbose) {
+			_ = analyzer.CleanUp()
+			os.Exit(1)
+		}
+		report = analyzer.JsonReport()
+		hasOffenders = analyzer.HasOffenders()
+		_ = analyzer.CleanUp()
 	}
 
-	analyzer.AddAnalyzerPlugin(globalfilechecks.New(string(cfgdata), analyzer))
-	analyzer.AddAnalyzerPlugin(filecontent.New(string(cfgdata), analyzer, *invertMatch))
-	analyzer.AddAnalyzerPlugin(filecmp.New(string(cfgdata), analyzer, *extra))
-	analyzer.AddAnalyzerPlugin(dataextract.New(string(cfgdata), analyzer))
-	analyzer.AddAnalyzerPlugin(dircontent.New(string(cfgdata), analyzer))
-	analyzer.AddAnalyzerPlugin(filestatcheck.New(string(cfgdata), analyzer))
-	analyzer.AddAnalyzerPlugin(filepathowner.New(string(cfgdata), analyzer))
-	analyzer.AddAnalyzerPlugin(filetree.New(string(cfgdata), analyzer, *extra))
-
-	analyzer.RunPlugins()
-
-	report := analyzer.JsonReport()
 	if *out == "" {
 		fmt.Fprintln(os.Stderr, "Use '-' for stdout or provide a filename.")
 	} else if *out == "-" {
@@ -146,10 +189,8 @@ func main() {
 		}
 	}
 
-	_ = analyzer.CleanUp()
-
 	// signal offenders by providing a error exit code
-	if *errorExit && analyzer.HasOffenders() {
+	if *errorExit && hasOffenders {
 		os.Exit(1)
 	}
 }
@@ -45,7 +45,7 @@ class CheckOTA:
         cmd = self._fwanalyzer + " -in " + img + cfginclude + " -cfg " + cfg + " -out " + out
         subprocess.check_call(cmd, shell=True)
 
-    def unpack(self, otafile, otaunpacker, mkboot):
+    def unpack(self, otafile):
         # customize based on firmware
         #
         # create tmp + unpackdir
@@ -53,12 +53,6 @@ class CheckOTA:
         subprocess.check_call(cmd, shell=True)
         cmd = "unzip " + otafile
         subprocess.check_call(cmd, shell=True, cwd=self._unpackdir)
-        # unpack payload
-        cmd = otaunpacker + " payload.bin"
-        subprocess.check_call(cmd, shell=True, cwd=self._unpackdir)
-        # unpack boot.img
-        cmd = mkboot + " boot.img boot_img"
-        subprocess.check_call(cmd, shell=True, cwd=self._unpackdir)
 
     def delTmpDir(self):
         cmd = "rm -rf " + self._tmpdir
@@ -85,10 +79,10 @@ def getOut(name):
     return name + "_out.json"
 
 
+# the partitions are read from payload.bin directly,
+# the config needs to select the partition using FsTypeOptions (e.g. "partition=system")
 def getImg(name):
-    if name == "boot":
-        return "unpacked/"
-    return "unpacked/" + name + ".img"
+    return "unpacked/payload.bin"
 
 
 def hashfile(fpath):
@@ -144,12 +138,10 @@ if __name__ == "__main__":
 
     ota = os.path.realpath(args.ota)
     cfg = os.path.realpath(args.cfg_path)
-    otaunpacker = "extract_android_ota_payload.py"
-    bootunpacker = "mkboot"
 
     check = CheckOTA(args.fwanalyzer_bin)
     if not ota.endswith("unpacked"):
-        check.unpack(ota, otaunpacker, bootunpacker)
+        check.unpack(ota)
     else:
         check.setUnpacked(ota)
         args.keep_unpacked = True
@@ -17,13 +17,11 @@ fi
 
 # unpack
 unzip $OTAFILE >../unpack.log 2>&1
-extract_android_ota_payload.py payload.bin >>../unpack.log 2>&1
-mkboot boot.img boot_img >>../unpack.log 2>&1
 
 # output targets, targets are consumed by check.py
 # key = name of fwanalyzer config file without extension
 #   e.g. 'system' => will look for 'system.toml'
 # value = path to filesystem image (or directory)
 
-# analyze system.img using system.toml
-echo -n '{ "system": "unpacked/system.img" }'
+# analyze the system partition of payload.bin using system.toml (system.toml selects the partition)
+echo -n '{ "system": "unpacked/payload.bin" }'
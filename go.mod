@@ -5,5 +5,9 @@ go 1.13
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/bmatcuk/doublestar v1.1.4
-	github.com/google/go-cmp v0.2.0
+	github.com/frankban/quicktest v1.14.6 // indirect
+	github.com/google/go-cmp v0.5.9
+	github.com/klauspost/compress v1.11.13
+	github.com/pierrec/lz4 v2.6.1+incompatible
+	github.com/ulikunitz/xz v0.5.10
 )
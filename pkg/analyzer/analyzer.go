@@ -18,24 +18,37 @@ package analyzer
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 
+	"github.com/cruise-automation/fwanalyzer/pkg/bootimgparser"
 	"github.com/cruise-automation/fwanalyzer/pkg/cpioparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
 	"github.com/cruise-automation/fwanalyzer/pkg/dirparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/erofsparser"
 	"github.com/cruise-automation/fwanalyzer/pkg/extparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/fitimageparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsdetect"
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/jffs2parser"
+	"github.com/cruise-automation/fwanalyzer/pkg/payloadparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/sparseimg"
 	"github.com/cruise-automation/fwanalyzer/pkg/squashfsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/tarparser"
 	"github.com/cruise-automation/fwanalyzer/pkg/ubifsparser"
 	"github.com/cruise-automation/fwanalyzer/pkg/util"
 	"github.com/cruise-automation/fwanalyzer/pkg/vfatparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/zipparser"
 )
 
 type AnalyzerPluginType interface {
@@ -45,11 +58,21 @@ type AnalyzerPluginType interface {
 	CheckFile(fi *fsparser.FileInfo, path string) error
 }
 
+// AnalyzerPluginConcurrentType is implemented by plugins that are safe to run
+// concurrently (optional). If more than one job is used (see SetJobs) CheckFileConcurrent
+// is called instead of CheckFile from multiple goroutines at the same time. The plugin has
+// to report through the given AnalyzerType, the results are added to the report in the
+// same order as if the plugins ran one after another.
+type AnalyzerPluginConcurrentType interface {
+	CheckFileConcurrent(a AnalyzerType, fi *fsparser.FileInfo, filepath string) error
+}
+
 type AnalyzerType interface {
 	GetFileInfo(filepath string) (fsparser.FileInfo, error)
 	RemoveFile(filepath string) error
 	FileGetSha256(filepath string) ([]byte, error)
 	FileGet(filepath string) (string, error)
+	FileOpen(filepath string) (io.ReadCloser, error)
 	AddOffender(filepath string, reason string)
 	AddInformational(filepath string, reason string)
 	CheckAllFilesWithPath(cb AllFilesCallback, cbdata AllFilesCallbackData, filepath string)
@@ -60,37 +83,68 @@ type AnalyzerType interface {
 type AllFilesCallbackData interface{}
 type AllFilesCallback func(fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData)
 
+// AllFilesConcurrentCallback is called by CheckAllFilesConcurrent, the results have to be reported through a
+type AllFilesConcurrentCallback func(a AnalyzerType, fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData)
+
+// FsType to detect the filesystem type based on the image content
+const FsTypeAuto = "auto"
+
 type globalConfigType struct {
 	FSType        string
 	FSTypeOptions string
 	DigestImage   bool
+	// size of the content cache in MiB, 0 disables the cache
+	ContentCacheSize *int
 }
 
 type AnalyzerReport struct {
 	FSType        string                   `json:"fs_type"`
 	ImageName     string                   `json:"image_name"`
 	ImageDigest   string                   `json:"image_digest,omitempty"`
+	RawDigest     string                   `json:"raw_image_digest,omitempty"`
+	Mounts        []MountReport            `json:"mounts,omitempty"`
 	Data          map[string]interface{}   `json:"data,omitempty"`
 	Offenders     map[string][]interface{} `json:"offenders,omitempty"`
 	Informational map[string][]interface{} `json:"informational,omitempty"`
 }
 
 type Analyzer struct {
-	fsparser      fsparser.FsParser
-	tmpdir        string
-	config        globalConfigType
-	analyzers     []AnalyzerPluginType
+	fsparser  fsparser.FsParser
+	tmpdir    string
+	config    globalConfigType
+	analyzers []AnalyzerPluginType
+	cache     *contentCache
+	// statistics of the content cache of the last RunPlugins
+	cacheStats cacheStats
+	extracted  map[string]string
+	// number of plugin jobs that run at the same time
+	jobs int
+	// worker pool and the results of the plugins in the order of the serial run,
+	// only set while the plugins run concurrently
+	pool       *workerPool
+	jobReports []*jobReport
+	// serializes the access to the fsparser and the cache, the parsers are not thread-safe
+	fsLock        sync.Mutex
 	PluginReports map[string]interface{}
 	AnalyzerReport
 }
 
 func New(fsp fsparser.FsParser, cfg globalConfigType) *Analyzer {
+	tmpdir, _ := util.MkTmpDir("analyzer")
+	return newAnalyzer(fsp, cfg, tmpdir, fsp.ImageName())
+}
+
+// newAnalyzer creates the analyzer for an image that was already prepared in tmpdir,
+// imagename is the image as given by the user and differs from fsp.ImageName()
+// if the image was decompressed, extracted, or expanded (e.g. OTA payload or Android sparse image)
+func newAnalyzer(fsp fsparser.FsParser, cfg globalConfigType, tmpdir string, imagename string) *Analyzer {
 	var a Analyzer
 	a.config = cfg
 	a.fsparser = fsp
 	a.FSType = cfg.FSType
-	a.ImageName = fsp.ImageName()
-	a.tmpdir, _ = util.MkTmpDir("analyzer")
+	a.ImageName = imagename
+	a.tmpdir = tmpdir
+	a.jobs = 1
 	a.Offenders = make(map[string][]interface{})
 	a.Informational = make(map[string][]interface{})
 	a.Data = make(map[string]interface{})
@@ -98,14 +152,31 @@ func New(fsp fsparser.FsParser, cfg globalConfigType) *Analyzer {
 
 	if cfg.DigestImage {
 		a.ImageDigest = hex.EncodeToString(util.DigestFileSha256(a.ImageName))
+		if fsp.ImageName() != a.ImageName {
+			a.RawDigest = hex.EncodeToString(util.DigestFileSha256(fsp.ImageName()))
+		}
 	}
 
 	return &a
 }
 
+// fsTypeOptionValue returns the value of a name=value option from FSTypeOptions,
+// options are separated by spaces or commas
+func fsTypeOptionValue(options string, name string) string {
+	fields := strings.FieldsFunc(options, func(r rune) bool { return r == ' ' || r == ',' })
+	for _, field := range fields {
+		if strings.HasPrefix(field, name+"=") {
+			return strings.TrimPrefix(field, name+"=")
+		}
+	}
+	return ""
+}
+
 func NewFromConfig(imagepath string, cfgdata string) *Analyzer {
 	type globalconfig struct {
 		GlobalConfig globalConfigType
+		Mount        map[string]mountConfigType
+		Nested       map[string]nestedConfigType
 	}
 	var config globalconfig
 
@@ -114,29 +185,125 @@ func NewFromConfig(imagepath string, cfgdata string) *Analyzer {
 		panic("can't read config data: " + err.Error())
 	}
 
+	var a *Analyzer
+	if strings.EqualFold(config.GlobalConfig.FSType, FsTypeComposite) {
+		a = newCompositeFromConfig(imagepath, config.GlobalConfig, config.Mount)
+	} else {
+		a = newFromGlobalConfig(imagepath, config.GlobalConfig)
+	}
+	a.addNested(config.Nested)
+	return a
+}
+
+func newFromGlobalConfig(imagepath string, cfg globalConfigType) *Analyzer {
+	tmpdir, _ := util.MkTmpDir("analyzer")
+	imagename := imagepath
+	imagepath, err := prepareImage(imagepath, tmpdir, cfg)
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		panic(err.Error())
+	}
+	// probe the magic numbers if the FsType is not set
+	if cfg.FSType == "" || strings.EqualFold(cfg.FSType, FsTypeAuto) {
+		cfg.FSType = fsdetect.Detect(imagepath)
+		if cfg.FSType == "" {
+			os.RemoveAll(tmpdir)
+			panic("Cannot detect the filesystem type of: " + imagename)
+		}
+	}
+
+	return newAnalyzer(newParser(imagepath, cfg), cfg, tmpdir, imagename)
+}
+
+// addNested mounts the images inside the image that match a Nested pattern
+func (a *Analyzer) addNested(nested map[string]nestedConfigType) {
+	if len(nested) > 0 {
+		a.fsparser = newNestedParser(a.fsparser, nested, a.tmpdir)
+	}
+}
+
+// prepareImage decompresses, extracts, and expands the image into tmpdir as needed,
+// it returns the path of the image that is handed to the parser
+func prepareImage(imagepath string, tmpdir string, cfg globalConfigType) (string, error) {
+	// compressed images (gzip, bzip2, xz, zstd, lz4) are decompressed into the tmpdir, this
+	// includes tar archives so the tarfs backend can read the files without decompressing
+	// the archive again
+	if decompress.IsCompressed(imagepath) {
+		rawpath := path.Join(tmpdir, strings.TrimSuffix(path.Base(imagepath), path.Ext(imagepath)))
+		// nested images are already in the tmpdir, don't overwrite an extension-less image
+		if rawpath == path.Clean(imagepath) {
+			rawpath += ".raw"
+		}
+		err := decompress.File(imagepath, rawpath)
+		if err != nil {
+			return "", errors.New("can't decompress image: " + err.Error())
+		}
+		imagepath = rawpath
+	}
+	// the partition of an Android OTA payload is extracted into the tmpdir (unless the payload itself is analyzed)
+	partition := fsTypeOptionValue(cfg.FSTypeOptions, "partition")
+	if partition != "" && !strings.EqualFold(cfg.FSType, "payload") && payloadparser.IsPayload(imagepath) {
+		rawpath := path.Join(tmpdir, partition+".img")
+		err := payloadparser.ExtractPartition(imagepath, partition, rawpath)
+		if err != nil {
+			return "", errors.New("can't extract partition from payload: " + err.Error())
+		}
+		imagepath = rawpath
+	}
+	// Android sparse images are expanded into the tmpdir, the parser only sees the raw image
+	if sparseimg.IsSparse(imagepath) {
+		rawpath := path.Join(tmpdir, path.Base(imagepath)+".raw")
+		err := sparseimg.Expand(imagepath, rawpath)
+		if err != nil {
+			return "", errors.New("can't expand sparse image: " + err.Error())
+		}
+		imagepath = rawpath
+	}
+	return imagepath, nil
+}
+
+// newParser returns the parser for the FSType in the config
+func newParser(imagepath string, cfg globalConfigType) fsparser.FsParser {
 	var fsp fsparser.FsParser
-	// Set the parser based on the FSType in the config
-	if strings.EqualFold(config.GlobalConfig.FSType, "extfs") {
+	if strings.EqualFold(cfg.FSType, "extfs") {
 		fsp = extparser.New(imagepath,
-			strings.Contains(config.GlobalConfig.FSTypeOptions, "selinux"),
-			strings.Contains(config.GlobalConfig.FSTypeOptions, "capabilities"))
-	} else if strings.EqualFold(config.GlobalConfig.FSType, "dirfs") {
+			strings.Contains(cfg.FSTypeOptions, "selinux"),
+			strings.Contains(cfg.FSTypeOptions, "capabilities"))
+	} else if strings.EqualFold(cfg.FSType, "dirfs") {
 		fsp = dirparser.New(imagepath)
-	} else if strings.EqualFold(config.GlobalConfig.FSType, "vfatfs") {
+	} else if strings.EqualFold(cfg.FSType, "vfatfs") {
 		fsp = vfatparser.New(imagepath)
-	} else if strings.EqualFold(config.GlobalConfig.FSType, "squashfs") {
+	} else if strings.EqualFold(cfg.FSType, "squashfs") {
 		fsp = squashfsparser.New(imagepath,
-			strings.Contains(config.GlobalConfig.FSTypeOptions, "securityinfo"))
-	} else if strings.EqualFold(config.GlobalConfig.FSType, "ubifs") {
-		fsp = ubifsparser.New(imagepath)
-	} else if strings.EqualFold(config.GlobalConfig.FSType, "cpiofs") {
+			strings.Contains(cfg.FSTypeOptions, "securityinfo"))
+	} else if strings.EqualFold(cfg.FSType, "ubifs") {
+		fsp = ubifsparser.New(imagepath,
+			fsTypeOptionValue(cfg.FSTypeOptions, "volume"),
+			strings.Contains(cfg.FSTypeOptions, "securityinfo"))
+	} else if strings.EqualFold(cfg.FSType, "cpiofs") {
 		fsp = cpioparser.New(imagepath,
-			strings.Contains(config.GlobalConfig.FSTypeOptions, "fixdirs"))
+			strings.Contains(cfg.FSTypeOptions, "fixdirs"))
+	} else if strings.EqualFold(cfg.FSType, "tarfs") {
+		fsp = tarparser.New(imagepath,
+			strings.Contains(cfg.FSTypeOptions, "fixdirs"))
+	} else if strings.EqualFold(cfg.FSType, "zipfs") {
+		fsp = zipparser.New(imagepath)
+	} else if strings.EqualFold(cfg.FSType, "jffs2fs") {
+		fsp = jffs2parser.New(imagepath,
+			strings.Contains(cfg.FSTypeOptions, "securityinfo"))
+	} else if strings.EqualFold(cfg.FSType, "erofs") {
+		fsp = erofsparser.New(imagepath)
+	} else if strings.EqualFold(cfg.FSType, "bootimg") {
+		fsp = bootimgparser.New(imagepath)
+	} else if strings.EqualFold(cfg.FSType, "payload") {
+		fsp = payloadparser.New(imagepath)
+	} else if strings.EqualFold(cfg.FSType, "fitimage") {
+		fsp = fitimageparser.New(imagepath)
 	} else {
-		panic("Cannot find an appropriate parser: " + config.GlobalConfig.FSType)
+		panic("Cannot find an appropriate parser: " + cfg.FSType)
 	}
 
-	return New(fsp, config.GlobalConfig)
+	return fsp
 }
 
 func (a *Analyzer) FsTypeSupported() (bool, string) {
@@ -152,6 +319,8 @@ func (a *Analyzer) ImageInfo() AnalyzerReport {
 		FSType:      a.FSType,
 		ImageName:   a.ImageName,
 		ImageDigest: a.ImageDigest,
+		RawDigest:   a.RawDigest,
+		Mounts:      a.Mounts,
 	}
 }
 
@@ -159,43 +328,109 @@ func (a *Analyzer) AddAnalyzerPlugin(aplug AnalyzerPluginType) {
 	a.analyzers = append(a.analyzers, aplug)
 }
 
-func (a *Analyzer) iterateFiles(curpath string) error {
-	dir, err := a.fsparser.GetDirInfo(curpath)
-	if err != nil {
-		return err
-	}
-	cp := curpath
-	for _, fi := range dir {
+// SetJobs sets the number of plugin jobs that run at the same time (default: 1),
+// only plugins that implement AnalyzerPluginConcurrentType are run concurrently
+func (a *Analyzer) SetJobs(jobs int) {
+	a.jobs = jobs
+}
+
+func (a *Analyzer) getDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	a.fsLock.Lock()
+	defer a.fsLock.Unlock()
+	return a.fsparser.GetDirInfo(dirpath)
+}
+
+// checkFile calls CheckFile of every plugin for the file, the concurrent plugins
+// run on the worker pool and report into their own jobReport
+func (a *Analyzer) checkFile(fi *fsparser.FileInfo, curpath string, batch *workBatch) error {
+	if a.pool == nil {
 		for _, ap := range a.analyzers {
-			err = ap.CheckFile(&fi, cp)
+			err := ap.CheckFile(fi, curpath)
 			if err != nil {
 				return err
 			}
 		}
+		return nil
+	}
 
-		if fi.IsDir() {
-			err = a.iterateFiles(path.Join(curpath, fi.Name))
+	for _, ap := range a.analyzers {
+		cp, ok := ap.(AnalyzerPluginConcurrentType)
+		if !ok {
+			// the results of the other plugins are recorded by AddOffender & co
+			err := ap.CheckFile(fi, curpath)
 			if err != nil {
 				return err
 			}
+			continue
+		}
+		job := a.newJobReport()
+		err := batch.run(func() error { return cp.CheckFileConcurrent(job, fi, curpath) })
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (a *Analyzer) checkRoot() error {
-	fi, err := a.fsparser.GetFileInfo("/")
+func (a *Analyzer) iterateFiles(curpath string, batch *workBatch) error {
+	dir, err := a.getDirInfo(curpath)
 	if err != nil {
 		return err
 	}
-
-	for _, ap := range a.analyzers {
-		err = ap.CheckFile(&fi, "/")
+	cp := curpath
+	for _, fi := range dir {
+		fi := fi
+		err = a.checkFile(&fi, cp, batch)
 		if err != nil {
 			return err
 		}
+
+		if fi.IsDir() {
+			err = a.iterateFiles(path.Join(curpath, fi.Name), batch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Analyzer) checkRoot(batch *workBatch) error {
+	fi, err := a.GetFileInfo("/")
+	if err != nil {
+		return err
 	}
 
+	return a.checkFile(&fi, "/", batch)
+}
+
+// checkFiles runs the plugins for every file, the concurrent plugins run on
+// the worker pool and their results are added in the order of the serial run
+func (a *Analyzer) checkFiles() error {
+	pool := newWorkerPool(a.jobs)
+	if pool != nil {
+		a.pool = pool
+		a.jobReports = []*jobReport{}
+		defer func() {
+			a.pool = nil
+			a.jobReports = nil
+		}()
+	}
+
+	batch := a.pool.newBatch()
+	err := a.checkRoot(batch)
+	if err == nil {
+		err = a.iterateFiles("/", batch)
+	}
+	if werr := batch.wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	for _, job := range a.jobReports {
+		job.applyAll()
+	}
 	return nil
 }
 
@@ -212,16 +447,26 @@ func (a *Analyzer) addPluginReport(report string) {
 }
 
 func (a *Analyzer) RunPlugins() {
+	cacheSize := defaultContentCacheSize
+	if a.config.ContentCacheSize != nil {
+		cacheSize = *a.config.ContentCacheSize
+	}
+	if cacheSize > 0 {
+		a.cache = newContentCache(int64(cacheSize) * 1024 * 1024)
+		defer func() {
+			a.cacheStats = a.cache.cacheStats
+			a.cache = nil
+		}()
+	}
+
 	for _, ap := range a.analyzers {
 		ap.Start()
 	}
 
-	err := a.checkRoot()
-	if err != nil {
-		panic("RunPlugins error: " + err.Error())
-	}
+	a.bulkExtract()
+	defer a.bulkCleanUp()
 
-	err = a.iterateFiles("/")
+	err := a.checkFiles()
 	if err != nil {
 		panic("RunPlugins error: " + err.Error())
 	}
@@ -232,43 +477,184 @@ func (a *Analyzer) RunPlugins() {
 	}
 }
 
+// CacheStats returns the statistics of the content cache of the last RunPlugins
+func (a *Analyzer) CacheStats() string {
+	return a.cacheStats.String()
+}
+
 func (a *Analyzer) CleanUp() error {
 	err := os.RemoveAll(a.tmpdir)
 	return err
 }
 
 func (a *Analyzer) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	a.fsLock.Lock()
+	defer a.fsLock.Unlock()
 	return a.fsparser.GetFileInfo(filepath)
 }
 
 func (a *Analyzer) FileGet(filepath string) (string, error) {
+	if tmpname, ok := a.extracted[filepath]; ok {
+		return tmpname, nil
+	}
 	tmpfile, _ := ioutil.TempFile(a.tmpdir, "")
 	tmpname := tmpfile.Name()
 	tmpfile.Close()
-	if a.fsparser.CopyFile(filepath, tmpname) {
-		return tmpname, nil
+
+	a.fsLock.Lock()
+	defer a.fsLock.Unlock()
+	if a.cache != nil {
+		// a hit saves the extraction from the image, the caller still gets its own
+		// copy of the file since it is removed after use
+		if data, ok := a.cache.get(filepath); ok {
+			return tmpname, ioutil.WriteFile(tmpname, data, 0600)
+		}
+	}
+	if !a.fsparser.CopyFile(filepath, tmpname) {
+		return "", errors.New("error copying file")
+	}
+	if a.cache != nil {
+		a.cache.extractions++
+		if st, err := os.Stat(tmpname); err == nil && a.cache.fits(st.Size()) {
+			if data, err := ioutil.ReadFile(tmpname); err == nil {
+				a.cache.add(filepath, data)
+			}
+		}
+	}
+	return tmpname, nil
+}
+
+// tmpFileReader removes the temporary copy of the file on Close
+type tmpFileReader struct {
+	*os.File
+}
+
+func (t *tmpFileReader) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
+
+// openFile streams the file if the parser implements fsparser.FileOpener,
+// otherwise the file is copied to tmpdir and removed once the reader is closed
+func openFile(fsp fsparser.FsParser, filepath string, tmpdir string) (io.ReadCloser, error) {
+	if opener, ok := fsp.(fsparser.FileOpener); ok {
+		return opener.Open(filepath)
+	}
+
+	tmpfile, err := ioutil.TempFile(tmpdir, "")
+	if err != nil {
+		return nil, err
+	}
+	tmpname := tmpfile.Name()
+	tmpfile.Close()
+	if !fsp.CopyFile(filepath, tmpname) {
+		os.Remove(tmpname)
+		return nil, errors.New("error copying file")
+	}
+	f, err := os.Open(tmpname)
+	if err != nil {
+		os.Remove(tmpname)
+		return nil, err
+	}
+	return &tmpFileReader{f}, nil
+}
+
+// lockedReader serializes the reads of a reader returned by the fsparser
+type lockedReader struct {
+	r  io.ReadCloser
+	mu *sync.Mutex
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
+func (l *lockedReader) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Close()
+}
+
+// FileOpen returns a reader for the content of the file, the caller has to close it
+func (a *Analyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	a.fsLock.Lock()
+	defer a.fsLock.Unlock()
+	if a.cache == nil {
+		r, err := openFile(a.fsparser, filepath, a.tmpdir)
+		if err != nil {
+			return nil, err
+		}
+		return &lockedReader{r, &a.fsLock}, nil
+	}
+	if data, ok := a.cache.get(filepath); ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	r, err := openFile(a.fsparser, filepath, a.tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	a.cache.extractions++
+	fi, err := a.fsparser.GetFileInfo(filepath)
+	if err != nil || !a.cache.fits(int64(fi.Size)) {
+		return &lockedReader{r, &a.fsLock}, nil
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
 	}
-	return "", errors.New("error copying file")
+	a.cache.add(filepath, data)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
 func (a *Analyzer) FileGetSha256(filepath string) ([]byte, error) {
-	tmpname, err := a.FileGet(filepath)
+	if digest, ok := a.cachedDigest(filepath); ok {
+		return digest, nil
+	}
+
+	r, err := a.FileOpen(filepath)
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 
-	defer os.Remove(tmpname)
-	digest := util.DigestFileSha256(tmpname)
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+	a.fsLock.Lock()
+	if a.cache != nil {
+		a.cache.addDigest(filepath, digest)
+	}
+	a.fsLock.Unlock()
 	return digest, nil
 }
 
+func (a *Analyzer) cachedDigest(filepath string) ([]byte, bool) {
+	a.fsLock.Lock()
+	defer a.fsLock.Unlock()
+	if a.cache == nil {
+		return nil, false
+	}
+	return a.cache.digest(filepath)
+}
+
 func (a *Analyzer) RemoveFile(filepath string) error {
+	// bulk extracted files are shared and removed after all plugins ran
+	if a.isBulkExtracted(filepath) {
+		return nil
+	}
 	os.Remove(filepath)
 	return nil
 }
 
 func (a *Analyzer) iterateAllDirs(curpath string, cb AllFilesCallback, cbdata AllFilesCallbackData) error {
-	dir, err := a.fsparser.GetDirInfo(curpath)
+	dir, err := a.getDirInfo(curpath)
 	if err != nil {
 		return err
 	}
@@ -294,7 +680,32 @@ func (a *Analyzer) CheckAllFilesWithPath(cb AllFilesCallback, cbdata AllFilesCal
 	}
 }
 
+// concurrentWalker is implemented by the AnalyzerType passed to CheckFileConcurrent
+type concurrentWalker interface {
+	checkAllFilesConcurrent(cb AllFilesConcurrentCallback, cbdata AllFilesCallbackData, filepath string)
+}
+
+// CheckAllFilesConcurrent is CheckAllFilesWithPath for concurrent plugins, if a was passed to
+// CheckFileConcurrent every callback runs on the worker pool. It returns once all callbacks are done.
+func CheckAllFilesConcurrent(a AnalyzerType, cb AllFilesConcurrentCallback, cbdata AllFilesCallbackData, filepath string) {
+	if w, ok := a.(concurrentWalker); ok {
+		w.checkAllFilesConcurrent(cb, cbdata, filepath)
+		return
+	}
+	a.CheckAllFilesWithPath(func(fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData) {
+		cb(a, fi, fullpath, data)
+	}, cbdata, filepath)
+}
+
 func (a *Analyzer) AddOffender(filepath string, reason string) {
+	a.addEntry(jobEntry{kind: offender, key: filepath, value: reason})
+}
+
+func (a *Analyzer) AddInformational(filepath string, reason string) {
+	a.addEntry(jobEntry{kind: informational, key: filepath, value: reason})
+}
+
+func (a *Analyzer) addOffender(filepath string, reason string) {
 	var data map[string]interface{}
 	// this is valid json?
 	if err := json.Unmarshal([]byte(reason), &data); err == nil {
@@ -306,7 +717,7 @@ func (a *Analyzer) AddOffender(filepath string, reason string) {
 	}
 }
 
-func (a *Analyzer) AddInformational(filepath string, reason string) {
+func (a *Analyzer) addInformational(filepath string, reason string) {
 	var data map[string]interface{}
 	// this is valid json?
 	if err := json.Unmarshal([]byte(reason), &data); err == nil {
@@ -323,6 +734,10 @@ func (a *Analyzer) HasOffenders() bool {
 }
 
 func (a *Analyzer) AddData(key string, value string) {
+	a.addEntry(jobEntry{kind: data, key: key, value: value})
+}
+
+func (a *Analyzer) addData(key string, value string) {
 	// this is a valid json object?
 	var data map[string]interface{}
 	if err := json.Unmarshal([]byte(value), &data); err == nil {
@@ -366,6 +781,8 @@ func (a *Analyzer) JsonReport() string {
 		Data:          a.Data,
 		ImageName:     a.ImageName,
 		ImageDigest:   a.ImageDigest,
+		RawDigest:     a.RawDigest,
+		Mounts:        a.Mounts,
 	}
 
 	jdata, _ := json.Marshal(ar)
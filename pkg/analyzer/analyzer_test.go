@@ -17,8 +17,23 @@ limitations under the License.
 package analyzer
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
 )
 
 func TestBasic(t *testing.T) {
@@ -66,10 +81,839 @@ DigestImage = false
 		t.Errorf("filename does not match")
 	}
 
-	err = analyzer.checkRoot()
+	err = analyzer.checkRoot(analyzer.pool.newBatch())
 	if err != nil {
 		t.Errorf("checkroot failed with %s", err)
 	}
 
 	_ = analyzer.CleanUp()
 }
+
+func TestFsTypeOptionValue(t *testing.T) {
+	tests := []struct {
+		options string
+		value   string
+	}{
+		{"", ""},
+		{"securityinfo", ""},
+		{"volume=rootfs", "rootfs"},
+		{"securityinfo volume=rootfs", "rootfs"},
+		{"securityinfo,volume=rootfs", "rootfs"},
+		{"volumes=rootfs", ""},
+	}
+	for _, test := range tests {
+		if v := fsTypeOptionValue(test.options, "volume"); v != test.value {
+			t.Errorf("%q: expected %q got %q", test.options, test.value, v)
+		}
+	}
+}
+
+func TestSparseImage(t *testing.T) {
+	cfg := `
+[GlobalConfig]
+FsType = "extfs"
+DigestImage = true
+`
+
+	analyzer := NewFromConfig("../../test/ext4_sparse.img", cfg)
+	defer analyzer.CleanUp()
+
+	if analyzer.ImageName != "../../test/ext4_sparse.img" {
+		t.Errorf("ImageName should be the sparse image: %s", analyzer.ImageName)
+	}
+	if analyzer.ImageDigest != "60d2d208589604480df4cc1a5901b80f1a78a5d9398beebc42ea2be94a0615c4" {
+		t.Errorf("bad sparse digest: %s", analyzer.ImageDigest)
+	}
+	if analyzer.RawDigest != "dc720ff3c38dd9701acfb51e3851c5b0e458e7dd12d136f9475310a9f9ea4e58" {
+		t.Errorf("bad raw digest: %s", analyzer.RawDigest)
+	}
+
+	fi, err := analyzer.GetFileInfo("/file1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsFile() || fi.Size != 11 {
+		t.Errorf("bad file info for /file1.txt: %v", fi)
+	}
+
+	// raw images are passed to the parser as is
+	analyzer = NewFromConfig("../../test/ext4.img", cfg)
+	defer analyzer.CleanUp()
+	if analyzer.RawDigest != "" {
+		t.Errorf("raw image should not have a raw digest")
+	}
+}
+
+func TestPayloadPartition(t *testing.T) {
+	cfg := `
+[GlobalConfig]
+FsType = "erofs"
+FsTypeOptions = "partition=system"
+DigestImage = true
+`
+
+	analyzer := NewFromConfig("../../test/payload.bin", cfg)
+	defer analyzer.CleanUp()
+
+	if analyzer.ImageName != "../../test/payload.bin" {
+		t.Errorf("ImageName should be the payload: %s", analyzer.ImageName)
+	}
+	if analyzer.RawDigest != "954692b094918ba65a6f85b410b20e4eff172b4f7926ca525d145f318e5faa3e" {
+		t.Errorf("bad partition digest: %s", analyzer.RawDigest)
+	}
+	fi, err := analyzer.GetFileInfo("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsSUid() || fi.Size != 8893 {
+		t.Errorf("bad file info for /bin/busybox: %v", fi)
+	}
+
+	// the payload itself lists the partitions
+	cfg = `
+[GlobalConfig]
+FsType = "payload"
+FsTypeOptions = "partition=system"
+`
+	analyzer = NewFromConfig("../../test/payload.bin", cfg)
+	defer analyzer.CleanUp()
+	fi, err = analyzer.GetFileInfo("/system.img")
+	if err != nil || fi.Size != 20480 {
+		t.Errorf("bad file info for /system.img: %v %v", fi, err)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	cfg := `
+[GlobalConfig]
+FsType = "disk"
+DigestImage = true
+
+[Partition.rootfs.GlobalConfig]
+DigestImage = true
+
+[Partition.rootfs.Test]
+a = "a"
+
+[Partition."3".GlobalConfig]
+FsType = "cpiofs"
+FsTypeOptions = "fixdirs"
+`
+	if !IsDiskConfig(cfg) {
+		t.Fatal("disk config not detected")
+	}
+
+	disk := NewDiskFromConfig("../../test/disk.img", cfg)
+	defer disk.CleanUp()
+
+	if disk.PartitionTable != "gpt" || len(disk.Partitions) != 3 {
+		t.Fatalf("bad partition table: %s %d", disk.PartitionTable, len(disk.Partitions))
+	}
+	rootfs := disk.Partitions[0]
+	if rootfs.Name() != "rootfs" || rootfs.FSType != "erofs" || !strings.Contains(rootfs.CfgData, "Test") {
+		t.Errorf("bad rootfs partition: %s %s %s", rootfs.Name(), rootfs.FSType, rootfs.CfgData)
+	}
+	// partitions without config are only identified
+	if disk.Partitions[1].Name() != "data" || disk.Partitions[1].FSType != "squashfs" || disk.Partitions[1].CfgData != "" {
+		t.Errorf("bad data partition: %v", disk.Partitions[1])
+	}
+
+	a := disk.NewAnalyzer(rootfs, rootfs.CfgData)
+	if a.ImageName != "../../test/disk.img:rootfs" || a.FSType != "erofs" {
+		t.Errorf("bad image name or fs type: %s %s", a.ImageName, a.FSType)
+	}
+	if a.ImageDigest != "954692b094918ba65a6f85b410b20e4eff172b4f7926ca525d145f318e5faa3e" {
+		t.Errorf("bad partition digest: %s", a.ImageDigest)
+	}
+	fi, err := a.GetFileInfo("/bin/busybox")
+	if err != nil || !fi.IsSUid() {
+		t.Errorf("bad file info for /bin/busybox: %v %v", fi, err)
+	}
+	a.AddOffender("/bin/busybox", "suid")
+
+	a = disk.NewAnalyzer(disk.Partitions[2], disk.Partitions[2].CfgData)
+	fi, err = a.GetFileInfo("/etc/fstab")
+	if err != nil || fi.Size != 385 {
+		t.Errorf("bad file info for /etc/fstab: %v %v", fi, err)
+	}
+
+	if !disk.HasOffenders() {
+		t.Errorf("offenders of the partitions should be reported")
+	}
+	var report struct {
+		FSType      string `json:"fs_type"`
+		ImageDigest string `json:"image_digest"`
+		Partitions  []struct {
+			Label  string `json:"label"`
+			FSType string `json:"fs_type"`
+			Report *struct {
+				Offenders map[string][]interface{} `json:"offenders"`
+			} `json:"report"`
+		} `json:"partitions"`
+	}
+	if err := json.Unmarshal([]byte(disk.JsonReport()), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.FSType != "disk" || report.ImageDigest == "" || len(report.Partitions) != 3 {
+		t.Fatalf("bad report: %v", report)
+	}
+	if report.Partitions[0].Report == nil || len(report.Partitions[0].Report.Offenders["/bin/busybox"]) != 1 {
+		t.Errorf("rootfs report missing")
+	}
+	if report.Partitions[1].Report != nil || report.Partitions[1].FSType != "squashfs" {
+		t.Errorf("data partition should not have a report")
+	}
+	if report.Partitions[2].FSType != "cpiofs" {
+		t.Errorf("FsType of the partition config should be used: %s", report.Partitions[2].FSType)
+	}
+}
+
+func TestDiskUnknownPartition(t *testing.T) {
+	cfg := `
+[GlobalConfig]
+FsType = "disk"
+
+[Partition.vendor.GlobalConfig]
+FsType = "extfs"
+`
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("config for a missing partition should fail")
+		}
+	}()
+	NewDiskFromConfig("../../test/disk.img", cfg)
+}
+
+func TestAutoFsType(t *testing.T) {
+	tests := []struct {
+		cfg    string
+		image  string
+		fsType string
+	}{
+		{"[GlobalConfig]\nFsType = \"auto\"\n", "../../test/testdir", "dirfs"},
+		{"[GlobalConfig]\nFsType = \"auto\"\n", "../../test/squashfs.img", "squashfs"},
+		// sparse images are detected after expansion
+		{"[GlobalConfig]\nFsType = \"auto\"\n", "../../test/ext4_sparse.img", "extfs"},
+		{"[GlobalConfig]\nFsTypeOptions = \"partition=system\"\n", "../../test/payload.bin", "erofs"},
+		// auto is the default
+		{"[GlobalConfig]\n", "../../test/vfat.img", "vfatfs"},
+		{"", "../../test/test.cpio", "cpiofs"},
+	}
+	for _, test := range tests {
+		analyzer := NewFromConfig(test.image, test.cfg)
+		if analyzer.FSType != test.fsType || analyzer.ImageInfo().FSType != test.fsType {
+			t.Errorf("%s: expected %s, got %s", test.image, test.fsType, analyzer.FSType)
+		}
+		analyzer.CleanUp()
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("unknown image type should fail")
+		}
+	}()
+	NewFromConfig("../../test/test_cfg.toml", "")
+}
+
+func TestCompressedImage(t *testing.T) {
+	cfg := `
+[GlobalConfig]
+FsType = "extfs"
+DigestImage = true
+`
+
+	analyzer := NewFromConfig("../../test/ext4.img.gz", cfg)
+	defer analyzer.CleanUp()
+
+	if analyzer.ImageName != "../../test/ext4.img.gz" {
+		t.Errorf("ImageName should be the compressed image: %s", analyzer.ImageName)
+	}
+	if analyzer.ImageDigest != "8150a8f7bca1bd970cd174600e0553f11f8997ecfb167b505324601aa954cfb2" {
+		t.Errorf("bad compressed digest: %s", analyzer.ImageDigest)
+	}
+	if analyzer.RawDigest != "dc720ff3c38dd9701acfb51e3851c5b0e458e7dd12d136f9475310a9f9ea4e58" {
+		t.Errorf("bad raw digest: %s", analyzer.RawDigest)
+	}
+	fi, err := analyzer.GetFileInfo("/file1.txt")
+	if err != nil || fi.Size != 11 {
+		t.Errorf("bad file info for /file1.txt: %v %v", fi, err)
+	}
+
+	// compressed sparse image with auto detection
+	cfg = `
+[GlobalConfig]
+DigestImage = true
+`
+	analyzer = NewFromConfig("../../test/ext4_sparse.img.gz", cfg)
+	defer analyzer.CleanUp()
+	if analyzer.FSType != "extfs" {
+		t.Errorf("bad fs type: %s", analyzer.FSType)
+	}
+	if analyzer.RawDigest != "dc720ff3c38dd9701acfb51e3851c5b0e458e7dd12d136f9475310a9f9ea4e58" {
+		t.Errorf("bad raw digest: %s", analyzer.RawDigest)
+	}
+}
+
+func TestNested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// gzip compressed initramfs
+	cpio, _ := ioutil.ReadFile("../../test/test.cpio")
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(cpio)
+	gw.Close()
+	_ = os.Mkdir(path.Join(dir, "boot"), 0755)
+	_ = ioutil.WriteFile(path.Join(dir, "boot", "initrd.img"), gz.Bytes(), 0644)
+
+	// extension-less name, larger than the read buffer of the decompressor
+	gz.Reset()
+	gw, _ = gzip.NewWriterLevel(&gz, gzip.NoCompression)
+	gw.Write(cpio)
+	gw.Write(make([]byte, 16*1024))
+	gw.Close()
+	_ = ioutil.WriteFile(path.Join(dir, "boot", "initrd"), gz.Bytes(), 0644)
+
+	// squashfs inside a tar inside the image
+	squashfs, _ := ioutil.ReadFile("../../test/squashfs.img")
+	var tb bytes.Buffer
+	tw := tar.NewWriter(&tb)
+	_ = tw.WriteHeader(&tar.Header{Name: "vendor.squashfs", Mode: 0644, Size: int64(len(squashfs)), Typeflag: tar.TypeReg})
+	tw.Write(squashfs)
+	tw.Close()
+	_ = ioutil.WriteFile(path.Join(dir, "vendor.tar"), tb.Bytes(), 0644)
+
+	// matches the pattern but is not an image
+	_ = ioutil.WriteFile(path.Join(dir, "data.squashfs"), []byte("not an image"), 0644)
+
+	cfg := `
+[GlobalConfig]
+FsType = "dirfs"
+
+[Nested."/boot/initrd.img"]
+FsType = "cpiofs"
+FsTypeOptions = "fixdirs"
+
+[Nested."/boot/initrd"]
+FsType = "cpiofs"
+FsTypeOptions = "fixdirs"
+
+[Nested."/*.tar"]
+
+[Nested."*.squashfs"]
+`
+	analyzer := NewFromConfig(dir, cfg)
+	defer analyzer.CleanUp()
+
+	var files []string
+	analyzer.CheckAllFilesWithPath(func(fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData) {
+		files = append(files, path.Join(fullpath, fi.Name))
+	}, nil, "/")
+	sort.Strings(files)
+	for _, f := range []string{
+		"/boot/initrd!/etc/fstab",
+		"/boot/initrd.img",
+		"/boot/initrd.img!",
+		"/boot/initrd.img!/etc/fstab",
+		"/data.squashfs",
+		"/vendor.tar!",
+		"/vendor.tar!/vendor.squashfs!",
+		"/vendor.tar!/vendor.squashfs!/dir2/file2",
+	} {
+		i := sort.SearchStrings(files, f)
+		if i >= len(files) || files[i] != f {
+			t.Errorf("%s missing: %v", f, files)
+		}
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f, "/data.squashfs!") {
+			t.Errorf("%s is not an image", f)
+		}
+	}
+
+	fi, err := analyzer.GetFileInfo("/boot/initrd.img!")
+	if err != nil || !fi.IsDir() || fi.Name != "initrd.img!" {
+		t.Errorf("bad mount point: %v %v", fi, err)
+	}
+	fi, err = analyzer.GetFileInfo("/boot/initrd.img!/etc/fstab")
+	if err != nil || fi.Size != 385 || fi.Name != "fstab" {
+		t.Errorf("bad nested file info: %v %v", fi, err)
+	}
+	fi, err = analyzer.GetFileInfo("/vendor.tar!/vendor.squashfs!/dir2/file2")
+	if err != nil || !fi.IsSUid() {
+		t.Errorf("bad nested file info: %v %v", fi, err)
+	}
+	tmpname, err := analyzer.FileGet("/vendor.tar!/vendor.squashfs!/dir2/subdir2/file4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(tmpname)
+	if len(data) != 20 {
+		t.Errorf("bad nested file content: %q", data)
+	}
+	if _, err = analyzer.GetFileInfo("/boot/initrd.img!/nothere"); err == nil {
+		t.Errorf("missing nested file should fail")
+	}
+
+	// bulk extraction is forwarded to the nested images
+	analyzer.AddAnalyzerPlugin(&bulkTestPlugin{a: analyzer, required: []RequiredFile{{Path: "/vendor.tar!/vendor.squashfs!/dir2"}}})
+	analyzer.bulkExtract()
+	defer analyzer.bulkCleanUp()
+	if len(analyzer.extracted) != 3 {
+		t.Errorf("all regular files below the nested /dir2 should be extracted: %v", analyzer.extracted)
+	}
+	data, err = ioutil.ReadFile(analyzer.extracted["/vendor.tar!/vendor.squashfs!/dir2/subdir2/file4"])
+	if err != nil || len(data) != 20 {
+		t.Errorf("bad content of the nested file: %q %v", data, err)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the root filesystem links into the vendor image
+	root := path.Join(dir, "root")
+	_ = os.MkdirAll(path.Join(root, "vendor"), 0755)
+	_ = os.MkdirAll(path.Join(root, "bin"), 0755)
+	_ = ioutil.WriteFile(path.Join(root, "bin", "sh"), []byte("shell"), 0755)
+	_ = os.Symlink("/vendor/dir2", path.Join(root, "etc"))
+	_ = os.Symlink("../vendor/dir2/file2", path.Join(root, "bin", "tool"))
+	_ = os.Symlink("loop", path.Join(root, "loop"))
+
+	// images are relative to the input directory unless the path is absolute
+	wd, _ := os.Getwd()
+	cfg := `
+[GlobalConfig]
+FsType = "composite"
+DigestImage = true
+
+[Mount."/"]
+Image = "root"
+FsType = "dirfs"
+
+[Mount."/vendor"]
+Image = "` + path.Join(wd, "../../test/squashfs.img") + `"
+`
+	analyzer := NewFromConfig(dir, cfg)
+	defer analyzer.CleanUp()
+
+	if len(analyzer.Mounts) != 2 || analyzer.Mounts[1].MountPoint != "/vendor" || analyzer.Mounts[1].FSType != "squashfs" ||
+		analyzer.Mounts[1].ImageDigest == "" {
+		t.Errorf("bad mounts: %v", analyzer.Mounts)
+	}
+
+	// the mount point replaces the directory in the root filesystem
+	fi, err := analyzer.GetFileInfo("/vendor")
+	if err != nil || fi.Name != "vendor" || fi.Uid != 1001 {
+		t.Errorf("bad mount point: %v %v", fi, err)
+	}
+	var files []string
+	analyzer.CheckAllFilesWithPath(func(fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData) {
+		files = append(files, path.Join(fullpath, fi.Name))
+	}, nil, "/")
+	sort.Strings(files)
+	if strings.Join(files, " ") != "/bin /bin/sh /bin/tool /etc /loop /vendor /vendor/Filey McFileFace /vendor/dir1 /vendor/dir2 "+
+		"/vendor/dir2/file1 /vendor/dir2/file2 /vendor/dir2/file3 /vendor/dir2/subdir2 /vendor/dir2/subdir2/file4" {
+		t.Errorf("bad tree: %v", files)
+	}
+
+	// inode numbers are only unique within a mount
+	fi, err = analyzer.GetFileInfo("/vendor/dir2/file1")
+	if err != nil || fi.HardlinkKey() != (fsparser.HardlinkKey{Image: "/vendor", Ino: fi.Ino}) {
+		t.Errorf("the hardlink key should contain the mount: %v %v", fi, err)
+	}
+
+	// links are resolved across the mount points
+	fi, err = analyzer.GetFileInfo("/etc")
+	if err != nil || !fi.IsLink() {
+		t.Errorf("/etc should be a link: %v %v", fi, err)
+	}
+	fi, err = analyzer.GetFileInfo("/etc/subdir2/file4")
+	if err != nil || fi.Size != 20 {
+		t.Errorf("bad file info through link: %v %v", fi, err)
+	}
+	dirInfo, err := analyzer.fsparser.GetDirInfo("/etc")
+	if err != nil || len(dirInfo) != 4 {
+		t.Errorf("bad dir info through link: %v %v", dirInfo, err)
+	}
+	for _, f := range []string{"/etc/file2", "/vendor/dir2/file2"} {
+		tmpname, err := analyzer.FileGet(f)
+		if err != nil {
+			t.Errorf("%s: %s", f, err)
+			continue
+		}
+		data, _ := ioutil.ReadFile(tmpname)
+		if len(data) != 5 {
+			t.Errorf("%s: bad content %q", f, data)
+		}
+	}
+	// the link itself is copied like in the other backends
+	tmpname, err := analyzer.FileGet("/bin/tool")
+	if err != nil {
+		t.Error(err)
+	} else if target, err := os.Readlink(tmpname); err != nil || target != "../vendor/dir2/file2" {
+		t.Errorf("/bin/tool should be copied as link: %q %v", target, err)
+	}
+	if _, err = analyzer.FileGet("/loop/file"); err == nil {
+		t.Errorf("link loop should fail")
+	}
+
+	// bulk extraction is forwarded to the mounts
+	analyzer.AddAnalyzerPlugin(&bulkTestPlugin{a: analyzer, required: []RequiredFile{{Path: "/vendor/dir2", Match: "file*"}}})
+	analyzer.bulkExtract()
+	defer analyzer.bulkCleanUp()
+	if len(analyzer.extracted) != 3 {
+		t.Errorf("all files below /vendor/dir2 should be extracted: %v", analyzer.extracted)
+	}
+	data, err := ioutil.ReadFile(analyzer.extracted["/vendor/dir2/subdir2/file4"])
+	if err != nil || len(data) != 20 {
+		t.Errorf("bad content of the file on the mount: %q %v", data, err)
+	}
+}
+
+func TestFileOpen(t *testing.T) {
+	analyzer := NewFromConfig("../../test/erofs.img", "[GlobalConfig]\nFsType = \"erofs\"\n")
+	defer analyzer.CleanUp()
+
+	r, err := analyzer.FileOpen("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || len(data) != 8893 {
+		t.Errorf("bad content of /bin/busybox: %d %v", len(data), err)
+	}
+	digest, err := analyzer.FileGetSha256("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(digest, sum[:]) {
+		t.Errorf("FileGetSha256 does not match the content")
+	}
+	if _, err := analyzer.FileOpen("/does/not/exist"); err == nil {
+		t.Errorf("open of a missing file should fail")
+	}
+
+	// payload has no native Open, the file is read through a temporary copy
+	analyzer = NewFromConfig("../../test/payload.bin", "[GlobalConfig]\nFsType = \"payload\"\nFsTypeOptions = \"partition=system\"\n")
+	defer analyzer.CleanUp()
+	r, err = analyzer.FileOpen("/system.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || len(data) != 20480 {
+		t.Errorf("bad content of /system.img: %d %v", len(data), err)
+	}
+	files, _ := ioutil.ReadDir(analyzer.tmpdir)
+	if len(files) != 0 {
+		t.Errorf("temporary copy was not removed: %v", files)
+	}
+}
+
+func TestContentCache(t *testing.T) {
+	c := newContentCache(10)
+	c.add("/a", []byte("12345"))
+	c.add("/b", []byte("1234"))
+	c.add("/big", []byte("12345678901"))
+	if _, ok := c.get("/big"); ok {
+		t.Errorf("content larger than the cache should not be cached")
+	}
+	// /a is now the most recently used entry, adding /c evicts /b
+	if data, ok := c.get("/a"); !ok || string(data) != "12345" {
+		t.Errorf("bad cached content for /a: %q", data)
+	}
+	c.add("/c", []byte("123"))
+	if _, ok := c.get("/b"); ok {
+		t.Errorf("/b should have been evicted")
+	}
+	if _, ok := c.get("/c"); !ok {
+		t.Errorf("/c should be cached")
+	}
+	if c.size != 8 || c.evictions != 1 || c.hits != 2 || c.digestHits != 0 {
+		t.Errorf("bad cache state: size %d %s", c.size, c.cacheStats)
+	}
+
+	analyzer := NewFromConfig("../../test/erofs.img", "[GlobalConfig]\nFsType = \"erofs\"\n")
+	defer analyzer.CleanUp()
+	analyzer.cache = newContentCache(defaultContentCacheSize * 1024 * 1024)
+
+	digest, err := analyzer.FileGetSha256("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := analyzer.FileGetSha256("/bin/busybox"); !bytes.Equal(d, digest) {
+		t.Errorf("cached digest differs")
+	}
+	r, err := analyzer.FileOpen("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], digest) {
+		t.Errorf("cached content does not match the digest")
+	}
+	tmpname, err := analyzer.FileGet("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer analyzer.RemoveFile(tmpname)
+	if data, _ := ioutil.ReadFile(tmpname); sha256.Sum256(data) != sum {
+		t.Errorf("bad content of the cached copy")
+	}
+	if analyzer.cache.extractions != 1 || analyzer.cache.hits != 2 || analyzer.cache.digestHits != 1 {
+		t.Errorf("file should be extracted once: %s", analyzer.cache.cacheStats)
+	}
+}
+
+type bulkTestPlugin struct {
+	a        *Analyzer
+	required []RequiredFile
+	files    map[string]string
+}
+
+func (p *bulkTestPlugin) Name() string     { return "BulkTest" }
+func (p *bulkTestPlugin) Start()           {}
+func (p *bulkTestPlugin) Finalize() string { return "" }
+func (p *bulkTestPlugin) RequiredFiles() []RequiredFile {
+	return p.required
+}
+func (p *bulkTestPlugin) CheckFile(fi *fsparser.FileInfo, filepath string) error {
+	fn := path.Join(filepath, fi.Name)
+	if fi.IsFile() && strings.HasPrefix(fn, "/dir2/") {
+		tmpname, err := p.a.FileGet(fn)
+		if err != nil {
+			return err
+		}
+		p.files[fn] = tmpname
+		return p.a.RemoveFile(tmpname)
+	}
+	return nil
+}
+
+func TestBulkExtract(t *testing.T) {
+	analyzer := NewFromConfig("../../test/squashfs.img", "[GlobalConfig]\nFsType = \"squashfs\"\n")
+	defer analyzer.CleanUp()
+
+	p := &bulkTestPlugin{a: analyzer, required: []RequiredFile{{Path: "/dir2", Match: "file[12]"}}, files: make(map[string]string)}
+	analyzer.AddAnalyzerPlugin(p)
+	analyzer.bulkExtract()
+	if len(analyzer.extracted) != 2 || analyzer.extracted["/dir2/file1"] == "" || analyzer.extracted["/dir2/file2"] == "" {
+		t.Errorf("only the files below /dir2 matching the pattern should be extracted: %v", analyzer.extracted)
+	}
+	analyzer.bulkCleanUp()
+
+	p.required = []RequiredFile{{Path: "/dir2"}}
+	analyzer.bulkExtract()
+	if len(analyzer.extracted) != 3 {
+		t.Errorf("all regular files below /dir2 should be extracted: %v", analyzer.extracted)
+	}
+	data, err := ioutil.ReadFile(analyzer.extracted["/dir2/subdir2/file4"])
+	if err != nil || string(data) != "feed me a stray cat\n" {
+		t.Errorf("bad content of /dir2/subdir2/file4: %q %v", data, err)
+	}
+	// FileOpen streams from the FsParser
+	r, err := analyzer.FileOpen("/dir2/subdir2/file4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := r.(*os.File); ok && strings.HasPrefix(f.Name(), analyzer.bulkDir()+"/") {
+		t.Errorf("FileOpen should not read the bulk extracted file")
+	}
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "feed me a stray cat\n" {
+		t.Errorf("bad content of /dir2/subdir2/file4: %q %v", data, err)
+	}
+	analyzer.bulkCleanUp()
+
+	analyzer.RunPlugins()
+	for _, fn := range []string{"/dir2/file1", "/dir2/file2", "/dir2/subdir2/file4"} {
+		if !strings.HasPrefix(p.files[fn], analyzer.bulkDir()+"/") {
+			t.Errorf("%s should be served from the bulk extracted files: %s", fn, p.files[fn])
+		}
+	}
+	if _, err := os.Stat(analyzer.bulkDir()); !os.IsNotExist(err) {
+		t.Errorf("bulk extracted files should be removed after the plugins ran")
+	}
+}
+
+// reportTestPlugin reads every file and reports it, CheckAllFilesConcurrent is used for /dir2
+type reportTestPlugin struct {
+	a    *Analyzer
+	name string
+}
+
+func (p *reportTestPlugin) Name() string     { return p.name }
+func (p *reportTestPlugin) Start()           {}
+func (p *reportTestPlugin) Finalize() string { return "" }
+func (p *reportTestPlugin) CheckFile(fi *fsparser.FileInfo, filepath string) error {
+	return p.check(p.a, fi, filepath)
+}
+
+func (p *reportTestPlugin) check(a AnalyzerType, fi *fsparser.FileInfo, filepath string) error {
+	fn := path.Join(filepath, fi.Name)
+	if fn == "/dir2" {
+		CheckAllFilesConcurrent(a, func(a AnalyzerType, fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData) {
+			a.AddInformational(path.Join(fullpath, fi.Name), p.name+" below /dir2")
+			a.AddInformational(path.Join(fullpath, fi.Name), p.name+" done")
+		}, nil, fn)
+	}
+	if !fi.IsFile() {
+		return nil
+	}
+	digest, err := a.FileGetSha256(fn)
+	if err != nil {
+		return err
+	}
+	a.AddOffender(fn, fmt.Sprintf("%s %x", p.name, digest[:4]))
+	a.AddOffender(fn, p.name+" done")
+	a.AddData(p.name+fn, fi.Name)
+	return nil
+}
+
+type concurrentTestPlugin struct {
+	reportTestPlugin
+}
+
+func (p *concurrentTestPlugin) CheckFileConcurrent(a AnalyzerType, fi *fsparser.FileInfo, filepath string) error {
+	return p.check(a, fi, filepath)
+}
+
+func TestRunPluginsConcurrent(t *testing.T) {
+	run := func(jobs int) map[string]interface{} {
+		analyzer := NewFromConfig("../../test/squashfs.img", "[GlobalConfig]\nFsType = \"squashfs\"\n")
+		defer analyzer.CleanUp()
+		analyzer.AddAnalyzerPlugin(&concurrentTestPlugin{reportTestPlugin{a: analyzer, name: "b"}})
+		analyzer.AddAnalyzerPlugin(&reportTestPlugin{a: analyzer, name: "c"})
+		analyzer.AddAnalyzerPlugin(&concurrentTestPlugin{reportTestPlugin{a: analyzer, name: "a"}})
+		analyzer.SetJobs(jobs)
+		analyzer.RunPlugins()
+		var report map[string]interface{}
+		err := json.Unmarshal([]byte(analyzer.JsonReport()), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	serial := run(1)
+	// the results are in the order of the plugins
+	offenders := serial["offenders"].(map[string]interface{})["/dir2/subdir2/file4"].([]interface{})
+	if len(offenders) != 6 || offenders[1] != "b done" || !strings.HasPrefix(offenders[2].(string), "c ") || offenders[5] != "a done" {
+		t.Errorf("bad offenders: %v", offenders)
+	}
+	informational := serial["informational"].(map[string]interface{})["/dir2/subdir2/file4"]
+	if !reflect.DeepEqual(informational, []interface{}{"b below /dir2", "b done", "c below /dir2", "c done", "a below /dir2", "a done"}) {
+		t.Errorf("bad informational: %v", informational)
+	}
+	for _, jobs := range []int{2, 8} {
+		for i := 0; i < 5; i++ {
+			report := run(jobs)
+			if !reflect.DeepEqual(report, serial) {
+				t.Errorf("the report with %d jobs should be the same as the serial report: %v", jobs, report)
+			}
+		}
+	}
+}
+
+func TestCheckAllFilesConcurrent(t *testing.T) {
+	analyzer := NewFromConfig("../../test/squashfs.img", "[GlobalConfig]\nFsType = \"squashfs\"\n")
+	defer analyzer.CleanUp()
+	analyzer.pool = newWorkerPool(4)
+	job := &jobReport{Analyzer: analyzer}
+
+	// the callbacks for file1 and file2 only return once both of them run
+	var wg sync.WaitGroup
+	wg.Add(2)
+	CheckAllFilesConcurrent(job, func(a AnalyzerType, fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData) {
+		if fi.Name == "file1" || fi.Name == "file2" {
+			wg.Done()
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Errorf("the callbacks did not run concurrently")
+			}
+		}
+		a.AddInformational(path.Join(fullpath, fi.Name), "checked")
+	}, nil, "/dir2")
+
+	var keys []string
+	for _, e := range job.entries {
+		if e.kind != nested || len(e.job.entries) != 1 || e.job.entries[0].kind != informational {
+			t.Fatalf("every callback should report into its own job: %v", job.entries)
+		}
+		keys = append(keys, e.job.entries[0].key)
+	}
+	if !reflect.DeepEqual(keys, []string{"/dir2/file1", "/dir2/file2", "/dir2/file3", "/dir2/subdir2", "/dir2/subdir2/file4"}) {
+		t.Errorf("the results should be in the order of the files: %v", keys)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(3)
+	var mu sync.Mutex
+	running, maxRunning, done := 0, 0, 0
+	batch := pool.newBatch()
+	for i := 0; i < 50; i++ {
+		i := i
+		_ = batch.run(func() error {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			// nested batches must not deadlock
+			nested := pool.newBatch()
+			for j := 0; j < 3; j++ {
+				_ = nested.run(func() error { return nil })
+			}
+			_ = nested.wait()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			done++
+			mu.Unlock()
+			if i == 7 {
+				return fmt.Errorf("error %d", i)
+			}
+			return nil
+		})
+	}
+	err := batch.wait()
+	if done != 50 {
+		t.Errorf("all functions should have run: %d", done)
+	}
+	// 2 workers + the caller
+	if maxRunning > 3 {
+		t.Errorf("too many functions ran at the same time: %d", maxRunning)
+	}
+	if err == nil || err.Error() != "error 7" {
+		t.Errorf("the error should be returned: %v", err)
+	}
+
+	// without a pool everything runs on the caller
+	var nilPool *workerPool
+	if newWorkerPool(1) != nil || nilPool.newBatch().run(func() error { return fmt.Errorf("x") }) == nil {
+		t.Errorf("functions should run on the caller without a pool")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+// RequiredFile is a file that is read by a plugin, for a directory all regular files below it
+// are read, Match (if set) is a pattern (doublestar) the file names have to match
+type RequiredFile struct {
+	Path  string
+	Match string
+}
+
+// AnalyzerPluginFilesType is implemented by plugins that know which files they will read with
+// FileGet (e.g. to pass them to a script), the files (or all files below a directory) are
+// extracted at once if the FsParser supports it. Files read with FileOpen should not be
+// included, FileOpen streams the content from the FsParser.
+type AnalyzerPluginFilesType interface {
+	RequiredFiles() []RequiredFile
+}
+
+// extractFiles extracts the files at once if the parser is a fsparser.BulkExtractor,
+// returns nil if the parser does not support bulk extraction
+func extractFiles(fsp fsparser.FsParser, filepaths []string, dstdir string) (map[string]string, error) {
+	bulk, ok := fsp.(fsparser.BulkExtractor)
+	if !ok || len(filepaths) == 0 {
+		return nil, nil
+	}
+	return bulk.ExtractFiles(filepaths, dstdir)
+}
+
+// bulkExtract extracts all files required by the plugins into the tmpdir
+// if the FsParser supports bulk extraction, FileGet is served from there
+func (a *Analyzer) bulkExtract() {
+	if _, ok := a.fsparser.(fsparser.BulkExtractor); !ok {
+		return
+	}
+
+	seen := make(map[RequiredFile]bool)
+	wanted := make(map[string]bool)
+	for _, ap := range a.analyzers {
+		if fp, ok := ap.(AnalyzerPluginFilesType); ok {
+			for _, rf := range fp.RequiredFiles() {
+				rf.Path = path.Clean(rf.Path)
+				a.collectFiles(rf, seen, wanted)
+			}
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	files := make([]string, 0, len(wanted))
+	for filepath := range wanted {
+		files = append(files, filepath)
+	}
+	sort.Strings(files)
+
+	extracted, err := extractFiles(a.fsparser, files, a.bulkDir())
+	if err != nil {
+		// FileGet falls back to CopyFile
+		fmt.Fprintln(os.Stderr, err)
+	}
+	a.extracted = extracted
+}
+
+// collectFiles adds the regular file or all regular files below the directory
+// that match the pattern of the required file
+func (a *Analyzer) collectFiles(rf RequiredFile, seen map[RequiredFile]bool, wanted map[string]bool) {
+	if seen[rf] {
+		return
+	}
+	seen[rf] = true
+
+	fi, err := a.fsparser.GetFileInfo(rf.Path)
+	if err != nil || fi.IsLink() {
+		return
+	}
+	if fi.IsFile() {
+		if rf.Match != "" {
+			if m, err := doublestar.Match(rf.Match, fi.Name); err != nil || !m {
+				return
+			}
+		}
+		wanted[rf.Path] = true
+		return
+	}
+	if fi.IsDir() {
+		dir, err := a.fsparser.GetDirInfo(rf.Path)
+		if err != nil {
+			return
+		}
+		for _, entry := range dir {
+			a.collectFiles(RequiredFile{Path: path.Join(rf.Path, entry.Name), Match: rf.Match}, seen, wanted)
+		}
+	}
+}
+
+func (a *Analyzer) bulkDir() string {
+	return path.Join(a.tmpdir, "bulk")
+}
+
+// isBulkExtracted returns true if the file in the tmpdir was created by bulkExtract
+func (a *Analyzer) isBulkExtracted(tmpname string) bool {
+	return a.extracted != nil && strings.HasPrefix(tmpname, a.bulkDir()+"/")
+}
+
+func (a *Analyzer) bulkCleanUp() {
+	if a.extracted != nil {
+		os.RemoveAll(a.bulkDir())
+		a.extracted = nil
+	}
+}
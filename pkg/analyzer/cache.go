@@ -0,0 +1,112 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// default size of the content cache in MiB
+const defaultContentCacheSize = 64
+
+type cacheEntry struct {
+	filepath string
+	data     []byte
+}
+
+// contentCache keeps the content and the digest of files that were extracted from the image,
+// the least recently used content is evicted once the size limit is reached
+type contentCache struct {
+	limit   int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	digests map[string][]byte
+
+	cacheStats
+}
+
+// cacheStats counts the files extracted from the image and the requests served
+// by the cache, a content hit saves the extraction of the file from the image
+type cacheStats struct {
+	extractions int
+	hits        int
+	digestHits  int
+	evictions   int
+}
+
+func (s cacheStats) String() string {
+	return fmt.Sprintf("content cache: %d files extracted from the image, %d content hits, %d digest hits, %d evicted",
+		s.extractions, s.hits, s.digestHits, s.evictions)
+}
+
+func newContentCache(limit int64) *contentCache {
+	return &contentCache{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		digests: make(map[string][]byte),
+	}
+}
+
+// fits returns true if content of the given size can be cached
+func (c *contentCache) fits(size int64) bool {
+	return size <= c.limit
+}
+
+func (c *contentCache) get(filepath string) ([]byte, bool) {
+	e, ok := c.entries[filepath]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	c.hits++
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (c *contentCache) add(filepath string, data []byte) {
+	if !c.fits(int64(len(data))) {
+		return
+	}
+	if e, ok := c.entries[filepath]; ok {
+		c.size -= int64(len(e.Value.(*cacheEntry).data))
+		c.lru.Remove(e)
+	}
+	for c.size+int64(len(data)) > c.limit {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		c.size -= int64(len(entry.data))
+		c.lru.Remove(e)
+		delete(c.entries, entry.filepath)
+		c.evictions++
+	}
+	c.entries[filepath] = c.lru.PushFront(&cacheEntry{filepath: filepath, data: data})
+	c.size += int64(len(data))
+}
+
+func (c *contentCache) digest(filepath string) ([]byte, bool) {
+	digest, ok := c.digests[filepath]
+	if ok {
+		c.digestHits++
+	}
+	return digest, ok
+}
+
+func (c *contentCache) addDigest(filepath string, digest []byte) {
+	c.digests[filepath] = digest
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsdetect"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+// FsType to combine multiple images into one tree using the Mount table
+const FsTypeComposite = "composite"
+
+// maximum number of links followed while resolving a path (same as Linux)
+const maxLinkFollow = 40
+
+type mountConfigType struct {
+	Image         string
+	FsType        string
+	FsTypeOptions string
+}
+
+type MountReport struct {
+	MountPoint  string `json:"mount_point"`
+	ImageName   string `json:"image_name"`
+	FSType      string `json:"fs_type"`
+	ImageDigest string `json:"image_digest,omitempty"`
+	RawDigest   string `json:"raw_image_digest,omitempty"`
+}
+
+type compositeMount struct {
+	mountpoint string
+	fsp        fsparser.FsParser
+}
+
+// compositeParser presents the mounted images as one tree, links are resolved across mount points
+type compositeParser struct {
+	imagepath string
+	tmpdir    string
+	// sorted by mount point, longest first
+	mounts []compositeMount
+}
+
+// newCompositeFromConfig creates the analyzer for a mount table, images are relative to imagepath
+func newCompositeFromConfig(imagepath string, cfg globalConfigType, mounts map[string]mountConfigType) *Analyzer {
+	tmpdir, _ := util.MkTmpDir("analyzer")
+	fail := func(msg string) {
+		os.RemoveAll(tmpdir)
+		panic(msg)
+	}
+
+	var mountpoints []string
+	for mp := range mounts {
+		mountpoints = append(mountpoints, mp)
+	}
+	sort.Strings(mountpoints)
+
+	c := &compositeParser{imagepath: imagepath, tmpdir: tmpdir}
+	var reports []MountReport
+	for i, mp := range mountpoints {
+		mcfg := mounts[mp]
+		if mcfg.Image == "" {
+			fail("composite: no Image for mount point: " + mp)
+		}
+		image := mcfg.Image
+		if !path.IsAbs(image) {
+			image = path.Join(imagepath, image)
+		}
+		dir := path.Join(tmpdir, fmt.Sprintf("mount%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			fail(err.Error())
+		}
+		gcfg := globalConfigType{FSType: mcfg.FsType, FSTypeOptions: mcfg.FsTypeOptions}
+		prepared, err := prepareImage(image, dir, gcfg)
+		if err != nil {
+			fail(err.Error())
+		}
+		if gcfg.FSType == "" || strings.EqualFold(gcfg.FSType, FsTypeAuto) {
+			gcfg.FSType = fsdetect.Detect(prepared)
+			if gcfg.FSType == "" {
+				fail("Cannot detect the filesystem type of: " + image)
+			}
+		}
+
+		report := MountReport{MountPoint: path.Clean("/" + mp), ImageName: image, FSType: gcfg.FSType}
+		if cfg.DigestImage {
+			report.ImageDigest = hex.EncodeToString(util.DigestFileSha256(image))
+			if prepared != image {
+				report.RawDigest = hex.EncodeToString(util.DigestFileSha256(prepared))
+			}
+		}
+		reports = append(reports, report)
+		c.mounts = append(c.mounts, compositeMount{report.MountPoint, newParser(prepared, gcfg)})
+	}
+	sort.Slice(c.mounts, func(i, j int) bool { return len(c.mounts[i].mountpoint) > len(c.mounts[j].mountpoint) })
+	if len(c.mounts) == 0 || c.mounts[len(c.mounts)-1].mountpoint != "/" {
+		fail("composite: no Mount for /")
+	}
+
+	a := newAnalyzer(c, cfg, tmpdir, imagepath)
+	a.Mounts = reports
+	return a
+}
+
+func (c *compositeParser) ImageName() string {
+	return c.imagepath
+}
+
+// mountOf returns the mount containing filepath and the path inside the mount
+func (c *compositeParser) mountOf(filepath string) (*compositeMount, string) {
+	filepath = path.Clean("/" + filepath)
+	for i := range c.mounts {
+		m := &c.mounts[i]
+		if m.mountpoint == "/" || filepath == m.mountpoint {
+			return m, "/" + strings.TrimPrefix(filepath, m.mountpoint)
+		}
+		if strings.HasPrefix(filepath, m.mountpoint+"/") {
+			return m, strings.TrimPrefix(filepath, m.mountpoint)
+		}
+	}
+	return nil, ""
+}
+
+// lstat returns the file info without following a link, the root of a mount is named like the mount point
+func (c *compositeParser) lstat(filepath string) (fsparser.FileInfo, error) {
+	m, inner := c.mountOf(filepath)
+	fi, err := m.fsp.GetFileInfo(path.Clean(inner))
+	if err == nil && path.Clean(inner) == "/" && m.mountpoint != "/" {
+		fi.Name = path.Base(m.mountpoint)
+	}
+	// inode numbers are only unique within an image
+	fi.Image = m.mountpoint
+	return fi, err
+}
+
+// resolve follows the links in filepath (the last element only if followLast is set)
+// and returns the resulting path in the composite tree
+func (c *compositeParser) resolve(filepath string, followLast bool) (string, error) {
+	elems := strings.Split(strings.Trim(path.Clean("/"+filepath), "/"), "/")
+	cur := "/"
+	links := 0
+	for i := 0; i < len(elems); i++ {
+		if elems[i] == "" {
+			continue
+		}
+		next := path.Join(cur, elems[i])
+		fi, err := c.lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsLink() || (i == len(elems)-1 && !followLast) {
+			cur = next
+			continue
+		}
+		links++
+		if links > maxLinkFollow {
+			return "", fmt.Errorf("composite: too many levels of symbolic links: %s", filepath)
+		}
+		// absolute link targets are relative to the root of the composite tree
+		target := fi.LinkTarget
+		if !path.IsAbs(target) {
+			target = path.Join(cur, target)
+		}
+		rest := append(strings.Split(strings.Trim(path.Clean(target), "/"), "/"), elems[i+1:]...)
+		elems = rest
+		cur = "/"
+		i = -1
+	}
+	return cur, nil
+}
+
+func (c *compositeParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	m, inner := c.mountOf(dirpath)
+	dir, err := m.fsp.GetDirInfo(inner)
+	if err != nil {
+		// the path may contain links to other mounts
+		resolved, rerr := c.resolve(dirpath, true)
+		if rerr != nil || resolved == path.Clean(dirpath) {
+			return nil, err
+		}
+		return c.GetDirInfo(resolved)
+	}
+	for i := range dir {
+		dir[i].Image = m.mountpoint
+	}
+
+	// mount points in this directory replace the directory they are mounted on
+	dirpath = path.Clean("/" + dirpath)
+	for i := range c.mounts {
+		mp := c.mounts[i].mountpoint
+		if mp == "/" || path.Dir(mp) != dirpath {
+			continue
+		}
+		root, err := c.lstat(mp)
+		if err != nil {
+			return nil, err
+		}
+		replaced := false
+		for j := range dir {
+			if dir[j].Name == root.Name {
+				dir[j] = root
+				replaced = true
+			}
+		}
+		if !replaced {
+			dir = append(dir, root)
+		}
+	}
+	return dir, nil
+}
+
+func (c *compositeParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	fi, err := c.lstat(filepath)
+	if err != nil {
+		// the path may contain links to other mounts
+		resolved, rerr := c.resolve(filepath, false)
+		if rerr != nil || resolved == path.Clean(filepath) {
+			return fi, err
+		}
+		return c.lstat(resolved)
+	}
+	return fi, nil
+}
+
+// CopyFile only follows links for the path leading to filepath, a link itself is
+// copied like in the other backends
+func (c *compositeParser) CopyFile(filepath string, dstdir string) bool {
+	resolved, err := c.resolve(filepath, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	m, inner := c.mountOf(resolved)
+	return m.fsp.CopyFile(inner, dstdir)
+}
+
+func (c *compositeParser) Open(filepath string) (io.ReadCloser, error) {
+	resolved, err := c.resolve(filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	m, inner := c.mountOf(resolved)
+	return openFile(m.fsp, inner, c.tmpdir)
+}
+
+func (c *compositeParser) Supported() bool {
+	for _, m := range c.mounts {
+		if !m.fsp.Supported() {
+			return false
+		}
+	}
+	return true
+}
+
+// ExtractFiles extracts the files with the parsers of their mounts,
+// files on mounts that don't support bulk extraction are not extracted
+func (c *compositeParser) ExtractFiles(filepaths []string, dstdir string) (map[string]string, error) {
+	files := make(map[*compositeMount][]string)
+	// path on the mount -> paths in the composite tree (links can lead to the same file)
+	paths := make(map[*compositeMount]map[string][]string)
+	for _, filepath := range filepaths {
+		resolved, err := c.resolve(filepath, false)
+		if err != nil {
+			continue
+		}
+		m, inner := c.mountOf(resolved)
+		if paths[m] == nil {
+			paths[m] = make(map[string][]string)
+		}
+		if _, ok := paths[m][inner]; !ok {
+			files[m] = append(files[m], inner)
+		}
+		paths[m][inner] = append(paths[m][inner], filepath)
+	}
+
+	extracted := make(map[string]string)
+	var err error
+	for i := range c.mounts {
+		m := &c.mounts[i]
+		ext, merr := extractFiles(m.fsp, files[m], path.Join(dstdir, fmt.Sprintf("mount%d", i)))
+		if merr != nil {
+			err = fmt.Errorf("%s: %s", m.mountpoint, merr)
+		}
+		for inner, tmpname := range ext {
+			for _, filepath := range paths[m][inner] {
+				extracted[filepath] = tmpname
+			}
+		}
+	}
+	return extracted, err
+}
@@ -86,6 +86,21 @@ func (state *dataExtractType) Finalize() string {
 	return ""
 }
 
+// RequiredFiles returns the files that are passed to a script, the other checks
+// read the files with FileOpen
+func (state *dataExtractType) RequiredFiles() []analyzer.RequiredFile {
+	var files []analyzer.RequiredFile
+	for fn, items := range state.config {
+		for _, item := range items {
+			if item.Script != "" {
+				files = append(files, analyzer.RequiredFile{Path: fn})
+				break
+			}
+		}
+	}
+	return files
+}
+
 func (state *dataExtractType) Name() string {
 	return "DataExtract"
 }
@@ -125,19 +140,19 @@ func (state *dataExtractType) CheckFile(fi *fsparser.FileInfo, filepath string)
 				continue
 			}
 
-			tmpfn, err := state.a.FileGet(fn)
+			r, err := state.a.FileOpen(fn)
 			if err != nil {
 				state.a.AddData(item.Name, fmt.Sprintf("DataExtract ERROR: file read error, file get: %s : %s : %s",
 					err, item.Name, item.Desc))
 				continue
 			}
-			fdata, err := ioutil.ReadFile(tmpfn)
+			fdata, err := ioutil.ReadAll(r)
+			r.Close()
 			if err != nil {
 				state.a.AddData(item.Name, fmt.Sprintf("DataExtract ERROR: file read error, file read: %s : %s : %s",
 					err, item.Name, item.Desc))
 				continue
 			}
-			_ = state.a.RemoveFile(tmpfn)
 			res := reg.FindAllStringSubmatch(string(fdata), -1)
 			if len(res) < 1 {
 				state.a.AddData(item.Name, fmt.Sprintf("DataExtract ERROR: regex match error, regex: %s : %s : %s",
@@ -178,19 +193,19 @@ func (state *dataExtractType) CheckFile(fi *fsparser.FileInfo, filepath string)
 		}
 
 		if item.Json != "" {
-			tmpfn, err := state.a.FileGet(fn)
+			r, err := state.a.FileOpen(fn)
 			if err != nil {
 				state.a.AddData(item.Name, fmt.Sprintf("DataExtract ERROR: file read error, file get: %s : %s : %s",
 					err, item.Name, item.Desc))
 				continue
 			}
-			fdata, err := ioutil.ReadFile(tmpfn)
+			fdata, err := ioutil.ReadAll(r)
+			r.Close()
 			if err != nil {
 				state.a.AddData(item.Name, fmt.Sprintf("DataExtract ERROR: file read error, file read: %s : %s : %s",
 					err, item.Name, item.Desc))
 				continue
 			}
-			_ = state.a.RemoveFile(tmpfn)
 
 			out, err := util.XtractJsonField(fdata, strings.Split(item.Json, "."))
 			if err != nil {
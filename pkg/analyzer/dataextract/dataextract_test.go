@@ -17,6 +17,7 @@ limitations under the License.
 package dataextract
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -47,6 +48,9 @@ func (a *testAnalyzer) FileGetSha256(filepath string) ([]byte, error) {
 func (a *testAnalyzer) FileGet(filepath string) (string, error) {
 	return a.testfile, nil
 }
+func (a *testAnalyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	return os.Open(a.testfile)
+}
 func (a *testAnalyzer) AddOffender(filepath string, reason string) {
 }
 func (a *testAnalyzer) AddInformational(filepath string, reason string) {}
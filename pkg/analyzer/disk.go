@@ -0,0 +1,232 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/diskimage"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsdetect"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+// FsType for whole-disk images (MBR or GPT partitioned)
+const FsTypeDisk = "disk"
+
+type DiskPartition struct {
+	diskimage.Partition
+	// FsType detected by magic or set in the partition config
+	FSType string
+	// the partition config section, empty if the partition is not analyzed
+	CfgData   string
+	Analyzer  *Analyzer
+	imagepath string
+}
+
+type DiskPartitionReport struct {
+	Index  int             `json:"index"`
+	Label  string          `json:"label,omitempty"`
+	Type   string          `json:"type"`
+	Offset int64           `json:"offset"`
+	Size   int64           `json:"size"`
+	FSType string          `json:"fs_type,omitempty"`
+	Report json.RawMessage `json:"report,omitempty"`
+}
+
+type DiskReport struct {
+	FSType         string                `json:"fs_type"`
+	ImageName      string                `json:"image_name"`
+	ImageDigest    string                `json:"image_digest,omitempty"`
+	PartitionTable string                `json:"partition_table"`
+	Partitions     []DiskPartitionReport `json:"partitions"`
+}
+
+// Disk analyzes each partition of a whole-disk image that has a config section
+// ([Partition."<label or index>"]) with its own Analyzer
+type Disk struct {
+	tmpdir     string
+	Partitions []*DiskPartition
+	DiskReport
+}
+
+// IsDiskConfig returns true if the config selects the disk image mode
+func IsDiskConfig(cfgdata string) bool {
+	type globalconfig struct {
+		GlobalConfig globalConfigType
+	}
+	var config globalconfig
+	_, err := toml.Decode(cfgdata, &config)
+	return err == nil && strings.EqualFold(config.GlobalConfig.FSType, FsTypeDisk)
+}
+
+func NewDiskFromConfig(imagepath string, cfgdata string) *Disk {
+	type diskconfig struct {
+		GlobalConfig globalConfigType
+		Partition    map[string]map[string]interface{}
+	}
+	var config diskconfig
+
+	_, err := toml.Decode(cfgdata, &config)
+	if err != nil {
+		panic("can't read config data: " + err.Error())
+	}
+
+	dimg, err := diskimage.Open(imagepath)
+	if err != nil {
+		panic("can't read disk image: " + err.Error())
+	}
+
+	var d Disk
+	d.tmpdir, _ = util.MkTmpDir("disk")
+	d.FSType = FsTypeDisk
+	d.ImageName = imagepath
+	d.PartitionTable = dimg.Scheme
+	if config.GlobalConfig.DigestImage {
+		d.ImageDigest = hex.EncodeToString(util.DigestFileSha256(imagepath))
+	}
+
+	used := make(map[string]bool)
+	for i := range dimg.Partitions {
+		p := &DiskPartition{Partition: dimg.Partitions[i]}
+		d.Partitions = append(d.Partitions, p)
+
+		// config sections are keyed by partition label or index
+		key := p.Label
+		section, ok := config.Partition[key]
+		if !ok {
+			key = strconv.Itoa(p.Index)
+			section, ok = config.Partition[key]
+		}
+		if !ok {
+			r, err := dimg.Reader(&p.Partition)
+			if err == nil {
+				p.FSType = fsdetect.DetectReader(r)
+				r.Close()
+			}
+			continue
+		}
+		used[key] = true
+
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(section)
+		if err != nil {
+			d.CleanUp()
+			panic(fmt.Sprintf("can't read config for partition %s: %s", key, err))
+		}
+		p.CfgData = buf.String()
+
+		p.imagepath = path.Join(d.tmpdir, strconv.Itoa(p.Index)+".img")
+		err = dimg.Extract(&p.Partition, p.imagepath)
+		if err != nil {
+			d.CleanUp()
+			panic(fmt.Sprintf("can't extract partition %s: %s", key, err))
+		}
+		p.FSType = fsdetect.Detect(p.imagepath)
+	}
+
+	var unused []string
+	for key := range config.Partition {
+		if !used[key] {
+			unused = append(unused, key)
+		}
+	}
+	if len(unused) > 0 {
+		d.CleanUp()
+		sort.Strings(unused)
+		panic("no partition found for config: " + strings.Join(unused, ", "))
+	}
+
+	return &d
+}
+
+// NewAnalyzer creates the analyzer for the partition, cfgdata is the partition config
+// (p.CfgData with includes resolved). The FsType from the config overrides the detected type.
+func (d *Disk) NewAnalyzer(p *DiskPartition, cfgdata string) *Analyzer {
+	type globalconfig struct {
+		GlobalConfig globalConfigType
+		Nested       map[string]nestedConfigType
+	}
+	var config globalconfig
+
+	_, err := toml.Decode(cfgdata, &config)
+	if err != nil {
+		panic("can't read config data: " + err.Error())
+	}
+	// an unset FsType is detected again after sparse images are expanded
+	a := newFromGlobalConfig(p.imagepath, config.GlobalConfig)
+	p.FSType = a.FSType
+	a.addNested(config.Nested)
+	// report the partition instead of the extracted file
+	a.ImageName = fmt.Sprintf("%s:%s", d.ImageName, p.Name())
+	p.Analyzer = a
+	return a
+}
+
+func (d *Disk) HasOffenders() bool {
+	for _, p := range d.Partitions {
+		if p.Analyzer != nil && p.Analyzer.HasOffenders() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Disk) CleanUp() error {
+	for _, p := range d.Partitions {
+		if p.Analyzer != nil {
+			_ = p.Analyzer.CleanUp()
+		}
+	}
+	return os.RemoveAll(d.tmpdir)
+}
+
+// JsonReport combines the reports of all partitions
+func (d *Disk) JsonReport() string {
+	dr := d.DiskReport
+	dr.Partitions = []DiskPartitionReport{}
+	for _, p := range d.Partitions {
+		pr := DiskPartitionReport{
+			Index:  p.Index,
+			Label:  p.Label,
+			Type:   p.Type,
+			Offset: p.Offset,
+			Size:   p.Size,
+			FSType: p.FSType,
+		}
+		if p.Analyzer != nil {
+			pr.Report = json.RawMessage(p.Analyzer.JsonReport())
+		}
+		dr.Partitions = append(dr.Partitions, pr)
+	}
+
+	jdata, _ := json.Marshal(dr)
+
+	// make json look pretty
+	var prettyJson bytes.Buffer
+	_ = json.Indent(&prettyJson, jdata, "", "\t")
+	return prettyJson.String()
+}
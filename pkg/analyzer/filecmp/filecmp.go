@@ -88,6 +88,15 @@ func (state *fileCmpType) Finalize() string {
 	return ""
 }
 
+// RequiredFiles returns the files that are compared, they are passed to a script
+func (state *fileCmpType) RequiredFiles() []analyzer.RequiredFile {
+	var files []analyzer.RequiredFile
+	for fn := range state.files {
+		files = append(files, analyzer.RequiredFile{Path: fn})
+	}
+	return files
+}
+
 func (state *fileCmpType) Name() string {
 	return "FileCmp"
 }
@@ -128,6 +137,11 @@ func makeTmpFromOld(filePath string) (string, error) {
 }
 
 func (state *fileCmpType) CheckFile(fi *fsparser.FileInfo, filepath string) error {
+	return state.CheckFileConcurrent(state.a, fi, filepath)
+}
+
+// CheckFileConcurrent is CheckFile reporting to a, every file is compared independently
+func (state *fileCmpType) CheckFileConcurrent(a analyzer.AnalyzerType, fi *fsparser.FileInfo, filepath string) error {
 	fn := path.Join(filepath, fi.Name)
 	if _, ok := state.files[fn]; !ok {
 		return nil
@@ -135,13 +149,13 @@ func (state *fileCmpType) CheckFile(fi *fsparser.FileInfo, filepath string) erro
 
 	for _, item := range state.files[fn] {
 		if !fi.IsFile() || fi.IsLink() {
-			state.a.AddOffender(fn, "FileCmp: is not a file or is a link")
+			a.AddOffender(fn, "FileCmp: is not a file or is a link")
 			continue
 		}
 
-		tmpfn, err := state.a.FileGet(fn)
+		tmpfn, err := a.FileGet(fn)
 		if err != nil {
-			state.a.AddOffender(fn, fmt.Sprintf("FileCmp: error getting file: %s", err))
+			a.AddOffender(fn, fmt.Sprintf("FileCmp: error getting file: %s", err))
 			continue
 		}
 
@@ -149,16 +163,16 @@ func (state *fileCmpType) CheckFile(fi *fsparser.FileInfo, filepath string) erro
 		if fileExists(item.OldFilePath) != nil {
 			err := copyFile(item.OldFilePath+".new", tmpfn)
 			if err != nil {
-				state.a.AddOffender(fn, fmt.Sprintf("FileCmp: error saving file: %s", err))
+				a.AddOffender(fn, fmt.Sprintf("FileCmp: error saving file: %s", err))
 				continue
 			}
-			state.a.AddInformational(fn, "FileCmp: saved file for next run")
+			a.AddInformational(fn, "FileCmp: saved file for next run")
 			continue
 		}
 
 		oldTmp, err := makeTmpFromOld(item.OldFilePath)
 		if err != nil {
-			state.a.AddOffender(fn, fmt.Sprintf("FileCmp: error getting old file: %s", err))
+			a.AddOffender(fn, fmt.Sprintf("FileCmp: error getting old file: %s", err))
 			continue
 		}
 		args := []string{fi.Name, oldTmp, tmpfn}
@@ -169,23 +183,23 @@ func (state *fileCmpType) CheckFile(fi *fsparser.FileInfo, filepath string) erro
 
 		out, err := exec.Command(item.Script, args...).CombinedOutput()
 		if err != nil {
-			state.a.AddOffender(path.Join(filepath, fi.Name), fmt.Sprintf("script(%s) error=%s", item.Script, err))
+			a.AddOffender(path.Join(filepath, fi.Name), fmt.Sprintf("script(%s) error=%s", item.Script, err))
 		}
 
-		err = state.a.RemoveFile(tmpfn)
+		err = a.RemoveFile(tmpfn)
 		if err != nil {
 			panic("removeFile failed")
 		}
-		err = state.a.RemoveFile(oldTmp)
+		err = a.RemoveFile(oldTmp)
 		if err != nil {
 			panic("removeFile failed")
 		}
 
 		if len(out) > 0 {
 			if item.InformationalOnly {
-				state.a.AddInformational(path.Join(filepath, fi.Name), string(out))
+				a.AddInformational(path.Join(filepath, fi.Name), string(out))
 			} else {
-				state.a.AddOffender(path.Join(filepath, fi.Name), string(out))
+				a.AddOffender(path.Join(filepath, fi.Name), string(out))
 			}
 		}
 	}
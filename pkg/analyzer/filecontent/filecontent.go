@@ -17,8 +17,10 @@ limitations under the License.
 package filecontent
 
 import (
+	"bufio"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -117,6 +119,26 @@ func (state *fileContentType) Finalize() string {
 	return ""
 }
 
+// RequiredFiles returns the files that are passed to a script, scripts only read
+// the files that match the pattern in ScriptOptions[0]. The other checks read the
+// files with FileOpen.
+func (state *fileContentType) RequiredFiles() []analyzer.RequiredFile {
+	var files []analyzer.RequiredFile
+	for fn, items := range state.files {
+		for _, item := range items {
+			if item.Script == "" {
+				continue
+			}
+			rf := analyzer.RequiredFile{Path: fn}
+			if len(item.ScriptOptions) >= 1 {
+				rf.Match = item.ScriptOptions[0]
+			}
+			files = append(files, rf)
+		}
+	}
+	return files
+}
+
 func (state *fileContentType) Name() string {
 	return "FileContent"
 }
@@ -129,19 +151,45 @@ func regexCompile(rx string) (*regexp.Regexp, error) {
 	return reg, err
 }
 
-func (state *fileContentType) canCheckFile(fi *fsparser.FileInfo, fn string, item contentType) bool {
+// forEachLine calls cb for every line of r without the line break,
+// a trailing line break does not start a new line and an empty file is one empty line
+func forEachLine(r io.Reader, cb func(line string)) error {
+	br := bufio.NewReader(r)
+	lines := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			if line != "" || lines == 0 {
+				cb(line)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cb(strings.TrimSuffix(line, "\n"))
+		lines++
+	}
+}
+
+func (state *fileContentType) canCheckFile(a analyzer.AnalyzerType, fi *fsparser.FileInfo, fn string, item contentType) bool {
 	if !fi.IsFile() {
-		state.a.AddOffender(fn, fmt.Sprintf("FileContent: '%s' file is NOT a file : %s", item.name, item.Desc))
+		a.AddOffender(fn, fmt.Sprintf("FileContent: '%s' file is NOT a file : %s", item.name, item.Desc))
 		return false
 	}
 	if fi.IsLink() {
-		state.a.AddOffender(fn, fmt.Sprintf("FileContent: '%s' file is a link (check actual file) : %s", item.name, item.Desc))
+		a.AddOffender(fn, fmt.Sprintf("FileContent: '%s' file is a link (check actual file) : %s", item.name, item.Desc))
 		return false
 	}
 	return true
 }
 
 func (state *fileContentType) CheckFile(fi *fsparser.FileInfo, filepath string) error {
+	return state.CheckFileConcurrent(state.a, fi, filepath)
+}
+
+// CheckFileConcurrent is CheckFile reporting to a, it only modifies the items of the file it checks
+func (state *fileContentType) CheckFileConcurrent(a analyzer.AnalyzerType, fi *fsparser.FileInfo, filepath string) error {
 	fn := path.Join(filepath, fi.Name)
 	if _, ok := state.files[fn]; !ok {
 		return nil
@@ -153,53 +201,52 @@ func (state *fileContentType) CheckFile(fi *fsparser.FileInfo, filepath string)
 		items[n].checked = true
 		//fmt.Printf("name: %s file: %s (%s)\n", item.name, item.File, fn)
 		if item.RegEx != "" {
-			if !state.canCheckFile(fi, fn, item) {
+			if !state.canCheckFile(a, fi, fn, item) {
 				continue
 			}
 			reg, err := regexCompile(item.RegEx)
 			if err != nil {
-				state.a.AddOffender(fn, fmt.Sprintf("FileContent: regex compile error: %s : %s : %s", item.RegEx, item.name, item.Desc))
+				a.AddOffender(fn, fmt.Sprintf("FileContent: regex compile error: %s : %s : %s", item.RegEx, item.name, item.Desc))
 				continue
 			}
 
-			tmpfn, err := state.a.FileGet(fn)
+			r, err := a.FileOpen(fn)
 			// this should never happen since this function is called for every existing file
 			if err != nil {
-				state.a.AddOffender(fn, fmt.Sprintf("FileContent: error reading file: %s", err))
+				a.AddOffender(fn, fmt.Sprintf("FileContent: error reading file: %s", err))
 				continue
 			}
-			fdata, _ := ioutil.ReadFile(tmpfn)
-			err = state.a.RemoveFile(tmpfn)
-			if err != nil {
-				panic("RemoveFile failed")
-			}
 			if item.RegExLineByLine {
-				for _, line := range strings.Split(strings.TrimSuffix(string(fdata), "\n"), "\n") {
+				err = forEachLine(r, func(line string) {
 					if reg.MatchString(line) == item.Match {
 						if item.InformationalOnly {
-							state.a.AddInformational(fn, fmt.Sprintf("RegEx check failed, for: %s : %s : line: %s", item.name, item.Desc, line))
+							a.AddInformational(fn, fmt.Sprintf("RegEx check failed, for: %s : %s : line: %s", item.name, item.Desc, line))
 						} else {
-							state.a.AddOffender(fn, fmt.Sprintf("RegEx check failed, for: %s : %s : line: %s", item.name, item.Desc, line))
+							a.AddOffender(fn, fmt.Sprintf("RegEx check failed, for: %s : %s : line: %s", item.name, item.Desc, line))
 						}
 					}
-				}
+				})
 			} else {
-				if reg.Match(fdata) == item.Match {
+				if reg.MatchReader(bufio.NewReader(r)) == item.Match {
 					if item.InformationalOnly {
-						state.a.AddInformational(fn, fmt.Sprintf("RegEx check failed, for: %s : %s", item.name, item.Desc))
+						a.AddInformational(fn, fmt.Sprintf("RegEx check failed, for: %s : %s", item.name, item.Desc))
 					} else {
-						state.a.AddOffender(fn, fmt.Sprintf("RegEx check failed, for: %s : %s", item.name, item.Desc))
+						a.AddOffender(fn, fmt.Sprintf("RegEx check failed, for: %s : %s", item.name, item.Desc))
 					}
 				}
 			}
+			r.Close()
+			if err != nil {
+				a.AddOffender(fn, fmt.Sprintf("FileContent: error reading file: %s", err))
+			}
 			continue
 		}
 
 		if item.Digest != "" {
-			if !state.canCheckFile(fi, fn, item) {
+			if !state.canCheckFile(a, fi, fn, item) {
 				continue
 			}
-			digestRaw, err := state.a.FileGetSha256(fn)
+			digestRaw, err := a.FileGetSha256(fn)
 			if err != nil {
 				return err
 			}
@@ -208,9 +255,9 @@ func (state *fileContentType) CheckFile(fi *fsparser.FileInfo, filepath string)
 			savedStr := hex.EncodeToString(saved)
 			if digest != savedStr {
 				if item.InformationalOnly {
-					state.a.AddInformational(fn, fmt.Sprintf("Digest (sha256) did not match found = %s should be = %s. %s : %s ", digest, savedStr, item.name, item.Desc))
+					a.AddInformational(fn, fmt.Sprintf("Digest (sha256) did not match found = %s should be = %s. %s : %s ", digest, savedStr, item.name, item.Desc))
 				} else {
-					state.a.AddOffender(fn, fmt.Sprintf("Digest (sha256) did not match found = %s should be = %s. %s : %s ", digest, savedStr, item.name, item.Desc))
+					a.AddOffender(fn, fmt.Sprintf("Digest (sha256) did not match found = %s should be = %s. %s : %s ", digest, savedStr, item.name, item.Desc))
 				}
 			}
 			continue
@@ -219,37 +266,35 @@ func (state *fileContentType) CheckFile(fi *fsparser.FileInfo, filepath string)
 		if item.Script != "" {
 			cbd := callbackDataType{state, item.Script, item.ScriptOptions, item.InformationalOnly}
 			if fi.IsDir() {
-				state.a.CheckAllFilesWithPath(checkFileScript, &cbd, fn)
+				// the script runs for every file on the worker pool
+				analyzer.CheckAllFilesConcurrent(a, checkFileScript, &cbd, fn)
 			} else {
-				if !state.canCheckFile(fi, fn, item) {
+				if !state.canCheckFile(a, fi, fn, item) {
 					continue
 				}
-				checkFileScript(fi, filepath, &cbd)
+				checkFileScript(a, fi, filepath, &cbd)
 			}
 		}
 
 		if item.Json != "" {
-			if !state.canCheckFile(fi, fn, item) {
+			if !state.canCheckFile(a, fi, fn, item) {
 				continue
 			}
-			tmpfn, err := state.a.FileGet(fn)
+			r, err := a.FileOpen(fn)
 			if err != nil {
-				state.a.AddOffender(fn, fmt.Sprintf("FileContent: error getting file: %s", err))
+				a.AddOffender(fn, fmt.Sprintf("FileContent: error getting file: %s", err))
 				continue
 			}
-			fdata, err := ioutil.ReadFile(tmpfn)
+			fdata, err := ioutil.ReadAll(r)
+			r.Close()
 			if err != nil {
-				state.a.AddOffender(fn, fmt.Sprintf("FileContent: error reading file: %s", err))
+				a.AddOffender(fn, fmt.Sprintf("FileContent: error reading file: %s", err))
 				continue
 			}
-			err = state.a.RemoveFile(tmpfn)
-			if err != nil {
-				panic("RemoveFile failed")
-			}
 
 			field := strings.SplitAfterN(item.Json, ":", 2)
 			if len(field) != 2 {
-				state.a.AddOffender(fn, fmt.Sprintf("FileContent: error Json config bad = %s, %s, %s", item.Json, item.name, item.Desc))
+				a.AddOffender(fn, fmt.Sprintf("FileContent: error Json config bad = %s, %s, %s", item.Json, item.name, item.Desc))
 				continue
 			}
 
@@ -258,14 +303,14 @@ func (state *fileContentType) CheckFile(fi *fsparser.FileInfo, filepath string)
 
 			fieldData, err := util.XtractJsonField(fdata, strings.Split(field[0], "."))
 			if err != nil {
-				state.a.AddOffender(fn, fmt.Sprintf("FileContent: error Json bad field = %s, %s, %s", field[0], item.name, item.Desc))
+				a.AddOffender(fn, fmt.Sprintf("FileContent: error Json bad field = %s, %s, %s", field[0], item.name, item.Desc))
 				continue
 			}
 			if fieldData != field[1] {
 				if item.InformationalOnly {
-					state.a.AddInformational(fn, fmt.Sprintf("Json field %s = %s did not match = %s, %s, %s", field[0], fieldData, field[1], item.name, item.Desc))
+					a.AddInformational(fn, fmt.Sprintf("Json field %s = %s did not match = %s, %s, %s", field[0], fieldData, field[1], item.name, item.Desc))
 				} else {
-					state.a.AddOffender(fn, fmt.Sprintf("Json field %s = %s did not match = %s, %s, %s", field[0], fieldData, field[1], item.name, item.Desc))
+					a.AddOffender(fn, fmt.Sprintf("Json field %s = %s did not match = %s, %s, %s", field[0], fieldData, field[1], item.name, item.Desc))
 				}
 			}
 		}
@@ -295,7 +340,7 @@ type callbackDataType struct {
  * The script is run with the following parameters:
  * script.sh <filename> <filename in filesystem> <uid> <gid> <mode> <selinux label - can be empty> -- <ScriptOptions[1]> <ScriptOptions[2]>
  */
-func checkFileScript(fi *fsparser.FileInfo, fullpath string, cbData analyzer.AllFilesCallbackData) {
+func checkFileScript(a analyzer.AnalyzerType, fi *fsparser.FileInfo, fullpath string, cbData analyzer.AllFilesCallbackData) {
 	cbd := cbData.(*callbackDataType)
 
 	fullname := path.Join(fullpath, fi.Name)
@@ -317,7 +362,7 @@ func checkFileScript(fi *fsparser.FileInfo, fullpath string, cbData analyzer.All
 		}
 	}
 
-	fname, _ := cbd.state.a.FileGet(fullname)
+	fname, _ := a.FileGet(fullname)
 	args := []string{fname,
 		fullname,
 		fmt.Sprintf("%d", fi.Uid),
@@ -332,19 +377,19 @@ func checkFileScript(fi *fsparser.FileInfo, fullpath string, cbData analyzer.All
 
 	out, err := exec.Command(cbd.script, args...).CombinedOutput()
 	if err != nil {
-		cbd.state.a.AddOffender(fullname, fmt.Sprintf("script(%s) error=%s", cbd.script, err))
+		a.AddOffender(fullname, fmt.Sprintf("script(%s) error=%s", cbd.script, err))
 	}
 
-	err = cbd.state.a.RemoveFile(fname)
+	err = a.RemoveFile(fname)
 	if err != nil {
 		panic("removeFile failed")
 	}
 
 	if len(out) > 0 {
 		if cbd.informationalOnly {
-			cbd.state.a.AddInformational(fullname, string(out))
+			a.AddInformational(fullname, string(out))
 		} else {
-			cbd.state.a.AddOffender(fullname, string(out))
+			a.AddOffender(fullname, string(out))
 		}
 	}
 }
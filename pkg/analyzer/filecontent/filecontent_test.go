@@ -17,8 +17,11 @@ limitations under the License.
 package filecontent
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/analyzer"
@@ -49,6 +52,9 @@ func (a *testAnalyzer) FileGetSha256(filepath string) ([]byte, error) {
 func (a *testAnalyzer) FileGet(filepath string) (string, error) {
 	return a.testfile, nil
 }
+func (a *testAnalyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	return os.Open(a.testfile)
+}
 func (a *testAnalyzer) AddOffender(filepath string, reason string) {
 	a.ocb(filepath)
 }
@@ -213,6 +219,28 @@ cat $1
 	g.Finalize()
 }
 
+func TestRequiredFiles(t *testing.T) {
+	a := &testAnalyzer{}
+
+	cfg := `
+[FileContent."script"]
+Script = "/tmp/testfilescript.sh"
+ScriptOptions = ["*.so"]
+File = "/lib"
+
+[FileContent."regex"]
+RegEx = ".*"
+File = "/etc/passwd"
+`
+
+	g := New(cfg, a, false)
+	files := g.RequiredFiles()
+	// only the files passed to a script need to be extracted
+	if len(files) != 1 || files[0].Path != "/lib" || files[0].Match != "*.so" {
+		t.Errorf("bad required files: %v", files)
+	}
+}
+
 func TestValidateItem(t *testing.T) {
 
 	a := &testAnalyzer{}
@@ -390,3 +418,18 @@ File ="/tmp/datatestfile.1"
 		t.Errorf("file content failed, found file flagged as not-found")
 	}
 }
+
+func TestForEachLine(t *testing.T) {
+	tests := []string{"", "a", "a\n", "a\nb", "a\n\nb\n", "a\n\n", "\n"}
+	for _, data := range tests {
+		var lines []string
+		err := forEachLine(strings.NewReader(data), func(line string) { lines = append(lines, line) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("%q: lines %q should be %q", data, lines, expected)
+		}
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package filepathowner
 
 import (
+	"io"
+	"os"
 	"testing"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/analyzer"
@@ -43,6 +45,9 @@ func (a *testAnalyzer) FileGetSha256(filepath string) ([]byte, error) {
 func (a *testAnalyzer) FileGet(filepath string) (string, error) {
 	return a.testfile, nil
 }
+func (a *testAnalyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	return os.Open(a.testfile)
+}
 func (a *testAnalyzer) AddOffender(filepath string, reason string) {
 	a.ocb(filepath)
 }
@@ -36,6 +36,11 @@ type fileexistType struct {
 	SELinuxLabel      string
 	LinkTarget        string
 	Capabilities      []string
+	DevMajor          int
+	DevMinor          int
+	XattrRequired     []string
+	XattrForbidden    []string
+	XattrMatch        map[string]string
 	Desc              string
 	InformationalOnly bool
 }
@@ -45,12 +50,13 @@ type fileExistListType struct {
 }
 
 type fileExistType struct {
-	files fileExistListType
-	a     analyzer.AnalyzerType
+	files  fileExistListType
+	xattrs map[string]*analyzer.XattrRules
+	a      analyzer.AnalyzerType
 }
 
 func New(config string, a analyzer.AnalyzerType) *fileExistType {
-	cfg := fileExistType{a: a}
+	cfg := fileExistType{a: a, xattrs: make(map[string]*analyzer.XattrRules)}
 
 	md, err := toml.Decode(config, &cfg.files)
 	if err != nil {
@@ -67,6 +73,24 @@ func New(config string, a analyzer.AnalyzerType) *fileExistType {
 			item.Gid = -1
 			cfg.files.FileStatCheck[fn] = item
 		}
+
+		if !md.IsDefined("FileStatCheck", fn, "DevMajor") {
+			item.DevMajor = -1
+			cfg.files.FileStatCheck[fn] = item
+		}
+
+		if !md.IsDefined("FileStatCheck", fn, "DevMinor") {
+			item.DevMinor = -1
+			cfg.files.FileStatCheck[fn] = item
+		}
+
+		rules, err := analyzer.NewXattrRules(item.XattrRequired, item.XattrForbidden, item.XattrMatch)
+		if err != nil {
+			panic("can't read config data: FileStatCheck " + fn + ": " + err.Error())
+		}
+		if !rules.Empty() {
+			cfg.xattrs[fn] = rules
+		}
 	}
 
 	return &cfg
@@ -149,6 +173,22 @@ func (state *fileExistType) Finalize() string {
 					state.a.AddOffender(fn, fmt.Sprintf("File State Check failed: selinux label found = %s should be = %s : %s", fi.SELinuxLabel, item.SELinuxLabel, item.Desc))
 				}
 			}
+			if item.DevMajor >= 0 || item.DevMinor >= 0 {
+				if !fi.IsDevice() {
+					if item.InformationalOnly {
+						state.a.AddInformational(fn, fmt.Sprintf("File State Check failed DevMajor/DevMinor set but file is not a device : %s", item.Desc))
+					} else {
+						state.a.AddOffender(fn, fmt.Sprintf("File State Check failed DevMajor/DevMinor set but file is not a device : %s", item.Desc))
+					}
+				} else if (item.DevMajor >= 0 && fi.DevMajor() != uint32(item.DevMajor)) ||
+					(item.DevMinor >= 0 && fi.DevMinor() != uint32(item.DevMinor)) {
+					if item.InformationalOnly {
+						state.a.AddInformational(fn, fmt.Sprintf("File State Check failed: device found %d:%d should be %s : %s", fi.DevMajor(), fi.DevMinor(), devString(item), item.Desc))
+					} else {
+						state.a.AddOffender(fn, fmt.Sprintf("File State Check failed: device found %d:%d should be %s : %s", fi.DevMajor(), fi.DevMinor(), devString(item), item.Desc))
+					}
+				}
+			}
 			if len(item.Capabilities) > 0 {
 				if !capability.CapsEqual(item.Capabilities, fi.Capabilities) {
 					if item.InformationalOnly {
@@ -158,7 +198,28 @@ func (state *fileExistType) Finalize() string {
 					}
 				}
 			}
+			if rules, ok := state.xattrs[fn]; ok {
+				for _, msg := range rules.Check(&fi) {
+					if item.InformationalOnly {
+						state.a.AddInformational(fn, fmt.Sprintf("File State Check failed: %s : %s", msg, item.Desc))
+					} else {
+						state.a.AddOffender(fn, fmt.Sprintf("File State Check failed: %s : %s", msg, item.Desc))
+					}
+				}
+			}
 		}
 	}
 	return ""
 }
+
+// devString returns major:minor, numbers that are not checked are shown as *
+func devString(item fileexistType) string {
+	major, minor := "*", "*"
+	if item.DevMajor >= 0 {
+		major = strconv.Itoa(item.DevMajor)
+	}
+	if item.DevMinor >= 0 {
+		minor = strconv.Itoa(item.DevMinor)
+	}
+	return major + ":" + minor
+}
@@ -18,6 +18,8 @@ package filestatcheck
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"testing"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/analyzer"
@@ -46,6 +48,9 @@ func (a *testAnalyzer) FileGetSha256(filepath string) ([]byte, error) {
 func (a *testAnalyzer) FileGet(filepath string) (string, error) {
 	return "", nil
 }
+func (a *testAnalyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	return nil, os.ErrNotExist
+}
 func (a *testAnalyzer) AddOffender(filepath string, reason string) {
 	a.ocb(filepath)
 }
@@ -225,3 +230,98 @@ Desc = "this need to be this way"
 		}
 	}
 }
+
+func TestDevice(t *testing.T) {
+	a := &testAnalyzer{}
+
+	cfg := `
+[FileStatCheck."/dev/tty6"]
+AllowEmpty = true
+DevMajor = 4
+DevMinor = 6
+`
+	g := New(cfg, a)
+
+	tests := []struct {
+		fi            fsparser.FileInfo
+		shouldTrigger bool
+	}{
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Rdev: fsparser.Mkdev(4, 6)}, false},
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFBLK | 0620, Rdev: fsparser.Mkdev(4, 6)}, false},
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Rdev: fsparser.Mkdev(4, 7)}, true},
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Rdev: fsparser.Mkdev(260, 6)}, true},
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFREG | 0620}, true},
+	}
+	for _, test := range tests {
+		triggered := false
+		a.fi = test.fi
+		a.ocb = func(fn string) { triggered = true }
+		g.Finalize()
+		if triggered != test.shouldTrigger {
+			t.Errorf("FileStatCheck device check failed for %o %d:%d", test.fi.Mode, test.fi.DevMajor(), test.fi.DevMinor())
+		}
+	}
+
+	// not a device with InformationalOnly
+	g = New("[FileStatCheck.\"/dev/tty6\"]\nAllowEmpty = true\nDevMajor = 4\nInformationalOnly = true\n", a)
+	triggered := false
+	a.fi = fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFREG | 0620}
+	a.ocb = func(fn string) { triggered = true }
+	g.Finalize()
+	if triggered {
+		t.Errorf("FileStatCheck device check should be informational only")
+	}
+
+	// only the minor number is checked
+	g = New("[FileStatCheck.\"/dev/tty6\"]\nAllowEmpty = true\nDevMinor = 1000\n", a)
+	triggered = false
+	a.fi = fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Rdev: fsparser.Mkdev(4, 1000)}
+	a.ocb = func(fn string) { triggered = true }
+	g.Finalize()
+	if triggered {
+		t.Errorf("FileStatCheck device check failed for minor 1000")
+	}
+}
+
+func TestXattr(t *testing.T) {
+	a := &testAnalyzer{}
+	a.ocb = func(fn string) { t.Errorf("invalid config: %s", fn) }
+
+	cfg := `
+[FileStatCheck."/usr/bin/su"]
+AllowEmpty = true
+XattrRequired = ["security.ima"]
+XattrForbidden = ["user.*"]
+XattrMatch = { "security.SMACK64*" = "^_$" }
+`
+	g := New(cfg, a)
+
+	tests := []struct {
+		xattrs        map[string][]byte
+		shouldTrigger bool
+	}{
+		{map[string][]byte{"security.ima": {3, 2, 4}, "security.SMACK64": []byte("_")}, false},
+		{map[string][]byte{"security.ima": {3, 2, 4}, "security.SMACK64": []byte("_"), "security.SMACK64EXEC": []byte("_\x00")}, false},
+		{map[string][]byte{"security.SMACK64": []byte("_")}, true},
+		{map[string][]byte{"security.ima": {3, 2, 4}}, false},
+		{map[string][]byte{"security.ima": {3, 2, 4}, "security.SMACK64": []byte("System")}, true},
+		{map[string][]byte{"security.ima": {3, 2, 4}, "security.SMACK64": []byte("_"), "user.comment": []byte("x")}, true},
+		{nil, true},
+	}
+	for _, test := range tests {
+		triggered := false
+		a.fi = fsparser.FileInfo{Name: "su", Mode: fsparser.S_IFREG | 0755, Size: 1, Xattrs: test.xattrs}
+		a.ocb = func(fn string) { triggered = true }
+		g.Finalize()
+		if triggered != test.shouldTrigger {
+			t.Errorf("FileStatCheck xattr check failed for %v", test.xattrs)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("invalid regex should fail")
+		}
+	}()
+	New("[FileStatCheck.\"/usr/bin/su\"]\nXattrMatch = { \"security.ima\" = \"[\" }\n", a)
+}
@@ -24,6 +24,8 @@ import (
 	"io/ioutil"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 
@@ -35,6 +37,8 @@ import (
 
 const (
 	newFileTreeExt string = ".new"
+	// version of the saved tree, trees from version 2 on contain the mtime and the device number
+	treeVersion = 2
 )
 
 type fileTreeConfig struct {
@@ -43,6 +47,7 @@ type fileTreeConfig struct {
 	CheckPermsOwnerChange bool
 	CheckFileSize         bool
 	CheckFileDigest       bool
+	CheckFileMtime        bool
 	SkipFileDigest        bool
 }
 
@@ -50,8 +55,13 @@ type fileTreeType struct {
 	config fileTreeConfig
 	a      analyzer.AnalyzerType
 
-	tree    map[string]fileInfoSaveType
-	oldTree map[string]fileInfoSaveType
+	// protects tree and linkDigests, CheckFile is called concurrently
+	mu         sync.Mutex
+	tree       map[string]fileInfoSaveType
+	oldTree    map[string]fileInfoSaveType
+	oldVersion int
+	// digests of hardlinks, the content of a hardlink group is only read once
+	linkDigests map[fsparser.HardlinkKey]string
 }
 
 type fileInfoSaveType struct {
@@ -59,6 +69,7 @@ type fileInfoSaveType struct {
 	Digest string `json:"digest,omitempty"`
 }
 type imageInfoSaveType struct {
+	Version     int                `json:"version,omitempty"`
 	ImageName   string             `json:"image_name"`
 	ImageDigest string             `json:"image_digest"`
 	Files       []fileInfoSaveType `json:"files"`
@@ -83,7 +94,7 @@ func New(config string, a analyzer.AnalyzerType, outputDirectory string) *fileTr
 		conf.FileTreeCheck.CheckPath[i] = util.CleanPathDir(conf.FileTreeCheck.CheckPath[i])
 	}
 
-	cfg := fileTreeType{config: conf.FileTreeCheck, a: a}
+	cfg := fileTreeType{config: conf.FileTreeCheck, a: a, linkDigests: make(map[fsparser.HardlinkKey]string)}
 
 	// if an output directory is set concat the path of the old filetree
 	if outputDirectory != "" && cfg.config.OldTreeFilePath != "" {
@@ -120,6 +131,7 @@ func (tree *fileTreeType) readOldTree() error {
 	if err != nil {
 		return err
 	}
+	tree.oldVersion = oldTree.Version
 	tree.oldTree = make(map[string]fileInfoSaveType)
 	for _, fi := range oldTree.Files {
 		tree.oldTree[fi.Name] = fi
@@ -130,6 +142,7 @@ func (tree *fileTreeType) readOldTree() error {
 func (tree *fileTreeType) saveTree() error {
 	imageInfo := tree.a.ImageInfo()
 	oldtree := imageInfoSaveType{
+		Version:     treeVersion,
 		ImageName:   imageInfo.ImageName,
 		ImageDigest: imageInfo.ImageDigest,
 	}
@@ -157,6 +170,11 @@ func (tree *fileTreeType) saveTree() error {
 }
 
 func (state *fileTreeType) CheckFile(fi *fsparser.FileInfo, filepath string) error {
+	return state.CheckFileConcurrent(state.a, fi, filepath)
+}
+
+// CheckFileConcurrent is CheckFile reporting to a, the digests are computed concurrently
+func (state *fileTreeType) CheckFileConcurrent(a analyzer.AnalyzerType, fi *fsparser.FileInfo, filepath string) error {
 	if state.config.OldTreeFilePath == "" {
 		return nil
 	}
@@ -165,13 +183,27 @@ func (state *fileTreeType) CheckFile(fi *fsparser.FileInfo, filepath string) err
 
 	digest := "0"
 	if fi.IsFile() && !state.config.SkipFileDigest {
-		digestRaw, err := state.a.FileGetSha256(fn)
-		if err != nil {
-			return err
+		state.mu.Lock()
+		d, ok := state.linkDigests[fi.HardlinkKey()]
+		state.mu.Unlock()
+		if ok && fi.IsHardlink() {
+			digest = d
+		} else {
+			digestRaw, err := a.FileGetSha256(fn)
+			if err != nil {
+				return err
+			}
+			digest = hex.EncodeToString(digestRaw)
+			if fi.IsHardlink() {
+				state.mu.Lock()
+				state.linkDigests[fi.HardlinkKey()] = digest
+				state.mu.Unlock()
+			}
 		}
-		digest = hex.EncodeToString(digestRaw)
 	}
 
+	state.mu.Lock()
+	defer state.mu.Unlock()
 	state.tree[fn] = fileInfoSaveType{
 		fsparser.FileInfo{
 			Name:         fn,
@@ -182,6 +214,8 @@ func (state *fileTreeType) CheckFile(fi *fsparser.FileInfo, filepath string) err
 			SELinuxLabel: fi.SELinuxLabel,
 			Capabilities: fi.Capabilities,
 			LinkTarget:   fi.LinkTarget,
+			Mtime:        fi.Mtime,
+			Rdev:         fi.Rdev,
 		},
 		digest,
 	}
@@ -197,8 +231,11 @@ func (state *fileTreeType) Finalize() string {
 	var added []fileInfoSaveType
 	var removed []fileInfoSaveType
 	var changed []string
+	var touched []string
 
 	_ = state.readOldTree()
+	// trees saved by older versions do not contain the mtime and the device number
+	hasMtime := state.oldVersion >= treeVersion
 
 	// find modified files
 	for filepath, fi := range state.oldTree {
@@ -219,8 +256,13 @@ func (state *fileTreeType) Finalize() string {
 				oFi.SELinuxLabel != cFi.SELinuxLabel ||
 				!capability.CapsEqual(oFi.Capabilities, cFi.Capabilities) ||
 				((oFi.Size != cFi.Size) && state.config.CheckFileSize) ||
-				((oFi.Digest != cFi.Digest) && state.config.CheckFileDigest) {
+				((oFi.Digest != cFi.Digest) && state.config.CheckFileDigest) ||
+				(hasMtime && oFi.Rdev != cFi.Rdev) {
 				changed = append(changed, filepath)
+			} else if state.config.CheckFileMtime && hasMtime && oFi.Mtime != cFi.Mtime &&
+				oFi.Size == cFi.Size && oFi.Digest == cFi.Digest {
+				// only the timestamp changed (e.g. the build is not reproducible)
+				touched = append(touched, filepath)
 			}
 		}
 	}
@@ -238,7 +280,8 @@ func (state *fileTreeType) Finalize() string {
 	}
 
 	treeUpdated := false
-	if len(added) > 0 || len(removed) > 0 || (len(changed) > 0 && state.config.CheckPermsOwnerChange) {
+	if len(added) > 0 || len(removed) > 0 || (len(changed) > 0 && state.config.CheckPermsOwnerChange) ||
+		len(touched) > 0 {
 		err := state.saveTree()
 		if err != nil {
 			panic("saveTree failed")
@@ -263,6 +306,11 @@ func (state *fileTreeType) Finalize() string {
 		}
 	}
 
+	for _, filepath := range touched {
+		state.a.AddInformational(filepath, fmt.Sprintf("CheckFileTree: only the timestamp changed from: %s to: %s",
+			mtimeToString(state.oldTree[filepath].Mtime), mtimeToString(state.tree[filepath].Mtime)))
+	}
+
 	if state.config.OldTreeFilePath != "" {
 		type reportData struct {
 			OldFileTreePath     string `json:"old_file_tree_path"`
@@ -281,6 +329,10 @@ func (state *fileTreeType) Finalize() string {
 	return ""
 }
 
+func mtimeToString(mtime int64) string {
+	return time.Unix(mtime, 0).UTC().Format(time.RFC3339)
+}
+
 // provide fileinfo as a human readable string
 func fiToString(fi fileInfoSaveType, selinux bool) string {
 	if selinux {
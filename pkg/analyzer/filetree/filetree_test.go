@@ -17,6 +17,8 @@ limitations under the License.
 package filetree
 
 import (
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
@@ -28,8 +30,9 @@ import (
 type OffenderCallack func(fn string, reason string)
 
 type testAnalyzer struct {
-	ocb      OffenderCallack
-	testfile string
+	ocb         OffenderCallack
+	testfile    string
+	digestCalls int
 }
 
 func (a *testAnalyzer) AddData(key, value string) {}
@@ -40,11 +43,15 @@ func (a *testAnalyzer) RemoveFile(filepath string) error {
 	return nil
 }
 func (a *testAnalyzer) FileGetSha256(filepath string) ([]byte, error) {
+	a.digestCalls++
 	return []byte(""), nil
 }
 func (a *testAnalyzer) FileGet(filepath string) (string, error) {
 	return a.testfile, nil
 }
+func (a *testAnalyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	return os.Open(a.testfile)
+}
 func (a *testAnalyzer) AddOffender(filepath string, reason string) {
 }
 func (a *testAnalyzer) AddInformational(filepath string, reason string) {
@@ -179,3 +186,116 @@ CheckFileDigest       = false
 		t.Error("CheckPath should be: /")
 	}
 }
+
+func TestMtime(t *testing.T) {
+	a := &testAnalyzer{}
+
+	cfg := `
+[FileTreeCheck]
+OldTreeFilePath = "/tmp/blatreetest1338.json"
+CheckPermsOwnerChange = true
+CheckFileMtime = true
+SkipFileDigest = true
+`
+	defer os.Remove("/tmp/blatreetest1338.json")
+	defer os.Remove("/tmp/blatreetest1338.json.new")
+
+	g := New(cfg, a, "")
+	g.Start()
+	a.ocb = func(fn string, reason string) {}
+	fi := fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Mtime: 1000, Rdev: fsparser.Mkdev(4, 6)}
+	_ = g.CheckFile(&fi, "/")
+	g.Finalize()
+	if err := os.Rename("/tmp/blatreetest1338.json.new", "/tmp/blatreetest1338.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fi     fsparser.FileInfo
+		reason string
+	}{
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Mtime: 1000, Rdev: fsparser.Mkdev(4, 6)}, ""},
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Mtime: 2000, Rdev: fsparser.Mkdev(4, 6)},
+			"CheckFileTree: only the timestamp changed from: 1970-01-01T00:16:40Z to: 1970-01-01T00:33:20Z"},
+		{fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Mtime: 2000, Rdev: fsparser.Mkdev(4, 7)},
+			"CheckFileTree: file perms/owner/size/digest changed"},
+	}
+	for _, test := range tests {
+		g = New(cfg, a, "")
+		g.Start()
+		var reasons []string
+		a.ocb = func(fn string, reason string) { reasons = append(reasons, reason) }
+		_ = g.CheckFile(&test.fi, "/")
+		g.Finalize()
+		if test.reason == "" && len(reasons) != 0 {
+			t.Errorf("nothing changed: %v", reasons)
+		}
+		if test.reason != "" && (len(reasons) != 1 || !strings.HasPrefix(reasons[0], test.reason)) {
+			t.Errorf("expected %q: %v", test.reason, reasons)
+		}
+	}
+
+	// an mtime of 0 in the old tree (e.g. SOURCE_DATE_EPOCH=0) is compared
+	g = New(cfg, a, "")
+	g.Start()
+	a.ocb = func(fn string, reason string) {}
+	fi = fsparser.FileInfo{Name: "tty6", Mode: fsparser.S_IFCHR | 0620, Rdev: fsparser.Mkdev(4, 6)}
+	_ = g.CheckFile(&fi, "/")
+	_ = g.saveTree()
+	if err := os.Rename("/tmp/blatreetest1338.json.new", "/tmp/blatreetest1338.json"); err != nil {
+		t.Fatal(err)
+	}
+	g = New(cfg, a, "")
+	g.Start()
+	var reasons []string
+	a.ocb = func(fn string, reason string) { reasons = append(reasons, reason) }
+	fi.Mtime = 1000
+	_ = g.CheckFile(&fi, "/")
+	g.Finalize()
+	if len(reasons) != 1 || !strings.HasPrefix(reasons[0], "CheckFileTree: only the timestamp changed from: 1970-01-01T00:00:00Z") {
+		t.Errorf("mtime 0 should be compared: %v", reasons)
+	}
+
+	// trees saved by older versions don't contain the mtime
+	old := `{"image_name": "", "image_digest": "", "files": [{"name": "/tty6", "mode": 8592, "uid": 0, "gid": 0, "size": 0}]}`
+	if err := ioutil.WriteFile("/tmp/blatreetest1338.json", []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g = New(cfg, a, "")
+	g.Start()
+	reasons = nil
+	_ = g.CheckFile(&fi, "/")
+	g.Finalize()
+	if len(reasons) != 0 {
+		t.Errorf("old tree without mtime should not report changes: %v", reasons)
+	}
+}
+
+func TestHardlinkDigest(t *testing.T) {
+	a := &testAnalyzer{}
+
+	cfg := `
+[FileTreeCheck]
+OldTreeFilePath = "/tmp/blatreetest1339.json"
+`
+	defer os.Remove("/tmp/blatreetest1339.json.new")
+
+	g := New(cfg, a, "")
+	g.Start()
+	a.ocb = func(fn string, reason string) {}
+	busybox := fsparser.FileInfo{Name: "busybox", Mode: fsparser.S_IFREG | 0755, Size: 10, Ino: 5, Nlink: 2}
+	_ = g.CheckFile(&busybox, "/bin")
+	su := busybox
+	su.Name = "su"
+	_ = g.CheckFile(&su, "/bin")
+	sh := fsparser.FileInfo{Name: "sh", Mode: fsparser.S_IFREG | 0755, Size: 10, Ino: 6, Nlink: 1}
+	_ = g.CheckFile(&sh, "/bin")
+	g.Finalize()
+
+	if a.digestCalls != 2 {
+		t.Errorf("the digest of a hardlink group should be computed once: %d", a.digestCalls)
+	}
+	if len(g.tree) != 3 || g.tree["/bin/su"].Digest != g.tree["/bin/busybox"].Digest {
+		t.Errorf("bad tree: %v", g.tree)
+	}
+}
@@ -19,6 +19,8 @@ package globalfilechecks
 import (
 	"fmt"
 	"path"
+	"sort"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/bmatcuk/doublestar"
@@ -37,14 +39,48 @@ type filePermsConfigType struct {
 	BadFiles                        map[string]bool
 	BadFilesInformationalOnly       bool
 	FlagCapabilityInformationalOnly bool
+	DosHidden                       bool
+	DosSystem                       bool
+	FsType                          string
+	Hardlinks                       bool
+	PrivilegedHardlinks             bool
+	CapabilityHardlinkAllowedList   map[string]bool
+	Xattr                           []xattrRule
+}
+
+// xattrRule applies the xattr rules to every file matching one of the paths
+type xattrRule struct {
+	name              string
+	paths             []string
+	executableOnly    bool
+	rules             *analyzer.XattrRules
+	informationalOnly bool
+	desc              string
+}
+
+// hardlinkGroup contains every path of an inode
+type hardlinkGroup struct {
+	paths []string
+	suid  bool
+	caps  bool
 }
 
 type filePermsType struct {
-	config *filePermsConfigType
-	a      analyzer.AnalyzerType
+	config    *filePermsConfigType
+	a         analyzer.AnalyzerType
+	hardlinks map[fsparser.HardlinkKey]*hardlinkGroup
 }
 
 func New(config string, a analyzer.AnalyzerType) *filePermsType {
+	type xattrRuleConfig struct {
+		Paths             []string
+		ExecutableOnly    bool
+		Required          []string
+		Forbidden         []string
+		Match             map[string]string
+		InformationalOnly bool
+		Desc              string
+	}
 	type filePermsConfig struct {
 		Suid                            bool
 		SuidWhiteList                   []string // keep for backward compatibility
@@ -56,6 +92,13 @@ func New(config string, a analyzer.AnalyzerType) *filePermsType {
 		BadFiles                        []string
 		BadFilesInformationalOnly       bool
 		FlagCapabilityInformationalOnly bool
+		DosHidden                       bool
+		DosSystem                       bool
+		FsType                          string
+		Hardlinks                       bool
+		PrivilegedHardlinks             bool
+		CapabilityHardlinkAllowedList   []string
+		Xattr                           map[string]xattrRuleConfig
 	}
 	type fpc struct {
 		GlobalFileChecks filePermsConfig
@@ -72,6 +115,11 @@ func New(config string, a analyzer.AnalyzerType) *filePermsType {
 		SELinuxLabel:                    conf.GlobalFileChecks.SELinuxLabel,
 		BadFilesInformationalOnly:       conf.GlobalFileChecks.BadFilesInformationalOnly,
 		FlagCapabilityInformationalOnly: conf.GlobalFileChecks.FlagCapabilityInformationalOnly,
+		DosHidden:                       conf.GlobalFileChecks.DosHidden,
+		DosSystem:                       conf.GlobalFileChecks.DosSystem,
+		FsType:                          conf.GlobalFileChecks.FsType,
+		Hardlinks:                       conf.GlobalFileChecks.Hardlinks,
+		PrivilegedHardlinks:             conf.GlobalFileChecks.PrivilegedHardlinks,
 	}
 	configuration.SuidAllowedList = make(map[string]bool)
 	for _, alfn := range conf.GlobalFileChecks.SuidAllowedList {
@@ -81,6 +129,10 @@ func New(config string, a analyzer.AnalyzerType) *filePermsType {
 	for _, wlfn := range conf.GlobalFileChecks.SuidWhiteList {
 		configuration.SuidAllowedList[path.Clean(wlfn)] = true
 	}
+	configuration.CapabilityHardlinkAllowedList = make(map[string]bool)
+	for _, alfn := range conf.GlobalFileChecks.CapabilityHardlinkAllowedList {
+		configuration.CapabilityHardlinkAllowedList[path.Clean(alfn)] = true
+	}
 	configuration.Uids = make(map[int]bool)
 	for _, uid := range conf.GlobalFileChecks.Uids {
 		configuration.Uids[uid] = true
@@ -95,26 +147,101 @@ func New(config string, a analyzer.AnalyzerType) *filePermsType {
 		configuration.BadFiles[path.Clean(bf)] = true
 	}
 
-	cfg := filePermsType{&configuration, a}
+	for name, rc := range conf.GlobalFileChecks.Xattr {
+		rules, err := analyzer.NewXattrRules(rc.Required, rc.Forbidden, rc.Match)
+		if err == nil {
+			for _, p := range rc.Paths {
+				if _, err = doublestar.Match(p, ""); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			panic("can't read config data: Xattr rule " + name + ": " + err.Error())
+		}
+		configuration.Xattr = append(configuration.Xattr, xattrRule{
+			name:              name,
+			paths:             rc.Paths,
+			executableOnly:    rc.ExecutableOnly,
+			rules:             rules,
+			informationalOnly: rc.InformationalOnly,
+			desc:              rc.Desc,
+		})
+	}
+	// report the results in the same order every time
+	sort.Slice(configuration.Xattr, func(i, j int) bool {
+		return configuration.Xattr[i].name < configuration.Xattr[j].name
+	})
+
+	cfg := filePermsType{&configuration, a, make(map[fsparser.HardlinkKey]*hardlinkGroup)}
 
 	return &cfg
 }
 
-func (state *filePermsType) Start() {}
+func (state *filePermsType) Start() {
+	// the FsType can be detected automatically, make sure it is the expected one
+	if state.config.FsType != "" {
+		fsType := state.a.ImageInfo().FSType
+		if !strings.EqualFold(fsType, state.config.FsType) {
+			state.a.AddOffender("/", fmt.Sprintf("FsType not allowed, FsType = %s should be = %s", fsType, state.config.FsType))
+		}
+	}
+}
 func (state *filePermsType) Finalize() string {
+	if state.config.Hardlinks || state.config.PrivilegedHardlinks {
+		state.checkHardlinks()
+	}
 	return ""
 }
 
+// suidAllowed returns true if the SUID/SGID file is in the SuidAllowedList
+func (state *filePermsType) suidAllowed(fn string) bool {
+	_, ok := state.config.SuidAllowedList[fn]
+	return ok
+}
+
+// checkHardlinks reports every hardlink group as Informational and the paths of
+// SUID/SGID and capability groups that are not allowed, the messages list all paths of the group
+func (state *filePermsType) checkHardlinks() {
+	groups := make([]*hardlinkGroup, 0, len(state.hardlinks))
+	for _, group := range state.hardlinks {
+		// the other names are not part of the image (e.g. a different mount point)
+		if len(group.paths) < 2 {
+			continue
+		}
+		sort.Strings(group.paths)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].paths[0] < groups[j].paths[0] })
+
+	for _, group := range groups {
+		hardlinks := strings.Join(group.paths, ", ")
+		for _, fn := range group.paths {
+			if state.config.Hardlinks {
+				state.a.AddInformational(fn, fmt.Sprintf("File has hardlinks: %s", hardlinks))
+			}
+			if !state.config.PrivilegedHardlinks {
+				continue
+			}
+			// SUID/SGID files that are not allowed are already reported by the Suid check
+			if group.suid && !state.config.Suid && !state.suidAllowed(fn) {
+				state.a.AddOffender(fn, fmt.Sprintf("File is a hardlink to a SUID/SGID file, not allowed, hardlinks: %s", hardlinks))
+			}
+			if group.caps && !state.config.CapabilityHardlinkAllowedList[fn] {
+				state.a.AddOffender(fn, fmt.Sprintf("File is a hardlink to a file with capabilities, not allowed, hardlinks: %s", hardlinks))
+			}
+		}
+	}
+}
+
 func (state *filePermsType) Name() string {
 	return "GlobalFileChecks"
 }
 
 func (state *filePermsType) CheckFile(fi *fsparser.FileInfo, fpath string) error {
 	if state.config.Suid {
-		if fi.IsSUid() || fi.IsSGid() {
-			if _, ok := state.config.SuidAllowedList[path.Join(fpath, fi.Name)]; !ok {
-				state.a.AddOffender(path.Join(fpath, fi.Name), "File is SUID, not allowed")
-			}
+		if (fi.IsSUid() || fi.IsSGid()) && !state.suidAllowed(path.Join(fpath, fi.Name)) {
+			state.a.AddOffender(path.Join(fpath, fi.Name), "File is SUID, not allowed")
 		}
 	}
 	if state.config.WorldWrite {
@@ -128,6 +255,17 @@ func (state *filePermsType) CheckFile(fi *fsparser.FileInfo, fpath string) error
 		}
 	}
 
+	if state.config.DosHidden {
+		if fi.IsDosHidden() {
+			state.a.AddOffender(path.Join(fpath, fi.Name), "File has DOS hidden attribute, not allowed")
+		}
+	}
+	if state.config.DosSystem {
+		if fi.IsDosSystem() {
+			state.a.AddOffender(path.Join(fpath, fi.Name), "File has DOS system attribute, not allowed")
+		}
+	}
+
 	if len(state.config.Uids) > 0 {
 		if _, ok := state.config.Uids[fi.Uid]; !ok {
 			state.a.AddOffender(path.Join(fpath, fi.Name), fmt.Sprintf("File Uid not allowed, Uid = %d", fi.Uid))
@@ -170,5 +308,48 @@ func (state *filePermsType) CheckFile(fi *fsparser.FileInfo, fpath string) error
 		}
 	}
 
+	if (state.config.Hardlinks || state.config.PrivilegedHardlinks) && fi.IsHardlink() {
+		key := fi.HardlinkKey()
+		group, ok := state.hardlinks[key]
+		if !ok {
+			group = &hardlinkGroup{suid: fi.IsSUid() || fi.IsSGid(), caps: len(fi.Capabilities) > 0}
+			state.hardlinks[key] = group
+		}
+		group.paths = append(group.paths, path.Join(fpath, fi.Name))
+	}
+
+	for _, rule := range state.config.Xattr {
+		if !rule.appliesTo(fi, path.Join(fpath, fi.Name)) {
+			continue
+		}
+		for _, msg := range rule.rules.Check(fi) {
+			msg = fmt.Sprintf("Xattr rule %s failed: %s : %s", rule.name, msg, rule.desc)
+			if rule.informationalOnly {
+				state.a.AddInformational(path.Join(fpath, fi.Name), msg)
+			} else {
+				state.a.AddOffender(path.Join(fpath, fi.Name), msg)
+			}
+		}
+	}
+
 	return nil
 }
+
+// appliesTo returns true if the rule needs to be checked for the file, links are never checked
+func (rule *xattrRule) appliesTo(fi *fsparser.FileInfo, fullpath string) bool {
+	if fi.IsLink() {
+		return false
+	}
+	if rule.executableOnly && (!fi.IsFile() || fi.Mode&(fsparser.S_IXUSR|fsparser.S_IXGRP|fsparser.S_IXOTH) == 0) {
+		return false
+	}
+	if len(rule.paths) == 0 {
+		return true
+	}
+	for _, p := range rule.paths {
+		if m, _ := doublestar.Match(p, fullpath); m {
+			return true
+		}
+	}
+	return false
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package globalfilechecks
 
 import (
+	"io"
+	"os"
 	"testing"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/analyzer"
@@ -27,6 +29,9 @@ type OffenderCallack func(fn string)
 
 type testAnalyzer struct {
 	ocb OffenderCallack
+	// informational callback, ocb is used if not set
+	icb    OffenderCallack
+	fsType string
 }
 
 func (a *testAnalyzer) AddData(key, value string) {}
@@ -42,16 +47,23 @@ func (a *testAnalyzer) FileGetSha256(filepath string) ([]byte, error) {
 func (a *testAnalyzer) FileGet(filepath string) (string, error) {
 	return "", nil
 }
+func (a *testAnalyzer) FileOpen(filepath string) (io.ReadCloser, error) {
+	return nil, os.ErrNotExist
+}
 func (a *testAnalyzer) AddOffender(filepath string, reason string) {
 	a.ocb(filepath)
 }
 func (a *testAnalyzer) AddInformational(filepath string, reason string) {
+	if a.icb != nil {
+		a.icb(filepath)
+		return
+	}
 	a.ocb(filepath)
 }
 func (a *testAnalyzer) CheckAllFilesWithPath(cb analyzer.AllFilesCallback, cbdata analyzer.AllFilesCallbackData, filepath string) {
 }
 func (a *testAnalyzer) ImageInfo() analyzer.AnalyzerReport {
-	return analyzer.AnalyzerReport{}
+	return analyzer.AnalyzerReport{FSType: a.fsType}
 }
 
 func TestGlobal(t *testing.T) {
@@ -66,6 +78,8 @@ Uids = [0]
 Gids = [0]
 BadFiles = ["/file99", "/file1", "**.h"]
 FlagCapabilityInformationalOnly = true
+DosHidden = true
+DosSystem = true
 `
 
 	g := New(cfg, a)
@@ -92,6 +106,10 @@ FlagCapabilityInformationalOnly = true
 		{fsparser.FileInfo{Name: "test.h", SELinuxLabel: "uidfile"}, "/usr/", true},
 		// Capability
 		{fsparser.FileInfo{Name: "ping", Capabilities: []string{"cap_net_admin+p"}}, "/usr/bin", true},
+		// DOS attributes
+		{fsparser.FileInfo{Name: "hidden", SELinuxLabel: "label", DosAttributes: fsparser.DosAttrHidden}, "/EFI", true},
+		{fsparser.FileInfo{Name: "system", SELinuxLabel: "label", DosAttributes: fsparser.DosAttrSystem}, "/EFI", true},
+		{fsparser.FileInfo{Name: "readonly", SELinuxLabel: "label", DosAttributes: fsparser.DosAttrReadOnly | fsparser.DosAttrArchive}, "/EFI", false},
 	}
 
 	var triggered bool
@@ -110,3 +128,156 @@ FlagCapabilityInformationalOnly = true
 
 	g.Finalize()
 }
+
+func TestFsType(t *testing.T) {
+	cfg := `
+[GlobalFileChecks]
+FsType = "extfs"
+`
+	tests := []struct {
+		fsType        string
+		shouldTrigger bool
+	}{
+		{"extfs", false},
+		{"squashfs", true},
+	}
+	for _, test := range tests {
+		triggered := false
+		a := &testAnalyzer{fsType: test.fsType}
+		a.ocb = func(fn string) { triggered = fn == "/" }
+		g := New(cfg, a)
+		g.Start()
+		if triggered != test.shouldTrigger {
+			t.Errorf("FsType %s test failed", test.fsType)
+		}
+	}
+
+	// no FsType configured
+	triggered := false
+	a := &testAnalyzer{fsType: "squashfs"}
+	a.ocb = func(fn string) { triggered = true }
+	New("", a).Start()
+	if triggered {
+		t.Errorf("FsType check should be disabled")
+	}
+}
+
+func TestXattr(t *testing.T) {
+	a := &testAnalyzer{}
+	a.ocb = func(fn string) { t.Errorf("invalid config: %s", fn) }
+	cfg := `
+[GlobalFileChecks.Xattr.ima]
+Paths = ["/usr/bin/*", "/usr/sbin/*"]
+ExecutableOnly = true
+Required = ["security.ima"]
+Desc = "executables need to be signed"
+
+[GlobalFileChecks.Xattr.smack]
+Forbidden = ["security.SMACK64EXEC"]
+Match = { "security.SMACK64" = "^(_|System)$" }
+`
+	g := New(cfg, a)
+	g.Start()
+
+	ima := map[string][]byte{"security.ima": {3, 2, 4}}
+	tests := []struct {
+		fi            fsparser.FileInfo
+		path          string
+		shouldTrigger bool
+	}{
+		{fsparser.FileInfo{Name: "ls", Mode: fsparser.S_IFREG | 0755, Xattrs: ima}, "/usr/bin", false},
+		{fsparser.FileInfo{Name: "ls", Mode: fsparser.S_IFREG | 0755}, "/usr/bin", true},
+		{fsparser.FileInfo{Name: "ls", Mode: fsparser.S_IFREG | 0755}, "/usr/lib", false},
+		// only executables need the signature
+		{fsparser.FileInfo{Name: "README", Mode: fsparser.S_IFREG | 0644}, "/usr/bin", false},
+		{fsparser.FileInfo{Name: "sh", Mode: fsparser.S_IFLNK | 0777, LinkTarget: "bash"}, "/usr/bin", false},
+		{fsparser.FileInfo{Name: "ls", Mode: fsparser.S_IFREG | 0755,
+			Xattrs: map[string][]byte{"security.ima": {3}, "security.SMACK64": []byte("System\x00")}}, "/usr/bin", false},
+		{fsparser.FileInfo{Name: "lib", Mode: fsparser.S_IFREG | 0644,
+			Xattrs: map[string][]byte{"security.SMACK64": []byte("User")}}, "/usr/lib", true},
+		{fsparser.FileInfo{Name: "lib", Mode: fsparser.S_IFREG | 0644,
+			Xattrs: map[string][]byte{"security.SMACK64": []byte("_"), "security.SMACK64EXEC": []byte("_")}}, "/usr/lib", true},
+	}
+
+	for _, test := range tests {
+		triggered := false
+		a.ocb = func(fn string) { triggered = true }
+		if err := g.CheckFile(&test.fi, test.path); err != nil {
+			t.Errorf("CheckFile failed")
+		}
+		if triggered != test.shouldTrigger {
+			t.Errorf("%s/%s xattr test failed", test.path, test.fi.Name)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("invalid Xattr rule should fail")
+		}
+	}()
+	New("[GlobalFileChecks.Xattr.bad]\nMatch = { \"user.*\" = \"(\" }\n", a)
+}
+
+func TestPrivilegedHardlinks(t *testing.T) {
+	a := &testAnalyzer{}
+	cfg := `
+[GlobalFileChecks]
+SuidAllowedList = ["/bin/su", "/bin/busybox"]
+CapabilityHardlinkAllowedList = ["/bin/ping"]
+Hardlinks = true
+PrivilegedHardlinks = true
+`
+	suid := fsparser.FileInfo{Mode: fsparser.S_IFREG | 04755, Ino: 10, Nlink: 3, Size: 100}
+	caps := fsparser.FileInfo{Mode: fsparser.S_IFREG | 0755, Ino: 11, Nlink: 2, Size: 50, Capabilities: []string{"cap_net_raw+p"}}
+	plain := fsparser.FileInfo{Mode: fsparser.S_IFREG | 0755, Ino: 12, Nlink: 2, Size: 10}
+	files := []struct {
+		fi   fsparser.FileInfo
+		path string
+		name string
+	}{
+		{suid, "/bin", "busybox"},
+		{suid, "/bin", "su"},
+		{suid, "/tmp", "x"},
+		{caps, "/bin", "ping"},
+		{caps, "/data", "p"},
+		{plain, "/bin", "ls"},
+		{plain, "/tmp", "ls"},
+		// same inode number in a different image
+		{fsparser.FileInfo{Mode: fsparser.S_IFREG | 04755, Ino: 10, Nlink: 2, Size: 100, Image: "/vendor"}, "/vendor/bin", "tool"},
+	}
+	run := func(cfg string) (map[string]int, map[string]int) {
+		g := New(cfg, a)
+		g.Start()
+		offenders := make(map[string]int)
+		informational := make(map[string]int)
+		a.ocb = func(fn string) { offenders[fn]++ }
+		a.icb = func(fn string) { informational[fn]++ }
+		for _, f := range files {
+			fi := f.fi
+			fi.Name = f.name
+			if err := g.CheckFile(&fi, f.path); err != nil {
+				t.Errorf("CheckFile failed")
+			}
+		}
+		if len(informational) != 0 {
+			t.Errorf("hardlinks should be reported by Finalize: %v", informational)
+		}
+		g.Finalize()
+		return offenders, informational
+	}
+
+	offenders, informational := run(cfg)
+	if len(offenders) != 2 || offenders["/tmp/x"] != 1 || offenders["/data/p"] != 1 {
+		t.Errorf("bad offenders: %v", offenders)
+	}
+	// every hardlink group is reported
+	if len(informational) != 7 || informational["/vendor/bin/tool"] != 0 {
+		t.Errorf("bad informational: %v", informational)
+	}
+
+	// SUID/SGID files that are not allowed are only reported once by the Suid check
+	offenders, _ = run(cfg + "Suid = true\n")
+	if len(offenders) != 3 || offenders["/tmp/x"] != 1 || offenders["/vendor/bin/tool"] != 1 || offenders["/data/p"] != 1 {
+		t.Errorf("bad offenders with the Suid check: %v", offenders)
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsdetect"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+// images nested deeper are not mounted, protects against patterns matching the content of their own image
+const maxNestedDepth = 8
+
+// nestedSeparator separates the path of a nested image from the path inside the image (e.g. /boot/initrd.img!/init)
+const nestedSeparator = "!"
+
+type nestedConfigType struct {
+	FsType        string
+	FsTypeOptions string
+}
+
+// nestedParser mounts images inside the image that match a Nested pattern,
+// the content of the image at <path> is available below <path>!
+type nestedParser struct {
+	fsparser.FsParser
+	// path of this parser's root in the analyzed image ("" for the analyzed image itself)
+	prefix   string
+	patterns []string
+	config   map[string]nestedConfigType
+	tmpdir   string
+	depth    int
+	// mounted images by path, nil if the file can't be mounted
+	mounted map[string]*nestedParser
+	count   *int
+}
+
+func newNestedParser(fsp fsparser.FsParser, config map[string]nestedConfigType, tmpdir string) *nestedParser {
+	n := &nestedParser{
+		FsParser: fsp,
+		config:   config,
+		tmpdir:   tmpdir,
+		mounted:  make(map[string]*nestedParser),
+		count:    new(int),
+	}
+	for pattern := range config {
+		n.patterns = append(n.patterns, pattern)
+	}
+	// the first matching pattern is used, keep the order stable
+	sort.Strings(n.patterns)
+	return n
+}
+
+// match returns the config of the first pattern matching the file,
+// patterns starting with "/" match the full path, other patterns match the file name
+func (n *nestedParser) match(filepath string) (nestedConfigType, bool) {
+	for _, pattern := range n.patterns {
+		name := path.Base(filepath)
+		if strings.HasPrefix(pattern, "/") {
+			name = n.prefix + filepath
+		}
+		if m, _ := doublestar.Match(pattern, name); m {
+			return n.config[pattern], true
+		}
+	}
+	return nestedConfigType{}, false
+}
+
+// mount returns the parser for the image at filepath or nil if the file is not a (supported) image
+func (n *nestedParser) mount(filepath string) *nestedParser {
+	cfg, ok := n.match(filepath)
+	if !ok || n.depth >= maxNestedDepth {
+		return nil
+	}
+	if m, ok := n.mounted[filepath]; ok {
+		return m
+	}
+	n.mounted[filepath] = nil
+
+	fi, err := n.FsParser.GetFileInfo(filepath)
+	if err != nil || !fi.IsFile() {
+		return nil
+	}
+
+	*n.count++
+	dir := path.Join(n.tmpdir, fmt.Sprintf("nested%d", *n.count))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+	imagepath := path.Join(dir, fi.Name)
+	if !n.FsParser.CopyFile(filepath, imagepath) {
+		return nil
+	}
+	gcfg := globalConfigType{FSType: cfg.FsType, FSTypeOptions: cfg.FsTypeOptions}
+	imagepath, err = prepareImage(imagepath, dir, gcfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nested image %s: %s\n", n.prefix+filepath, err)
+		return nil
+	}
+	if gcfg.FSType == "" || strings.EqualFold(gcfg.FSType, FsTypeAuto) {
+		gcfg.FSType = fsdetect.Detect(imagepath)
+		if gcfg.FSType == "" {
+			return nil
+		}
+	}
+
+	m := &nestedParser{
+		FsParser: newParser(imagepath, gcfg),
+		prefix:   n.prefix + filepath + nestedSeparator,
+		patterns: n.patterns,
+		config:   n.config,
+		tmpdir:   n.tmpdir,
+		depth:    n.depth + 1,
+		mounted:  make(map[string]*nestedParser),
+		count:    n.count,
+	}
+	// the parsers open the image on first use, make sure the image can be read
+	if _, err := m.FsParser.GetDirInfo("/"); err != nil {
+		fmt.Fprintf(os.Stderr, "nested image %s: %s\n", n.prefix+filepath, err)
+		return nil
+	}
+	n.mounted[filepath] = m
+	return m
+}
+
+// split splits filepath into the path of a mounted image and the path inside the image
+func (n *nestedParser) split(filepath string) (*nestedParser, string, string) {
+	for i := 0; i < len(filepath); i++ {
+		if !strings.HasPrefix(filepath[i:], nestedSeparator) {
+			continue
+		}
+		rest := filepath[i+len(nestedSeparator):]
+		if rest != "" && rest[0] != '/' {
+			continue
+		}
+		if m := n.mount(filepath[:i]); m != nil {
+			if rest == "" {
+				rest = "/"
+			}
+			return m, filepath[:i], rest
+		}
+	}
+	return nil, "", ""
+}
+
+// rootInfo returns the root of the mounted image named like the mount point
+func (n *nestedParser) rootInfo(m *nestedParser, filepath string) (fsparser.FileInfo, error) {
+	fi, err := m.GetFileInfo("/")
+	fi.Name = path.Base(filepath) + nestedSeparator
+	return fi, err
+}
+
+// setImage sets the image of the files of a nested image, inode numbers are only unique within an image
+func (n *nestedParser) setImage(fi *fsparser.FileInfo) {
+	if n.prefix != "" {
+		fi.Image = n.prefix
+	}
+}
+
+func (n *nestedParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	if m, _, inner := n.split(dirpath); m != nil {
+		return m.GetDirInfo(inner)
+	}
+	dir, err := n.FsParser.GetDirInfo(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dir {
+		n.setImage(&dir[i])
+	}
+	for _, fi := range dir {
+		if !fi.IsFile() {
+			continue
+		}
+		filepath := path.Join(dirpath, fi.Name)
+		if m := n.mount(filepath); m != nil {
+			root, err := n.rootInfo(m, filepath)
+			if err != nil {
+				return nil, err
+			}
+			dir = append(dir, root)
+		}
+	}
+	return dir, nil
+}
+
+func (n *nestedParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	if m, mountpath, inner := n.split(filepath); m != nil {
+		if inner == "/" {
+			return n.rootInfo(m, mountpath)
+		}
+		return m.GetFileInfo(inner)
+	}
+	fi, err := n.FsParser.GetFileInfo(filepath)
+	n.setImage(&fi)
+	return fi, err
+}
+
+func (n *nestedParser) CopyFile(filepath string, dstdir string) bool {
+	if m, _, inner := n.split(filepath); m != nil {
+		return m.CopyFile(inner, dstdir)
+	}
+	return n.FsParser.CopyFile(filepath, dstdir)
+}
+
+func (n *nestedParser) Open(filepath string) (io.ReadCloser, error) {
+	if m, _, inner := n.split(filepath); m != nil {
+		return m.Open(inner)
+	}
+	return openFile(n.FsParser, filepath, n.tmpdir)
+}
+
+// ExtractFiles extracts the files with the parsers of the images they are stored in,
+// files in images that don't support bulk extraction are not extracted
+func (n *nestedParser) ExtractFiles(filepaths []string, dstdir string) (map[string]string, error) {
+	var mountpaths []string
+	parsers := make(map[string]fsparser.FsParser)
+	files := make(map[string][]string)
+	for _, filepath := range filepaths {
+		var fsp fsparser.FsParser = n.FsParser
+		mountpath, inner := "", filepath
+		if m, mp, in := n.split(filepath); m != nil {
+			fsp, mountpath, inner = m, mp, in
+		}
+		if _, ok := parsers[mountpath]; !ok {
+			parsers[mountpath] = fsp
+			mountpaths = append(mountpaths, mountpath)
+		}
+		files[mountpath] = append(files[mountpath], inner)
+	}
+
+	extracted := make(map[string]string)
+	var err error
+	for _, mountpath := range mountpaths {
+		dir := dstdir
+		if mountpath != "" {
+			dir = path.Join(dstdir, mountpath+nestedSeparator)
+		}
+		ext, merr := extractFiles(parsers[mountpath], files[mountpath], dir)
+		if merr != nil {
+			err = fmt.Errorf("%s%s: %s", n.prefix, mountpath, merr)
+		}
+		for inner, tmpname := range ext {
+			if mountpath != "" {
+				inner = mountpath + nestedSeparator + inner
+			}
+			extracted[inner] = tmpname
+		}
+	}
+	return extracted, err
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"sync"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+// workerPool runs functions on a bounded number of goroutines, if all workers
+// are busy the function is run by the caller. This way the caller can't get
+// ahead of the pool by more than one function.
+type workerPool struct {
+	workers chan struct{}
+}
+
+// newWorkerPool returns a pool that runs up to jobs functions at the same time
+// (including the caller), nil is returned if jobs is 1 or less
+func newWorkerPool(jobs int) *workerPool {
+	if jobs <= 1 {
+		return nil
+	}
+	return &workerPool{workers: make(chan struct{}, jobs-1)}
+}
+
+// workBatch is a group of functions run by the pool, wait returns once all of them are done
+type workBatch struct {
+	pool *workerPool
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+}
+
+// newBatch returns a batch for the pool, the functions of a batch for a nil pool run on the caller
+func (p *workerPool) newBatch() *workBatch {
+	return &workBatch{pool: p}
+}
+
+// run calls fn on a worker or on the caller if no worker is available,
+// the error of fn is returned if it ran on the caller
+func (b *workBatch) run(fn func() error) error {
+	if b.pool != nil {
+		select {
+		case b.pool.workers <- struct{}{}:
+			b.wg.Add(1)
+			go func() {
+				defer func() {
+					<-b.pool.workers
+					b.wg.Done()
+				}()
+				b.setErr(fn())
+			}()
+			return nil
+		default:
+		}
+	}
+	err := fn()
+	b.setErr(err)
+	return err
+}
+
+func (b *workBatch) setErr(err error) {
+	if err == nil {
+		return
+	}
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+}
+
+// wait waits for all functions of the batch and returns the first error
+func (b *workBatch) wait() error {
+	b.wg.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+const (
+	offender = iota
+	informational
+	data
+	nested
+)
+
+// jobEntry is a result of a plugin, kind is offender, informational, data, or
+// nested for the results of a job started by the plugin
+type jobEntry struct {
+	kind  int
+	key   string
+	value string
+	job   *jobReport
+}
+
+// jobReport records the results of a plugin run until they are added to the report,
+// a jobReport is only used by a single goroutine at a time
+type jobReport struct {
+	*Analyzer
+	entries []jobEntry
+	// the results of the plugins that run on the caller
+	serial bool
+}
+
+// newJobReport returns a jobReport for a concurrent plugin, the results are added
+// to the report in the order the jobReports were created
+func (a *Analyzer) newJobReport() *jobReport {
+	job := &jobReport{Analyzer: a}
+	a.jobReports = append(a.jobReports, job)
+	return job
+}
+
+// addEntry adds a result to the report, while plugins run concurrently the result
+// is recorded after the results of the plugins that ran before
+func (a *Analyzer) addEntry(entry jobEntry) {
+	if a.jobReports == nil {
+		a.apply(entry)
+		return
+	}
+	n := len(a.jobReports)
+	if n == 0 || !a.jobReports[n-1].serial {
+		a.jobReports = append(a.jobReports, &jobReport{Analyzer: a, serial: true})
+		n++
+	}
+	job := a.jobReports[n-1]
+	job.entries = append(job.entries, entry)
+}
+
+func (a *Analyzer) apply(entry jobEntry) {
+	switch entry.kind {
+	case offender:
+		a.addOffender(entry.key, entry.value)
+	case informational:
+		a.addInformational(entry.key, entry.value)
+	case data:
+		a.addData(entry.key, entry.value)
+	}
+}
+
+func (j *jobReport) AddOffender(filepath string, reason string) {
+	j.entries = append(j.entries, jobEntry{kind: offender, key: filepath, value: reason})
+}
+
+func (j *jobReport) AddInformational(filepath string, reason string) {
+	j.entries = append(j.entries, jobEntry{kind: informational, key: filepath, value: reason})
+}
+
+func (j *jobReport) AddData(key string, value string) {
+	j.entries = append(j.entries, jobEntry{kind: data, key: key, value: value})
+}
+
+// checkAllFilesConcurrent runs every callback as a job with its own jobReport,
+// the results are added in the order of the files
+func (j *jobReport) checkAllFilesConcurrent(cb AllFilesConcurrentCallback, cbdata AllFilesCallbackData, filepath string) {
+	batch := j.pool.newBatch()
+	j.Analyzer.CheckAllFilesWithPath(func(fi *fsparser.FileInfo, fullpath string, data AllFilesCallbackData) {
+		job := &jobReport{Analyzer: j.Analyzer}
+		j.entries = append(j.entries, jobEntry{kind: nested, job: job})
+		fic := *fi
+		_ = batch.run(func() error {
+			cb(job, &fic, fullpath, data)
+			return nil
+		})
+	}, cbdata, filepath)
+	_ = batch.wait()
+}
+
+// applyAll adds the recorded results to the report
+func (j *jobReport) applyAll() {
+	for _, entry := range j.entries {
+		if entry.kind == nested {
+			entry.job.applyAll()
+			continue
+		}
+		j.Analyzer.apply(entry)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analyzer
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+// XattrRules checks the extended attributes of a file, attribute names can be
+// patterns (see path.Match, e.g. "trusted.*")
+type XattrRules struct {
+	// every pattern has to match at least one attribute
+	required []string
+	// no attribute may match any of the patterns
+	forbidden []string
+	// the value (see fsparser.XattrString) of the attributes matching the
+	// pattern has to match the regex, use required to make sure they exist
+	match map[string]*regexp.Regexp
+}
+
+// NewXattrRules validates the patterns and compiles the regular expressions
+func NewXattrRules(required []string, forbidden []string, match map[string]string) (*XattrRules, error) {
+	rules := XattrRules{
+		required:  required,
+		forbidden: forbidden,
+		match:     make(map[string]*regexp.Regexp),
+	}
+	for _, pattern := range append(append([]string{}, required...), forbidden...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad xattr pattern %s: %s", pattern, err)
+		}
+	}
+	for pattern, rx := range match {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad xattr pattern %s: %s", pattern, err)
+		}
+		reg, err := regexp.Compile(rx)
+		if err != nil {
+			return nil, fmt.Errorf("bad xattr regex %s: %s", rx, err)
+		}
+		rules.match[pattern] = reg
+	}
+	return &rules, nil
+}
+
+// Empty returns true if there are no rules
+func (r *XattrRules) Empty() bool {
+	return len(r.required) == 0 && len(r.forbidden) == 0 && len(r.match) == 0
+}
+
+// Check returns a message for every rule the file does not satisfy
+func (r *XattrRules) Check(fi *fsparser.FileInfo) []string {
+	var msgs []string
+	for _, pattern := range r.required {
+		if len(fi.XattrNames(pattern)) == 0 {
+			msgs = append(msgs, fmt.Sprintf("xattr %s not found", pattern))
+		}
+	}
+	for _, pattern := range r.forbidden {
+		for _, name := range fi.XattrNames(pattern) {
+			msgs = append(msgs, fmt.Sprintf("xattr %s not allowed", name))
+		}
+	}
+	patterns := make([]string, 0, len(r.match))
+	for pattern := range r.match {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		for _, name := range fi.XattrNames(pattern) {
+			value := fsparser.XattrString(fi.Xattrs[name])
+			if !r.match[pattern].MatchString(value) {
+				msgs = append(msgs, fmt.Sprintf("xattr %s = %s does not match %s", name, value, r.match[pattern]))
+			}
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootimgparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+ * Reader for Android boot images (header version 0 to 4) and vendor_boot images (version 3 and 4).
+ * see: system/tools/mkbootimg/include/bootimg/bootimg.h
+ */
+
+const (
+	bootMagic       = "ANDROID!"
+	vendorBootMagic = "VNDRBOOT"
+
+	// boot image v3 and later use a fixed page size
+	bootV3PageSize = 4096
+	maxHeaderSize  = 4096
+
+	vendorHeaderSizeV3        = 2112
+	vendorHeaderSizeV4        = 2128
+	vendorRamdiskNameSize     = 32
+	vendorRamdiskTableEntryV4 = 108
+)
+
+// bootSection is a part of the image that is exposed as a file
+type bootSection struct {
+	name   string
+	offset int64
+	size   int64
+	// content that is stored in the header (e.g. the cmdline), nil if the content is at offset
+	data []byte
+}
+
+type bootImage struct {
+	file    *os.File
+	vendor  bool
+	version uint32
+	// sections in image order
+	sections []bootSection
+	// the (vendor) ramdisk containing the cpio archive
+	ramdisk *bootSection
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func pageAlign(size int64, pageSize int64) int64 {
+	return (size + pageSize - 1) / pageSize * pageSize
+}
+
+func openBootImage(imagepath string) (*bootImage, error) {
+	file, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	img, err := readBootImage(file, st.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	img.file = file
+	return img, nil
+}
+
+// readBootImage parses the header and computes the location of all sections
+func readBootImage(r io.ReaderAt, imageSize int64) (*bootImage, error) {
+	hdr := make([]byte, maxHeaderSize)
+	n, err := r.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	hdr = hdr[:n]
+	if len(hdr) < 8 {
+		return nil, fmt.Errorf("bootimg: image too small")
+	}
+
+	var img *bootImage
+	switch string(hdr[:8]) {
+	case bootMagic:
+		img, err = readBootHeader(hdr)
+	case vendorBootMagic:
+		img, err = readVendorBootHeader(r, hdr)
+	default:
+		return nil, fmt.Errorf("bootimg: bad magic %q", hdr[:8])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range img.sections {
+		s := &img.sections[i]
+		if s.data == nil && (s.offset < 0 || s.size < 0 || s.offset+s.size > imageSize) {
+			return nil, fmt.Errorf("bootimg: %s exceeds image size", s.name)
+		}
+		if s.name == "ramdisk.img" {
+			img.ramdisk = s
+		}
+	}
+	return img, nil
+}
+
+// sectionList places sections one after the other, each section starts at a page boundary
+type sectionList struct {
+	sections []bootSection
+	offset   int64
+	pageSize int64
+}
+
+func (l *sectionList) add(name string, size uint32) {
+	if size > 0 {
+		l.sections = append(l.sections, bootSection{name: name, offset: l.offset, size: int64(size)})
+	}
+	l.offset += pageAlign(int64(size), l.pageSize)
+}
+
+func (l *sectionList) addData(name string, data string) {
+	if data != "" {
+		l.sections = append(l.sections, bootSection{name: name, size: int64(len(data)), data: []byte(data)})
+	}
+}
+
+func readBootHeader(hdr []byte) (*bootImage, error) {
+	if len(hdr) < 44 {
+		return nil, fmt.Errorf("bootimg: header truncated")
+	}
+	le := binary.LittleEndian
+	version := le.Uint32(hdr[40:])
+	// the field was unused before version 1 and may contain garbage
+	if version > 4 {
+		version = 0
+	}
+	img := &bootImage{version: version}
+
+	if version >= 3 {
+		if len(hdr) < 1584 {
+			return nil, fmt.Errorf("bootimg: header truncated")
+		}
+		l := sectionList{offset: bootV3PageSize, pageSize: bootV3PageSize}
+		l.add("kernel", le.Uint32(hdr[8:]))
+		l.add("ramdisk.img", le.Uint32(hdr[12:]))
+		if version >= 4 {
+			l.add("signature", le.Uint32(hdr[1580:]))
+		}
+		l.addData("cmdline", cString(hdr[44:1580]))
+		img.sections = l.sections
+		return img, nil
+	}
+
+	if len(hdr) < 1660 {
+		return nil, fmt.Errorf("bootimg: header truncated")
+	}
+	pageSize := int64(le.Uint32(hdr[36:]))
+	if pageSize < 2048 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("bootimg: bad page size %d", pageSize)
+	}
+	l := sectionList{offset: pageSize, pageSize: pageSize}
+	l.add("kernel", le.Uint32(hdr[8:]))
+	l.add("ramdisk.img", le.Uint32(hdr[16:]))
+	l.add("second", le.Uint32(hdr[24:]))
+	if version >= 1 {
+		l.add("recovery_dtbo", le.Uint32(hdr[1632:]))
+	}
+	if version >= 2 {
+		l.add("dtb", le.Uint32(hdr[1648:]))
+	}
+	// the cmdline is split into cmdline and extra_cmdline
+	l.addData("cmdline", cString(hdr[64:576])+cString(hdr[608:1632]))
+	img.sections = l.sections
+	return img, nil
+}
+
+func readVendorBootHeader(r io.ReaderAt, hdr []byte) (*bootImage, error) {
+	if len(hdr) < vendorHeaderSizeV4 {
+		return nil, fmt.Errorf("bootimg: header truncated")
+	}
+	le := binary.LittleEndian
+	version := le.Uint32(hdr[8:])
+	if version < 3 || version > 4 {
+		return nil, fmt.Errorf("bootimg: unsupported vendor_boot version %d", version)
+	}
+	img := &bootImage{vendor: true, version: version}
+
+	pageSize := int64(le.Uint32(hdr[12:]))
+	if pageSize < 2048 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("bootimg: bad page size %d", pageSize)
+	}
+	headerSize := int64(vendorHeaderSizeV3)
+	if version >= 4 {
+		headerSize = vendorHeaderSizeV4
+	}
+	l := sectionList{offset: pageAlign(headerSize, pageSize), pageSize: pageSize}
+	ramdiskOffset := l.offset
+	l.add("ramdisk.img", le.Uint32(hdr[24:]))
+	l.add("dtb", le.Uint32(hdr[2100:]))
+	if version >= 4 {
+		tableOffset := l.offset
+		l.offset += pageAlign(int64(le.Uint32(hdr[2112:])), pageSize)
+		l.add("bootconfig", le.Uint32(hdr[2124:]))
+
+		fragments, err := readVendorRamdiskTable(r, tableOffset, ramdiskOffset,
+			le.Uint32(hdr[2116:]), le.Uint32(hdr[2120:]))
+		if err != nil {
+			return nil, err
+		}
+		l.sections = append(l.sections, fragments...)
+	}
+	l.addData("cmdline", cString(hdr[28:2076]))
+	img.sections = l.sections
+	return img, nil
+}
+
+// readVendorRamdiskTable returns the ramdisk fragments of a v4 vendor_boot image,
+// the fragments are concatenated in the vendor ramdisk section
+func readVendorRamdiskTable(r io.ReaderAt, tableOffset int64, ramdiskOffset int64, num uint32, entrySize uint32) ([]bootSection, error) {
+	if num == 0 {
+		return nil, nil
+	}
+	if entrySize < vendorRamdiskTableEntryV4 || num > 1024 {
+		return nil, fmt.Errorf("bootimg: bad vendor ramdisk table")
+	}
+	table := make([]byte, int(num)*int(entrySize))
+	if _, err := r.ReadAt(table, tableOffset); err != nil {
+		return nil, fmt.Errorf("bootimg: can't read vendor ramdisk table: %s", err)
+	}
+	var fragments []bootSection
+	names := make(map[string]bool)
+	le := binary.LittleEndian
+	for i := 0; i < int(num); i++ {
+		entry := table[i*int(entrySize):]
+		name := strings.Replace(cString(entry[12:12+vendorRamdiskNameSize]), "/", "_", -1)
+		if name == "" || names[name] {
+			name = fmt.Sprintf("%d", i)
+		}
+		names[name] = true
+		fragments = append(fragments, bootSection{
+			name:   "ramdisk_" + name + ".img",
+			offset: ramdiskOffset + int64(le.Uint32(entry[4:])),
+			size:   int64(le.Uint32(entry)),
+		})
+	}
+	return fragments, nil
+}
+
+// reader returns the content of a section
+func (img *bootImage) reader(s *bootSection) io.Reader {
+	if s.data != nil {
+		return bytes.NewReader(s.data)
+	}
+	return io.NewSectionReader(img.file, s.offset, s.size)
+}
+
+func (img *bootImage) section(name string) *bootSection {
+	for i := range img.sections {
+		if img.sections[i].name == name {
+			return &img.sections[i]
+		}
+	}
+	return nil
+}
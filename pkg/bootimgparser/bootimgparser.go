@@ -0,0 +1,186 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootimgparser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/cpioparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+// the content of the ramdisk is available below this directory
+const ramdiskDir = "/ramdisk"
+
+type BootImgParser struct {
+	imagepath string
+	img       *bootImage
+	imgErr    error
+	// nil if the image has no ramdisk or the ramdisk can't be read
+	ramdisk *cpioparser.CpioParser
+}
+
+func New(imagepath string) *BootImgParser {
+	parser := &BootImgParser{
+		imagepath: imagepath,
+	}
+
+	return parser
+}
+
+func (b *BootImgParser) ImageName() string {
+	return b.imagepath
+}
+
+// open the image on first use
+func (b *BootImgParser) open() (*bootImage, error) {
+	if b.img == nil && b.imgErr == nil {
+		b.img, b.imgErr = openBootImage(b.imagepath)
+		if b.imgErr == nil && b.img.ramdisk != nil {
+			b.ramdisk, b.imgErr = b.openRamdisk(b.img)
+		}
+	}
+	return b.img, b.imgErr
+}
+
+// openRamdisk decompresses the ramdisk, the cpio archive is kept in memory
+func (b *BootImgParser) openRamdisk(img *bootImage) (*cpioparser.CpioParser, error) {
+	r, _, err := decompress.NewReader(img.reader(img.ramdisk))
+	if err != nil {
+		return nil, fmt.Errorf("bootimgparser: can't decompress ramdisk: %s", err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("bootimgparser: can't decompress ramdisk: %s", err)
+	}
+	ramdisk := cpioparser.NewFromReader(b.imagepath+":"+img.ramdisk.name, bytes.NewReader(data), true)
+	// parse the archive now so that errors are reported for the image
+	if _, err := ramdisk.GetFileInfo("/"); err != nil {
+		return nil, fmt.Errorf("bootimgparser: can't read ramdisk: %s", err)
+	}
+	return ramdisk, nil
+}
+
+// ramdiskPath returns the path inside the ramdisk for paths below ramdiskDir
+func (b *BootImgParser) ramdiskPath(filepath string) (string, bool) {
+	filepath = path.Clean("/" + filepath)
+	if b.ramdisk == nil || (filepath != ramdiskDir && !strings.HasPrefix(filepath, ramdiskDir+"/")) {
+		return "", false
+	}
+	return path.Clean("/" + strings.TrimPrefix(filepath, ramdiskDir)), true
+}
+
+func sectionFileInfo(s *bootSection) fsparser.FileInfo {
+	return fsparser.FileInfo{
+		Name:         s.name,
+		Size:         s.size,
+		Mode:         0100644,
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+	}
+}
+
+func (b *BootImgParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	img, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	if rpath, ok := b.ramdiskPath(dirpath); ok {
+		return b.ramdisk.GetDirInfo(rpath)
+	}
+	if path.Clean("/"+dirpath) != "/" {
+		return nil, fmt.Errorf("bootimgparser: %s is not a directory", dirpath)
+	}
+	var dir []fsparser.FileInfo
+	for i := range img.sections {
+		dir = append(dir, sectionFileInfo(&img.sections[i]))
+	}
+	if b.ramdisk != nil {
+		fi, err := b.GetFileInfo(ramdiskDir)
+		if err != nil {
+			return nil, err
+		}
+		dir = append(dir, fi)
+	}
+	return dir, nil
+}
+
+func (b *BootImgParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	img, err := b.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	if rpath, ok := b.ramdiskPath(filepath); ok {
+		fi, err := b.ramdisk.GetFileInfo(rpath)
+		if rpath == "/" {
+			fi.Name = path.Base(ramdiskDir)
+		}
+		return fi, err
+	}
+	filepath = path.Clean("/" + filepath)
+	if filepath == "/" {
+		return fsparser.FileInfo{Name: "/", Mode: 040755, SELinuxLabel: fsparser.SELinuxNoLabel}, nil
+	}
+	if s := img.section(strings.TrimPrefix(filepath, "/")); s != nil {
+		return sectionFileInfo(s), nil
+	}
+	return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
+}
+
+// Open returns a reader for the content of the file
+func (b *BootImgParser) Open(filepath string) (io.ReadCloser, error) {
+	img, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	if rpath, ok := b.ramdiskPath(filepath); ok {
+		return b.ramdisk.Open(rpath)
+	}
+	s := img.section(strings.TrimPrefix(path.Clean("/"+filepath), "/"))
+	if s == nil {
+		return nil, fmt.Errorf("bootimgparser: can't find file %s", filepath)
+	}
+	return ioutil.NopCloser(img.reader(s)), nil
+}
+
+func (b *BootImgParser) CopyFile(filepath string, dstdir string) bool {
+	r, err := b.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Supported returns true since no external tools are required
+func (b *BootImgParser) Supported() bool {
+	return true
+}
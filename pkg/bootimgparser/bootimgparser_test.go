@@ -0,0 +1,301 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootimgparser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4"
+)
+
+// newc returns a cpio archive (newc format) with the given name and content pairs
+func newc(files ...string) []byte {
+	var buf bytes.Buffer
+	entry := func(ino int, mode int, name string, data string) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+			ino, mode, 0, 2000, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0, name)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+		buf.WriteString(data)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+	}
+	entry(1, 040755, ".", "")
+	ino := 2
+	for i := 0; i+1 < len(files); i += 2 {
+		entry(ino, 0100750, files[i], files[i+1])
+		ino++
+	}
+	entry(0, 0, "TRAILER!!!", "")
+	return buf.Bytes()
+}
+
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// lz4Legacy compresses data in the lz4 legacy frame format (single block)
+func lz4Legacy(data []byte) []byte {
+	block := make([]byte, lz4.CompressBlockBound(len(data)))
+	n, _ := lz4.CompressBlock(data, block, nil)
+	out := []byte{0x02, 0x21, 0x4c, 0x18, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(out[4:], uint32(n))
+	return append(out, block[:n]...)
+}
+
+// image places the header and the sections at page boundaries
+func image(header []byte, pageSize int, sections ...[]byte) []byte {
+	pad := func(b []byte) []byte {
+		return append(b, make([]byte, (pageSize-len(b)%pageSize)%pageSize)...)
+	}
+	img := pad(header)
+	for _, s := range sections {
+		img = append(img, pad(append([]byte{}, s...))...)
+	}
+	return img
+}
+
+func writeImage(t *testing.T, dir string, name string, data []byte) string {
+	imagepath := path.Join(dir, name)
+	if err := ioutil.WriteFile(imagepath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return imagepath
+}
+
+func fileContent(t *testing.T, b *BootImgParser, dir string, filepath string) string {
+	dst := path.Join(dir, "out")
+	if !b.CopyFile(filepath, dst) {
+		t.Errorf("CopyFile %s failed", filepath)
+		return ""
+	}
+	data, _ := ioutil.ReadFile(dst)
+	os.Remove(dst)
+	return string(data)
+}
+
+func dirNames(t *testing.T, b *BootImgParser, dirpath string) string {
+	dir, err := b.GetDirInfo(dirpath)
+	if err != nil {
+		t.Errorf("GetDirInfo %s: %s", dirpath, err)
+	}
+	var names []string
+	for _, fi := range dir {
+		names = append(names, fi.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestBootV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel := []byte("kernel data")
+	ramdisk := gzipData(newc("init.rc", "on boot\n"))
+	second := []byte("second stage")
+	dtbo := []byte("recovery dtbo")
+	dtb := []byte("device tree")
+	cmdline := "console=ttyS0 " + strings.Repeat("x", 600) + " androidboot.selinux=enforcing"
+
+	le := binary.LittleEndian
+	hdr := make([]byte, 1660)
+	copy(hdr, bootMagic)
+	le.PutUint32(hdr[8:], uint32(len(kernel)))
+	le.PutUint32(hdr[16:], uint32(len(ramdisk)))
+	le.PutUint32(hdr[24:], uint32(len(second)))
+	le.PutUint32(hdr[36:], 2048)
+	le.PutUint32(hdr[40:], 2)
+	copy(hdr[64:64+511], cmdline)
+	copy(hdr[608:], cmdline[511:])
+	le.PutUint32(hdr[1632:], uint32(len(dtbo)))
+	le.PutUint32(hdr[1648:], uint32(len(dtb)))
+	imagepath := writeImage(t, dir, "boot.img", image(hdr, 2048, kernel, ramdisk, second, dtbo, dtb))
+
+	b := New(imagepath)
+	if names := dirNames(t, b, "/"); names != "kernel,ramdisk.img,second,recovery_dtbo,dtb,cmdline,ramdisk" {
+		t.Errorf("bad root directory: %s", names)
+	}
+	if names := dirNames(t, b, "/ramdisk"); names != "init.rc" {
+		t.Errorf("bad ramdisk directory: %s", names)
+	}
+
+	fi, err := b.GetFileInfo("/kernel")
+	if err != nil || fi.Size != int64(len(kernel)) || !fi.IsFile() {
+		t.Errorf("bad /kernel: %v %v", fi, err)
+	}
+	fi, err = b.GetFileInfo("/ramdisk")
+	if err != nil || fi.Name != "ramdisk" || !fi.IsDir() {
+		t.Errorf("bad /ramdisk: %v %v", fi, err)
+	}
+	fi, err = b.GetFileInfo("/ramdisk/init.rc")
+	if err != nil || fi.Mode != 0100750 || fi.Gid != 2000 || fi.Size != 8 {
+		t.Errorf("bad /ramdisk/init.rc: %v %v", fi, err)
+	}
+	if _, err := b.GetFileInfo("/ramdisk/missing"); err == nil {
+		t.Errorf("/ramdisk/missing should not exist")
+	}
+	if _, err := b.GetDirInfo("/kernel"); err == nil {
+		t.Errorf("/kernel is not a directory")
+	}
+
+	for name, data := range map[string]string{
+		"/kernel":           string(kernel),
+		"/second":           string(second),
+		"/recovery_dtbo":    string(dtbo),
+		"/dtb":              string(dtb),
+		"/ramdisk.img":      string(ramdisk),
+		"/cmdline":          cmdline,
+		"/ramdisk/init.rc":  "on boot\n",
+		"ramdisk/../kernel": string(kernel),
+	} {
+		if content := fileContent(t, b, dir, name); content != data {
+			t.Errorf("bad content of %s: %q", name, content)
+		}
+	}
+}
+
+func TestBootV4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel := []byte("kernel data")
+	ramdisk := lz4Legacy(newc("init", "first stage init"))
+	signature := []byte("boot signature")
+
+	le := binary.LittleEndian
+	hdr := make([]byte, 1584)
+	copy(hdr, bootMagic)
+	le.PutUint32(hdr[8:], uint32(len(kernel)))
+	le.PutUint32(hdr[12:], uint32(len(ramdisk)))
+	le.PutUint32(hdr[40:], 4)
+	copy(hdr[44:], "console=ttyS0")
+	le.PutUint32(hdr[1580:], uint32(len(signature)))
+	imagepath := writeImage(t, dir, "boot.img", image(hdr, bootV3PageSize, kernel, ramdisk, signature))
+
+	b := New(imagepath)
+	if names := dirNames(t, b, "/"); names != "kernel,ramdisk.img,signature,cmdline,ramdisk" {
+		t.Errorf("bad root directory: %s", names)
+	}
+	if content := fileContent(t, b, dir, "/ramdisk/init"); content != "first stage init" {
+		t.Errorf("bad content of /ramdisk/init: %q", content)
+	}
+	if content := fileContent(t, b, dir, "/signature"); content != string(signature) {
+		t.Errorf("bad content of /signature: %q", content)
+	}
+	if content := fileContent(t, b, dir, "/cmdline"); content != "console=ttyS0" {
+		t.Errorf("bad content of /cmdline: %q", content)
+	}
+}
+
+func TestVendorBootV4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	platform := gzipData(newc("fstab", "platform fstab", "init.rc", "platform"))
+	dlkm := gzipData(newc("fstab", "dlkm fstab", "modules.load", "a.ko"))
+	ramdisk := append(append([]byte{}, platform...), dlkm...)
+	dtb := []byte("vendor dtb")
+	bootconfig := []byte("androidboot.hardware=test\n")
+
+	le := binary.LittleEndian
+	table := make([]byte, 2*vendorRamdiskTableEntryV4)
+	le.PutUint32(table, uint32(len(platform)))
+	le.PutUint32(table[8:], 1)
+	copy(table[12:], "platform")
+	entry := table[vendorRamdiskTableEntryV4:]
+	le.PutUint32(entry, uint32(len(dlkm)))
+	le.PutUint32(entry[4:], uint32(len(platform)))
+	le.PutUint32(entry[8:], 3)
+	copy(entry[12:], "dlkm")
+
+	hdr := make([]byte, vendorHeaderSizeV4)
+	copy(hdr, vendorBootMagic)
+	le.PutUint32(hdr[8:], 4)
+	le.PutUint32(hdr[12:], 4096)
+	le.PutUint32(hdr[24:], uint32(len(ramdisk)))
+	copy(hdr[28:], "vendor cmdline")
+	le.PutUint32(hdr[2100:], uint32(len(dtb)))
+	le.PutUint32(hdr[2112:], uint32(len(table)))
+	le.PutUint32(hdr[2116:], 2)
+	le.PutUint32(hdr[2120:], vendorRamdiskTableEntryV4)
+	le.PutUint32(hdr[2124:], uint32(len(bootconfig)))
+	imagepath := writeImage(t, dir, "vendor_boot.img", image(hdr, 4096, ramdisk, dtb, table, bootconfig))
+
+	b := New(imagepath)
+	if names := dirNames(t, b, "/"); names != "ramdisk.img,dtb,bootconfig,ramdisk_platform.img,ramdisk_dlkm.img,cmdline,ramdisk" {
+		t.Errorf("bad root directory: %s", names)
+	}
+	// the fragments are merged, later fragments overwrite earlier ones
+	if names := dirNames(t, b, "/ramdisk"); names != "fstab,init.rc,modules.load" {
+		t.Errorf("bad ramdisk directory: %s", names)
+	}
+	for name, data := range map[string]string{
+		"/ramdisk/fstab":        "dlkm fstab",
+		"/ramdisk/init.rc":      "platform",
+		"/ramdisk_platform.img": string(platform),
+		"/ramdisk_dlkm.img":     string(dlkm),
+		"/bootconfig":           string(bootconfig),
+		"/dtb":                  string(dtb),
+		"/cmdline":              "vendor cmdline",
+	} {
+		if content := fileContent(t, b, dir, name); content != data {
+			t.Errorf("bad content of %s: %q", name, content)
+		}
+	}
+}
+
+func TestBadImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New(writeImage(t, dir, "bad.img", make([]byte, 4096)))
+	if _, err := b.GetDirInfo("/"); err == nil {
+		t.Errorf("bad magic should fail")
+	}
+
+	// the ramdisk exceeds the image
+	hdr := make([]byte, 1660)
+	copy(hdr, bootMagic)
+	binary.LittleEndian.PutUint32(hdr[16:], 8192)
+	binary.LittleEndian.PutUint32(hdr[36:], 2048)
+	b = New(writeImage(t, dir, "short.img", image(hdr, 2048, []byte("ramdisk"))))
+	if _, err := b.GetFileInfo("/"); err == nil {
+		t.Errorf("truncated image should fail")
+	}
+}
@@ -225,7 +225,7 @@ func capsParse(caps []byte, capsLen uint32) ([]uint32, error) {
 }
 
 // parse caps from string: 0x2000001,0x1000,0x0,0x0,0x0
-// this is the format produced by e2tools and unsquashfs
+// this is the format produced by unsquashfs
 func capsParseFromText(capsText string) ([]uint32, error) {
 	capsInts := strings.Split(capsText, ",")
 	capsParsedInts := make([]uint32, 5)
@@ -0,0 +1,342 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cpioparser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+ * Reader for the cpio archive formats: newc (070701), crc (070702),
+ * odc/portable ASCII (070707), and old binary (both byte orders).
+ * see: man 5 cpio
+ */
+
+const (
+	magicNewc       = "070701"
+	magicCrc        = "070702"
+	magicOdc        = "070707"
+	magicBin        = 070707
+	newcHeaderSize  = 110
+	odcHeaderSize   = 76
+	binHeaderSize   = 26
+	cpioTrailerName = "TRAILER!!!"
+	maxNameSize     = 4096
+)
+
+type cpioFormat int
+
+const (
+	formatNewc cpioFormat = iota
+	formatCrc
+	formatOdc
+	formatBinLE
+	formatBinBE
+)
+
+type cpioEntry struct {
+	name      string
+	mode      uint64
+	uid       int
+	gid       int
+	nlink     uint32
+	mtime     int64
+	ino       uint64
+	dev       uint64
+	rdevMajor uint32
+	rdevMinor uint32
+	size      int64
+	check     uint32
+	format    cpioFormat
+	// offset of the file data in the archive
+	dataOffset int64
+	linkTarget string
+}
+
+func (e *cpioEntry) isReg() bool {
+	return e.mode&0170000 == 0100000
+}
+
+func (e *cpioEntry) isLink() bool {
+	return e.mode&0170000 == 0120000
+}
+
+// hardlinkKey identifies the inode of an entry, entries with the same key are hardlinks
+type hardlinkKey struct {
+	dev uint64
+	ino uint64
+}
+
+func pad(off int64, align int64) int64 {
+	return (off + align - 1) &^ (align - 1)
+}
+
+func parseHex(field []byte) (uint64, error) {
+	return strconv.ParseUint(string(field), 16, 32)
+}
+
+func parseOctal(field []byte) (uint64, error) {
+	return strconv.ParseUint(string(field), 8, 64)
+}
+
+// readEntry reads the header at off and returns the entry and the offset of the next header
+func readEntry(r io.ReaderAt, off int64) (*cpioEntry, int64, error) {
+	magic := make([]byte, 6)
+	if _, err := r.ReadAt(magic, off); err != nil {
+		return nil, 0, fmt.Errorf("cpio: can't read header at %d: %s", off, err)
+	}
+	switch {
+	case string(magic) == magicNewc || string(magic) == magicCrc:
+		return readNewcEntry(r, off, string(magic) == magicCrc)
+	case string(magic) == magicOdc:
+		return readOdcEntry(r, off)
+	case binary.LittleEndian.Uint16(magic) == magicBin:
+		return readBinEntry(r, off, binary.LittleEndian)
+	case binary.BigEndian.Uint16(magic) == magicBin:
+		return readBinEntry(r, off, binary.BigEndian)
+	}
+	return nil, 0, fmt.Errorf("cpio: bad magic at %d", off)
+}
+
+func readName(r io.ReaderAt, off int64, size uint64) (string, error) {
+	if size == 0 || size > maxNameSize {
+		return "", fmt.Errorf("cpio: bad name size %d at %d", size, off)
+	}
+	name := make([]byte, size)
+	if _, err := r.ReadAt(name, off); err != nil {
+		return "", err
+	}
+	// name is NUL terminated
+	return string(name[:size-1]), nil
+}
+
+func readNewcEntry(r io.ReaderAt, off int64, crc bool) (*cpioEntry, int64, error) {
+	hdr := make([]byte, newcHeaderSize)
+	if _, err := r.ReadAt(hdr, off); err != nil {
+		return nil, 0, err
+	}
+	var fields [13]uint64
+	for i := range fields {
+		var err error
+		fields[i], err = parseHex(hdr[6+i*8 : 6+i*8+8])
+		if err != nil {
+			return nil, 0, fmt.Errorf("cpio: bad header at %d: %s", off, err)
+		}
+	}
+	e := &cpioEntry{
+		ino:       fields[0],
+		mode:      fields[1],
+		uid:       int(fields[2]),
+		gid:       int(fields[3]),
+		nlink:     uint32(fields[4]),
+		mtime:     int64(fields[5]),
+		size:      int64(fields[6]),
+		dev:       fields[7]<<32 | fields[8],
+		rdevMajor: uint32(fields[9]),
+		rdevMinor: uint32(fields[10]),
+		check:     uint32(fields[12]),
+		format:    formatNewc,
+	}
+	if crc {
+		e.format = formatCrc
+	}
+	name, err := readName(r, off+newcHeaderSize, fields[11])
+	if err != nil {
+		return nil, 0, err
+	}
+	e.name = name
+	e.dataOffset = pad(off+newcHeaderSize+int64(fields[11]), 4)
+	return e, pad(e.dataOffset+e.size, 4), nil
+}
+
+func readOdcEntry(r io.ReaderAt, off int64) (*cpioEntry, int64, error) {
+	hdr := make([]byte, odcHeaderSize)
+	if _, err := r.ReadAt(hdr, off); err != nil {
+		return nil, 0, err
+	}
+	// field widths following the magic: dev, ino, mode, uid, gid, nlink, rdev, mtime, namesize, filesize
+	widths := []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}
+	fields := make([]uint64, len(widths))
+	pos := 6
+	for i, w := range widths {
+		var err error
+		fields[i], err = parseOctal(hdr[pos : pos+w])
+		if err != nil {
+			return nil, 0, fmt.Errorf("cpio: bad header at %d: %s", off, err)
+		}
+		pos += w
+	}
+	e := &cpioEntry{
+		dev:       fields[0],
+		ino:       fields[1],
+		mode:      fields[2],
+		uid:       int(fields[3]),
+		gid:       int(fields[4]),
+		nlink:     uint32(fields[5]),
+		rdevMajor: uint32(fields[6] >> 8),
+		rdevMinor: uint32(fields[6] & 0xff),
+		mtime:     int64(fields[7]),
+		size:      int64(fields[9]),
+		format:    formatOdc,
+	}
+	name, err := readName(r, off+odcHeaderSize, fields[8])
+	if err != nil {
+		return nil, 0, err
+	}
+	e.name = name
+	e.dataOffset = off + odcHeaderSize + int64(fields[8])
+	return e, e.dataOffset + e.size, nil
+}
+
+func readBinEntry(r io.ReaderAt, off int64, order binary.ByteOrder) (*cpioEntry, int64, error) {
+	hdr := make([]byte, binHeaderSize)
+	if _, err := r.ReadAt(hdr, off); err != nil {
+		return nil, 0, err
+	}
+	var fields [13]uint64
+	for i := range fields {
+		fields[i] = uint64(order.Uint16(hdr[i*2:]))
+	}
+	// 32bit values are stored as two 16bit values, most significant first
+	rdev := fields[7]
+	e := &cpioEntry{
+		dev:       fields[1],
+		ino:       fields[2],
+		mode:      fields[3],
+		uid:       int(fields[4]),
+		gid:       int(fields[5]),
+		nlink:     uint32(fields[6]),
+		rdevMajor: uint32(rdev >> 8),
+		rdevMinor: uint32(rdev & 0xff),
+		mtime:     int64(fields[8]<<16 | fields[9]),
+		size:      int64(fields[11]<<16 | fields[12]),
+		format:    formatBinLE,
+	}
+	if order == binary.BigEndian {
+		e.format = formatBinBE
+	}
+	name, err := readName(r, off+binHeaderSize, fields[10])
+	if err != nil {
+		return nil, 0, err
+	}
+	e.name = name
+	e.dataOffset = pad(off+binHeaderSize+int64(fields[10]), 2)
+	return e, pad(e.dataOffset+e.size, 2), nil
+}
+
+// readArchive reads all entries of the archive up to the trailer
+func readArchive(r io.ReaderAt) ([]*cpioEntry, error) {
+	var entries []*cpioEntry
+	var off int64
+	for {
+		e, next, err := readEntry(r, off)
+		if err != nil {
+			return nil, err
+		}
+		if e.name == cpioTrailerName {
+			// archives can be concatenated (e.g. Linux and Android ramdisks), separated by zero padding
+			off = skipPadding(r, next)
+			if _, _, err := readEntry(r, off); err != nil {
+				break
+			}
+			continue
+		}
+		if e.isLink() {
+			if e.size > maxNameSize {
+				return nil, fmt.Errorf("cpio: bad link target size for %s", e.name)
+			}
+			target := make([]byte, e.size)
+			if _, err := r.ReadAt(target, e.dataOffset); err != nil {
+				return nil, err
+			}
+			e.linkTarget = string(target)
+		}
+		entries = append(entries, e)
+		off = next
+	}
+	resolveHardlinks(entries)
+	return entries, nil
+}
+
+// skipPadding returns the offset of the first non-zero 4 byte word at or after off
+func skipPadding(r io.ReaderAt, off int64) int64 {
+	off = pad(off, 4)
+	buf := make([]byte, 512)
+	for {
+		n, _ := r.ReadAt(buf, off)
+		n &^= 3
+		if n == 0 {
+			return off
+		}
+		for i := 0; i < n; i += 4 {
+			if buf[i] != 0 || buf[i+1] != 0 || buf[i+2] != 0 || buf[i+3] != 0 {
+				return off + int64(i)
+			}
+		}
+		off += int64(n)
+	}
+}
+
+// resolveHardlinks points hardlinks without data to the entry that carries the data,
+// in the newc format only the last entry of a hardlink group contains the file data
+func resolveHardlinks(entries []*cpioEntry) {
+	data := make(map[hardlinkKey]*cpioEntry)
+	for _, e := range entries {
+		if e.isReg() && e.nlink > 1 && e.size > 0 {
+			data[hardlinkKey{e.dev, e.ino}] = e
+		}
+	}
+	for _, e := range entries {
+		if e.isReg() && e.nlink > 1 && e.size == 0 {
+			if d, ok := data[hardlinkKey{e.dev, e.ino}]; ok {
+				e.size = d.size
+				e.dataOffset = d.dataOffset
+				e.check = d.check
+			}
+		}
+	}
+}
+
+// crcReader computes the checksum used by the crc format (sum of all bytes)
+type crcReader struct {
+	r     io.Reader
+	sum   uint32
+	check uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for _, b := range p[:n] {
+		c.sum += uint32(b)
+	}
+	if err == io.EOF && c.sum != c.check {
+		return n, fmt.Errorf("cpio: checksum mismatch")
+	}
+	return n, err
+}
+
+// reader returns a reader for the content of a regular file
+func (e *cpioEntry) reader(r io.ReaderAt) io.Reader {
+	data := io.NewSectionReader(r, e.dataOffset, e.size)
+	if e.format == formatCrc {
+		return &crcReader{r: data, check: e.check}
+	}
+	return data
+}
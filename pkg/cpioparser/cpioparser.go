@@ -17,154 +17,77 @@ limitations under the License.
 package cpioparser
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path"
-	"regexp"
-	"strconv"
 	"strings"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
-)
-
-const (
-	cpioCmd         = "cpio"
-	cpCmd           = "cp"
-	MIN_LINE_LENGTH = 25
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
 )
 
 type CpioParser struct {
-	fileInfoReg *regexp.Regexp
-	devInfoReg  *regexp.Regexp
-	fileLinkReg *regexp.Regexp
-	imagepath   string
-	files       map[string][]fsparser.FileInfo
-	fixDirs     bool
+	imagepath string
+	// archive data if the archive is not a file (e.g. a decompressed ramdisk)
+	img     io.ReaderAt
+	fixDirs bool
+	// directory -> entries
+	files map[string][]fsparser.FileInfo
+	// full path -> archive entry
+	entries map[string]*cpioEntry
 }
 
 func New(imagepath string, fixDirs bool) *CpioParser {
 	parser := &CpioParser{
-		//lrwxrwxrwx   1 0        0              19 Apr 24  2019 lib/libnss_dns.so.2 -> libnss_dns-2.18.so
-		//-rwxrwxrwx   1 0        0              19 Apr 24 13:37 lib/lib.c
-		fileInfoReg: regexp.MustCompile(
-			`^([\w-]+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\w+\s+\d+\s+[\d:]+)\s+(.*)$`),
-		// crw-r--r--   1 0        0          4,  64 Apr 24  2019 dev/ttyS0
-		devInfoReg: regexp.MustCompile(
-			`^([\w-]+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+),\s+(\d+)\s+(\w+\s+\d+\s+[\d:]+)\s+(.*)$`),
-		fileLinkReg: regexp.MustCompile(`(\S+)\s->\s(\S+)`),
-		imagepath:   imagepath,
-		fixDirs:     fixDirs,
+		imagepath: imagepath,
+		fixDirs:   fixDirs,
 	}
 
 	return parser
 }
 
-func (p *CpioParser) ImageName() string {
-	return p.imagepath
-}
-
-var modeFlags = []struct {
-	pos int
-	chr byte
-	val uint64
-}{
-	{0, '-', fsparser.S_IFREG},
-	{0, 's', fsparser.S_IFSOCK},
-	{0, 'l', fsparser.S_IFLNK},
-	{0, 'b', fsparser.S_IFBLK},
-	{0, 'd', fsparser.S_IFDIR},
-	{0, 'c', fsparser.S_IFCHR},
-	{0, 'p', fsparser.S_IFIFO},
-	{1, 'r', fsparser.S_IRUSR},
-	{2, 'w', fsparser.S_IWUSR},
-	{3, 'x', fsparser.S_IXUSR},
-	{3, 's', fsparser.S_IXUSR | fsparser.S_ISUID},
-	{3, 'S', fsparser.S_ISUID},
-	{4, 'r', fsparser.S_IRGRP},
-	{5, 'w', fsparser.S_IWGRP},
-	{6, 'x', fsparser.S_IXGRP},
-	{6, 's', fsparser.S_IXGRP | fsparser.S_ISGID},
-	{6, 'S', fsparser.S_ISGID},
-	{7, 'r', fsparser.S_IROTH},
-	{8, 'w', fsparser.S_IWOTH},
-	{9, 'x', fsparser.S_IXOTH},
-	{9, 't', fsparser.S_IXOTH | fsparser.S_ISVTX},
-	{9, 'T', fsparser.S_ISVTX},
+// NewFromReader returns a parser for an archive that is already in memory or
+// embedded in another image, name is reported as the image name
+func NewFromReader(name string, img io.ReaderAt, fixDirs bool) *CpioParser {
+	return &CpioParser{
+		imagepath: name,
+		img:       img,
+		fixDirs:   fixDirs,
+	}
 }
 
-const (
-	FILE_MODE_STR_LEN = 10 // such as "-rw-r--r--"
-)
-
-func parseMode(mode string) (uint64, error) {
-	var m uint64
-	if len(mode) != FILE_MODE_STR_LEN {
-		return 0, fmt.Errorf("parseMode: invalid mode string %s", mode)
-	}
-	for _, f := range modeFlags {
-		if mode[f.pos] == f.chr {
-			m |= f.val
-		}
-	}
-	return m, nil
+func (p *CpioParser) ImageName() string {
+	return p.imagepath
 }
 
 // Ensure directory and file names are consistent, with no relative parts
 // or trailing slash on directory names.
 func normalizePath(filepath string) (dir string, name string) {
-	dir, name = path.Split(path.Clean(filepath))
+	dir, name = path.Split(path.Clean("/" + filepath))
 	dir = path.Clean(dir)
 	return
 }
 
-const (
-	NAME_IDX_NORMAL_FILE = 7
-	NAME_IDX_DEVICE_FILE = 8
-)
-
-func (p *CpioParser) parseFileLine(line string) (string, fsparser.FileInfo, error) {
-	reg := p.fileInfoReg
-	nameIdx := NAME_IDX_NORMAL_FILE
-	dirpath := ""
-	if strings.HasPrefix(line, "b") || strings.HasPrefix(line, "c") {
-		reg = p.devInfoReg
-		nameIdx = NAME_IDX_DEVICE_FILE
+func entryFileInfo(e *cpioEntry, name string) fsparser.FileInfo {
+	fi := fsparser.FileInfo{
+		Name:       name,
+		Mode:       e.mode,
+		Uid:        e.uid,
+		Gid:        e.gid,
+		LinkTarget: e.linkTarget,
+		Mtime:      e.mtime,
+		Ino:        e.ino,
+		Nlink:      e.nlink,
 	}
-	res := reg.FindAllStringSubmatch(line, -1)
-	var fi fsparser.FileInfo
-	// only normal files have a size
-	if nameIdx == NAME_IDX_NORMAL_FILE {
-		size, _ := strconv.Atoi(res[0][5])
-		fi.Size = int64(size)
+	if fi.IsDevice() {
+		fi.Rdev = fsparser.Mkdev(e.rdevMajor, e.rdevMinor)
 	}
-	fi.Mode, _ = parseMode(res[0][1])
-	fi.Uid, _ = strconv.Atoi(res[0][3])
-	fi.Gid, _ = strconv.Atoi(res[0][4])
-	// cpio returns relative pathnames so add leading "/"
-	fi.Name = "/" + res[0][nameIdx]
-
-	// fill in linktarget
-	if fi.IsLink() && strings.Contains(fi.Name, "->") {
-		rlnk := p.fileLinkReg.FindAllStringSubmatch(fi.Name, -1)
-		if rlnk == nil {
-			return "", fsparser.FileInfo{}, fmt.Errorf("can't parse LinkTarget from %s", fi.Name)
-		}
-		fi.Name = rlnk[0][1]
-		fi.LinkTarget = rlnk[0][2]
-	}
-
-	// handle root directory
-	if fi.Name == "/." {
-		dirpath = "."
-		fi.Name = "."
-	} else {
-		dirpath, fi.Name = normalizePath(fi.Name)
+	// only regular files and links have a size
+	if e.isReg() || e.isLink() {
+		fi.Size = e.size
 	}
-
-	return dirpath, fi, nil
-
+	return fi
 }
 
 // GetDirInfo returns information on the specified directory.
@@ -183,10 +106,8 @@ func (p *CpioParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
 	}
 
 	dirpath, name := normalizePath(filepath)
-	// the root is stored as "."
 	if dirpath == "/" && name == "" {
-		dirpath = "."
-		name = "."
+		return entryFileInfo(p.entries["/"], "/"), nil
 	}
 	dir := p.files[dirpath]
 	for _, fi := range dir {
@@ -197,44 +118,70 @@ func (p *CpioParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
 	return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
 }
 
+// open returns the archive data and a function to release it
+func (p *CpioParser) open() (io.ReaderAt, func(), error) {
+	if p.img != nil {
+		return p.img, func() {}, nil
+	}
+	img, err := os.Open(p.imagepath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, func() { img.Close() }, nil
+}
+
 func (p *CpioParser) loadFileList() error {
 	if p.files != nil {
 		return nil
 	}
 
-	out, err := exec.Command("sh", "-c", cpioCmd+" -tvn --quiet < "+p.imagepath).CombinedOutput()
+	img, closeImg, err := p.open()
 	if err != nil {
-		if err.Error() != errors.New("exit status 2").Error() {
-			fmt.Fprintf(os.Stderr, "getDirList: >%s<", err)
-			return err
-		}
+		return err
 	}
-	return p.loadFileListFromString(string(out))
+	defer closeImg()
+	entries, err := readArchive(img)
+	if err != nil {
+		return err
+	}
+	p.loadEntries(entries)
+	return nil
 }
 
-func (p *CpioParser) loadFileListFromString(rawFileList string) error {
+func (p *CpioParser) loadEntries(entries []*cpioEntry) {
 	p.files = make(map[string][]fsparser.FileInfo)
+	p.entries = make(map[string]*cpioEntry)
 
-	lines := strings.Split(rawFileList, "\n")
-	for _, line := range lines {
-		if len(line) < MIN_LINE_LENGTH {
-			continue
-		}
-		if strings.HasPrefix(line, "cpio") {
+	for _, e := range entries {
+		dirpath, name := normalizePath(e.name)
+		// root directory ("." or "/")
+		if name == "" {
+			p.entries["/"] = e
 			continue
 		}
-		path, fi, err := p.parseFileLine(line)
-		if err == nil {
-			dirfiles := p.files[path]
-			dirfiles = append(dirfiles, fi)
-			p.files[path] = dirfiles
-
-			if p.fixDirs {
-				p.fixDir(path, fi.Name)
+		fullpath := path.Join(dirpath, name)
+		fi := entryFileInfo(e, name)
+		// the last entry for a path wins
+		if _, exists := p.entries[fullpath]; exists {
+			for i := range p.files[dirpath] {
+				if p.files[dirpath][i].Name == name {
+					p.files[dirpath][i] = fi
+				}
 			}
+		} else {
+			p.files[dirpath] = append(p.files[dirpath], fi)
+		}
+		p.entries[fullpath] = e
+
+		if p.fixDirs {
+			p.fixDir(dirpath, name)
 		}
 	}
-	return nil
+
+	// the archive does not need to contain an entry for the root directory
+	if _, ok := p.entries["/"]; !ok {
+		p.entries["/"] = &cpioEntry{name: ".", mode: 040755}
+	}
 }
 
 /*
@@ -254,37 +201,61 @@ func (p *CpioParser) fixDir(dir string, name string) {
 		p.fixDir(dirname, basename)
 	}
 
-	dirExists := false
-	for _, f := range p.files[dirname] {
-		if f.Name == basename {
-			dirExists = true
-		}
+	if _, exists := p.entries[dir]; !exists {
+		e := &cpioEntry{name: dir, mode: 040755}
+		p.entries[dir] = e
+		p.files[dirname] = append(p.files[dirname], entryFileInfo(e, basename))
+	}
+}
+
+// Open returns a reader for the content of the file
+func (p *CpioParser) Open(filepath string) (io.ReadCloser, error) {
+	if err := p.loadFileList(); err != nil {
+		return nil, err
 	}
-	if !dirExists {
-		dirfiles := p.files[dirname]
-		dirfiles = append(dirfiles, fsparser.FileInfo{Name: basename, Mode: 040755, Uid: 0, Gid: 0, Size: 0})
-		p.files[dirname] = dirfiles
+	e, ok := p.entries[path.Clean("/"+filepath)]
+	if !ok {
+		return nil, fmt.Errorf("cpioparser: can't find file %s", filepath)
 	}
+	if !e.isReg() {
+		return nil, fmt.Errorf("cpioparser: %s is not a regular file", filepath)
+	}
+
+	img, closeImg, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{e.reader(img), closeImg}, nil
 }
 
 // CopyFile copies the specified file to the specified destination.
 func (p *CpioParser) CopyFile(filepath string, dstdir string) bool {
-	out, err := exec.Command("sh", "-c", cpioCmd+" -i --to-stdout "+filepath[1:]+" < "+p.imagepath+" > "+dstdir).CombinedOutput()
+	r, err := p.Open(filepath)
 	if err != nil {
-		if err.Error() != errors.New("exit status 2").Error() {
-			fmt.Fprintf(os.Stderr, "cpio failed: %v: %s\n", err, out)
-			return false
-		}
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
 	}
 	return true
 }
 
+// Supported returns true since no external tools are required
 func (p *CpioParser) Supported() bool {
-	if _, err := exec.LookPath(cpioCmd); err != nil {
-		return false
-	}
-	if _, err := exec.LookPath(cpCmd); err != nil {
-		return false
-	}
 	return true
 }
+
+// readCloser calls close when the reader is closed
+type readCloser struct {
+	io.Reader
+	close func()
+}
+
+func (r readCloser) Close() error {
+	r.close()
+	return nil
+}
@@ -17,64 +17,218 @@ limitations under the License.
 package cpioparser
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 )
 
-type testData struct {
-	Line       string
-	Mode       uint64
-	Dir        string
-	Name       string
-	IsFile     bool
-	LinkTarget string
+// writeNewc appends a newc (or crc) entry to the archive
+func writeNewc(buf *bytes.Buffer, magic string, ino int, mode int, nlink int, rdev int, name string, data string) {
+	check := 0
+	if magic == magicCrc {
+		for _, b := range []byte(data) {
+			check += int(b)
+		}
+	}
+	fmt.Fprintf(buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+		magic, ino, mode, 1000, 1001, nlink, 0, len(data), 0, 0, rdev>>8, rdev&0xff, len(name)+1, check, name)
+	buf.Write(make([]byte, pad(int64(buf.Len()), 4)-int64(buf.Len())))
+	buf.WriteString(data)
+	buf.Write(make([]byte, pad(int64(buf.Len()), 4)-int64(buf.Len())))
 }
 
-func TestParseLine(t *testing.T) {
-	testImage := "../../test/test.cpio"
-	p := New(testImage, true)
+// writeOdc appends an odc entry to the archive
+func writeOdc(buf *bytes.Buffer, magic string, ino int, mode int, nlink int, rdev int, name string, data string) {
+	fmt.Fprintf(buf, "%s%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00%s",
+		magicOdc, 0, ino, mode, 1000, 1001, nlink, rdev, 0, len(name)+1, len(data), name, data)
+}
+
+// writeBin appends an old binary entry to the archive
+func writeBin(buf *bytes.Buffer, order binary.ByteOrder, ino int, mode int, nlink int, rdev int, mtime int64, name string, data string) {
+	// 32bit values are stored as two 16bit values, most significant first
+	hdr := []int{magicBin, 0, ino, mode, 1000, 1001, nlink, rdev, int(mtime >> 16), int(mtime & 0xffff),
+		len(name) + 1, len(data) >> 16, len(data) & 0xffff}
+	for _, v := range hdr {
+		_ = binary.Write(buf, order, uint16(v))
+	}
+	buf.WriteString(name + "\x00")
+	buf.Write(make([]byte, pad(int64(buf.Len()), 2)-int64(buf.Len())))
+	buf.WriteString(data)
+	buf.Write(make([]byte, pad(int64(buf.Len()), 2)-int64(buf.Len())))
+}
 
-	testdata := []testData{
-		{`-rw-r--r--   1 0        0              21 Apr 11  2008 etc/motd`, 0100644, "/etc/", "motd", true, ""},
-		{`-rw-r--r--   1 0        0              21 Apr 11 13:37 etc/mxtd`, 0100644, "/etc/", "mxtd", true, ""},
-		{`crw-r--r--   1 0        0          4,  64 Apr 24  2019 dev/ttyS0`, 020644, "/dev", "ttyS0", false, ""},
-		{`lrwxrwxrwx   1 0        0              19 Apr 24  2019 lib/libcrypto.so.1.0.0 -> libcrypto-1.0.0.so`, 0120777, "/lib", "libcrypto.so.1.0.0", false, "libcrypto-1.0.0.so"},
-		{`drwxr-xr-x   2 0        0               0 Aug  8 18:53 .`, 040755, ".", ".", false, ""},
+func writeBinLE(buf *bytes.Buffer, magic string, ino int, mode int, nlink int, rdev int, name string, data string) {
+	writeBin(buf, binary.LittleEndian, ino, mode, nlink, rdev, 0, name, data)
+}
+
+func writeBinBE(buf *bytes.Buffer, magic string, ino int, mode int, nlink int, rdev int, name string, data string) {
+	writeBin(buf, binary.BigEndian, ino, mode, nlink, rdev, 0, name, data)
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name  string
+		magic string
+		write func(*bytes.Buffer, string, int, int, int, int, string, string)
+	}{
+		{"newc", magicNewc, writeNewc},
+		{"crc", magicCrc, writeNewc},
+		{"odc", magicOdc, writeOdc},
+		{"binary little endian", "", writeBinLE},
+		{"binary big endian", "", writeBinBE},
 	}
 
-	for _, test := range testdata {
-		dir, res, err := p.parseFileLine(test.Line)
+	for _, test := range tests {
+		var buf bytes.Buffer
+		test.write(&buf, test.magic, 1, 040755, 2, 0, ".", "")
+		test.write(&buf, test.magic, 2, 020620, 1, 4<<8|6, "dev/tty6", "")
+		test.write(&buf, test.magic, 3, 0120777, 1, 0, "bin/sh", "busybox")
+		// hardlinks: only the last entry of the group has data (newc)
+		test.write(&buf, test.magic, 4, 0104755, 2, 0, "bin/su", "")
+		test.write(&buf, test.magic, 4, 0104755, 2, 0, "bin/busybox", "hello world")
+		test.write(&buf, test.magic, 0, 0, 1, 0, cpioTrailerName, "")
+
+		entries, err := readArchive(bytes.NewReader(buf.Bytes()))
 		if err != nil {
-			t.Error(err)
+			t.Errorf("%s: %s", test.name, err)
+			continue
 		}
-		if res.Mode != test.Mode {
-			t.Errorf("bad file mode: %o", res.Mode)
+		p := New("", true)
+		p.loadEntries(entries)
+
+		fi, err := p.GetFileInfo("/dev/tty6")
+		if err != nil || fi.Mode != 020620 || fi.Uid != 1000 || fi.Gid != 1001 {
+			t.Errorf("%s: bad /dev/tty6: %v %v", test.name, fi, err)
 		}
-		if dir != test.Dir && res.Name != test.Name {
-			t.Errorf("name error: %s %s", dir, res.Name)
+		if e := p.entries["/dev/tty6"]; e.rdevMajor != 4 || e.rdevMinor != 6 {
+			t.Errorf("%s: bad device number: %d, %d", test.name, e.rdevMajor, e.rdevMinor)
 		}
-		if res.IsFile() != test.IsFile {
-			t.Error("isFile bad")
+
+		fi, err = p.GetFileInfo("/bin/sh")
+		if err != nil || fi.LinkTarget != "busybox" || fi.Size != 7 {
+			t.Errorf("%s: bad /bin/sh: %v %v", test.name, fi, err)
 		}
-		if test.LinkTarget != res.LinkTarget {
-			t.Errorf("bad link target: %s", res.LinkTarget)
+
+		fi, err = p.GetFileInfo("/bin")
+		if err != nil || !fi.IsDir() {
+			t.Errorf("%s: /bin should have been created by fixdirs: %v %v", test.name, fi, err)
+		}
+
+		fi, err = p.GetFileInfo("/bin/su")
+		if err != nil || fi.Size != 11 || !fi.IsSUid() {
+			t.Errorf("%s: bad /bin/su: %v %v", test.name, fi, err)
+		}
+		busybox, _ := p.GetFileInfo("/bin/busybox")
+		if !fi.IsHardlink() || fi.HardlinkKey() != busybox.HardlinkKey() {
+			t.Errorf("%s: /bin/su and /bin/busybox should be hardlinks: %v %v", test.name, fi, busybox)
+		}
+		data := new(bytes.Buffer)
+		_, err = data.ReadFrom(p.entries["/bin/su"].reader(bytes.NewReader(buf.Bytes())))
+		if err != nil || data.String() != "hello world" {
+			t.Errorf("%s: bad content of /bin/su: %q %v", test.name, data, err)
 		}
 	}
 }
 
-func TestFixDir(t *testing.T) {
-	testImage := "../../test/test.cpio"
-	p := New(testImage, true)
+func TestBinary(t *testing.T) {
+	// sizes and times above 16bit test the order of the 16bit halves, the odd name
+	// and data sizes test the padding
+	content := append(bytes.Repeat([]byte("0123456789"), 7000), '!')
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var buf bytes.Buffer
+		writeBin(&buf, order, 1, 0100644, 1, 0, 1574719442, "odd1", string(content))
+		writeBin(&buf, order, 2, 0100600, 1, 0, 1574719442, "even.txt", "x")
+		writeBin(&buf, order, 0, 0, 1, 0, 0, cpioTrailerName, "")
 
-	testdata := `
-crw-r--r--   1 0        0          3,   1 Jan 13 17:57 dev/ttyp1
-crw-r--r--   1 0        0          3,   1 Jan 13 17:57 dev/x/ttyp1`
+		p := NewFromReader("binary", bytes.NewReader(buf.Bytes()), false)
+		fi, err := p.GetFileInfo("/odd1")
+		if err != nil || fi.Size != int64(len(content)) || fi.Mtime != 1574719442 || fi.Mode != 0100644 || fi.Uid != 1000 {
+			t.Errorf("%s: bad /odd1: %v %v", order, fi, err)
+		}
+		expected := formatBinLE
+		if order == binary.BigEndian {
+			expected = formatBinBE
+		}
+		if p.entries["/odd1"].format != expected {
+			t.Errorf("%s: bad format: %v", order, p.entries["/odd1"].format)
+		}
+		for fn, data := range map[string][]byte{"/odd1": content, "/even.txt": []byte("x")} {
+			r, err := p.Open(fn)
+			if err != nil {
+				t.Errorf("%s: %s", order, err)
+				continue
+			}
+			out, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(out, data) {
+				t.Errorf("%s: bad content of %s: %d bytes %v", order, fn, len(out), err)
+			}
+		}
+	}
+}
 
-	err := p.loadFileListFromString(testdata)
+func TestCrcMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	writeNewc(&buf, magicCrc, 1, 0100644, 1, 0, "file", "data")
+	writeNewc(&buf, magicCrc, 0, 0, 1, 0, cpioTrailerName, "")
+	archive := buf.Bytes()
+	// corrupt the file data
+	archive[bytes.Index(archive, []byte("data"))] = 'x'
+
+	entries, err := readArchive(bytes.NewReader(archive))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	_, err = new(bytes.Buffer).ReadFrom(entries[0].reader(bytes.NewReader(archive)))
+	if err == nil {
+		t.Error("checksum mismatch not detected")
+	}
+}
+
+func TestConcatenated(t *testing.T) {
+	var buf bytes.Buffer
+	writeNewc(&buf, magicNewc, 1, 0100644, 1, 0, "init.rc", "first")
+	writeNewc(&buf, magicNewc, 2, 0100644, 1, 0, "a", "a")
+	writeNewc(&buf, magicNewc, 0, 0, 1, 0, cpioTrailerName, "")
+	buf.Write(make([]byte, 512))
+	writeNewc(&buf, magicNewc, 1, 0100644, 1, 0, "init.rc", "second")
+	writeNewc(&buf, magicNewc, 3, 0100644, 1, 0, "b", "b")
+	writeNewc(&buf, magicNewc, 0, 0, 1, 0, cpioTrailerName, "")
+	buf.Write(make([]byte, 100))
+
+	p := NewFromReader("ramdisk", bytes.NewReader(buf.Bytes()), false)
+	dir, err := p.GetDirInfo("/")
+	if err != nil || len(dir) != 3 {
+		t.Fatalf("expected 3 entries: %v %v", dir, err)
+	}
+
+	tmp, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// the last archive wins
+	if !p.CopyFile("/init.rc", tmp) {
+		t.Fatal("CopyFile failed")
+	}
+	data, _ := ioutil.ReadFile(tmp + "/init.rc")
+	if string(data) != "second" {
+		t.Errorf("bad content of /init.rc: %q", data)
+	}
+}
+
+func TestFixDir(t *testing.T) {
+	entries := []*cpioEntry{
+		{name: "dev/ttyp1", mode: 020644},
+		{name: "dev/x/ttyp1", mode: 020644},
 	}
 
+	p := New("", true)
+	p.loadEntries(entries)
+
 	ok := false
 	for _, fn := range p.files["/"] {
 		if fn.Name == "dev" {
@@ -94,6 +248,12 @@ crw-r--r--   1 0        0          3,   1 Jan 13 17:57 dev/x/ttyp1`
 	if !ok {
 		t.Errorf("dir '/dev/x' not found")
 	}
+
+	p = New("", false)
+	p.loadEntries(entries)
+	if len(p.files["/"]) != 0 {
+		t.Errorf("dir '/dev' should not exist without fixdirs")
+	}
 }
 
 func TestFull(t *testing.T) {
@@ -136,6 +296,16 @@ func TestFull(t *testing.T) {
 		t.Error("bad owner/group")
 	}
 
+	r, err := p.Open("/etc/fstab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || len(data) != 385 {
+		t.Errorf("bad content of /etc/fstab: %d %v", len(data), err)
+	}
+
 	fi, err = p.GetFileInfo("/dev/tty6")
 	if err != nil {
 		t.Error(err)
@@ -146,6 +316,12 @@ func TestFull(t *testing.T) {
 	if fi.Name != "tty6" {
 		t.Errorf("name bad: %s", fi.Name)
 	}
+	if !fi.IsDevice() || fi.DevMajor() != 4 || fi.DevMinor() != 69 {
+		t.Errorf("bad device number: %d:%d", fi.DevMajor(), fi.DevMinor())
+	}
+	if fi.Mtime != 1574719442 || fi.Ino != 7505 || fi.Nlink != 1 {
+		t.Errorf("bad mtime/inode/nlink: %d %d %d", fi.Mtime, fi.Ino, fi.Nlink)
+	}
 	if fi.IsDir() {
 		t.Error("should not be a dir")
 	}
@@ -0,0 +1,139 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package decompress provides the block decompressors used by the filesystem parsers.
+package decompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// read at most maxSize bytes, maxSize <= 0 means no limit
+func readAll(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize > 0 {
+		r = io.LimitReader(r, int64(maxSize))
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Zlib decompresses a zlib stream (deflate with zlib header)
+func Zlib(src []byte, maxSize int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAll(r, maxSize)
+}
+
+// Deflate decompresses a raw deflate stream (no header)
+func Deflate(src []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readAll(r, maxSize)
+}
+
+// Xz decompresses a xz stream
+func Xz(src []byte, maxSize int) ([]byte, error) {
+	r, err := xz.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return readAll(r, maxSize)
+}
+
+// Lzma decompresses a legacy lzma (lzma_alone) stream
+func Lzma(src []byte, maxSize int) ([]byte, error) {
+	r, err := lzma.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return readAll(r, maxSize)
+}
+
+// zstdMinLimit is the smallest output limit of a decoder, the window of a frame
+// can be larger than its content
+const zstdMinLimit = 1 << 17
+
+var (
+	zstdLock     sync.Mutex
+	zstdDecoders = make(map[uint64]*zstd.Decoder)
+)
+
+// zstdDecoder returns a decoder that fails once the output exceeds limit, the decoders
+// are safe for concurrent use of DecodeAll and expensive to create
+func zstdDecoder(limit uint64) (*zstd.Decoder, error) {
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+	if d, ok := zstdDecoders[limit]; ok {
+		return d, nil
+	}
+	var opts []zstd.DOption
+	if limit > 0 {
+		opts = append(opts, zstd.WithDecoderMaxMemory(limit))
+	}
+	d, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoders[limit] = d
+	return d, nil
+}
+
+// Zstd decompresses a zstd frame
+func Zstd(src []byte, maxSize int) ([]byte, error) {
+	// the limit is rounded up to a power of two so only a few decoders are created
+	var limit uint64
+	if maxSize > 0 {
+		limit = zstdMinLimit
+		for limit < uint64(maxSize) {
+			limit <<= 1
+		}
+	}
+	d, err := zstdDecoder(limit)
+	if err != nil {
+		return nil, err
+	}
+	out, err := d.DecodeAll(src, nil)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && len(out) > maxSize {
+		return nil, fmt.Errorf("zstd: output exceeds %d bytes", maxSize)
+	}
+	return out, nil
+}
+
+// Lz4Block decompresses a single lz4 block (no frame header), maxSize is the size of the uncompressed data
+func Lz4Block(src []byte, maxSize int) ([]byte, error) {
+	out := make([]byte, maxSize)
+	n, err := lz4.UncompressBlock(src, out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
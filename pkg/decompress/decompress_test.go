@@ -0,0 +1,270 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var testData = []byte(strings.Repeat("fwanalyzer lzo test data ", 40) + "abcdefghijklmnopqrstuvwxyz0123456789" + strings.Repeat("A", 300))
+
+func TestLzo1x(t *testing.T) {
+	// generated with LZO1X-1 and LZO1X-999
+	tests := []string{
+		"000b6677616e616c797a6572206c7a6f20746573742064617461206677616e20000000ad600000146162636465666768696a6b6c6d6e6f707172737475767778797a30313233343536373839414120000a0400110000",
+		"2a6677616e616c797a6572206c7a6f207465737420646174612020000000b1600000136162636465666768696a6b6c6d6e6f707172737475767778797a303132333435363738394120000b0000110000",
+	}
+	for _, test := range tests {
+		src, _ := hex.DecodeString(test)
+		out, err := Lzo1x(src, len(testData))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(out, testData) {
+			t.Errorf("lzo output does not match")
+		}
+		// output bigger than allowed
+		if _, err := Lzo1x(src, len(testData)-1); err == nil {
+			t.Errorf("lzo should fail on output overrun")
+		}
+		// truncated input
+		if _, err := Lzo1x(src[:len(src)-4], len(testData)); err == nil {
+			t.Errorf("lzo should fail on truncated input")
+		}
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	var zbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	_, _ = zw.Write(testData)
+	zw.Close()
+
+	var xbuf bytes.Buffer
+	xw, _ := xz.NewWriter(&xbuf)
+	_, _ = xw.Write(testData)
+	xw.Close()
+
+	zstdEnc, _ := zstd.NewWriter(nil)
+	zstdData := zstdEnc.EncodeAll(testData, nil)
+
+	lz4Data := make([]byte, lz4.CompressBlockBound(len(testData)))
+	n, _ := lz4.CompressBlock(testData, lz4Data, nil)
+	lz4Data = lz4Data[:n]
+
+	tests := []struct {
+		name string
+		fn   func([]byte, int) ([]byte, error)
+		data []byte
+	}{
+		{"zlib", Zlib, zbuf.Bytes()},
+		{"xz", Xz, xbuf.Bytes()},
+		{"zstd", Zstd, zstdData},
+		{"lz4", Lz4Block, lz4Data},
+	}
+	for _, test := range tests {
+		out, err := test.fn(test.data, len(testData))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(out, testData) {
+			t.Errorf("%s: output does not match", test.name)
+		}
+	}
+}
+
+func TestZstdLimit(t *testing.T) {
+	enc, _ := zstd.NewWriter(nil)
+	// the decoder has to stop before the whole output is in memory, with and without the content size in the frame
+	var stream bytes.Buffer
+	zw, _ := zstd.NewWriter(&stream)
+	_, _ = zw.Write(make([]byte, 64<<20))
+	zw.Close()
+	for _, bomb := range [][]byte{enc.EncodeAll(make([]byte, 64<<20), nil), stream.Bytes()} {
+		if _, err := Zstd(bomb, 4096); err == nil {
+			t.Errorf("zstd output larger than the limit should fail")
+		}
+	}
+
+	data := enc.EncodeAll(testData[:100], nil)
+	if out, err := Zstd(data, 100); err != nil || !bytes.Equal(out, testData[:100]) {
+		t.Errorf("zstd output of maxSize should not fail: %v", err)
+	}
+	if _, err := Zstd(data, 99); err == nil {
+		t.Errorf("zstd output larger than maxSize should fail")
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	data := []byte("hello stream\n")
+	var gz, xzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+	xw, _ := xz.NewWriter(&xzBuf)
+	xw.Write(data)
+	xw.Close()
+	zw, _ := zstd.NewWriter(nil)
+	// generated with bzip2
+	bz, _ := hex.DecodeString("425a6839314159265359746f435a000002d1800010400022469c0020002201a6408069a68c211149476f78bb9229c28483a37a1ad0")
+	// generated with lz4 -l
+	lz4l, _ := hex.DecodeString("02214c180e000000d068656c6c6f2073747265616d0a")
+	var lz4f bytes.Buffer
+	lw := lz4.NewWriter(&lz4f)
+	lw.Write(data)
+	lw.Close()
+
+	tests := []struct {
+		format string
+		src    []byte
+	}{
+		{FormatNone, data},
+		{FormatGzip, gz.Bytes()},
+		{FormatBzip2, bz},
+		{FormatXz, xzBuf.Bytes()},
+		{FormatZstd, zw.EncodeAll(data, nil)},
+		{FormatLz4Legacy, lz4l},
+		{FormatLz4Frame, lz4f.Bytes()},
+	}
+	for _, test := range tests {
+		r, format, err := NewReader(bytes.NewReader(test.src))
+		if err != nil {
+			t.Errorf("%s: %s", test.format, err)
+			continue
+		}
+		if format != test.format {
+			t.Errorf("expected format %q got %q", test.format, format)
+		}
+		out, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: bad output %q %v", test.format, out, err)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(testData)
+	gw.Close()
+	src := path.Join(dir, "test.img.gz")
+	dst := path.Join(dir, "test.img")
+	_ = ioutil.WriteFile(src, gz.Bytes(), 0644)
+
+	if !IsCompressed(src) {
+		t.Errorf("compressed file not detected")
+	}
+	if err := File(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadFile(dst)
+	if !bytes.Equal(out, testData) {
+		t.Errorf("bad output")
+	}
+	if IsCompressed(dst) || IsCompressed(dir) || IsCompressed(dst+".none") {
+		t.Errorf("uncompressed file, directory, or missing file detected as compressed")
+	}
+
+	// truncated data
+	_ = ioutil.WriteFile(src, gz.Bytes()[:gz.Len()/2], 0644)
+	os.Remove(dst)
+	if err := File(src, dst); err == nil {
+		t.Errorf("truncated data should fail")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("dst should be removed on error")
+	}
+}
+
+func TestRtime(t *testing.T) {
+	// generated with the JFFS2 rtime compressor
+	src := []byte{'a', 0, 'b', 4, 'b', 1, 'x', 0}
+	out, err := Rtime(src, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "abababbax" {
+		t.Errorf("bad rtime output: %q", out)
+	}
+	if _, err := Rtime(src[:4], 9); err == nil {
+		t.Errorf("rtime should fail on truncated input")
+	}
+}
+
+func TestLz4BlockPartial(t *testing.T) {
+	src := make([]byte, lz4.CompressBlockBound(len(testData)))
+	n, err := lz4.CompressBlock(testData, src, nil)
+	if err != nil || n == 0 {
+		t.Fatal(err)
+	}
+	// trailing padding is ignored
+	src = append(src[:n], make([]byte, 64)...)
+	out, err := Lz4BlockPartial(src, len(testData))
+	if err != nil || !bytes.Equal(out, testData) {
+		t.Errorf("lz4 output does not match: %v", err)
+	}
+	out, err = Lz4BlockPartial(src, 100)
+	if err != nil || !bytes.Equal(out, testData[:100]) {
+		t.Errorf("lz4 partial output does not match: %v", err)
+	}
+	if _, err := Lz4BlockPartial(src[:n/2], len(testData)); err == nil {
+		t.Errorf("lz4 should fail on truncated input")
+	}
+}
+
+func TestMicroLzma(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := lzma.WriterConfig{Size: int64(len(testData)), DictCap: 1 << 16}.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(testData)
+	w.Close()
+	// convert to MicroLZMA: drop the header, store the inverted properties in the first byte
+	stream := buf.Bytes()
+	micro := append([]byte{^stream[0]}, stream[14:]...)
+
+	out, err := MicroLzma(micro, 1<<16, len(testData))
+	if err != nil || !bytes.Equal(out, testData) {
+		t.Errorf("microlzma output does not match: %v", err)
+	}
+	if _, err := MicroLzma(micro[:len(micro)/2], 1<<16, len(testData)); err == nil {
+		t.Errorf("microlzma should fail on truncated input")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decompress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pierrec/lz4"
+)
+
+// Lz4BlockPartial decompresses a lz4 block until size bytes are produced, data following
+// the compressed block (e.g. padding) is ignored (like LZ4_decompress_safe_partial)
+func Lz4BlockPartial(src []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	pos := 0
+	readLen := func(l int) (int, error) {
+		if l != 15 {
+			return l, nil
+		}
+		for {
+			if pos >= len(src) {
+				return 0, fmt.Errorf("lz4: input truncated")
+			}
+			b := src[pos]
+			pos++
+			l += int(b)
+			if b != 255 {
+				return l, nil
+			}
+		}
+	}
+	for len(out) < size {
+		if pos >= len(src) {
+			return nil, fmt.Errorf("lz4: input truncated")
+		}
+		token := src[pos]
+		pos++
+		litLen, err := readLen(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if pos+litLen > len(src) {
+			return nil, fmt.Errorf("lz4: input truncated")
+		}
+		if len(out)+litLen > size {
+			litLen = size - len(out)
+		}
+		out = append(out, src[pos:pos+litLen]...)
+		pos += litLen
+		if len(out) >= size {
+			break
+		}
+		if pos+2 > len(src) {
+			return nil, fmt.Errorf("lz4: input truncated")
+		}
+		offset := int(src[pos]) | int(src[pos+1])<<8
+		pos += 2
+		if offset == 0 || offset > len(out) {
+			return nil, fmt.Errorf("lz4: bad match offset")
+		}
+		matchLen, err := readLen(int(token & 0xF))
+		if err != nil {
+			return nil, err
+		}
+		matchLen += 4
+		// the match can overlap with the output, copy byte by byte
+		start := len(out) - offset
+		for i := 0; i < matchLen && len(out) < size; i++ {
+			out = append(out, out[start+i])
+		}
+	}
+	return out, nil
+}
+
+const (
+	lz4LegacyMagic     = 0x184c2102
+	lz4LegacyBlockSize = 8 << 20
+)
+
+// lz4LegacyReader decompresses the lz4 legacy frame format (lz4 -l) used for
+// Linux kernel and Android ramdisk images
+type lz4LegacyReader struct {
+	r   io.Reader
+	buf []byte
+	out []byte
+	err error
+}
+
+func newLz4LegacyReader(r io.Reader) (*lz4LegacyReader, error) {
+	var magic uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return nil, err
+	}
+	if magic != lz4LegacyMagic {
+		return nil, fmt.Errorf("lz4: bad legacy magic 0x%08x", magic)
+	}
+	return &lz4LegacyReader{r: r}, nil
+}
+
+func (l *lz4LegacyReader) nextBlock() error {
+	var size uint32
+	// the stream ends at EOF or with a zero block (padding), the magic starts a new frame
+	for {
+		if err := binary.Read(l.r, binary.LittleEndian, &size); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return io.EOF
+			}
+			return err
+		}
+		if size == 0 {
+			return io.EOF
+		}
+		if size != lz4LegacyMagic {
+			break
+		}
+	}
+	if size > uint32(lz4.CompressBlockBound(lz4LegacyBlockSize)) {
+		return fmt.Errorf("lz4: bad legacy block size %d", size)
+	}
+	if l.buf == nil {
+		l.buf = make([]byte, lz4LegacyBlockSize)
+	}
+	src := make([]byte, size)
+	if _, err := io.ReadFull(l.r, src); err != nil {
+		return fmt.Errorf("lz4: legacy block truncated: %s", err)
+	}
+	n, err := lz4.UncompressBlock(src, l.buf)
+	if err != nil {
+		return err
+	}
+	l.out = l.buf[:n]
+	return nil
+}
+
+func (l *lz4LegacyReader) Read(p []byte) (int, error) {
+	for len(l.out) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		l.err = l.nextBlock()
+	}
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	return n, nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decompress
+
+import (
+	"fmt"
+)
+
+var errLzoCorrupt = fmt.Errorf("lzo: corrupt input")
+
+const lzoM2MaxOffset = 0x0800
+
+type lzoState struct {
+	in  []byte
+	ip  int
+	out []byte
+	max int
+}
+
+func (s *lzoState) byte() (int, error) {
+	if s.ip >= len(s.in) {
+		return 0, errLzoCorrupt
+	}
+	b := int(s.in[s.ip])
+	s.ip++
+	return b, nil
+}
+
+func (s *lzoState) le16() (int, error) {
+	if s.ip+2 > len(s.in) {
+		return 0, errLzoCorrupt
+	}
+	v := int(s.in[s.ip]) | int(s.in[s.ip+1])<<8
+	s.ip += 2
+	return v, nil
+}
+
+// length returns the extended length encoding: a run of zero bytes (each adds 255) and a final byte
+func (s *lzoState) length(base int) (int, error) {
+	zeros := 0
+	for s.ip < len(s.in) && s.in[s.ip] == 0 {
+		s.ip++
+		zeros++
+	}
+	b, err := s.byte()
+	if err != nil {
+		return 0, err
+	}
+	return base + zeros*255 + b, nil
+}
+
+func (s *lzoState) literals(n int) error {
+	if s.ip+n > len(s.in) {
+		return errLzoCorrupt
+	}
+	if len(s.out)+n > s.max {
+		return fmt.Errorf("lzo: output overrun")
+	}
+	s.out = append(s.out, s.in[s.ip:s.ip+n]...)
+	s.ip += n
+	return nil
+}
+
+func (s *lzoState) match(dist int, n int) error {
+	pos := len(s.out) - dist
+	if pos < 0 {
+		return errLzoCorrupt
+	}
+	if len(s.out)+n > s.max {
+		return fmt.Errorf("lzo: output overrun")
+	}
+	// byte by byte since source and destination may overlap
+	for i := 0; i < n; i++ {
+		s.out = append(s.out, s.out[pos+i])
+	}
+	return nil
+}
+
+// Lzo1x decompresses a LZO1X compressed block, maxSize is the maximum size of the uncompressed data
+func Lzo1x(src []byte, maxSize int) ([]byte, error) {
+	s := &lzoState{in: src, out: make([]byte, 0, maxSize), max: maxSize}
+	if len(src) < 3 {
+		return nil, errLzoCorrupt
+	}
+
+	// state: number of literals copied after the last match, 4 means a literal run
+	state := 0
+	if src[0] > 17 {
+		s.ip++
+		t := int(src[0]) - 17
+		if err := s.literals(t); err != nil {
+			return nil, err
+		}
+		state = 4
+		if t < 4 {
+			state = t
+		}
+	}
+
+	for {
+		t, err := s.byte()
+		if err != nil {
+			return nil, err
+		}
+		var dist, length int
+		switch {
+		case t < 16 && state == 0:
+			// literal run
+			if t == 0 {
+				if t, err = s.length(15); err != nil {
+					return nil, err
+				}
+			}
+			if err := s.literals(t + 3); err != nil {
+				return nil, err
+			}
+			state = 4
+			continue
+		case t < 16 && state != 4:
+			// 2 byte match, short distance
+			b, err := s.byte()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + (t >> 2) + (b << 2)
+			length = 2
+		case t < 16:
+			// 3 byte match, after a literal run
+			b, err := s.byte()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + lzoM2MaxOffset + (t >> 2) + (b << 2)
+			length = 3
+		case t >= 64:
+			b, err := s.byte()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + ((t >> 2) & 7) + (b << 3)
+			length = (t >> 5) + 1
+		case t >= 32:
+			length = (t & 31) + 2
+			if length == 2 {
+				if length, err = s.length(33); err != nil {
+					return nil, err
+				}
+			}
+			v, err := s.le16()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + (v >> 2)
+			t = v
+		default:
+			// 16 <= t < 32
+			dist = (t & 8) << 11
+			length = (t & 7) + 2
+			if length == 2 {
+				if length, err = s.length(9); err != nil {
+					return nil, err
+				}
+			}
+			v, err := s.le16()
+			if err != nil {
+				return nil, err
+			}
+			dist += v >> 2
+			if dist == 0 {
+				// end of stream marker
+				if length != 3 {
+					return nil, errLzoCorrupt
+				}
+				return s.out, nil
+			}
+			dist += 0x4000
+			t = v
+		}
+		if err := s.match(dist, length); err != nil {
+			return nil, err
+		}
+		// the lower two bits encode the number of trailing literals
+		state = t & 3
+		if err := s.literals(state); err != nil {
+			return nil, err
+		}
+	}
+}
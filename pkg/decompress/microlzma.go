@@ -0,0 +1,51 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decompress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// MicroLzma decompresses a MicroLZMA stream (used by EROFS), size is the size of the
+// uncompressed data. MicroLZMA replaces the first byte of the range coder (always 0)
+// with the inverted properties byte and has no header.
+func MicroLzma(src []byte, dictSize uint32, size int) ([]byte, error) {
+	if len(src) < 1 {
+		return nil, fmt.Errorf("microlzma: input truncated")
+	}
+	// rebuild a legacy lzma header: properties, dictionary size, uncompressed size
+	hdr := make([]byte, 13)
+	hdr[0] = ^src[0]
+	binary.LittleEndian.PutUint32(hdr[1:], dictSize)
+	binary.LittleEndian.PutUint64(hdr[5:], uint64(size))
+	stream := append(append(hdr, 0), src[1:]...)
+
+	r, err := lzma.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decompress
+
+import (
+	"fmt"
+)
+
+// Rtime decompresses data compressed with the JFFS2 rtime compressor, maxSize is the
+// size of the uncompressed data
+// see: linux/fs/jffs2/compr_rtime.c
+func Rtime(src []byte, maxSize int) ([]byte, error) {
+	var positions [256]int
+	out := make([]byte, maxSize)
+	outpos := 0
+	pos := 0
+	for outpos < maxSize {
+		if pos+2 > len(src) {
+			return nil, fmt.Errorf("rtime: input truncated")
+		}
+		value := src[pos]
+		repeat := int(src[pos+1])
+		pos += 2
+		out[outpos] = value
+		outpos++
+		backoffs := positions[value]
+		positions[value] = outpos
+		if outpos+repeat > maxSize {
+			return nil, fmt.Errorf("rtime: output overrun")
+		}
+		// the copy can overlap, copy byte by byte
+		for ; repeat > 0; repeat-- {
+			out[outpos] = out[backoffs]
+			outpos++
+			backoffs++
+		}
+	}
+	return out, nil
+}
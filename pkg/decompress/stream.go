@@ -0,0 +1,148 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+// stream compression formats
+const (
+	FormatNone  = ""
+	FormatGzip  = "gzip"
+	FormatBzip2 = "bzip2"
+	FormatXz    = "xz"
+	FormatZstd  = "zstd"
+	// lz4 legacy frame format, as used by the Linux kernel and Android ramdisks
+	FormatLz4Legacy = "lz4"
+	// lz4 frame format, as written by the lz4 tool
+	FormatLz4Frame = "lz4frame"
+)
+
+var streamMagics = []struct {
+	format string
+	magic  []byte
+}{
+	{FormatGzip, []byte{0x1f, 0x8b}},
+	{FormatBzip2, []byte("BZh")},
+	{FormatXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{FormatZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{FormatLz4Legacy, []byte{0x02, 0x21, 0x4c, 0x18}},
+	{FormatLz4Frame, []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+// DetectFormat returns the compression format of the data based on its magic number
+func DetectFormat(header []byte) string {
+	for _, m := range streamMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.format
+		}
+	}
+	return FormatNone
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// NewReader detects the compression format of the stream and returns a reader
+// for the decompressed data, uncompressed data is passed through unchanged
+func NewReader(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	// Peek returns an error for short streams, the magic check handles that
+	header, _ := br.Peek(6)
+	format := DetectFormat(header)
+	switch format {
+	case FormatGzip:
+		gz, err := gzip.NewReader(br)
+		return gz, format, err
+	case FormatBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), format, nil
+	case FormatXz:
+		xr, err := xz.NewReader(br)
+		return ioutil.NopCloser(xr), format, err
+	case FormatZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		return zstdReadCloser{zr}, format, nil
+	case FormatLz4Legacy:
+		lr, err := newLz4LegacyReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		return ioutil.NopCloser(lr), format, nil
+	case FormatLz4Frame:
+		return ioutil.NopCloser(lz4.NewReader(br)), format, nil
+	}
+	return ioutil.NopCloser(br), format, nil
+}
+
+// IsCompressed returns true if the file starts with the magic of a supported compression format
+func IsCompressed(filepath string) bool {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 6)
+	n, _ := io.ReadFull(f, header)
+	return DetectFormat(header[:n]) != FormatNone
+}
+
+// File decompresses src into dst, uncompressed data is copied unchanged
+func File(src string, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, _, err := NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
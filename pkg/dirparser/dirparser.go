@@ -18,10 +18,12 @@ package dirparser
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/capability"
@@ -79,6 +81,17 @@ func (dir *DirParser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
 	fi.Gid = int(fileStat.Gid)
 	fi.SELinuxLabel = fsparser.SELinuxNoLabel
 	fi.Size = fileStat.Size
+	fi.Mtime = int64(fileStat.Mtim.Sec)
+	fi.Ino = uint64(fileStat.Ino)
+	fi.Nlink = uint32(fileStat.Nlink)
+	if fi.IsDevice() {
+		fi.Rdev = uint64(fileStat.Rdev)
+	}
+
+	// Listxattr and Getxattr follow links
+	if !fi.IsLink() {
+		fi.Xattrs = xattrs(fpath)
+	}
 
 	capsBytes := make([]byte, capability.CapByteSizeMax)
 	capsSize, _ := syscall.Getxattr(fpath, "security.capability", capsBytes)
@@ -99,6 +112,51 @@ func (dir *DirParser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
 	return fi, nil
 }
 
+// Open returns a reader for the content of the file, links are not followed
+func (dir *DirParser) Open(filepath string) (io.ReadCloser, error) {
+	fi, err := dir.GetFileInfo(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsFile() {
+		return nil, fmt.Errorf("dirparser: %s is not a regular file", filepath)
+	}
+	return os.Open(path.Join(dir.imagepath, filepath))
+}
+
+// xattrs returns the extended attributes of the file, attributes that can't be read are skipped
+func xattrs(fpath string) map[string][]byte {
+	size, err := syscall.Listxattr(fpath, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(fpath, names)
+	if err != nil {
+		return nil
+	}
+	out := make(map[string][]byte)
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := syscall.Getxattr(fpath, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		vsize, err = syscall.Getxattr(fpath, name, value)
+		if err != nil {
+			continue
+		}
+		out[name] = value[:vsize]
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
 // copy (extract) file out of the FS into dest dir
 func (dir *DirParser) CopyFile(filepath string, dstdir string) bool {
 	_, err := dir.GetFileInfo(filepath)
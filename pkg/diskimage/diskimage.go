@@ -0,0 +1,306 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package diskimage reads the MBR and GPT partition tables of whole-disk images (e.g. eMMC or SD-card dumps).
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 512
+
+	mbrSignatureOffset = 510
+	mbrTableOffset     = 446
+	mbrEntrySize       = 16
+	mbrTypeGPT         = 0xee
+	// limit the number of logical partitions (loops in the EBR chain)
+	maxLogicalPartitions = 128
+
+	gptSignature     = "EFI PART"
+	gptMinHeaderSize = 92
+	gptMinEntrySize  = 128
+	gptMaxEntries    = 1024
+)
+
+const (
+	SchemeMBR = "mbr"
+	SchemeGPT = "gpt"
+)
+
+type Partition struct {
+	// 1 based index, MBR logical partitions start at 5
+	Index int
+	// partition name (GPT only)
+	Label string
+	// GPT partition type GUID or MBR partition type (e.g. 0x83)
+	Type string
+	// offset and size in bytes
+	Offset int64
+	Size   int64
+}
+
+// Name returns the label or the index if the partition has no label
+func (p *Partition) Name() string {
+	if p.Label != "" {
+		return p.Label
+	}
+	return strconv.Itoa(p.Index)
+}
+
+type Disk struct {
+	imagepath  string
+	Scheme     string
+	Partitions []Partition
+}
+
+// Open reads the partition table of the disk image
+func Open(imagepath string) (*Disk, error) {
+	f, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	d, err := readDisk(f, st.Size())
+	if err != nil {
+		return nil, err
+	}
+	d.imagepath = imagepath
+	return d, nil
+}
+
+func readDisk(r io.ReaderAt, size int64) (*Disk, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("diskimage: can't read MBR: %s", err)
+	}
+	if mbr[mbrSignatureOffset] != 0x55 || mbr[mbrSignatureOffset+1] != 0xaa {
+		return nil, fmt.Errorf("diskimage: no partition table")
+	}
+
+	d := &Disk{}
+	var err error
+	if mbr[mbrTableOffset+4] == mbrTypeGPT {
+		d.Scheme = SchemeGPT
+		d.Partitions, err = readGPT(r)
+	} else {
+		d.Scheme = SchemeMBR
+		d.Partitions, err = readMBR(r, mbr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range d.Partitions {
+		if p.Offset+p.Size > size {
+			return nil, fmt.Errorf("diskimage: partition %d exceeds image size", p.Index)
+		}
+	}
+	return d, nil
+}
+
+func isExtended(partType byte) bool {
+	return partType == 0x05 || partType == 0x0f || partType == 0x85
+}
+
+func readMBR(r io.ReaderAt, mbr []byte) ([]Partition, error) {
+	var parts []Partition
+	var extended int64
+	for i := 0; i < 4; i++ {
+		e := mbr[mbrTableOffset+i*mbrEntrySize:]
+		partType := e[4]
+		start := int64(binary.LittleEndian.Uint32(e[8:]))
+		sectors := int64(binary.LittleEndian.Uint32(e[12:]))
+		if partType == 0 || sectors == 0 {
+			continue
+		}
+		if isExtended(partType) {
+			extended = start
+			continue
+		}
+		parts = append(parts, Partition{
+			Index:  i + 1,
+			Type:   fmt.Sprintf("0x%02x", partType),
+			Offset: start * sectorSize,
+			Size:   sectors * sectorSize,
+		})
+	}
+	if extended == 0 {
+		return parts, nil
+	}
+
+	// logical partitions are stored in a chain of extended boot records,
+	// the first entry is relative to the EBR, the second entry points to the next EBR
+	// and is relative to the start of the extended partition
+	ebr := make([]byte, sectorSize)
+	next := extended
+	for i := 0; i < maxLogicalPartitions; i++ {
+		if _, err := r.ReadAt(ebr, next*sectorSize); err != nil {
+			return nil, fmt.Errorf("diskimage: can't read EBR: %s", err)
+		}
+		if ebr[mbrSignatureOffset] != 0x55 || ebr[mbrSignatureOffset+1] != 0xaa {
+			return nil, fmt.Errorf("diskimage: bad EBR signature")
+		}
+		e := ebr[mbrTableOffset:]
+		if sectors := int64(binary.LittleEndian.Uint32(e[12:])); e[4] != 0 && sectors != 0 {
+			parts = append(parts, Partition{
+				Index:  5 + i,
+				Type:   fmt.Sprintf("0x%02x", e[4]),
+				Offset: (next + int64(binary.LittleEndian.Uint32(e[8:]))) * sectorSize,
+				Size:   sectors * sectorSize,
+			})
+		}
+		e = ebr[mbrTableOffset+mbrEntrySize:]
+		if !isExtended(e[4]) {
+			return parts, nil
+		}
+		next = extended + int64(binary.LittleEndian.Uint32(e[8:]))
+	}
+	return nil, fmt.Errorf("diskimage: too many logical partitions")
+}
+
+// guidString formats a GUID in its canonical form, the first three fields are little endian
+func guidString(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+func readGPT(r io.ReaderAt) ([]Partition, error) {
+	// the header is in the second block, the block size is 512 or 4096
+	var hdr []byte
+	var blockSize int64
+	for _, bs := range []int64{512, 4096} {
+		buf := make([]byte, gptMinHeaderSize)
+		if _, err := r.ReadAt(buf, bs); err == nil && string(buf[:8]) == gptSignature {
+			hdr = buf
+			blockSize = bs
+			break
+		}
+	}
+	if hdr == nil {
+		return nil, fmt.Errorf("diskimage: GPT header not found")
+	}
+	le := binary.LittleEndian
+	headerSize := le.Uint32(hdr[12:])
+	if headerSize < gptMinHeaderSize || int64(headerSize) > blockSize {
+		return nil, fmt.Errorf("diskimage: bad GPT header size %d", headerSize)
+	}
+	hdr = make([]byte, headerSize)
+	if _, err := r.ReadAt(hdr, blockSize); err != nil {
+		return nil, err
+	}
+	// the crc is calculated with the crc field set to zero
+	headerCrc := le.Uint32(hdr[16:])
+	copy(hdr[16:20], []byte{0, 0, 0, 0})
+	if crc32.ChecksumIEEE(hdr) != headerCrc {
+		return nil, fmt.Errorf("diskimage: GPT header checksum mismatch")
+	}
+
+	entriesLBA := int64(le.Uint64(hdr[72:]))
+	numEntries := le.Uint32(hdr[80:])
+	entrySize := le.Uint32(hdr[84:])
+	if numEntries > gptMaxEntries || entrySize < gptMinEntrySize || entrySize > 4096 {
+		return nil, fmt.Errorf("diskimage: bad GPT partition entries")
+	}
+	entries := make([]byte, int(numEntries)*int(entrySize))
+	if _, err := r.ReadAt(entries, entriesLBA*blockSize); err != nil {
+		return nil, fmt.Errorf("diskimage: can't read GPT partition entries: %s", err)
+	}
+	if crc32.ChecksumIEEE(entries) != le.Uint32(hdr[88:]) {
+		return nil, fmt.Errorf("diskimage: GPT partition entries checksum mismatch")
+	}
+
+	var parts []Partition
+	zero := make([]byte, 16)
+	for i := 0; i < int(numEntries); i++ {
+		e := entries[i*int(entrySize):]
+		if bytes.Equal(e[:16], zero) {
+			continue
+		}
+		first := int64(le.Uint64(e[32:]))
+		last := int64(le.Uint64(e[40:]))
+		if last < first {
+			return nil, fmt.Errorf("diskimage: bad GPT partition %d", i+1)
+		}
+		// the name is UTF-16LE, NUL terminated
+		var name []uint16
+		for j := 56; j+1 < 128; j += 2 {
+			c := le.Uint16(e[j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		parts = append(parts, Partition{
+			Index:  i + 1,
+			Label:  string(utf16.Decode(name)),
+			Type:   guidString(e[:16]),
+			Offset: first * blockSize,
+			Size:   (last - first + 1) * blockSize,
+		})
+	}
+	return parts, nil
+}
+
+type PartitionReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *PartitionReader) Close() error {
+	return r.f.Close()
+}
+
+// Reader returns a reader for the content of the partition, the caller has to close the reader
+func (d *Disk) Reader(p *Partition) (*PartitionReader, error) {
+	f, err := os.Open(d.imagepath)
+	if err != nil {
+		return nil, err
+	}
+	return &PartitionReader{io.NewSectionReader(f, p.Offset, p.Size), f}, nil
+}
+
+// Extract writes the content of the partition to dst
+func (d *Disk) Extract(p *Partition, dst string) error {
+	r, err := d.Reader(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
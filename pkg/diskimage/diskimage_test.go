@@ -0,0 +1,228 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"unicode/utf16"
+)
+
+type testPart struct {
+	partType byte
+	label    string
+	start    int64 // in sectors
+	data     []byte
+}
+
+func sectors(data []byte) int64 {
+	return int64((len(data) + sectorSize - 1) / sectorSize)
+}
+
+func putMBREntry(sector []byte, i int, partType byte, start int64, count int64) {
+	e := sector[mbrTableOffset+i*mbrEntrySize:]
+	e[4] = partType
+	binary.LittleEndian.PutUint32(e[8:], uint32(start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(count))
+	sector[mbrSignatureOffset] = 0x55
+	sector[mbrSignatureOffset+1] = 0xaa
+}
+
+// writeMBR creates a disk with two primary partitions and the remaining partitions
+// as logical partitions in an extended partition
+func writeMBR(t *testing.T, name string, parts []testPart, diskSectors int64) {
+	img := make([]byte, diskSectors*sectorSize)
+	for i, p := range parts[:2] {
+		putMBREntry(img, i, p.partType, p.start, sectors(p.data))
+		copy(img[p.start*sectorSize:], p.data)
+	}
+	// the extended partition starts one sector before the first logical partition
+	extended := parts[2].start - 1
+	putMBREntry(img, 2, 0x05, extended, diskSectors-extended)
+	for i, p := range parts[2:] {
+		ebr := img[(p.start-1)*sectorSize:]
+		putMBREntry(ebr, 0, p.partType, 1, sectors(p.data))
+		if i+3 < len(parts) {
+			next := parts[i+3].start - 1
+			putMBREntry(ebr, 1, 0x05, next-extended, sectors(parts[i+3].data)+1)
+		}
+		copy(img[p.start*sectorSize:], p.data)
+	}
+	if err := ioutil.WriteFile(name, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeGPT(t *testing.T, name string, parts []testPart, diskSectors int64) {
+	le := binary.LittleEndian
+	img := make([]byte, diskSectors*sectorSize)
+	putMBREntry(img, 0, mbrTypeGPT, 1, diskSectors-1)
+
+	entries := img[2*sectorSize : 2*sectorSize+128*128]
+	for i, p := range parts {
+		e := entries[i*128:]
+		// linux filesystem data 0fc63daf-8483-4772-8e79-3d69d8477de4
+		copy(e, []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+		e[16] = byte(i + 1)
+		le.PutUint64(e[32:], uint64(p.start))
+		le.PutUint64(e[40:], uint64(p.start+sectors(p.data)-1))
+		for j, c := range utf16.Encode([]rune(p.label)) {
+			le.PutUint16(e[56+j*2:], c)
+		}
+		copy(img[p.start*sectorSize:], p.data)
+	}
+
+	hdr := img[sectorSize : sectorSize+gptMinHeaderSize]
+	copy(hdr, gptSignature)
+	le.PutUint32(hdr[8:], 0x00010000)
+	le.PutUint32(hdr[12:], gptMinHeaderSize)
+	le.PutUint64(hdr[24:], 1)
+	le.PutUint64(hdr[32:], uint64(diskSectors-1))
+	le.PutUint64(hdr[40:], 34)
+	le.PutUint64(hdr[48:], uint64(diskSectors-34))
+	le.PutUint64(hdr[72:], 2)
+	le.PutUint32(hdr[80:], 128)
+	le.PutUint32(hdr[84:], 128)
+	le.PutUint32(hdr[88:], crc32.ChecksumIEEE(entries))
+	le.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr))
+
+	if err := ioutil.WriteFile(name, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkPartitions(t *testing.T, d *Disk, parts []testPart, indexes []int) {
+	if len(d.Partitions) != len(parts) {
+		t.Fatalf("expected %d partitions, got %d", len(parts), len(d.Partitions))
+	}
+	for i, p := range d.Partitions {
+		if p.Index != indexes[i] || p.Label != parts[i].label || p.Offset != parts[i].start*sectorSize {
+			t.Errorf("partition %d: bad index, label or offset: %+v", i, p)
+		}
+		if p.Size != sectors(parts[i].data)*sectorSize {
+			t.Errorf("partition %d: bad size %d", i, p.Size)
+		}
+		dst := path.Join(path.Dir(d.imagepath), "part")
+		if err := d.Extract(&d.Partitions[i], dst); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(dst)
+		if !bytes.HasPrefix(data, parts[i].data) {
+			t.Errorf("partition %d: bad content", i)
+		}
+	}
+}
+
+func TestMBR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parts := []testPart{
+		{0x0c, "", 2, []byte("boot partition")},
+		{0x83, "", 4, bytes.Repeat([]byte("rootfs"), 100)},
+		{0x83, "", 8, []byte("first logical")},
+		{0x83, "", 12, []byte("second logical")},
+	}
+	name := path.Join(dir, "mbr.img")
+	writeMBR(t, name, parts, 16)
+
+	d, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Scheme != SchemeMBR {
+		t.Errorf("bad scheme: %s", d.Scheme)
+	}
+	checkPartitions(t, d, parts, []int{1, 2, 5, 6})
+	if d.Partitions[0].Type != "0x0c" || d.Partitions[0].Name() != "1" {
+		t.Errorf("bad type or name: %s %s", d.Partitions[0].Type, d.Partitions[0].Name())
+	}
+}
+
+func TestGPT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parts := []testPart{
+		{0, "boot", 40, []byte("boot partition")},
+		{0, "rootfs", 48, bytes.Repeat([]byte("rootfs"), 200)},
+		{0, "", 56, []byte("no label")},
+	}
+	name := path.Join(dir, "gpt.img")
+	writeGPT(t, name, parts, 100)
+
+	d, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Scheme != SchemeGPT {
+		t.Errorf("bad scheme: %s", d.Scheme)
+	}
+	checkPartitions(t, d, parts, []int{1, 2, 3})
+	if d.Partitions[1].Type != "0fc63daf-8483-4772-8e79-3d69d8477de4" || d.Partitions[1].Name() != "rootfs" {
+		t.Errorf("bad type or name: %s %s", d.Partitions[1].Type, d.Partitions[1].Name())
+	}
+	if d.Partitions[2].Name() != "3" {
+		t.Errorf("partition without label should use the index as name: %s", d.Partitions[2].Name())
+	}
+
+	// corrupt a partition entry
+	img, _ := ioutil.ReadFile(name)
+	img[2*sectorSize+56] = 'x'
+	_ = ioutil.WriteFile(name, img, 0644)
+	if _, err = Open(name); err == nil {
+		t.Errorf("GPT entries checksum mismatch not detected")
+	}
+}
+
+func TestBadImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "bad.img")
+	_ = ioutil.WriteFile(name, make([]byte, 4096), 0644)
+	if _, err = Open(name); err == nil {
+		t.Errorf("image without partition table should fail")
+	}
+
+	// partition exceeds the image
+	writeMBR(t, name, []testPart{
+		{0x83, "", 2, make([]byte, 4096)},
+		{0x83, "", 10, []byte("x")},
+		{0x83, "", 12, []byte("x")},
+	}, 14)
+	img, _ := ioutil.ReadFile(name)
+	binary.LittleEndian.PutUint32(img[mbrTableOffset+12:], 100)
+	_ = ioutil.WriteFile(name, img, 0644)
+	if _, err = Open(name); err == nil {
+		t.Errorf("partition outside of the image not detected")
+	}
+}
@@ -0,0 +1,831 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erofsparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
+)
+
+/*
+ * Minimal read-only implementation of EROFS.
+ * see: linux/fs/erofs/erofs_fs.h
+ */
+
+const (
+	erofsSuperOffset = 1024
+	erofsSuperSize   = 128
+	erofsMagic       = 0xE0F5E1E2
+	erofsSlotSize    = 32
+	erofsNullAddr    = 0xFFFFFFFF
+
+	erofsInodeCompactSize  = 32
+	erofsInodeExtendedSize = 64
+	erofsDirentSize        = 12
+	erofsXattrHeaderSize   = 12
+
+	erofsFeatureZeroPadding = 0x01
+	erofsFeatureComprCfgs   = 0x02
+	erofsFeatureChunked     = 0x04
+	erofsChunkFormatIndexes = 0x20
+	erofsChunkFormatBits    = 0x1F
+)
+
+// data layouts
+const (
+	erofsLayoutFlatPlain         = 0
+	erofsLayoutCompressedFull    = 1
+	erofsLayoutFlatInline        = 2
+	erofsLayoutCompressedCompact = 3
+	erofsLayoutChunkBased        = 4
+)
+
+// compressed files
+const (
+	zErofsMapHeaderSize = 8
+
+	zErofsAdviseCompacted2B  = 0x01
+	zErofsAdviseBigPcluster1 = 0x02
+	zErofsAdviseBigPcluster2 = 0x04
+	zErofsAdviseUnsupported  = 0x08 | 0x10 | 0x20 // inline, interlaced, and fragment pclusters
+
+	zErofsLclusterPlain   = 0
+	zErofsLclusterHead1   = 1
+	zErofsLclusterNonhead = 2
+	zErofsLclusterHead2   = 3
+
+	zErofsD0CblkCnt = 1 << 11
+
+	zErofsAlgLz4     = 0
+	zErofsAlgLzma    = 1
+	zErofsAlgDeflate = 2
+
+	// default dictionary size of the erofs lzma compressor
+	zErofsLzmaDefaultDict = 8 << 20
+)
+
+var erofsXattrPrefix = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	5: "lustre.",
+	6: "security.",
+}
+
+type erofsInode struct {
+	nid         uint64
+	layout      int
+	isize       int
+	xattrIcount uint16
+	mode        uint32
+	nlink       uint32
+	size        uint64
+	// raw_blkaddr, rdev, or chunk format depending on the file type and layout
+	iu    uint32
+	uid   uint32
+	gid   uint32
+	mtime uint64
+	iloc  int64
+}
+
+type erofsDirent struct {
+	name string
+	nid  uint64
+}
+
+// extent maps a range of the file to its (compressed) data
+type erofsExtent struct {
+	offset uint64
+	length uint64
+	// position and length of the data in the image, hole if plen is 0
+	pos   int64
+	plen  int
+	alg   int
+	plain bool
+}
+
+type erofsFS struct {
+	img             *os.File
+	imgSize         int64
+	blkszbits       uint
+	rootNid         uint64
+	metaBlkaddr     uint32
+	xattrBlkaddr    uint32
+	featureIncompat uint32
+	dirBlkSize      int
+	buildTime       uint64
+	lzmaDictSize    uint32
+}
+
+func openErofsFS(imagepath string) (*erofsFS, error) {
+	img, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := img.Stat()
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	fs := &erofsFS{img: img, imgSize: st.Size()}
+	if err := fs.readSuperblock(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// checkRange returns an error if the range is not inside the image, the sizes come from the image
+func (fs *erofsFS) checkRange(pos int64, size uint64) error {
+	if pos < 0 || pos > fs.imgSize || size > uint64(fs.imgSize-pos) {
+		return fmt.Errorf("erofs: read at %d: %d bytes beyond the end of the image", pos, size)
+	}
+	return nil
+}
+
+func (fs *erofsFS) read(pos int64, size int) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("erofs: read at %d: bad size %d", pos, size)
+	}
+	if err := fs.checkRange(pos, uint64(size)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := fs.img.ReadAt(buf, pos); err != nil {
+		return nil, fmt.Errorf("erofs: read at %d: %s", pos, err)
+	}
+	return buf, nil
+}
+
+func (fs *erofsFS) blkSize() int64 {
+	return 1 << fs.blkszbits
+}
+
+func (fs *erofsFS) readSuperblock() error {
+	sb, err := fs.read(erofsSuperOffset, erofsSuperSize)
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(sb) != erofsMagic {
+		return fmt.Errorf("erofs: bad magic")
+	}
+	fs.blkszbits = uint(sb[12])
+	if fs.blkszbits < 9 || fs.blkszbits > 16 {
+		return fmt.Errorf("erofs: bad block size")
+	}
+	fs.rootNid = uint64(le.Uint16(sb[14:]))
+	fs.buildTime = le.Uint64(sb[24:])
+	fs.metaBlkaddr = le.Uint32(sb[40:])
+	fs.xattrBlkaddr = le.Uint32(sb[44:])
+	fs.featureIncompat = le.Uint32(sb[80:])
+	fs.dirBlkSize = int(fs.blkSize()) << sb[90]
+	fs.lzmaDictSize = zErofsLzmaDefaultDict
+
+	// compression configurations follow the superblock, one record per algorithm
+	if fs.featureIncompat&erofsFeatureComprCfgs != 0 {
+		algs := le.Uint16(sb[84:])
+		pos := int64(erofsSuperOffset + erofsSuperSize + int(sb[13])*16)
+		for alg := 0; alg < 16; alg++ {
+			if algs&(1<<uint(alg)) == 0 {
+				continue
+			}
+			lenBuf, err := fs.read(pos, 2)
+			if err != nil {
+				return err
+			}
+			cfgLen := int(le.Uint16(lenBuf))
+			cfg, err := fs.read(pos+2, cfgLen)
+			if err != nil {
+				return err
+			}
+			if alg == zErofsAlgLzma && cfgLen >= 4 && le.Uint32(cfg) != 0 {
+				fs.lzmaDictSize = le.Uint32(cfg)
+			}
+			pos += 2 + int64(cfgLen)
+		}
+	}
+	return nil
+}
+
+func (fs *erofsFS) readInode(nid uint64) (*erofsInode, error) {
+	iloc := int64(fs.metaBlkaddr)*fs.blkSize() + int64(nid)*erofsSlotSize
+	raw, err := fs.read(iloc, erofsInodeCompactSize)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	format := le.Uint16(raw)
+	in := &erofsInode{
+		nid:         nid,
+		iloc:        iloc,
+		layout:      int(format>>1) & 0x7,
+		xattrIcount: le.Uint16(raw[2:]),
+		mode:        uint32(le.Uint16(raw[4:])),
+		iu:          le.Uint32(raw[16:]),
+	}
+	if format&1 == 0 {
+		in.isize = erofsInodeCompactSize
+		in.nlink = uint32(le.Uint16(raw[6:]))
+		in.size = uint64(le.Uint32(raw[8:]))
+		in.uid = uint32(le.Uint16(raw[24:]))
+		in.gid = uint32(le.Uint16(raw[26:]))
+		// compact inodes use the build time of the image
+		in.mtime = fs.buildTime
+	} else {
+		raw, err = fs.read(iloc, erofsInodeExtendedSize)
+		if err != nil {
+			return nil, err
+		}
+		in.isize = erofsInodeExtendedSize
+		in.size = le.Uint64(raw[8:])
+		in.uid = le.Uint32(raw[24:])
+		in.gid = le.Uint32(raw[28:])
+		in.mtime = le.Uint64(raw[32:])
+		in.nlink = le.Uint32(raw[44:])
+	}
+	if in.layout > erofsLayoutChunkBased {
+		return nil, fmt.Errorf("erofs: inode %d: unsupported data layout %d", nid, in.layout)
+	}
+	return in, nil
+}
+
+// xattrSize is the size of the inline xattr area following the inode
+func (in *erofsInode) xattrSize() int {
+	if in.xattrIcount == 0 {
+		return 0
+	}
+	return erofsXattrHeaderSize + (int(in.xattrIcount)-1)*4
+}
+
+// metaEnd is the position following the inode and its inline xattrs
+func (in *erofsInode) metaEnd() int64 {
+	return in.iloc + int64(in.isize+in.xattrSize())
+}
+
+func (in *erofsInode) isDir() bool {
+	return in.mode&0170000 == 0040000
+}
+
+func (in *erofsInode) isReg() bool {
+	return in.mode&0170000 == 0100000
+}
+
+func (in *erofsInode) isLink() bool {
+	return in.mode&0170000 == 0120000
+}
+
+func (in *erofsInode) hasData() bool {
+	return in.isReg() || in.isDir() || in.isLink()
+}
+
+// parseXattrEntry parses a single xattr entry and returns its size (4 byte aligned)
+func parseXattrEntry(buf []byte, out map[string][]byte) (int, error) {
+	if len(buf) < 4 {
+		return 0, fmt.Errorf("erofs: xattr entry truncated")
+	}
+	nameLen := int(buf[0])
+	index := buf[1]
+	valueSize := int(binary.LittleEndian.Uint16(buf[2:]))
+	if 4+nameLen+valueSize > len(buf) {
+		return 0, fmt.Errorf("erofs: xattr entry truncated")
+	}
+	// long name prefixes (index & 0x80) are not supported
+	if prefix, ok := erofsXattrPrefix[index]; ok {
+		out[prefix+string(buf[4:4+nameLen])] = buf[4+nameLen : 4+nameLen+valueSize]
+	}
+	return (4 + nameLen + valueSize + 3) &^ 3, nil
+}
+
+// xattrs returns the inline and shared extended attributes of the inode
+func (fs *erofsFS) xattrs(in *erofsInode) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	if in.xattrSize() == 0 {
+		return out, nil
+	}
+	buf, err := fs.read(in.iloc+int64(in.isize), in.xattrSize())
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	shared := int(buf[4])
+	pos := erofsXattrHeaderSize + shared*4
+	if pos > len(buf) {
+		return nil, fmt.Errorf("erofs: inode %d: bad xattr header", in.nid)
+	}
+	for i := 0; i < shared; i++ {
+		id := le.Uint32(buf[erofsXattrHeaderSize+i*4:])
+		xpos := int64(fs.xattrBlkaddr)*fs.blkSize() + int64(id)*4
+		xhdr, err := fs.read(xpos, 4)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := fs.read(xpos, 4+int(xhdr[0])+int(le.Uint16(xhdr[2:])))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseXattrEntry(entry, out); err != nil {
+			return nil, err
+		}
+	}
+	for pos < len(buf) {
+		n, err := parseXattrEntry(buf[pos:], out)
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+	}
+	return out, nil
+}
+
+// extents returns the data mapping of the inode
+func (fs *erofsFS) extents(in *erofsInode) ([]erofsExtent, error) {
+	if in.size == 0 || !in.hasData() {
+		return nil, nil
+	}
+	bs := uint64(fs.blkSize())
+	switch in.layout {
+	case erofsLayoutFlatPlain:
+		pos := int64(in.iu) * int64(bs)
+		if err := fs.checkRange(pos, in.size); err != nil {
+			return nil, err
+		}
+		return []erofsExtent{{offset: 0, length: in.size, pos: pos, plen: int(in.size)}}, nil
+	case erofsLayoutFlatInline:
+		// all blocks but the last are stored at raw_blkaddr, the tail follows the inode
+		blocks := (in.size + bs - 1) / bs
+		full := (blocks - 1) * bs
+		if err := fs.checkRange(int64(in.iu)*int64(bs), full); err != nil {
+			return nil, err
+		}
+		var ext []erofsExtent
+		if full > 0 {
+			ext = append(ext, erofsExtent{offset: 0, length: full, pos: int64(in.iu) * int64(bs), plen: int(full)})
+		}
+		ext = append(ext, erofsExtent{offset: full, length: in.size - full, pos: in.metaEnd(), plen: int(in.size - full)})
+		return ext, nil
+	case erofsLayoutChunkBased:
+		return fs.chunkExtents(in)
+	default:
+		return fs.compressedExtents(in)
+	}
+}
+
+func (fs *erofsFS) chunkExtents(in *erofsInode) ([]erofsExtent, error) {
+	format := in.iu & 0xFFFF
+	chunkSize := uint64(fs.blkSize()) << (format & erofsChunkFormatBits)
+	count := int((in.size + chunkSize - 1) / chunkSize)
+	unit := int64(4)
+	if format&erofsChunkFormatIndexes != 0 {
+		unit = 8
+	}
+	pos := (in.metaEnd() + unit - 1) &^ (unit - 1)
+	buf, err := fs.read(pos, count*int(unit))
+	if err != nil {
+		return nil, err
+	}
+	var ext []erofsExtent
+	for i := 0; i < count; i++ {
+		var blkaddr uint32
+		if unit == 8 {
+			if binary.LittleEndian.Uint16(buf[i*8+2:]) != 0 {
+				return nil, fmt.Errorf("erofs: inode %d: extra devices are not supported", in.nid)
+			}
+			blkaddr = binary.LittleEndian.Uint32(buf[i*8+4:])
+		} else {
+			blkaddr = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		e := erofsExtent{offset: uint64(i) * chunkSize, length: chunkSize}
+		if e.offset+e.length > in.size {
+			e.length = in.size - e.offset
+		}
+		if blkaddr != erofsNullAddr {
+			e.pos = int64(blkaddr) * fs.blkSize()
+			e.plen = int(e.length)
+		}
+		ext = append(ext, e)
+	}
+	return ext, nil
+}
+
+// lcluster is a decoded logical cluster index
+type lcluster struct {
+	ltype      int
+	clusterofs uint64
+	pblk       uint32
+	// compressed blocks of the pcluster (stored in the first non-head lcluster)
+	cblks uint32
+}
+
+func (fs *erofsFS) compressedExtents(in *erofsInode) ([]erofsExtent, error) {
+	le := binary.LittleEndian
+	hpos := (in.metaEnd() + 7) &^ 7
+	hdr, err := fs.read(hpos, zErofsMapHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	advise := le.Uint16(hdr[4:])
+	algs := [2]int{int(hdr[6] & 0xF), int(hdr[6] >> 4)}
+	if advise&zErofsAdviseUnsupported != 0 {
+		return nil, fmt.Errorf("erofs: inode %d: unsupported compression layout (advise 0x%x)", in.nid, advise)
+	}
+	lclusterbits := fs.blkszbits + uint(hdr[7]&0x7)
+	lsize := uint64(1) << lclusterbits
+	total := int((in.size + lsize - 1) / lsize)
+	ebase := hpos + zErofsMapHeaderSize
+
+	var lcs []lcluster
+	if in.layout == erofsLayoutCompressedFull {
+		buf, err := fs.read(ebase, total*8)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < total; i++ {
+			lcs = append(lcs, decodeFullIndex(buf[i*8:]))
+		}
+	} else {
+		lcs, err = fs.decodeCompactIndexes(ebase, total, in.size, lclusterbits, advise)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bigPcluster := advise&(zErofsAdviseBigPcluster1|zErofsAdviseBigPcluster2) != 0
+	var ext []erofsExtent
+	for i, lc := range lcs {
+		if lc.ltype == zErofsLclusterNonhead {
+			continue
+		}
+		e := erofsExtent{offset: uint64(i)*lsize + lc.clusterofs, plain: lc.ltype == zErofsLclusterPlain}
+		if e.offset >= in.size {
+			break
+		}
+		if lc.ltype == zErofsLclusterHead2 {
+			e.alg = algs[1]
+		} else {
+			e.alg = algs[0]
+		}
+		cblks := uint32(1)
+		if bigPcluster && i+1 < len(lcs) && lcs[i+1].ltype == zErofsLclusterNonhead && lcs[i+1].cblks > 0 {
+			cblks = lcs[i+1].cblks
+		}
+		e.pos = int64(lc.pblk) * fs.blkSize()
+		e.plen = int(cblks) * int(fs.blkSize())
+		ext = append(ext, e)
+	}
+	if len(ext) == 0 || ext[0].offset != 0 {
+		return nil, fmt.Errorf("erofs: inode %d: bad compression index", in.nid)
+	}
+	for i := range ext {
+		if i+1 < len(ext) {
+			ext[i].length = ext[i+1].offset - ext[i].offset
+		} else {
+			ext[i].length = in.size - ext[i].offset
+		}
+	}
+	return ext, nil
+}
+
+func decodeFullIndex(buf []byte) lcluster {
+	le := binary.LittleEndian
+	advise := le.Uint16(buf)
+	lc := lcluster{ltype: int(advise & 0x3)}
+	if lc.ltype == zErofsLclusterNonhead {
+		delta0 := le.Uint16(buf[4:])
+		if delta0&zErofsD0CblkCnt != 0 {
+			lc.cblks = uint32(delta0 &^ zErofsD0CblkCnt)
+		}
+		return lc
+	}
+	lc.clusterofs = uint64(le.Uint16(buf[2:]))
+	lc.pblk = le.Uint32(buf[4:])
+	return lc
+}
+
+// decodeCompactIndexes decodes the compacted (2B/4B) lcluster indexes, the indexes are
+// stored in packs, each pack ends with the block address of its first pcluster
+// see: linux/fs/erofs/zmap.c
+func (fs *erofsFS) decodeCompactIndexes(ebase int64, total int, size uint64, lclusterbits uint, advise uint16) ([]lcluster, error) {
+	// the split into 4B and 2B packs is based on the number of blocks
+	totalidx := int((size + uint64(fs.blkSize()) - 1) >> fs.blkszbits)
+	initial4B := int((32 - ebase%32) / 4)
+	if initial4B == 32/4 {
+		initial4B = 0
+	}
+	compacted2B := 0
+	if advise&zErofsAdviseCompacted2B != 0 && initial4B < totalidx {
+		compacted2B = (totalidx - initial4B) / 16 * 16
+	}
+	if initial4B > total {
+		initial4B = total
+	}
+	if compacted2B > total-initial4B {
+		compacted2B = total - initial4B
+	}
+	lobits := lclusterbits
+	if lobits < 12 {
+		lobits = 12
+	}
+	bigPcluster := advise&zErofsAdviseBigPcluster1 != 0
+
+	var lcs []lcluster
+	pos := ebase
+	decodePacks := func(count int, amortizedshift uint) error {
+		vcnt := 2
+		if amortizedshift == 1 {
+			vcnt = 16
+			if lclusterbits > 12 {
+				return fmt.Errorf("erofs: unsupported compact index")
+			}
+		} else if lclusterbits > 14 {
+			return fmt.Errorf("erofs: unsupported compact index")
+		}
+		packSize := vcnt << amortizedshift
+		encodebits := uint((packSize - 4) * 8 / vcnt)
+		for done := 0; done < count; {
+			// the last pack can be partial for 4B indexes
+			pack, err := fs.read(pos, packSize)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < vcnt && done < count; i++ {
+				lcs = append(lcs, decodeCompactIndex(pack, i, vcnt, lobits, encodebits, lclusterbits, bigPcluster))
+				done++
+			}
+			pos += int64(packSize)
+		}
+		return nil
+	}
+
+	if err := decodePacks(initial4B, 2); err != nil {
+		return nil, err
+	}
+	if err := decodePacks(compacted2B, 1); err != nil {
+		return nil, err
+	}
+	if err := decodePacks(total-initial4B-compacted2B, 2); err != nil {
+		return nil, err
+	}
+	return lcs, nil
+}
+
+func decodeCompactedBits(lobits uint, in []byte, pos uint) (lo uint32, ltype int) {
+	var buf [4]byte
+	copy(buf[:], in[pos/8:])
+	v := binary.LittleEndian.Uint32(buf[:]) >> (pos & 7)
+	return v & (1<<lobits - 1), int(v>>lobits) & 3
+}
+
+func decodeCompactIndex(pack []byte, i int, vcnt int, lobits uint, encodebits uint, lclusterbits uint, bigPcluster bool) lcluster {
+	lo, ltype := decodeCompactedBits(lobits, pack, encodebits*uint(i))
+	lc := lcluster{ltype: ltype}
+	if ltype == zErofsLclusterNonhead {
+		if lo&zErofsD0CblkCnt != 0 {
+			lc.cblks = lo &^ zErofsD0CblkCnt
+		}
+		return lc
+	}
+	lc.clusterofs = uint64(lo)
+	// the block address is relative to the first pcluster of the pack
+	nblk := uint32(0)
+	if !bigPcluster {
+		nblk = 1
+		for j := i; j > 0; {
+			j--
+			lo, t := decodeCompactedBits(lobits, pack, encodebits*uint(j))
+			if t == zErofsLclusterNonhead {
+				j -= int(lo)
+			}
+			if j >= 0 {
+				nblk++
+			}
+		}
+	} else {
+		for j := i; j > 0; {
+			j--
+			lo, t := decodeCompactedBits(lobits, pack, encodebits*uint(j))
+			if t == zErofsLclusterNonhead {
+				if lo&zErofsD0CblkCnt != 0 {
+					j--
+					nblk += lo &^ zErofsD0CblkCnt
+					continue
+				}
+				if lo <= 1 {
+					// corrupted, bigpcluster can't have plain d0 == 1
+					break
+				}
+				j -= int(lo) - 2
+				continue
+			}
+			nblk++
+		}
+	}
+	lc.pblk = binary.LittleEndian.Uint32(pack[len(pack)-4:]) + nblk
+	return lc
+}
+
+// readExtent returns the (decompressed) data of the extent
+func (fs *erofsFS) readExtent(in *erofsInode, e erofsExtent) ([]byte, error) {
+	if e.plen == 0 {
+		return make([]byte, e.length), nil
+	}
+	src, err := fs.read(e.pos, e.plen)
+	if err != nil {
+		return nil, err
+	}
+	if in.layout != erofsLayoutCompressedFull && in.layout != erofsLayoutCompressedCompact {
+		return src, nil
+	}
+	if e.plain {
+		if uint64(len(src)) < e.length {
+			return nil, fmt.Errorf("erofs: inode %d: short uncompressed pcluster", in.nid)
+		}
+		return src[:e.length], nil
+	}
+	// compressed data is stored at the end of the pcluster
+	if fs.featureIncompat&erofsFeatureZeroPadding != 0 {
+		src = bytes.TrimLeft(src, "\x00")
+	}
+	var out []byte
+	switch e.alg {
+	case zErofsAlgLz4:
+		out, err = decompress.Lz4BlockPartial(src, int(e.length))
+	case zErofsAlgLzma:
+		out, err = decompress.MicroLzma(src, fs.lzmaDictSize, int(e.length))
+	case zErofsAlgDeflate:
+		out, err = decompress.Deflate(src, int(e.length))
+	default:
+		return nil, fmt.Errorf("erofs: inode %d: unsupported compression algorithm %d", in.nid, e.alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erofs: inode %d: %s", in.nid, err)
+	}
+	if uint64(len(out)) != e.length {
+		return nil, fmt.Errorf("erofs: inode %d: short decompressed pcluster", in.nid)
+	}
+	return out, nil
+}
+
+type erofsFileReader struct {
+	fs     *erofsFS
+	in     *erofsInode
+	extent []erofsExtent
+	buf    []byte
+}
+
+// reader returns a reader for the content of the inode
+func (fs *erofsFS) reader(in *erofsInode) (io.Reader, error) {
+	ext, err := fs.extents(in)
+	if err != nil {
+		return nil, err
+	}
+	return &erofsFileReader{fs: fs, in: in, extent: ext}, nil
+}
+
+// nextExtent removes the next extent from the list, uncompressed extents and holes
+// are split into blocks so large files are not read into memory at once
+func (r *erofsFileReader) nextExtent() erofsExtent {
+	e := r.extent[0]
+	bs := uint64(r.fs.blkSize())
+	if r.in.layout == erofsLayoutCompressedFull || r.in.layout == erofsLayoutCompressedCompact || e.length <= bs {
+		r.extent = r.extent[1:]
+		return e
+	}
+	rest := erofsExtent{offset: e.offset + bs, length: e.length - bs}
+	e.length = bs
+	if e.plen != 0 {
+		rest.pos = e.pos + int64(bs)
+		rest.plen = e.plen - int(bs)
+		e.plen = int(bs)
+	}
+	r.extent[0] = rest
+	return e
+}
+
+func (r *erofsFileReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.extent) == 0 {
+			return 0, io.EOF
+		}
+		var err error
+		r.buf, err = r.fs.readExtent(r.in, r.nextExtent())
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (fs *erofsFS) readAll(in *erofsInode) ([]byte, error) {
+	r, err := fs.reader(in)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// readDir returns the entries of the directory excluding "." and ".."
+func (fs *erofsFS) readDir(in *erofsInode) ([]erofsDirent, error) {
+	if !in.isDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+	data, err := fs.readAll(in)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	var entries []erofsDirent
+	for off := 0; off < len(data); off += fs.dirBlkSize {
+		end := off + fs.dirBlkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		blk := data[off:end]
+		if len(blk) < erofsDirentSize {
+			break
+		}
+		count := int(le.Uint16(blk[8:])) / erofsDirentSize
+		if count == 0 || count*erofsDirentSize > len(blk) {
+			return nil, fmt.Errorf("erofs: inode %d: bad directory block", in.nid)
+		}
+		for i := 0; i < count; i++ {
+			d := blk[i*erofsDirentSize:]
+			nameoff := int(le.Uint16(d[8:]))
+			nameend := len(blk)
+			if i+1 < count {
+				nameend = int(le.Uint16(blk[(i+1)*erofsDirentSize+8:]))
+			}
+			if nameoff > nameend || nameend > len(blk) {
+				return nil, fmt.Errorf("erofs: inode %d: bad directory entry", in.nid)
+			}
+			name := blk[nameoff:nameend]
+			// the last name in the block is padded
+			if i+1 == count {
+				if n := bytes.IndexByte(name, 0); n >= 0 {
+					name = name[:n]
+				}
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			entries = append(entries, erofsDirent{name: string(name), nid: le.Uint64(d)})
+		}
+	}
+	return entries, nil
+}
+
+// lookup resolves the path to an inode, symlinks are not followed
+func (fs *erofsFS) lookup(path string) (*erofsInode, error) {
+	in, err := fs.readInode(fs.rootNid)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		entries, err := fs.readDir(in)
+		if err != nil {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+		found := false
+		for _, e := range entries {
+			if e.name == name {
+				if in, err = fs.readInode(e.nid); err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+	}
+	return in, nil
+}
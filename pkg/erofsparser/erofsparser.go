@@ -0,0 +1,176 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erofsparser
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/capability"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+type ErofsParser struct {
+	imagepath string
+	fs        *erofsFS
+	fsErr     error
+}
+
+func New(imagepath string) *ErofsParser {
+	parser := &ErofsParser{
+		imagepath: imagepath,
+	}
+
+	return parser
+}
+
+func (e *ErofsParser) ImageName() string {
+	return e.imagepath
+}
+
+// open the image on first use
+func (e *ErofsParser) open() (*erofsFS, error) {
+	if e.fs == nil && e.fsErr == nil {
+		e.fs, e.fsErr = openErofsFS(e.imagepath)
+	}
+	return e.fs, e.fsErr
+}
+
+func (e *ErofsParser) fileInfo(fs *erofsFS, in *erofsInode, name string) (fsparser.FileInfo, error) {
+	fi := fsparser.FileInfo{
+		Name:         name,
+		Size:         int64(in.size),
+		Mode:         uint64(in.mode),
+		Uid:          int(in.uid),
+		Gid:          int(in.gid),
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+		Mtime:        int64(in.mtime),
+		// the kernel uses the nid as inode number
+		Ino:   in.nid,
+		Nlink: in.nlink,
+	}
+	if fi.IsDevice() {
+		fi.Rdev = fsparser.DecodeDev(in.iu)
+	}
+	// the link target is stored as file data
+	if in.isLink() {
+		target, err := fs.readAll(in)
+		if err != nil {
+			return fi, err
+		}
+		fi.LinkTarget = string(target)
+	}
+	xattrs, err := fs.xattrs(in)
+	if err != nil {
+		return fi, err
+	}
+	if len(xattrs) > 0 {
+		fi.Xattrs = xattrs
+	}
+	if label, ok := xattrs["security.selinux"]; ok {
+		fi.SELinuxLabel = strings.TrimRight(string(label), "\x00")
+	}
+	if caps, ok := xattrs["security.capability"]; ok {
+		fi.Capabilities, _ = capability.New(caps)
+	}
+	return fi, nil
+}
+
+func (e *ErofsParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.readDir(in)
+	if err != nil {
+		return nil, err
+	}
+	var dir []fsparser.FileInfo
+	for _, entry := range entries {
+		ein, err := fs.readInode(entry.nid)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := e.fileInfo(fs, ein, entry.name)
+		if err != nil {
+			return nil, err
+		}
+		dir = append(dir, fi)
+	}
+	return dir, nil
+}
+
+func (e *ErofsParser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
+	fs, err := e.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	return e.fileInfo(fs, in, path.Base(dirpath))
+}
+
+// Open returns a reader for the content of the file
+func (e *ErofsParser) Open(filepath string) (io.ReadCloser, error) {
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	in, err := fs.lookup(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if !in.isReg() {
+		return nil, fmt.Errorf("erofsparser: %s is not a regular file", filepath)
+	}
+	r, err := fs.reader(in)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+func (e *ErofsParser) CopyFile(filepath string, dstdir string) bool {
+	r, err := e.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Supported returns true since no external tools are required
+func (e *ErofsParser) Supported() bool {
+	return true
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package erofsparser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func TestImage(t *testing.T) {
+	// generated with github.com/erofs/go-erofs, uncompressed
+	e := New("../../test/erofs.img")
+
+	fi, err := e.GetFileInfo("/")
+	if err != nil || !fi.IsDir() || fi.Name != "/" {
+		t.Errorf("bad /: %v %v", fi, err)
+	}
+
+	dir, err := e.GetDirInfo("/bin")
+	if err != nil || len(dir) != 3 {
+		t.Errorf("/bin should contain 3 entries: %v %v", dir, err)
+	}
+
+	fi, err = e.GetFileInfo("/bin/busybox")
+	if err != nil || !fi.IsFile() || !fi.IsSUid() || fi.Size != 8893 || fi.Uid != 1000 || fi.Gid != 1001 {
+		t.Errorf("bad /bin/busybox: %v %v", fi, err)
+	}
+	if fi.SELinuxLabel != "u:object_r:system_file:s0" {
+		t.Errorf("bad selinux label: %s", fi.SELinuxLabel)
+	}
+	if names := fi.XattrNames("security.*"); len(names) != 1 || names[0] != "security.selinux" {
+		t.Errorf("bad /bin/busybox xattrs: %v", fi.Xattrs)
+	}
+
+	fi, err = e.GetFileInfo("/bin/ping")
+	if err != nil || len(fi.Capabilities) != 1 || fi.Capabilities[0] != "cap_net_raw+p" {
+		t.Errorf("bad /bin/ping: %v %v", fi, err)
+	}
+
+	fi, err = e.GetFileInfo("/bin/sh")
+	if err != nil || !fi.IsLink() || fi.LinkTarget != "busybox" {
+		t.Errorf("bad /bin/sh: %v %v", fi, err)
+	}
+
+	// extended inode
+	fi, err = e.GetFileInfo("/etc/fstab")
+	if err != nil || fi.Uid != 100000 || fi.Gid != 100000 || fi.Size != 29 || fi.SELinuxLabel != "-" {
+		t.Errorf("bad /etc/fstab: %v %v", fi, err)
+	}
+
+	fi, err = e.GetFileInfo("/dev/tty6")
+	if err != nil || fi.Mode != 020620 {
+		t.Errorf("bad /dev/tty6: %v %v", fi, err)
+	}
+
+	if _, err := e.GetFileInfo("/bin/missing"); err == nil {
+		t.Errorf("/bin/missing should not exist")
+	}
+
+	tmpfile := "erofs-test-busybox"
+	if !e.CopyFile("/bin/busybox", tmpfile) {
+		t.Fatal("copy failed")
+	}
+	defer os.Remove(tmpfile)
+	data, _ := ioutil.ReadFile(tmpfile)
+	// seq 1 2000
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != "6251e5743b6fd6a7d606130bdf7c15077ce85ebd3a0fdee284d15a46df199e38" {
+		t.Errorf("bad content of /bin/busybox")
+	}
+	if e.CopyFile("/bin/sh", tmpfile) {
+		t.Errorf("copy of a symlink should fail")
+	}
+
+	r, err := e.Open("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Sum(nil), digest[:]) {
+		t.Errorf("Open content differs from CopyFile")
+	}
+	if _, err := e.Open("/bin/sh"); err == nil {
+		t.Errorf("open of a symlink should fail")
+	}
+}
+
+// writeCompressedImage creates an image with a single compressed inode (nid 0) of four
+// lclusters: a LZ4 pcluster (lcluster 0-1) and a MicroLZMA pcluster (lcluster 1-3)
+func writeCompressedImage(t *testing.T, layout int, content []byte) string {
+	const bs = 4096
+	const split = 6000
+	img := make([]byte, 12*bs)
+	le := binary.LittleEndian
+
+	sb := img[erofsSuperOffset:]
+	le.PutUint32(sb[0:], erofsMagic)
+	sb[12] = 12
+	le.PutUint32(sb[40:], 1)
+	le.PutUint32(sb[80:], erofsFeatureZeroPadding)
+
+	in := img[bs:]
+	le.PutUint16(in[0:], uint16(layout<<1))
+	le.PutUint16(in[4:], 0100644)
+	le.PutUint32(in[8:], uint32(len(content)))
+	le.PutUint32(in[16:], 2)
+
+	// map header: head1 lz4, head2 lzma
+	hdr := in[erofsInodeCompactSize:]
+	hdr[6] = zErofsAlgLz4 | zErofsAlgLzma<<4
+	idx := hdr[zErofsMapHeaderSize:]
+	if layout == erofsLayoutCompressedFull {
+		le.PutUint16(idx[0:], zErofsLclusterHead1)
+		le.PutUint32(idx[4:], 10)
+		le.PutUint16(idx[8:], zErofsLclusterHead2)
+		le.PutUint16(idx[10:], split-bs)
+		le.PutUint32(idx[12:], 11)
+		le.PutUint16(idx[16:], zErofsLclusterNonhead)
+		le.PutUint16(idx[20:], 1)
+		le.PutUint16(idx[24:], zErofsLclusterNonhead)
+		le.PutUint16(idx[28:], 2)
+	} else {
+		// 4B packs: two 16 bit entries (type << 12 | lo) and the block address
+		le.PutUint16(idx[0:], zErofsLclusterHead1<<12)
+		le.PutUint16(idx[2:], zErofsLclusterHead2<<12|(split-bs))
+		le.PutUint32(idx[4:], 9)
+		le.PutUint16(idx[8:], zErofsLclusterNonhead<<12|1)
+		le.PutUint16(idx[10:], zErofsLclusterNonhead<<12|1)
+	}
+
+	lz := make([]byte, lz4.CompressBlockBound(split))
+	n, err := lz4.CompressBlock(content[:split], lz, nil)
+	if err != nil || n == 0 || n > bs {
+		t.Fatalf("lz4 failed: %v", err)
+	}
+	copy(img[11*bs-n:], lz[:n])
+
+	var buf bytes.Buffer
+	w, err := lzma.WriterConfig{Size: int64(len(content) - split), DictCap: 1 << 16}.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content[split:])
+	w.Close()
+	stream := buf.Bytes()
+	micro := append([]byte{^stream[0]}, stream[14:]...)
+	if len(micro) > bs {
+		t.Fatal("lzma output too big")
+	}
+	copy(img[12*bs-len(micro):], micro)
+
+	f, err := ioutil.TempFile("", "erofsparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(img)
+	return f.Name()
+}
+
+func TestCompressed(t *testing.T) {
+	var content bytes.Buffer
+	for i := 0; content.Len() < 3*4096+100; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	data := content.Bytes()[:3*4096+100]
+
+	for _, layout := range []int{erofsLayoutCompressedFull, erofsLayoutCompressedCompact} {
+		image := writeCompressedImage(t, layout, data)
+		defer os.Remove(image)
+
+		fs, err := openErofsFS(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := fs.readInode(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := fs.reader(in)
+		if err != nil {
+			t.Errorf("layout %d: %s", layout, err)
+			continue
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("layout %d: bad content (%d bytes): %v", layout, len(out), err)
+		}
+		fs.img.Close()
+	}
+}
+
+func TestCorruptSize(t *testing.T) {
+	data, err := ioutil.ReadFile("../../test/erofs.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := openErofsFS("../../test/erofs.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	busybox, err := fs.lookup("/bin/busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fstab, err := fs.lookup("/etc/fstab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.img.Close()
+
+	// compact and extended inode with a size larger than the image
+	binary.LittleEndian.PutUint32(data[busybox.iloc+8:], 0xffffffff)
+	binary.LittleEndian.PutUint64(data[fstab.iloc+8:], 1<<62)
+	f, err := ioutil.TempFile("", "erofs-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	e := New(f.Name())
+	for _, fn := range []string{"/bin/busybox", "/etc/fstab"} {
+		r, err := e.Open(fn)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, r)
+			r.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: reading beyond the end of the image should fail", fn)
+		}
+		if e.CopyFile(fn, f.Name()+".copy") {
+			t.Errorf("%s: copy should fail", fn)
+		}
+		os.Remove(f.Name() + ".copy")
+	}
+}
@@ -0,0 +1,689 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package extparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+ * Minimal read-only implementation of the ext2/3/4 on-disk format.
+ * see: https://www.kernel.org/doc/html/latest/filesystems/ext4/index.html
+ */
+
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	extMagic         = 0xEF53
+	rootInode        = 2
+
+	incompatFiletype   = 0x0002
+	incompatMetaBg     = 0x0010
+	incompat64Bit      = 0x0080
+	incompatInlineData = 0x8000
+	roCompatSparse     = 0x0001
+	roCompatHugeFile   = 0x0008
+
+	inodeFlagHugeFile   = 0x40000
+	inodeFlagExtents    = 0x80000
+	inodeFlagEaInode    = 0x200000
+	inodeFlagInlineData = 0x10000000
+
+	extentMagic = 0xF30A
+	xattrMagic  = 0xEA020000
+
+	numBlockPtrs   = 12
+	inodeBlockSize = 60
+)
+
+var xattrPrefix = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+	7: "system.",
+	8: "system.richacl",
+}
+
+type superblock struct {
+	inodesCount     uint32
+	blocksCount     uint64
+	firstDataBlock  uint32
+	blockSize       uint64
+	blocksPerGroup  uint32
+	inodesPerGroup  uint32
+	inodeSize       uint16
+	featureIncompat uint32
+	featureRoCompat uint32
+	descSize        uint16
+	firstMetaBg     uint32
+}
+
+type inode struct {
+	num        uint32
+	mode       uint16
+	uid        uint32
+	gid        uint32
+	size       uint64
+	atime      uint32
+	ctime      uint32
+	mtime      int64
+	linksCount uint16
+	blocks     uint64
+	flags      uint32
+	block      [inodeBlockSize]byte
+	fileACL    uint64
+	extra      []byte // in-inode extended attribute space
+}
+
+type dirEntry struct {
+	inode    uint32
+	name     string
+	fileType uint8
+}
+
+type extent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+	uninit   bool
+}
+
+type extFS struct {
+	img         *os.File
+	sb          superblock
+	inodeTables []uint64
+}
+
+func openExtFS(imagepath string) (*extFS, error) {
+	img, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	fs := &extFS{img: img}
+	if err := fs.readSuperblock(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	if err := fs.readGroupDescriptors(); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *extFS) readAt(off uint64, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := fs.img.ReadAt(buf, int64(off))
+	if err != nil && !(err == io.EOF && uint64(n) == size) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (fs *extFS) readBlock(blk uint64) ([]byte, error) {
+	return fs.readAt(blk*fs.sb.blockSize, fs.sb.blockSize)
+}
+
+func (fs *extFS) readSuperblock() error {
+	data, err := fs.readAt(superblockOffset, superblockSize)
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	if le.Uint16(data[56:]) != extMagic {
+		return fmt.Errorf("not an ext2/3/4 filesystem")
+	}
+	sb := &fs.sb
+	sb.inodesCount = le.Uint32(data[0:])
+	sb.blocksCount = uint64(le.Uint32(data[4:]))
+	sb.firstDataBlock = le.Uint32(data[20:])
+	sb.blockSize = 1024 << le.Uint32(data[24:])
+	sb.blocksPerGroup = le.Uint32(data[32:])
+	sb.inodesPerGroup = le.Uint32(data[40:])
+	sb.inodeSize = 128
+	// dynamic revision
+	if le.Uint32(data[76:]) >= 1 {
+		sb.inodeSize = le.Uint16(data[88:])
+	}
+	sb.featureIncompat = le.Uint32(data[96:])
+	sb.featureRoCompat = le.Uint32(data[100:])
+	sb.descSize = 32
+	if sb.featureIncompat&incompat64Bit != 0 {
+		sb.descSize = le.Uint16(data[254:])
+		sb.blocksCount |= uint64(le.Uint32(data[336:])) << 32
+	}
+	sb.firstMetaBg = le.Uint32(data[260:])
+	if sb.blocksPerGroup == 0 || sb.inodesPerGroup == 0 || sb.descSize < 32 || sb.inodeSize < 128 {
+		return fmt.Errorf("bad ext superblock")
+	}
+	return nil
+}
+
+func isPowerOf(n, base uint64) bool {
+	for n > 1 && n%base == 0 {
+		n /= base
+	}
+	return n == 1
+}
+
+// groupHasSuper returns true if the block group contains a superblock backup
+func (fs *extFS) groupHasSuper(group uint64) bool {
+	if group <= 1 || fs.sb.featureRoCompat&roCompatSparse == 0 {
+		return true
+	}
+	return isPowerOf(group, 3) || isPowerOf(group, 5) || isPowerOf(group, 7)
+}
+
+// descBlock returns the block number of the n-th group descriptor block
+func (fs *extFS) descBlock(n uint64) uint64 {
+	first := uint64(fs.sb.firstDataBlock)
+	if fs.sb.featureIncompat&incompatMetaBg == 0 || n < uint64(fs.sb.firstMetaBg) {
+		return first + 1 + n
+	}
+	// with meta_bg the descriptors for a meta group are stored in the first group of the meta group
+	group := n * (fs.sb.blockSize / uint64(fs.sb.descSize))
+	blk := first + group*uint64(fs.sb.blocksPerGroup)
+	if fs.groupHasSuper(group) {
+		blk++
+	}
+	return blk
+}
+
+func (fs *extFS) readGroupDescriptors() error {
+	sb := &fs.sb
+	groups := (sb.blocksCount - uint64(sb.firstDataBlock) + uint64(sb.blocksPerGroup) - 1) / uint64(sb.blocksPerGroup)
+	descPerBlock := sb.blockSize / uint64(sb.descSize)
+	fs.inodeTables = make([]uint64, groups)
+	le := binary.LittleEndian
+	var data []byte
+	for g := uint64(0); g < groups; g++ {
+		if g%descPerBlock == 0 {
+			var err error
+			data, err = fs.readBlock(fs.descBlock(g / descPerBlock))
+			if err != nil {
+				return err
+			}
+		}
+		desc := data[(g%descPerBlock)*uint64(sb.descSize):]
+		table := uint64(le.Uint32(desc[8:]))
+		if sb.descSize >= 64 {
+			table |= uint64(le.Uint32(desc[40:])) << 32
+		}
+		fs.inodeTables[g] = table
+	}
+	return nil
+}
+
+func (fs *extFS) readInode(num uint32) (*inode, error) {
+	if num == 0 || num > fs.sb.inodesCount {
+		return nil, fmt.Errorf("invalid inode number: %d", num)
+	}
+	group := uint64(num-1) / uint64(fs.sb.inodesPerGroup)
+	index := uint64(num-1) % uint64(fs.sb.inodesPerGroup)
+	if group >= uint64(len(fs.inodeTables)) {
+		return nil, fmt.Errorf("invalid inode number: %d", num)
+	}
+	off := fs.inodeTables[group]*fs.sb.blockSize + index*uint64(fs.sb.inodeSize)
+	data, err := fs.readAt(off, uint64(fs.sb.inodeSize))
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	in := &inode{num: num}
+	in.mode = le.Uint16(data[0:])
+	in.uid = uint32(le.Uint16(data[2:])) | uint32(le.Uint16(data[120:]))<<16
+	in.size = uint64(le.Uint32(data[4:])) | uint64(le.Uint32(data[108:]))<<32
+	in.atime = le.Uint32(data[8:])
+	in.ctime = le.Uint32(data[12:])
+	in.mtime = int64(int32(le.Uint32(data[16:])))
+	in.gid = uint32(le.Uint16(data[24:])) | uint32(le.Uint16(data[122:]))<<16
+	in.linksCount = le.Uint16(data[26:])
+	in.flags = le.Uint32(data[32:])
+	in.blocks = uint64(le.Uint32(data[28:]))
+	if fs.sb.featureRoCompat&roCompatHugeFile != 0 {
+		in.blocks |= uint64(le.Uint16(data[116:])) << 32
+		if in.flags&inodeFlagHugeFile != 0 {
+			in.blocks *= fs.sb.blockSize / 512
+		}
+	}
+	copy(in.block[:], data[40:40+inodeBlockSize])
+	in.fileACL = uint64(le.Uint32(data[104:])) | uint64(le.Uint16(data[118:]))<<32
+
+	if fs.sb.inodeSize > 128 {
+		extraISize := uint64(le.Uint16(data[128:]))
+		if 128+extraISize+4 <= uint64(fs.sb.inodeSize) {
+			in.extra = data[128+extraISize:]
+		}
+		// the lower two bits of i_mtime_extra extend the epoch
+		if extraISize >= 12 {
+			in.mtime += int64(le.Uint32(data[136:])&3) << 32
+		}
+	}
+	return in, nil
+}
+
+// rdev returns the encoded device number of a device inode, the old 16 bit
+// encoding is stored in i_block[0] and the new 32 bit encoding in i_block[1]
+func (in *inode) rdev() uint32 {
+	dev := binary.LittleEndian.Uint32(in.block[0:])
+	if dev == 0 {
+		dev = binary.LittleEndian.Uint32(in.block[4:])
+	}
+	return dev
+}
+
+func (in *inode) isDir() bool {
+	return in.mode&0170000 == 0040000
+}
+
+func (in *inode) isReg() bool {
+	return in.mode&0170000 == 0100000
+}
+
+func (in *inode) isLink() bool {
+	return in.mode&0170000 == 0120000
+}
+
+// extents returns the mapping of logical to physical blocks for the inode
+func (fs *extFS) extents(in *inode) ([]extent, error) {
+	if in.flags&inodeFlagExtents != 0 {
+		var out []extent
+		err := fs.walkExtentTree(in.block[:], &out, 0)
+		return out, err
+	}
+	return fs.indirectExtents(in)
+}
+
+func (fs *extFS) walkExtentTree(node []byte, out *[]extent, level int) error {
+	le := binary.LittleEndian
+	if len(node) < 12 || le.Uint16(node[0:]) != extentMagic {
+		return fmt.Errorf("bad extent header")
+	}
+	// guard against corrupted images
+	if level > 8 {
+		return fmt.Errorf("extent tree too deep")
+	}
+	entries := int(le.Uint16(node[2:]))
+	max := int(le.Uint16(node[4:]))
+	depth := le.Uint16(node[6:])
+	if entries > max || 12+entries*12 > len(node) {
+		return fmt.Errorf("bad extent header: %d entries", entries)
+	}
+	for i := 0; i < entries; i++ {
+		e := node[12+i*12 : 12+(i+1)*12]
+		if depth == 0 {
+			length := uint64(le.Uint16(e[4:]))
+			uninit := false
+			if length > 32768 {
+				length -= 32768
+				uninit = true
+			}
+			*out = append(*out, extent{
+				logical:  uint64(le.Uint32(e[0:])),
+				physical: uint64(le.Uint32(e[8:])) | uint64(le.Uint16(e[6:]))<<32,
+				length:   length,
+				uninit:   uninit,
+			})
+		} else {
+			leaf := uint64(le.Uint32(e[4:])) | uint64(le.Uint16(e[8:]))<<32
+			child, err := fs.readBlock(leaf)
+			if err != nil {
+				return err
+			}
+			if err := fs.walkExtentTree(child, out, level+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indirectExtents maps the classic ext2/3 (in)direct block pointers to extents
+func (fs *extFS) indirectExtents(in *inode) ([]extent, error) {
+	le := binary.LittleEndian
+	nblocks := (in.size + fs.sb.blockSize - 1) / fs.sb.blockSize
+	var out []extent
+	add := func(logical, physical uint64) {
+		if physical == 0 {
+			return
+		}
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if last.logical+last.length == logical && last.physical+last.length == physical {
+				last.length++
+				return
+			}
+		}
+		out = append(out, extent{logical: logical, physical: physical, length: 1})
+	}
+
+	var logical uint64
+	for i := 0; i < numBlockPtrs && logical < nblocks; i++ {
+		add(logical, uint64(le.Uint32(in.block[i*4:])))
+		logical++
+	}
+
+	ptrsPerBlock := fs.sb.blockSize / 4
+	var walk func(blk uint64, level int) error
+	walk = func(blk uint64, level int) error {
+		span := uint64(1)
+		for i := 0; i < level; i++ {
+			span *= ptrsPerBlock
+		}
+		if blk == 0 {
+			logical += span * ptrsPerBlock
+			return nil
+		}
+		data, err := fs.readBlock(blk)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < ptrsPerBlock && logical < nblocks; i++ {
+			ptr := uint64(le.Uint32(data[i*4:]))
+			if level == 0 {
+				add(logical, ptr)
+				logical++
+			} else if err := walk(ptr, level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for level := 0; level < 3 && logical < nblocks; level++ {
+		if err := walk(uint64(le.Uint32(in.block[(numBlockPtrs+level)*4:])), level); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+type extentReader struct {
+	fs      *extFS
+	extents []extent
+	size    uint64
+	offset  uint64
+}
+
+func (r *extentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	bs := r.fs.sb.blockSize
+	lblk := r.offset / bs
+
+	// find the extent containing the current block, the run ends at the
+	// end of that extent or at the start of the next extent (sparse area)
+	var cur *extent
+	end := r.size
+	for i := range r.extents {
+		e := &r.extents[i]
+		if lblk >= e.logical && lblk < e.logical+e.length {
+			cur = e
+			if (e.logical+e.length)*bs < end {
+				end = (e.logical + e.length) * bs
+			}
+			break
+		}
+		if e.logical > lblk && e.logical*bs < end {
+			end = e.logical * bs
+		}
+	}
+	n := end - r.offset
+	if n > uint64(len(p)) {
+		n = uint64(len(p))
+	}
+
+	if cur == nil || cur.uninit {
+		for i := uint64(0); i < n; i++ {
+			p[i] = 0
+		}
+	} else {
+		off := (cur.physical+lblk-cur.logical)*bs + r.offset%bs
+		if _, err := r.fs.img.ReadAt(p[:n], int64(off)); err != nil {
+			return 0, err
+		}
+	}
+	r.offset += n
+	return int(n), nil
+}
+
+// inlineData returns the content of an inode with the inline data flag set
+func (fs *extFS) inlineData(in *inode) ([]byte, error) {
+	data := make([]byte, inodeBlockSize)
+	copy(data, in.block[:])
+	xattrs, err := fs.xattrs(in)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, xattrs["system.data"]...)
+	if uint64(len(data)) > in.size {
+		data = data[:in.size]
+	}
+	return data, nil
+}
+
+// reader returns a reader for the content of the inode
+func (fs *extFS) reader(in *inode) (io.Reader, error) {
+	if in.flags&inodeFlagInlineData != 0 {
+		data, err := fs.inlineData(in)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	extents, err := fs.extents(in)
+	if err != nil {
+		return nil, err
+	}
+	return &extentReader{fs: fs, extents: extents, size: in.size}, nil
+}
+
+func (fs *extFS) readAll(in *inode) ([]byte, error) {
+	r, err := fs.reader(in)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, in.size))
+	_, err = io.Copy(buf, r)
+	return buf.Bytes(), err
+}
+
+func (fs *extFS) parseDirEntries(data []byte, out []dirEntry) []dirEntry {
+	le := binary.LittleEndian
+	for off := 0; off+8 <= len(data); {
+		recLen := int(le.Uint16(data[off+4:]))
+		if recLen < 8 || off+recLen > len(data) {
+			break
+		}
+		ino := le.Uint32(data[off:])
+		nameLen := int(data[off+6])
+		fileType := data[off+7]
+		if fs.sb.featureIncompat&incompatFiletype == 0 {
+			nameLen = int(le.Uint16(data[off+6:]))
+			fileType = 0
+		}
+		if ino != 0 && 8+nameLen <= recLen {
+			out = append(out, dirEntry{inode: ino, name: string(data[off+8 : off+8+nameLen]), fileType: fileType})
+		}
+		off += recLen
+	}
+	return out
+}
+
+// readDir returns all entries of the directory including "." and ".."
+func (fs *extFS) readDir(in *inode) ([]dirEntry, error) {
+	if !in.isDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+	if in.flags&inodeFlagInlineData != 0 {
+		data, err := fs.inlineData(in)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 4 {
+			return nil, fmt.Errorf("bad inline directory")
+		}
+		// inline directories only store the parent inode followed by the entries
+		entries := []dirEntry{
+			{inode: in.num, name: ".", fileType: 2},
+			{inode: binary.LittleEndian.Uint32(data[0:]), name: "..", fileType: 2},
+		}
+		// the part in i_block and the part in the xattr are separate entry lists
+		end := inodeBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		entries = fs.parseDirEntries(data[4:end], entries)
+		return fs.parseDirEntries(data[end:], entries), nil
+	}
+
+	data, err := fs.readAll(in)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirEntry
+	bs := int(fs.sb.blockSize)
+	for off := 0; off < len(data); off += bs {
+		end := off + bs
+		if end > len(data) {
+			end = len(data)
+		}
+		entries = fs.parseDirEntries(data[off:end], entries)
+	}
+	return entries, nil
+}
+
+// lookup resolves the path to an inode, symlinks are not followed
+func (fs *extFS) lookup(path string) (*inode, error) {
+	in, err := fs.readInode(rootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		entries, err := fs.readDir(in)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		found := false
+		for _, e := range entries {
+			if e.name == name {
+				in, err = fs.readInode(e.inode)
+				if err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+	}
+	return in, nil
+}
+
+func (fs *extFS) readLink(in *inode) (string, error) {
+	if in.flags&(inodeFlagExtents|inodeFlagInlineData) == 0 && in.size < inodeBlockSize {
+		eaBlocks := uint64(0)
+		if in.fileACL != 0 {
+			eaBlocks = fs.sb.blockSize / 512
+		}
+		// fast symlink: the target is stored in the block pointers
+		if in.blocks-eaBlocks == 0 {
+			return string(in.block[:in.size]), nil
+		}
+	}
+	data, err := fs.readAll(in)
+	return string(data), err
+}
+
+func (fs *extFS) parseXattrEntries(buf []byte, entryOff int, out map[string][]byte) error {
+	le := binary.LittleEndian
+	for off := entryOff; off+16 <= len(buf); {
+		if le.Uint32(buf[off:]) == 0 {
+			break
+		}
+		nameLen := int(buf[off])
+		nameIndex := buf[off+1]
+		valueOff := int(le.Uint16(buf[off+2:]))
+		valueInum := le.Uint32(buf[off+4:])
+		valueSize := int(le.Uint32(buf[off+8:]))
+		if off+16+nameLen > len(buf) {
+			return fmt.Errorf("bad xattr entry")
+		}
+		name := xattrPrefix[nameIndex] + string(buf[off+16:off+16+nameLen])
+
+		var value []byte
+		if valueInum != 0 {
+			// value is stored in a separate inode (ea_inode feature)
+			vin, err := fs.readInode(valueInum)
+			if err != nil {
+				return err
+			}
+			if vin.flags&inodeFlagEaInode == 0 {
+				return fmt.Errorf("bad xattr value inode")
+			}
+			value, err = fs.readAll(vin)
+			if err != nil {
+				return err
+			}
+		} else {
+			if valueOff+valueSize > len(buf) {
+				return fmt.Errorf("bad xattr value")
+			}
+			value = buf[valueOff : valueOff+valueSize]
+		}
+		out[name] = value
+		off += (16 + nameLen + 3) &^ 3
+	}
+	return nil
+}
+
+// xattrs returns all extended attributes stored in the inode and in the external attribute block
+func (fs *extFS) xattrs(in *inode) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	le := binary.LittleEndian
+	if len(in.extra) >= 4 && le.Uint32(in.extra) == xattrMagic {
+		// in-inode value offsets are relative to the first entry
+		if err := fs.parseXattrEntries(in.extra[4:], 0, out); err != nil {
+			return nil, err
+		}
+	}
+	if in.fileACL != 0 {
+		data, err := fs.readBlock(in.fileACL)
+		if err != nil {
+			return nil, err
+		}
+		if le.Uint32(data) == xattrMagic {
+			if err := fs.parseXattrEntries(data, 32, out); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
@@ -18,46 +18,31 @@ package extparser
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
+	"path"
 	"strings"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/capability"
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
 )
 
 type Ext2Parser struct {
-	fileinfoReg  *regexp.Regexp
-	regexString  string
 	selinux      bool
 	capabilities bool
 	imagepath    string
+	fs           *extFS
+	fsErr        error
 }
 
-const (
-	e2ToolsCp = "e2cp"
-	e2ToolsLs = "e2ls"
-)
-
 func New(imagepath string, selinux, capabilities bool) *Ext2Parser {
 	parser := &Ext2Parser{
-		// 365  120777     0     0        7 12-Jul-2018 10:15 true
-		regexString:  `^\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+-\w+-\d+)\s+(\d+:\d+)\s+([\S ]+)`,
 		imagepath:    imagepath,
-		selinux:      false,
-		capabilities: false,
-	}
-
-	if selinux && seLinuxSupported() {
-		parser.enableSeLinux()
+		selinux:      selinux,
+		capabilities: capabilities,
 	}
-	if capabilities && capabilitiesSupported() {
-		parser.enableCapabilities()
-	}
-	parser.fileinfoReg = regexp.MustCompile(parser.regexString)
 	return parser
 }
 
@@ -65,92 +50,82 @@ func (e *Ext2Parser) ImageName() string {
 	return e.imagepath
 }
 
-func (e *Ext2Parser) enableSeLinux() {
-	// with selinux support (-Z)
-	// 2600  100750     0  2000     1041   1-Jan-2009 03:00 init.environ.rc   u:object_r:rootfs:s0
-	// `^\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+-\w+-\d+)\s+(\d+:\d+)\s+(\S+)\s+(\S+)`)
-
-	// append selinux part
-	e.regexString = e.regexString + `\t\s+(\S+)`
-	e.selinux = true
-}
-
-func (e *Ext2Parser) enableCapabilities() {
-	// with capabilities support (-C)
-	// 2600  100750     0  2000     1041   1-Jan-2009 03:00 init.environ.rc 0x2000001,0x0,0x0,0x0,0x0
-	// `^\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+-\w+-\d+)\s+(\d+:\d+)\s+(\S+)\s+(\S+)`)
-
-	// tab is the separator for security options
-	if !e.selinux {
-		e.regexString = e.regexString + `\t`
+// open the image on first use
+func (e *Ext2Parser) open() (*extFS, error) {
+	if e.fs == nil && e.fsErr == nil {
+		e.fs, e.fsErr = openExtFS(e.imagepath)
 	}
-	// append capability part
-	e.regexString = e.regexString + `\s+(\S+)`
-	e.capabilities = true
+	return e.fs, e.fsErr
 }
 
-func (e *Ext2Parser) parseFileLine(line string) fsparser.FileInfo {
-	res := e.fileinfoReg.FindAllStringSubmatch(line, -1)
+func (e *Ext2Parser) fileInfo(fs *extFS, in *inode, name string) (fsparser.FileInfo, error) {
 	var fi fsparser.FileInfo
-	size, _ := strconv.Atoi(res[0][5])
-	fi.Size = int64(size)
-	fi.Mode, _ = strconv.ParseUint(res[0][2], 8, 32)
-	fi.Uid, _ = strconv.Atoi(res[0][3])
-	fi.Gid, _ = strconv.Atoi(res[0][4])
-	fi.Name = res[0][8]
-
-	if fi.IsLink() && strings.Contains(fi.Name, " -> ") {
-		parts := strings.Split(fi.Name, " -> ")
-		fi.Name = parts[0]
-		fi.LinkTarget = parts[1]
+	fi.Name = name
+	fi.Size = int64(in.size)
+	fi.Mode = uint64(in.mode)
+	fi.Uid = int(in.uid)
+	fi.Gid = int(in.gid)
+	fi.SELinuxLabel = fsparser.SELinuxNoLabel
+	fi.Mtime = in.mtime
+	fi.Ino = uint64(in.num)
+	fi.Nlink = uint32(in.linksCount)
+	if fi.IsDevice() {
+		fi.Rdev = fsparser.DecodeDev(in.rdev())
+	}
+
+	if in.isLink() {
+		target, err := fs.readLink(in)
+		if err != nil {
+			return fi, err
+		}
+		fi.LinkTarget = target
 	}
 
-	if e.selinux {
-		fi.SELinuxLabel = res[0][9]
-	} else {
-		fi.SELinuxLabel = fsparser.SELinuxNoLabel
+	xattrs, err := fs.xattrs(in)
+	if err != nil {
+		return fi, err
 	}
-
-	if e.capabilities {
-		idx := 9
-		if e.selinux {
-			idx = 10
-		}
-		if res[0][idx] != "-" {
-			fi.Capabilities, _ = capability.New(res[0][idx])
-		}
+	if len(xattrs) > 0 {
+		fi.Xattrs = xattrs
+	}
+	if label, ok := xattrs["security.selinux"]; ok && e.selinux {
+		fi.SELinuxLabel = strings.TrimRight(string(label), "\x00")
+	}
+	if caps, ok := xattrs["security.capability"]; ok && e.capabilities {
+		fi.Capabilities, _ = capability.New(caps)
 	}
-	return fi
+	return fi, nil
 }
 
 // ignoreDot=true: will filter out "." and ".." files from the directory listing
 func (e *Ext2Parser) getDirList(dirpath string, ignoreDot bool) ([]fsparser.FileInfo, error) {
-	arg := fmt.Sprintf("%s:%s", e.imagepath, dirpath)
-	params := "-la"
-	if e.selinux {
-		params += "Z"
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
 	}
-	if e.capabilities {
-		params += "C"
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return nil, err
 	}
-	out, err := exec.Command(e2ToolsLs, params, arg).CombinedOutput()
+	entries, err := fs.readDir(in)
 	if err != nil {
-		// do NOT print file not found error
-		if !strings.EqualFold(string(out), "File not found by ext2_lookup") {
-			fmt.Fprintln(os.Stderr, err)
-		}
 		return nil, err
 	}
 	var dir []fsparser.FileInfo
-	lines := strings.Split(string(out), "\n")
-	for _, fline := range lines {
-		if len(fline) > 1 && fline[0] != '>' {
-			fi := e.parseFileLine(fline)
-			// filter: . and ..
-			if !ignoreDot || (fi.Name != "." && fi.Name != "..") {
-				dir = append(dir, fi)
-			}
+	for _, entry := range entries {
+		// filter: . and ..
+		if ignoreDot && (entry.name == "." || entry.name == "..") {
+			continue
+		}
+		ein, err := fs.readInode(entry.inode)
+		if err != nil {
+			return nil, err
 		}
+		fi, err := e.fileInfo(fs, ein, entry.name)
+		if err != nil {
+			return nil, err
+		}
+		dir = append(dir, fi)
 	}
 	return dir, nil
 }
@@ -161,56 +136,53 @@ func (e *Ext2Parser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
 }
 
 func (e *Ext2Parser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
-	var fi fsparser.FileInfo
-	dir, err := e.getDirList(dirpath, false)
-	if len(dir) == 1 {
-		return dir[0], err
-	}
-	// GetFileInfo was called on a directory only return entry for "."
-	for _, info := range dir {
-		if info.Name == "." {
-			info.Name = filepath.Base(dirpath)
-			return info, nil
-		}
+	fs, err := e.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return fsparser.FileInfo{}, err
 	}
-	return fi, fmt.Errorf("file not found: %s", dirpath)
+	return e.fileInfo(fs, in, path.Base(dirpath))
 }
 
-func (e *Ext2Parser) CopyFile(filepath string, dstdir string) bool {
-	src := fmt.Sprintf("%s:%s", e.imagepath, filepath)
-	_, err := exec.Command(e2ToolsCp, src, dstdir).Output()
+// Open returns a reader for the content of the file
+func (e *Ext2Parser) Open(filepath string) (io.ReadCloser, error) {
+	fs, err := e.open()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return false
+		return nil, err
 	}
-	return true
+	in, err := fs.lookup(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if !in.isReg() {
+		return nil, fmt.Errorf("extparser: %s is not a regular file", filepath)
+	}
+	r, err := fs.reader(in)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
 }
 
-func (f *Ext2Parser) Supported() bool {
-	_, err := exec.LookPath(e2ToolsLs)
+func (e *Ext2Parser) CopyFile(filepath string, dstdir string) bool {
+	r, err := e.Open(filepath)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		return false
 	}
-	_, err = exec.LookPath(e2ToolsCp)
-	return err == nil
-}
-
-func seLinuxSupported() bool {
-	out, _ := exec.Command(e2ToolsLs).CombinedOutput()
-	// look for Z (selinux support) in "Usage: e2ls [-acDfilrtZ][-d dir] file"
-	if strings.Contains(string(out), "Z") {
-		return true
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
 	}
-	fmt.Fprintln(os.Stderr, "extparser: selinux not supported by your version of e2ls")
-	return false
+	return true
 }
 
-func capabilitiesSupported() bool {
-	out, _ := exec.Command(e2ToolsLs).CombinedOutput()
-	// look for C (capability support) in "Usage: e2ls [-acDfilrtZC][-d dir] file"
-	if strings.Contains(string(out), "C") {
-		return true
-	}
-	fmt.Fprintln(os.Stderr, "extparser: capabilities not supported by your version of e2ls")
-	return false
+// Supported returns true since no external tools are required
+func (e *Ext2Parser) Supported() bool {
+	return true
 }
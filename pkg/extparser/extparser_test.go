@@ -17,6 +17,10 @@ limitations under the License.
 package extparser
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
@@ -130,10 +134,6 @@ func TestCap(t *testing.T) {
 	testImage := "../../test/cap_ext2.img"
 
 	e = New(testImage, false, true)
-	if !capabilitiesSupported() {
-		t.Error("capabilities are not supported by e2ls")
-		return
-	}
 
 	if e.ImageName() != testImage {
 		t.Errorf("ImageName returned bad name")
@@ -147,3 +147,105 @@ func TestCap(t *testing.T) {
 		t.Errorf("Capabilities %s don't match", fi.Capabilities)
 	}
 }
+
+func TestExt4(t *testing.T) {
+	testImage := "../../test/ext4.img"
+
+	p := New(testImage, true, true)
+
+	tests := []struct {
+		filePath   string
+		mode       uint64
+		uid        int
+		gid        int
+		size       int64
+		linkTarget string
+		selinux    string
+		caps       []string
+	}{
+		{"/file1.txt", 0100644, 0, 0, 11, "", "u:object_r:system_file:s0", nil},
+		{"/bin/seq.bin", 0104755, 0, 0, 348894, "", "-", []string{"cap_net_admin+p"}},
+		{"/dir1/sub/tiny", 0100644, 1001, 1002, 1, "", "-", nil},
+		{"/link_fast", 0120777, 0, 0, 9, "file1.txt", "-", nil},
+		{"/link_slow", 0120777, 0, 0, 100, strings.Repeat("a", 100), "-", nil},
+	}
+	for _, test := range tests {
+		fi, err := p.GetFileInfo(test.filePath)
+		if err != nil {
+			t.Errorf("GetFileInfo(%s) failed: %v", test.filePath, err)
+			continue
+		}
+		if fi.Mode != test.mode {
+			t.Errorf("%s: mode %o should be %o", test.filePath, fi.Mode, test.mode)
+		}
+		if fi.Uid != test.uid || fi.Gid != test.gid {
+			t.Errorf("%s: owner %d:%d should be %d:%d", test.filePath, fi.Uid, fi.Gid, test.uid, test.gid)
+		}
+		if fi.Size != test.size {
+			t.Errorf("%s: size %d should be %d", test.filePath, fi.Size, test.size)
+		}
+		if fi.LinkTarget != test.linkTarget {
+			t.Errorf("%s: link target %s should be %s", test.filePath, fi.LinkTarget, test.linkTarget)
+		}
+		if fi.SELinuxLabel != test.selinux {
+			t.Errorf("%s: selinux label %s should be %s", test.filePath, fi.SELinuxLabel, test.selinux)
+		}
+		if len(fi.Capabilities) != len(test.caps) || (len(test.caps) > 0 && fi.Capabilities[0] != test.caps[0]) {
+			t.Errorf("%s: capabilities %s should be %s", test.filePath, fi.Capabilities, test.caps)
+		}
+	}
+
+	dir, err := p.GetDirInfo("/bigdir")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(dir) != 300 {
+		t.Errorf("/bigdir should have 300 entries, has %d", len(dir))
+	}
+
+	if _, err := p.GetFileInfo("/does/not/exist"); err == nil {
+		t.Errorf("GetFileInfo should fail for non existing file")
+	}
+
+	digests := map[string]string{
+		"/bin/seq.bin": "67235281ebbe500c400cb9fd79407125d547975f9fffe671917e0a8000df7dd3",
+		"/sparse":      "827b1fb796c76e831b92eda183fb361387e229c03ddfbbcc34545853c125b9d6",
+	}
+	for fn, digest := range digests {
+		if !p.CopyFile(fn, "xxx-test-xxx") {
+			t.Errorf("CopyFile(%s) returned false", fn)
+			continue
+		}
+		data, err := ioutil.ReadFile("xxx-test-xxx")
+		if err != nil {
+			t.Error(err)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != digest {
+			t.Errorf("%s: digest mismatch", fn)
+		}
+		os.Remove("xxx-test-xxx")
+	}
+}
+
+func TestCorruptExtentHeader(t *testing.T) {
+	fs := &extFS{}
+	// the inode i_block holds a 12 byte header and 4 extents
+	node := make([]byte, 60)
+	binary.LittleEndian.PutUint16(node[0:], extentMagic)
+	binary.LittleEndian.PutUint16(node[4:], 4)
+	for _, entries := range []uint16{5, 0xffff} {
+		binary.LittleEndian.PutUint16(node[2:], entries)
+		var out []extent
+		if err := fs.walkExtentTree(node, &out, 0); err == nil {
+			t.Errorf("%d entries should fail", entries)
+		}
+	}
+	// eh_max larger than the node
+	binary.LittleEndian.PutUint16(node[4:], 0xffff)
+	binary.LittleEndian.PutUint16(node[2:], 10)
+	var out []extent
+	if err := fs.walkExtentTree(node, &out, 0); err == nil {
+		t.Error("entries beyond the node should fail")
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fitimageparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Reader for the flattened device tree (FDT) format, FIT images are device trees.
+ * see: https://devicetree-specification.readthedocs.io (Flattened Devicetree (DTB) Format)
+ */
+
+const (
+	fdtMagic      = 0xd00dfeed
+	fdtHeaderSize = 40
+	maxFdtDepth   = 64
+
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtNop       = 4
+	fdtEnd       = 9
+)
+
+type fdtProperty struct {
+	name  string
+	value []byte
+}
+
+type fdtNode struct {
+	name     string
+	props    []fdtProperty
+	children []*fdtNode
+}
+
+func (n *fdtNode) prop(name string) ([]byte, bool) {
+	for _, p := range n.props {
+		if p.name == name {
+			return p.value, true
+		}
+	}
+	return nil, false
+}
+
+func (n *fdtNode) propString(name string) string {
+	value, _ := n.prop(name)
+	return strings.TrimRight(string(value), "\x00")
+}
+
+// propUint returns the value of a property with one or two cells
+func (n *fdtNode) propUint(name string) (uint64, bool) {
+	value, ok := n.prop(name)
+	switch {
+	case ok && len(value) == 4:
+		return uint64(binary.BigEndian.Uint32(value)), true
+	case ok && len(value) == 8:
+		return binary.BigEndian.Uint64(value), true
+	}
+	return 0, false
+}
+
+func (n *fdtNode) child(name string) *fdtNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// fdtTotalSize returns the size of the device tree blob or an error if data is not a device tree
+func fdtTotalSize(hdr []byte) (uint32, error) {
+	if len(hdr) < fdtHeaderSize || binary.BigEndian.Uint32(hdr) != fdtMagic {
+		return 0, fmt.Errorf("fdt: bad magic")
+	}
+	return binary.BigEndian.Uint32(hdr[4:]), nil
+}
+
+// parseFdt returns the root node of the device tree blob
+func parseFdt(blob []byte) (*fdtNode, error) {
+	size, err := fdtTotalSize(blob)
+	if err != nil {
+		return nil, err
+	}
+	if int(size) > len(blob) {
+		return nil, fmt.Errorf("fdt: blob truncated")
+	}
+	be := binary.BigEndian
+	structOff := be.Uint32(blob[8:])
+	stringsOff := be.Uint32(blob[12:])
+	stringsSize := be.Uint32(blob[32:])
+	structSize := be.Uint32(blob[36:])
+	if uint64(structOff)+uint64(structSize) > uint64(size) || uint64(stringsOff)+uint64(stringsSize) > uint64(size) {
+		return nil, fmt.Errorf("fdt: bad header")
+	}
+	structBlock := blob[structOff : structOff+structSize]
+	stringsBlock := blob[stringsOff : stringsOff+stringsSize]
+
+	var stack []*fdtNode
+	var root *fdtNode
+	off := 0
+	align := func(o int) int { return (o + 3) &^ 3 }
+	for {
+		if off+4 > len(structBlock) {
+			return nil, fmt.Errorf("fdt: structure block truncated")
+		}
+		token := be.Uint32(structBlock[off:])
+		off += 4
+		switch token {
+		case fdtBeginNode:
+			end := bytes.IndexByte(structBlock[off:], 0)
+			if end < 0 || len(stack) >= maxFdtDepth {
+				return nil, fmt.Errorf("fdt: bad node at %d", off)
+			}
+			node := &fdtNode{name: string(structBlock[off : off+end])}
+			off = align(off + end + 1)
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			} else {
+				return nil, fmt.Errorf("fdt: multiple root nodes")
+			}
+			stack = append(stack, node)
+		case fdtEndNode:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("fdt: unbalanced end node at %d", off)
+			}
+			stack = stack[:len(stack)-1]
+		case fdtProp:
+			if off+8 > len(structBlock) || len(stack) == 0 {
+				return nil, fmt.Errorf("fdt: bad property at %d", off)
+			}
+			length := int(be.Uint32(structBlock[off:]))
+			nameOff := int(be.Uint32(structBlock[off+4:]))
+			off += 8
+			if length < 0 || length > len(structBlock)-off || nameOff >= len(stringsBlock) {
+				return nil, fmt.Errorf("fdt: bad property at %d", off)
+			}
+			name := stringsBlock[nameOff:]
+			if end := bytes.IndexByte(name, 0); end >= 0 {
+				name = name[:end]
+			}
+			node := stack[len(stack)-1]
+			node.props = append(node.props, fdtProperty{name: string(name), value: structBlock[off : off+length]})
+			off = align(off + length)
+		case fdtNop:
+		case fdtEnd:
+			if root == nil || len(stack) != 0 {
+				return nil, fmt.Errorf("fdt: unexpected end")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("fdt: bad token 0x%x at %d", token, off-4)
+		}
+	}
+}
+
+// isStringList returns true if the value is a list of printable NUL terminated strings
+func isStringList(value []byte) bool {
+	if len(value) == 0 || value[len(value)-1] != 0 {
+		return false
+	}
+	for i, b := range value {
+		if b == 0 {
+			// no empty strings
+			if i == 0 || value[i-1] == 0 {
+				return false
+			}
+			continue
+		}
+		if b < 0x20 || b > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// propValue converts a property value into a JSON friendly value:
+// strings (or a list of strings), cells as hex strings (or a list of cells), everything else as hex
+func propValue(value []byte) interface{} {
+	if len(value) == 0 {
+		return true
+	}
+	if isStringList(value) {
+		list := strings.Split(string(value[:len(value)-1]), "\x00")
+		if len(list) == 1 {
+			return list[0]
+		}
+		return list
+	}
+	if len(value)%4 == 0 {
+		var cells []string
+		for i := 0; i < len(value); i += 4 {
+			cells = append(cells, fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(value[i:])))
+		}
+		if len(cells) == 1 {
+			return cells[0]
+		}
+		return cells
+	}
+	return fmt.Sprintf("%x", value)
+}
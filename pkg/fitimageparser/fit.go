@@ -0,0 +1,231 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fitimageparser
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+ * Reader for U-Boot FIT images (flattened image tree) and legacy uImages.
+ * see: u-boot/doc/uImage.FIT/source_file_format.txt and u-boot/include/image.h
+ */
+
+// imageData is an image contained in the FIT image or uImage
+type imageData struct {
+	name string
+	// embedded data, nil if the data is stored outside of the device tree
+	data   []byte
+	offset int64
+	size   int64
+}
+
+type bootImage struct {
+	file   *os.File
+	images []imageData
+	// JSON encoded node properties
+	metadata []byte
+}
+
+func openBootImage(imagepath string) (*bootImage, error) {
+	file, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	img, err := readBootImage(file, st.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	img.file = file
+	return img, nil
+}
+
+func readBootImage(r io.ReaderAt, imageSize int64) (*bootImage, error) {
+	hdr := make([]byte, fdtHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("fitimage: can't read header: %s", err)
+	}
+	if binary.BigEndian.Uint32(hdr) == uImageMagic {
+		return readUImage(r, imageSize)
+	}
+	size, err := fdtTotalSize(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("fitimage: not a FIT image or uImage")
+	}
+	if int64(size) > imageSize {
+		return nil, fmt.Errorf("fitimage: device tree exceeds image size")
+	}
+	blob := make([]byte, size)
+	if _, err := r.ReadAt(blob, 0); err != nil {
+		return nil, err
+	}
+	return readFit(r, imageSize, blob)
+}
+
+func (img *bootImage) reader(d *imageData) io.Reader {
+	if d.data != nil {
+		return bytes.NewReader(d.data)
+	}
+	return io.NewSectionReader(img.file, d.offset, d.size)
+}
+
+func (img *bootImage) image(name string) *imageData {
+	for i := range img.images {
+		if img.images[i].name == name {
+			return &img.images[i]
+		}
+	}
+	return nil
+}
+
+// nodeMetadata converts the properties and subnodes of a node into a map, image data is skipped
+func nodeMetadata(n *fdtNode) map[string]interface{} {
+	meta := make(map[string]interface{})
+	for _, p := range n.props {
+		switch p.name {
+		case "data":
+			continue
+		case "value":
+			// hash and signature values
+			meta[p.name] = fmt.Sprintf("%x", p.value)
+		default:
+			meta[p.name] = propValue(p.value)
+		}
+	}
+	for _, c := range n.children {
+		meta[c.name] = nodeMetadata(c)
+	}
+	return meta
+}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "crc32":
+		return crc32.NewIEEE()
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+func readFit(r io.ReaderAt, imageSize int64, blob []byte) (*bootImage, error) {
+	root, err := parseFdt(blob)
+	if err != nil {
+		return nil, err
+	}
+	images := root.child("images")
+	if images == nil {
+		return nil, fmt.Errorf("fitimage: no /images node")
+	}
+	img := &bootImage{}
+	meta := nodeMetadata(root)
+	meta["format"] = "fit"
+
+	// external data is stored after the device tree (aligned to 4 bytes)
+	externalOffset := int64(len(blob)+3) &^ 3
+	for _, node := range images.children {
+		d := imageData{name: node.name}
+		if data, ok := node.prop("data"); ok {
+			d.data = data
+			d.size = int64(len(data))
+		} else if size, ok := node.propUint("data-size"); ok {
+			d.size = int64(size)
+			if pos, ok := node.propUint("data-position"); ok {
+				d.offset = int64(pos)
+			} else if off, ok := node.propUint("data-offset"); ok {
+				d.offset = externalOffset + int64(off)
+			} else {
+				return nil, fmt.Errorf("fitimage: image %s has no data", node.name)
+			}
+			if d.offset < 0 || d.size < 0 || d.offset+d.size > imageSize {
+				return nil, fmt.Errorf("fitimage: image %s exceeds image size", node.name)
+			}
+		} else {
+			return nil, fmt.Errorf("fitimage: image %s has no data", node.name)
+		}
+
+		imeta := meta["images"].(map[string]interface{})[node.name].(map[string]interface{})
+		imeta["data-size"] = d.size
+		// verify the hashes of the image data
+		for _, hn := range node.children {
+			if !strings.HasPrefix(hn.name, "hash") {
+				continue
+			}
+			h := newHash(hn.propString("algo"))
+			value, ok := hn.prop("value")
+			if h == nil || !ok {
+				continue
+			}
+			var src io.Reader = bytes.NewReader(d.data)
+			if d.data == nil {
+				src = io.NewSectionReader(r, d.offset, d.size)
+			}
+			if _, err := io.Copy(h, src); err != nil {
+				return nil, err
+			}
+			imeta[hn.name].(map[string]interface{})["verified"] = bytes.Equal(h.Sum(nil), value)
+		}
+		img.images = append(img.images, d)
+	}
+
+	// a configuration is signed if it has a signature node
+	signed := false
+	if configs := root.child("configurations"); configs != nil {
+		cmeta := meta["configurations"].(map[string]interface{})
+		signed = len(configs.children) > 0
+		for _, conf := range configs.children {
+			confSigned := false
+			for _, c := range conf.children {
+				if strings.HasPrefix(c.name, "signature") {
+					confSigned = true
+				}
+			}
+			cmeta[conf.name].(map[string]interface{})["signed"] = confSigned
+			signed = signed && confSigned
+		}
+	}
+	meta["signed"] = signed
+
+	img.metadata, err = json.MarshalIndent(meta, "", "  ")
+	return img, err
+}
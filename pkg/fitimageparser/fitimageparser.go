@@ -0,0 +1,157 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fitimageparser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+const (
+	// node properties of the image as JSON
+	metadataFile = "/metadata.json"
+	// image nodes are exposed as files in this directory
+	imagesDir = "/images"
+)
+
+type FitImageParser struct {
+	imagepath string
+	img       *bootImage
+	imgErr    error
+}
+
+func New(imagepath string) *FitImageParser {
+	parser := &FitImageParser{
+		imagepath: imagepath,
+	}
+
+	return parser
+}
+
+func (f *FitImageParser) ImageName() string {
+	return f.imagepath
+}
+
+// open the image on first use
+func (f *FitImageParser) open() (*bootImage, error) {
+	if f.img == nil && f.imgErr == nil {
+		f.img, f.imgErr = openBootImage(f.imagepath)
+	}
+	return f.img, f.imgErr
+}
+
+func fileInfo(name string, size int64) fsparser.FileInfo {
+	return fsparser.FileInfo{
+		Name:         name,
+		Size:         size,
+		Mode:         0100644,
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+	}
+}
+
+func dirInfo(name string) fsparser.FileInfo {
+	return fsparser.FileInfo{
+		Name:         name,
+		Mode:         040755,
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+	}
+}
+
+func (f *FitImageParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	img, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	switch path.Clean("/" + dirpath) {
+	case "/":
+		return []fsparser.FileInfo{
+			fileInfo(path.Base(metadataFile), int64(len(img.metadata))),
+			dirInfo(path.Base(imagesDir)),
+		}, nil
+	case imagesDir:
+		var dir []fsparser.FileInfo
+		for _, d := range img.images {
+			dir = append(dir, fileInfo(d.name, d.size))
+		}
+		return dir, nil
+	}
+	return nil, fmt.Errorf("fitimageparser: %s is not a directory", dirpath)
+}
+
+func (f *FitImageParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	img, err := f.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	filepath = path.Clean("/" + filepath)
+	switch filepath {
+	case "/":
+		return dirInfo("/"), nil
+	case imagesDir:
+		return dirInfo(path.Base(imagesDir)), nil
+	case metadataFile:
+		return fileInfo(path.Base(metadataFile), int64(len(img.metadata))), nil
+	}
+	if path.Dir(filepath) == imagesDir {
+		if d := img.image(path.Base(filepath)); d != nil {
+			return fileInfo(d.name, d.size), nil
+		}
+	}
+	return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
+}
+
+// Open returns a reader for the content of the file
+func (f *FitImageParser) Open(filepath string) (io.ReadCloser, error) {
+	img, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	cleanpath := path.Clean("/" + filepath)
+	if cleanpath == metadataFile {
+		return ioutil.NopCloser(bytes.NewReader(img.metadata)), nil
+	} else if d := img.image(path.Base(cleanpath)); d != nil && path.Dir(cleanpath) == imagesDir {
+		return ioutil.NopCloser(img.reader(d)), nil
+	}
+	return nil, fmt.Errorf("fitimageparser: can't find file %s", filepath)
+}
+
+func (f *FitImageParser) CopyFile(filepath string, dstdir string) bool {
+	r, err := f.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Supported returns true since no external tools are required
+func (f *FitImageParser) Supported() bool {
+	return true
+}
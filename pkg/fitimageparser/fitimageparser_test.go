@@ -0,0 +1,285 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fitimageparser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+type testNode struct {
+	name     string
+	props    []fdtProperty
+	children []testNode
+}
+
+func str(s ...string) []byte {
+	var b []byte
+	for _, v := range s {
+		b = append(append(b, v...), 0)
+	}
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// writeFdt returns the device tree blob for the node tree
+func writeFdt(root testNode) []byte {
+	var structBlock, stringsBlock bytes.Buffer
+	offsets := make(map[string]int)
+	pad := func() {
+		structBlock.Write(make([]byte, (4-structBlock.Len()%4)%4))
+	}
+	var write func(n testNode)
+	write = func(n testNode) {
+		structBlock.Write(u32(fdtBeginNode))
+		structBlock.WriteString(n.name + "\x00")
+		pad()
+		for _, p := range n.props {
+			if _, ok := offsets[p.name]; !ok {
+				offsets[p.name] = stringsBlock.Len()
+				stringsBlock.WriteString(p.name + "\x00")
+			}
+			structBlock.Write(u32(fdtProp))
+			structBlock.Write(u32(uint32(len(p.value))))
+			structBlock.Write(u32(uint32(offsets[p.name])))
+			structBlock.Write(p.value)
+			pad()
+		}
+		for _, c := range n.children {
+			write(c)
+		}
+		structBlock.Write(u32(fdtEndNode))
+	}
+	write(root)
+	structBlock.Write(u32(fdtEnd))
+
+	// header, empty memory reservation map, structure block, strings block
+	structOff := fdtHeaderSize + 16
+	stringsOff := structOff + structBlock.Len()
+	total := stringsOff + stringsBlock.Len()
+	var blob bytes.Buffer
+	for _, v := range []int{fdtMagic, total, structOff, stringsOff, fdtHeaderSize, 17, 16, 0, stringsBlock.Len(), structBlock.Len()} {
+		blob.Write(u32(uint32(v)))
+	}
+	blob.Write(make([]byte, 16))
+	blob.Write(structBlock.Bytes())
+	blob.Write(stringsBlock.Bytes())
+	return blob.Bytes()
+}
+
+func jsonField(t *testing.T, data []byte, field ...string) string {
+	value, err := util.XtractJsonField(data, field)
+	if err != nil {
+		t.Errorf("%v: %s", field, err)
+	}
+	return value
+}
+
+func readFile(t *testing.T, f *FitImageParser, dir string, filepath string) []byte {
+	dst := path.Join(dir, "out")
+	defer os.Remove(dst)
+	if !f.CopyFile(filepath, dst) {
+		t.Errorf("CopyFile %s failed", filepath)
+		return nil
+	}
+	data, _ := ioutil.ReadFile(dst)
+	return data
+}
+
+func TestFit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fitimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel := []byte("kernel data")
+	kernelHash := sha256.Sum256(kernel)
+	ramdisk := []byte("external ramdisk data")
+	fit := writeFdt(testNode{"", []fdtProperty{
+		{"description", str("test FIT")},
+		{"#address-cells", u32(1)},
+	}, []testNode{
+		{"images", nil, []testNode{
+			{"kernel-1", []fdtProperty{
+				{"data", kernel},
+				{"type", str("kernel")},
+				{"arch", str("arm64")},
+				{"compression", str("none")},
+				{"load", u32(0x80080000)},
+			}, []testNode{
+				{"hash-1", []fdtProperty{{"algo", str("sha256")}, {"value", kernelHash[:]}}, nil},
+			}},
+			{"fdt-1", []fdtProperty{
+				{"data", []byte("device tree")},
+				{"type", str("flat_dt")},
+			}, []testNode{
+				{"hash-1", []fdtProperty{{"algo", str("crc32")}, {"value", u32(0x12345678)}}, nil},
+			}},
+			{"ramdisk-1", []fdtProperty{
+				{"data-offset", u32(0)},
+				{"data-size", u32(uint32(len(ramdisk)))},
+				{"type", str("ramdisk")},
+			}, []testNode{
+				{"hash-1", []fdtProperty{{"algo", str("crc32")}, {"value", u32(crc32.ChecksumIEEE(ramdisk))}}, nil},
+			}},
+		}},
+		{"configurations", []fdtProperty{{"default", str("conf-1")}}, []testNode{
+			{"conf-1", []fdtProperty{{"kernel", str("kernel-1")}, {"fdt", str("fdt-1")}}, []testNode{
+				{"signature-1", []fdtProperty{
+					{"algo", str("sha256,rsa2048")},
+					{"key-name-hint", str("dev")},
+					{"sign-images", str("fdt", "kernel")},
+					{"value", []byte{1, 2, 3}},
+				}, nil},
+			}},
+			{"conf-2", []fdtProperty{{"kernel", str("kernel-1")}, {"ramdisk", str("ramdisk-1")}}, nil},
+		}},
+	}})
+	// external data starts after the device tree (aligned to 4 bytes)
+	fit = append(fit, make([]byte, (4-len(fit)%4)%4)...)
+	fit = append(fit, ramdisk...)
+	imagepath := path.Join(dir, "image.itb")
+	if err := ioutil.WriteFile(imagepath, fit, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(imagepath)
+	files, err := f.GetDirInfo("/images")
+	if err != nil || len(files) != 3 || files[0].Name != "kernel-1" || files[0].Size != int64(len(kernel)) {
+		t.Fatalf("bad /images: %v %v", files, err)
+	}
+	if fi, err := f.GetFileInfo("/images"); err != nil || !fi.IsDir() {
+		t.Errorf("bad /images: %v %v", fi, err)
+	}
+	if _, err := f.GetFileInfo("/images/missing"); err == nil {
+		t.Errorf("/images/missing should not exist")
+	}
+	if data := readFile(t, f, dir, "/images/kernel-1"); !bytes.Equal(data, kernel) {
+		t.Errorf("bad kernel: %q", data)
+	}
+	if data := readFile(t, f, dir, "/images/ramdisk-1"); !bytes.Equal(data, ramdisk) {
+		t.Errorf("bad ramdisk: %q", data)
+	}
+
+	meta := readFile(t, f, dir, "/metadata.json")
+	for _, test := range []struct {
+		field []string
+		value string
+	}{
+		{[]string{"format"}, "fit"},
+		{[]string{"description"}, "test FIT"},
+		{[]string{"images", "kernel-1", "load"}, "0x80080000"},
+		{[]string{"images", "kernel-1", "hash-1", "verified"}, "true"},
+		{[]string{"images", "kernel-1", "hash-1", "value"}, fmt.Sprintf("%x", kernelHash)},
+		{[]string{"images", "fdt-1", "hash-1", "value"}, "12345678"},
+		{[]string{"images", "fdt-1", "hash-1", "verified"}, "false"},
+		{[]string{"images", "ramdisk-1", "hash-1", "verified"}, "true"},
+		{[]string{"configurations", "default"}, "conf-1"},
+		{[]string{"configurations", "conf-1", "signature-1", "sign-images", "1"}, "kernel"},
+		{[]string{"configurations", "conf-1", "signature-1", "value"}, "010203"},
+		{[]string{"configurations", "conf-1", "signed"}, "true"},
+		{[]string{"configurations", "conf-2", "signed"}, "false"},
+		{[]string{"signed"}, "false"},
+	} {
+		if value := jsonField(t, meta, test.field...); value != test.value {
+			t.Errorf("%v: expected %q got %q", test.field, test.value, value)
+		}
+	}
+}
+
+func TestUImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fitimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uimage := func(imageType byte, data []byte) []byte {
+		hdr := make([]byte, uImageHeaderSize)
+		be := binary.BigEndian
+		be.PutUint32(hdr, uImageMagic)
+		be.PutUint32(hdr[8:], 0x5f000000)
+		be.PutUint32(hdr[12:], uint32(len(data)))
+		be.PutUint32(hdr[16:], 0x80008000)
+		be.PutUint32(hdr[20:], 0x80008040)
+		be.PutUint32(hdr[24:], crc32.ChecksumIEEE(data))
+		copy(hdr[28:], []byte{5, 2, imageType, 1})
+		copy(hdr[32:], "Linux-5.10")
+		be.PutUint32(hdr[4:], crc32.ChecksumIEEE(hdr))
+		return append(hdr, data...)
+	}
+
+	imagepath := path.Join(dir, "uImage")
+	ioutil.WriteFile(imagepath, uimage(2, []byte("gzip kernel")), 0644)
+	f := New(imagepath)
+	if data := readFile(t, f, dir, "/images/image"); string(data) != "gzip kernel" {
+		t.Errorf("bad image: %q", data)
+	}
+	meta := readFile(t, f, dir, "/metadata.json")
+	for _, test := range []struct {
+		field []string
+		value string
+	}{
+		{[]string{"format"}, "uimage"},
+		{[]string{"description"}, "Linux-5.10"},
+		{[]string{"os"}, "linux"},
+		{[]string{"arch"}, "arm"},
+		{[]string{"type"}, "kernel"},
+		{[]string{"compression"}, "gzip"},
+		{[]string{"load"}, "0x80008000"},
+		{[]string{"header-crc", "verified"}, "true"},
+		{[]string{"hash", "verified"}, "true"},
+		{[]string{"signed"}, "false"},
+	} {
+		if value := jsonField(t, meta, test.field...); value != test.value {
+			t.Errorf("%v: expected %q got %q", test.field, test.value, value)
+		}
+	}
+
+	// multi-file image: size list, then the images aligned to 4 bytes
+	multi := append(append(append(u32(5), u32(3)...), u32(0)...), []byte("first\x00\x00\x00abc")...)
+	imagepath = path.Join(dir, "multi")
+	ioutil.WriteFile(imagepath, uimage(uImageTypeMulti, multi), 0644)
+	f = New(imagepath)
+	if data := readFile(t, f, dir, "/images/image-0"); string(data) != "first" {
+		t.Errorf("bad image-0: %q", data)
+	}
+	if data := readFile(t, f, dir, "/images/image-1"); string(data) != "abc" {
+		t.Errorf("bad image-1: %q", data)
+	}
+
+	imagepath = path.Join(dir, "bad")
+	ioutil.WriteFile(imagepath, make([]byte, 128), 0644)
+	if _, err := New(imagepath).GetDirInfo("/"); err == nil {
+		t.Errorf("bad image should fail")
+	}
+}
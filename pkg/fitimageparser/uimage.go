@@ -0,0 +1,144 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fitimageparser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	uImageMagic      = 0x27051956
+	uImageHeaderSize = 64
+	uImageTypeMulti  = 4
+	maxMultiImages   = 256
+)
+
+// names as used by mkimage
+var (
+	uImageOS = map[uint8]string{
+		5: "linux", 14: "vxworks", 16: "qnx", 17: "u-boot", 18: "rtems",
+		25: "arm-trusted-firmware", 26: "tee", 27: "opensbi", 28: "efi",
+	}
+	uImageArch = map[uint8]string{
+		2: "arm", 3: "x86", 5: "mips", 6: "mips64", 7: "powerpc", 12: "m68k", 14: "microblaze",
+		15: "nios2", 21: "openrisc", 22: "arm64", 23: "arc", 24: "x86_64", 25: "xtensa", 26: "riscv",
+	}
+	uImageType = map[uint8]string{
+		1: "standalone", 2: "kernel", 3: "ramdisk", 4: "multi", 5: "firmware",
+		6: "script", 7: "filesystem", 8: "flat_dt",
+	}
+	uImageComp = map[uint8]string{
+		0: "none", 1: "gzip", 2: "bzip2", 3: "lzma", 4: "lzo", 5: "lz4", 6: "zstd",
+	}
+)
+
+func uImageName(names map[uint8]string, v uint8) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// readUImage reads a legacy uImage, multi-file images contain a list of image sizes before the data
+func readUImage(r io.ReaderAt, imageSize int64) (*bootImage, error) {
+	hdr := make([]byte, uImageHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("fitimage: can't read uImage header: %s", err)
+	}
+	be := binary.BigEndian
+	headerCrc := be.Uint32(hdr[4:])
+	size := int64(be.Uint32(hdr[12:]))
+	dataCrc := be.Uint32(hdr[24:])
+	if uImageHeaderSize+size > imageSize {
+		return nil, fmt.Errorf("fitimage: uImage data exceeds image size")
+	}
+	// the header crc is calculated with the crc field set to zero
+	crcHdr := append([]byte{}, hdr...)
+	copy(crcHdr[4:8], []byte{0, 0, 0, 0})
+
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, uImageHeaderSize); err != nil {
+		return nil, err
+	}
+
+	img := &bootImage{}
+	if hdr[30] == uImageTypeMulti {
+		var sizes []int64
+		off := 0
+		for {
+			if off+4 > len(data) || len(sizes) > maxMultiImages {
+				return nil, fmt.Errorf("fitimage: bad multi-file uImage")
+			}
+			s := int64(be.Uint32(data[off:]))
+			off += 4
+			if s == 0 {
+				break
+			}
+			sizes = append(sizes, s)
+		}
+		pos := int64(off)
+		for i, s := range sizes {
+			if pos+s > size {
+				return nil, fmt.Errorf("fitimage: bad multi-file uImage")
+			}
+			img.images = append(img.images, imageData{name: fmt.Sprintf("image-%d", i), data: data[pos : pos+s], size: s})
+			pos = (pos + s + 3) &^ 3
+		}
+	} else {
+		img.images = append(img.images, imageData{name: "image", data: data, size: size})
+	}
+
+	meta := map[string]interface{}{
+		"format":      "uimage",
+		"description": cString(hdr[32:64]),
+		"timestamp":   fmt.Sprintf("0x%08x", be.Uint32(hdr[8:])),
+		"load":        fmt.Sprintf("0x%08x", be.Uint32(hdr[16:])),
+		"entry":       fmt.Sprintf("0x%08x", be.Uint32(hdr[20:])),
+		"os":          uImageName(uImageOS, hdr[28]),
+		"arch":        uImageName(uImageArch, hdr[29]),
+		"type":        uImageName(uImageType, hdr[30]),
+		"compression": uImageName(uImageComp, hdr[31]),
+		"data-size":   size,
+		"header-crc": map[string]interface{}{
+			"value":    fmt.Sprintf("%08x", headerCrc),
+			"verified": crc32.ChecksumIEEE(crcHdr) == headerCrc,
+		},
+		"hash": map[string]interface{}{
+			"algo":     "crc32",
+			"value":    fmt.Sprintf("%08x", dataCrc),
+			"verified": crc32.ChecksumIEEE(data) == dataCrc,
+		},
+		// legacy images can't be signed
+		"signed": false,
+	}
+	var err error
+	img.metadata, err = json.MarshalIndent(meta, "", "  ")
+	return img, err
+}
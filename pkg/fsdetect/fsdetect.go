@@ -0,0 +1,136 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fsdetect identifies the filesystem or image type based on magic numbers.
+package fsdetect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// number of bytes read from the start of the image, covers all magics below
+const headerSize = 4096
+
+type magic struct {
+	fsType string
+	offset int
+	value  []byte
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// the magics are checked in order of their strength, long magics at offset 0
+// go first, magics at higher offsets could be part of the data of other formats
+var magics = []magic{
+	{"bootimg", 0, []byte("ANDROID!")},
+	{"bootimg", 0, []byte("VNDRBOOT")},
+	{"cpiofs", 0, []byte("070701")},
+	{"cpiofs", 0, []byte("070702")},
+	{"cpiofs", 0, []byte("070707")},
+	{"squashfs", 0, []byte("hsqs")},
+	{"ubifs", 0, []byte("UBI#")},
+	{"ubifs", 0, le32(0x06101831)},
+	{"zipfs", 0, []byte("PK\x03\x04")},
+	{"zipfs", 0, []byte("PK\x05\x06")},
+	{"payload", 0, []byte("CrAU")},
+	{"fitimage", 0, be32(0xd00dfeed)},
+	{"fitimage", 0, be32(0x27051956)},
+	{"tarfs", 257, []byte("ustar")},
+	{"erofs", 1024, le32(0xe0f5e1e2)},
+	{"extfs", 0x438, le16(0xef53)},
+}
+
+// weakMagics are only 2 bytes long and are checked after everything else
+// including FAT, JFFS2 goes last since 0x1985 easily shows up in other data
+var weakMagics = []magic{
+	{"cpiofs", 0, le16(070707)},
+	{"jffs2fs", 0, le16(0x1985)},
+	{"jffs2fs", 0, []byte{0x19, 0x85}},
+}
+
+func (m magic) match(hdr []byte) bool {
+	return len(hdr) >= m.offset+len(m.value) && bytes.Equal(hdr[m.offset:m.offset+len(m.value)], m.value)
+}
+
+// isFat checks the boot sector of a FAT12/16/32 filesystem
+func isFat(hdr []byte) bool {
+	if len(hdr) < 512 || hdr[510] != 0x55 || hdr[511] != 0xaa {
+		return false
+	}
+	// jump instruction
+	if hdr[0] != 0xeb && hdr[0] != 0xe9 {
+		return false
+	}
+	return bytes.HasPrefix(hdr[54:], []byte("FAT")) || bytes.HasPrefix(hdr[82:], []byte("FAT32"))
+}
+
+// DetectReader returns the FsType for the data in r or an empty string if the type is unknown
+func DetectReader(r io.ReaderAt) string {
+	hdr := make([]byte, headerSize)
+	n, err := r.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return ""
+	}
+	hdr = hdr[:n]
+
+	for _, m := range magics {
+		if m.match(hdr) {
+			return m.fsType
+		}
+	}
+	if isFat(hdr) {
+		return "vfatfs"
+	}
+	for _, m := range weakMagics {
+		if m.match(hdr) {
+			return m.fsType
+		}
+	}
+	return ""
+}
+
+// Detect returns the FsType of the image file or an empty string if the type is unknown,
+// directories are detected as dirfs
+func Detect(imagepath string) string {
+	if st, err := os.Stat(imagepath); err == nil && st.IsDir() {
+		return "dirfs"
+	}
+	f, err := os.Open(imagepath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return DetectReader(f)
+}
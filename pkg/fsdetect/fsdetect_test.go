@@ -0,0 +1,59 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsdetect
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		image  string
+		fsType string
+	}{
+		{"../../test/test.img", "extfs"},
+		{"../../test/squashfs.img", "squashfs"},
+		{"../../test/vfat.img", "vfatfs"},
+		{"../../test/fat32.img", "vfatfs"},
+		{"../../test/ubifs.img", "ubifs"},
+		{"../../test/erofs.img", "erofs"},
+		{"../../test/test.cpio", "cpiofs"},
+		{"../../test/payload.bin", "payload"},
+		{"../../test/testdir", "dirfs"},
+		{"../../test/test_cfg.toml", ""},
+		{"../../test/does_not_exist", ""},
+	}
+	for _, test := range tests {
+		if fsType := Detect(test.image); fsType != test.fsType {
+			t.Errorf("%s: expected %q, got %q", test.image, test.fsType, fsType)
+		}
+	}
+}
+
+func TestDetectWeakMagic(t *testing.T) {
+	// an ext image that starts with the JFFS2 magic
+	hdr := make([]byte, headerSize)
+	copy(hdr, le16(0x1985))
+	if fsType := DetectReader(bytes.NewReader(hdr)); fsType != "jffs2fs" {
+		t.Errorf("expected jffs2fs, got %q", fsType)
+	}
+	copy(hdr[0x438:], le16(0xef53))
+	if fsType := DetectReader(bytes.NewReader(hdr)); fsType != "extfs" {
+		t.Errorf("expected extfs, got %q", fsType)
+	}
+}
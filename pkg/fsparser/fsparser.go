@@ -16,6 +16,16 @@ limitations under the License.
 
 package fsparser
 
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"path"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
 type FsParser interface {
 	// get directory listing. only returns files in the given directory and
 	// does not recurse into subdirectories.
@@ -30,6 +40,22 @@ type FsParser interface {
 	Supported() bool
 }
 
+// FileOpener is implemented by parsers that can read the content of a file
+// without copying it (optional, CopyFile is used otherwise)
+type FileOpener interface {
+	// open a regular file for reading, the caller has to close the reader
+	Open(filepath string) (io.ReadCloser, error)
+}
+
+// BulkExtractor is implemented by parsers that can extract many files at once
+// more efficiently than calling CopyFile for every file (optional)
+type BulkExtractor interface {
+	// extract the regular files into dstDir (using their path in the image),
+	// returns the extracted files by their path in the image. Files that can't
+	// be extracted are not included in the result.
+	ExtractFiles(filepaths []string, dstDir string) (map[string]string, error)
+}
+
 type FileInfo struct {
 	Size         int64    `json:"size"`
 	Mode         uint64   `json:"mode"`
@@ -39,12 +65,36 @@ type FileInfo struct {
 	Capabilities []string `json:"capabilities,omitempty"`
 	Name         string   `json:"name"`
 	LinkTarget   string   `json:"link_target,omitempty"`
+	// DOS attributes (FAT filesystems only)
+	DosAttributes uint8 `json:"dos_attributes,omitempty"`
+	// modification time in seconds since the epoch
+	Mtime int64 `json:"mtime,omitempty"`
+	// inode number and link count (0 if the filesystem does not have them)
+	Ino   uint64 `json:"ino,omitempty"`
+	Nlink uint32 `json:"nlink,omitempty"`
+	// image the inode belongs to if multiple images are analyzed together
+	// (nested and composite images), empty for the analyzed image itself
+	Image string `json:"-"`
+	// device number of character and block devices (see Mkdev)
+	Rdev uint64 `json:"rdev,omitempty"`
+	// extended attributes by name (e.g. security.ima, user.comment)
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
 }
 
 const (
 	SELinuxNoLabel string = "-"
 )
 
+// DOS file attributes
+const (
+	DosAttrReadOnly  = 0x01
+	DosAttrHidden    = 0x02
+	DosAttrSystem    = 0x04
+	DosAttrVolumeID  = 0x08
+	DosAttrDirectory = 0x10
+	DosAttrArchive   = 0x20
+)
+
 const (
 	S_IFMT   = 0170000 // bit mask for the file type bit fields
 	S_IFSOCK = 0140000 // socket
@@ -94,3 +144,84 @@ func (fi *FileInfo) IsDir() bool {
 func (fi *FileInfo) IsLink() bool {
 	return (fi.Mode & S_IFMT) == S_IFLNK
 }
+
+func (fi *FileInfo) IsDevice() bool {
+	return fi.Mode&S_IFMT == S_IFCHR || fi.Mode&S_IFMT == S_IFBLK
+}
+
+// IsHardlink returns true if the file has more than one name, directories are
+// never reported as hardlinks (their link count includes the subdirectories)
+func (fi *FileInfo) IsHardlink() bool {
+	return fi.Ino != 0 && fi.Nlink > 1 && !fi.IsDir()
+}
+
+// HardlinkKey identifies the inode of a file, hardlinks have the same key.
+// Inode numbers are only unique within an image, the key contains the image.
+type HardlinkKey struct {
+	Image string
+	Ino   uint64
+}
+
+// HardlinkKey returns the key of the inode of the file
+func (fi *FileInfo) HardlinkKey() HardlinkKey {
+	return HardlinkKey{Image: fi.Image, Ino: fi.Ino}
+}
+
+// DevMajor returns the major device number of a device
+func (fi *FileInfo) DevMajor() uint32 {
+	return uint32((fi.Rdev>>8)&0xfff) | uint32((fi.Rdev>>32)&^0xfff)
+}
+
+// DevMinor returns the minor device number of a device
+func (fi *FileInfo) DevMinor() uint32 {
+	return uint32(fi.Rdev&0xff) | uint32((fi.Rdev>>12)&^0xff)
+}
+
+// Mkdev returns the device number for major and minor (same encoding as glibc)
+func Mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
+
+// DecodeDev returns the device number for the 32 bit encoding used by
+// the Linux kernel to store device numbers in inodes (new_encode_dev)
+func DecodeDev(dev uint32) uint64 {
+	return Mkdev((dev&0xfff00)>>8, (dev&0xff)|((dev>>12)&0xfff00))
+}
+
+func (fi *FileInfo) IsDosHidden() bool {
+	return (fi.DosAttributes & DosAttrHidden) != 0
+}
+
+func (fi *FileInfo) IsDosSystem() bool {
+	return (fi.DosAttributes & DosAttrSystem) != 0
+}
+
+func (fi *FileInfo) IsDosReadOnly() bool {
+	return (fi.DosAttributes & DosAttrReadOnly) != 0
+}
+
+// XattrNames returns the sorted names of the extended attributes that match
+// the pattern (see path.Match, e.g. "security.*")
+func (fi *FileInfo) XattrNames(pattern string) []string {
+	var names []string
+	for name := range fi.Xattrs {
+		if m, _ := path.Match(pattern, name); m {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// XattrString returns the value of an extended attribute as a string,
+// trailing NUL bytes are removed and binary values are hex encoded
+func XattrString(value []byte) string {
+	value = bytes.TrimRight(value, "\x00")
+	for _, r := range string(value) {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return hex.EncodeToString(value)
+		}
+	}
+	return string(value)
+}
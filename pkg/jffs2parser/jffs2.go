@@ -0,0 +1,432 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jffs2parser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
+)
+
+/*
+ * Minimal read-only implementation of JFFS2. The whole image is scanned for
+ * nodes, for every inode the node with the highest version wins.
+ * see: linux/include/uapi/linux/jffs2.h
+ */
+
+const (
+	jffs2Magic        = 0x1985
+	jffs2HeaderSize   = 12
+	jffs2RootInode    = 1
+	jffs2NodeAccurate = 0x2000
+
+	jffs2NodeDirent = 0xE001
+	jffs2NodeInode  = 0xE002
+	jffs2NodeXattr  = 0xE008
+	jffs2NodeXref   = 0xE009
+
+	jffs2DirentSize = 40
+	jffs2InodeSize  = 68
+	jffs2XattrSize  = 32
+	jffs2XrefSize   = 28
+
+	// xattr datum/reference deletion markers
+	jffs2XattrDeleted = 0xFFFFFFFF
+	jffs2XrefDeleted  = 0x1
+)
+
+// compression types
+const (
+	jffs2ComprNone  = 0x00
+	jffs2ComprZero  = 0x01
+	jffs2ComprRtime = 0x02
+	jffs2ComprZlib  = 0x06
+	jffs2ComprLzo   = 0x07
+)
+
+// xattr name prefixes
+var jffs2XattrPrefix = map[uint8]string{
+	1: "user.",
+	2: "security.",
+	3: "system.posix_acl_access",
+	4: "system.posix_acl_default",
+	5: "trusted.",
+}
+
+// jffs2CRC is the crc32 used by JFFS2 (initial value 0, no final xor)
+func jffs2CRC(data []byte) uint32 {
+	return ^crc32.Update(0xFFFFFFFF, crc32.IEEETable, data)
+}
+
+type jffs2Inode struct {
+	ino     uint32
+	version uint32
+	mode    uint32
+	uid     uint16
+	gid     uint16
+	size    uint32
+	mtime   uint32
+	// data nodes of the inode
+	frags []jffs2Frag
+}
+
+type jffs2Frag struct {
+	version uint32
+	offset  uint32
+	dsize   uint32
+	compr   uint8
+	// compressed data (points into the image)
+	data []byte
+}
+
+type jffs2Dirent struct {
+	name    string
+	ino     uint32
+	version uint32
+	dtype   uint8
+}
+
+type jffs2Xattr struct {
+	version uint32
+	name    string
+	value   []byte
+}
+
+type jffs2Xref struct {
+	xid   uint32
+	seqno uint32
+}
+
+type jffs2FS struct {
+	img    []byte
+	order  binary.ByteOrder
+	inodes map[uint32]*jffs2Inode
+	// parent inode -> name -> entry
+	dirents map[uint32]map[string]*jffs2Dirent
+	xattrs  map[uint32]*jffs2Xattr
+	// inode -> xid -> reference
+	xrefs map[uint32]map[uint32]jffs2Xref
+}
+
+func openJffs2FS(imagepath string) (*jffs2FS, error) {
+	img, err := ioutil.ReadFile(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	fs := &jffs2FS{
+		img:     img,
+		inodes:  make(map[uint32]*jffs2Inode),
+		dirents: make(map[uint32]map[string]*jffs2Dirent),
+		xattrs:  make(map[uint32]*jffs2Xattr),
+		xrefs:   make(map[uint32]map[uint32]jffs2Xref),
+	}
+	if err := fs.scan(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// detectOrder returns the byte order of the first valid node header
+func detectOrder(img []byte) (binary.ByteOrder, error) {
+	for offs := 0; offs+jffs2HeaderSize <= len(img); offs += 4 {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if order.Uint16(img[offs:]) == jffs2Magic && jffs2CRC(img[offs:offs+8]) == order.Uint32(img[offs+8:]) {
+				return order, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("jffs2: no valid nodes found")
+}
+
+// scan walks the image and collects all valid nodes, nodes are 4 byte aligned
+func (fs *jffs2FS) scan() error {
+	var err error
+	fs.order, err = detectOrder(fs.img)
+	if err != nil {
+		return err
+	}
+	img := fs.img
+	for offs := 0; offs+jffs2HeaderSize <= len(img); {
+		hdr := img[offs:]
+		totlen := int(fs.order.Uint32(hdr[4:]))
+		if fs.order.Uint16(hdr) != jffs2Magic || jffs2CRC(hdr[:8]) != fs.order.Uint32(hdr[8:]) ||
+			totlen < jffs2HeaderSize || offs+totlen > len(img) {
+			offs += 4
+			continue
+		}
+		fs.addNode(img[offs : offs+totlen])
+		offs += (totlen + 3) &^ 3
+	}
+	if len(fs.dirents) == 0 && len(fs.inodes) == 0 {
+		return fmt.Errorf("jffs2: filesystem is empty")
+	}
+	return nil
+}
+
+// addNode records the node, nodes with a bad crc and obsolete nodes are ignored
+func (fs *jffs2FS) addNode(node []byte) {
+	o := fs.order
+	switch o.Uint16(node[2:]) {
+	case jffs2NodeInode:
+		if len(node) < jffs2InodeSize || jffs2CRC(node[:jffs2InodeSize-8]) != o.Uint32(node[64:]) {
+			return
+		}
+		csize := int(o.Uint32(node[48:]))
+		if jffs2InodeSize+csize > len(node) || jffs2CRC(node[jffs2InodeSize:jffs2InodeSize+csize]) != o.Uint32(node[60:]) {
+			return
+		}
+		ino := o.Uint32(node[12:])
+		version := o.Uint32(node[16:])
+		in, ok := fs.inodes[ino]
+		if !ok {
+			in = &jffs2Inode{ino: ino}
+			fs.inodes[ino] = in
+		}
+		if version >= in.version {
+			in.version = version
+			in.mode = o.Uint32(node[20:])
+			in.uid = o.Uint16(node[24:])
+			in.gid = o.Uint16(node[26:])
+			in.size = o.Uint32(node[28:])
+			in.mtime = o.Uint32(node[36:])
+		}
+		in.frags = append(in.frags, jffs2Frag{
+			version: version,
+			offset:  o.Uint32(node[44:]),
+			dsize:   o.Uint32(node[52:]),
+			compr:   node[56],
+			data:    node[jffs2InodeSize : jffs2InodeSize+csize],
+		})
+	case jffs2NodeDirent:
+		if len(node) < jffs2DirentSize || jffs2CRC(node[:jffs2DirentSize-8]) != o.Uint32(node[32:]) {
+			return
+		}
+		nsize := int(node[28])
+		if jffs2DirentSize+nsize > len(node) || jffs2CRC(node[jffs2DirentSize:jffs2DirentSize+nsize]) != o.Uint32(node[36:]) {
+			return
+		}
+		pino := o.Uint32(node[12:])
+		d := &jffs2Dirent{
+			name:    string(node[jffs2DirentSize : jffs2DirentSize+nsize]),
+			version: o.Uint32(node[16:]),
+			ino:     o.Uint32(node[20:]),
+			dtype:   node[29],
+		}
+		if fs.dirents[pino] == nil {
+			fs.dirents[pino] = make(map[string]*jffs2Dirent)
+		}
+		// a dirent pointing to inode 0 is a deletion (unlink), it is kept
+		// until all nodes are scanned since it can have the highest version
+		if old, ok := fs.dirents[pino][d.name]; !ok || old.version < d.version {
+			fs.dirents[pino][d.name] = d
+		}
+	case jffs2NodeXattr:
+		if len(node) < jffs2XattrSize || jffs2CRC(node[:jffs2XattrSize-4]) != o.Uint32(node[28:]) {
+			return
+		}
+		nameLen := int(node[21])
+		valueLen := int(o.Uint16(node[22:]))
+		dataLen := nameLen + 1 + valueLen
+		if jffs2XattrSize+dataLen > len(node) || jffs2CRC(node[jffs2XattrSize:jffs2XattrSize+dataLen]) != o.Uint32(node[24:]) {
+			return
+		}
+		xid := o.Uint32(node[12:])
+		version := o.Uint32(node[16:])
+		if old, ok := fs.xattrs[xid]; ok && old.version >= version {
+			return
+		}
+		data := node[jffs2XattrSize:]
+		fs.xattrs[xid] = &jffs2Xattr{
+			version: version,
+			name:    jffs2XattrPrefix[node[20]] + string(data[:nameLen]),
+			value:   data[nameLen+1 : nameLen+1+valueLen],
+		}
+	case jffs2NodeXref:
+		if len(node) < jffs2XrefSize || jffs2CRC(node[:jffs2XrefSize-4]) != o.Uint32(node[24:]) {
+			return
+		}
+		ino := o.Uint32(node[12:])
+		ref := jffs2Xref{xid: o.Uint32(node[16:]), seqno: o.Uint32(node[20:])}
+		if fs.xrefs[ino] == nil {
+			fs.xrefs[ino] = make(map[uint32]jffs2Xref)
+		}
+		if old, ok := fs.xrefs[ino][ref.xid]; !ok || old.seqno < ref.seqno {
+			fs.xrefs[ino][ref.xid] = ref
+		}
+	}
+}
+
+func (in *jffs2Inode) isDir() bool {
+	return in.mode&0170000 == 0040000
+}
+
+func (in *jffs2Inode) isReg() bool {
+	return in.mode&0170000 == 0100000
+}
+
+func (in *jffs2Inode) isLink() bool {
+	return in.mode&0170000 == 0120000
+}
+
+// nlink returns the link count of the inode, JFFS2 does not store it so it is
+// computed from the directory entries like the kernel does
+func (fs *jffs2FS) nlink(in *jffs2Inode) uint32 {
+	var nlink uint32
+	if in.isDir() {
+		nlink = 2
+		for _, d := range fs.dirents[in.ino] {
+			if child, ok := fs.inodes[d.ino]; ok && child.isDir() {
+				nlink++
+			}
+		}
+		return nlink
+	}
+	for _, dir := range fs.dirents {
+		for _, d := range dir {
+			if d.ino == in.ino {
+				nlink++
+			}
+		}
+	}
+	return nlink
+}
+
+// rdev returns the encoded device number of a device inode (old 16 bit or new 32 bit encoding)
+func (fs *jffs2FS) rdev(in *jffs2Inode) (uint32, error) {
+	data, err := fs.readData(in)
+	if err != nil {
+		return 0, err
+	}
+	switch len(data) {
+	case 2:
+		return uint32(fs.order.Uint16(data)), nil
+	case 4:
+		return fs.order.Uint32(data), nil
+	}
+	return 0, fmt.Errorf("jffs2: inode %d: bad device node", in.ino)
+}
+
+// inode returns the inode, the root directory has no inode node
+func (fs *jffs2FS) inode(ino uint32) (*jffs2Inode, error) {
+	in, ok := fs.inodes[ino]
+	if !ok {
+		if ino == jffs2RootInode {
+			return &jffs2Inode{ino: ino, mode: 040755}, nil
+		}
+		return nil, fmt.Errorf("jffs2: inode %d not found", ino)
+	}
+	return in, nil
+}
+
+// readDir returns the entries of the directory sorted by name
+func (fs *jffs2FS) readDir(in *jffs2Inode) ([]*jffs2Dirent, error) {
+	if !in.isDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+	var entries []*jffs2Dirent
+	for _, d := range fs.dirents[in.ino] {
+		// skip deleted entries
+		if d.ino == 0 {
+			continue
+		}
+		if _, ok := fs.inodes[d.ino]; ok {
+			entries = append(entries, d)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// lookup resolves the path to an inode, symlinks are not followed
+func (fs *jffs2FS) lookup(path string) (*jffs2Inode, error) {
+	in, err := fs.inode(jffs2RootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !in.isDir() {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+		d, ok := fs.dirents[in.ino][name]
+		if !ok || d.ino == 0 {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+		if in, err = fs.inode(d.ino); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// xattrList returns the extended attributes of the inode
+func (fs *jffs2FS) xattrList(in *jffs2Inode) map[string][]byte {
+	out := make(map[string][]byte)
+	for xid, ref := range fs.xrefs[in.ino] {
+		if ref.seqno&jffs2XrefDeleted != 0 {
+			continue
+		}
+		if x, ok := fs.xattrs[xid]; ok && x.version != jffs2XattrDeleted {
+			out[x.name] = x.value
+		}
+	}
+	return out
+}
+
+// readData assembles the content of the inode from its data nodes, nodes with a
+// higher version overwrite older data
+func (fs *jffs2FS) readData(in *jffs2Inode) ([]byte, error) {
+	frags := append([]jffs2Frag{}, in.frags...)
+	sort.SliceStable(frags, func(i, j int) bool { return frags[i].version < frags[j].version })
+	out := make([]byte, in.size)
+	for _, f := range frags {
+		if f.dsize == 0 || f.offset >= in.size {
+			continue
+		}
+		var data []byte
+		var err error
+		switch f.compr {
+		case jffs2ComprNone:
+			data = f.data
+		case jffs2ComprZero:
+			data = make([]byte, f.dsize)
+		case jffs2ComprRtime:
+			data, err = decompress.Rtime(f.data, int(f.dsize))
+		case jffs2ComprZlib:
+			data, err = decompress.Zlib(f.data, int(f.dsize))
+		case jffs2ComprLzo:
+			data, err = decompress.Lzo1x(f.data, int(f.dsize))
+		default:
+			return nil, fmt.Errorf("jffs2: unsupported compression %d", f.compr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > int(f.dsize) {
+			data = data[:f.dsize]
+		}
+		copy(out[f.offset:], data)
+	}
+	return out, nil
+}
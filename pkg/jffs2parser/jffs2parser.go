@@ -0,0 +1,182 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jffs2parser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/capability"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+type Jffs2Parser struct {
+	imagepath    string
+	securityInfo bool
+	fs           *jffs2FS
+	fsErr        error
+}
+
+func New(imagepath string, securityInfo bool) *Jffs2Parser {
+	parser := &Jffs2Parser{
+		imagepath:    imagepath,
+		securityInfo: securityInfo,
+	}
+
+	return parser
+}
+
+func (e *Jffs2Parser) ImageName() string {
+	return e.imagepath
+}
+
+// open the image on first use, the image is only scanned once
+func (e *Jffs2Parser) open() (*jffs2FS, error) {
+	if e.fs == nil && e.fsErr == nil {
+		e.fs, e.fsErr = openJffs2FS(e.imagepath)
+	}
+	return e.fs, e.fsErr
+}
+
+func (e *Jffs2Parser) fileInfo(fs *jffs2FS, in *jffs2Inode, name string) (fsparser.FileInfo, error) {
+	fi := fsparser.FileInfo{
+		Name:         name,
+		Size:         int64(in.size),
+		Mode:         uint64(in.mode),
+		Uid:          int(in.uid),
+		Gid:          int(in.gid),
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+		Mtime:        int64(in.mtime),
+		Ino:          uint64(in.ino),
+		Nlink:        fs.nlink(in),
+	}
+	// the link target is stored as inode data
+	if in.isLink() {
+		target, err := fs.readData(in)
+		if err != nil {
+			return fi, err
+		}
+		fi.LinkTarget = string(target)
+	}
+	// the device number is stored as inode data
+	if fi.IsDevice() {
+		rdev, err := fs.rdev(in)
+		if err != nil {
+			return fi, err
+		}
+		fi.Rdev = fsparser.DecodeDev(rdev)
+	}
+	xattrs := fs.xattrList(in)
+	if len(xattrs) > 0 {
+		fi.Xattrs = xattrs
+	}
+	if e.securityInfo {
+		if label, ok := xattrs["security.selinux"]; ok {
+			fi.SELinuxLabel = strings.TrimRight(string(label), "\x00")
+		}
+		if caps, ok := xattrs["security.capability"]; ok {
+			fi.Capabilities, _ = capability.New(caps)
+		}
+	}
+	return fi, nil
+}
+
+func (e *Jffs2Parser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.readDir(in)
+	if err != nil {
+		return nil, err
+	}
+	var dir []fsparser.FileInfo
+	for _, entry := range entries {
+		ein, err := fs.inode(entry.ino)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := e.fileInfo(fs, ein, entry.name)
+		if err != nil {
+			return nil, err
+		}
+		dir = append(dir, fi)
+	}
+	return dir, nil
+}
+
+func (e *Jffs2Parser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
+	fs, err := e.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	return e.fileInfo(fs, in, path.Base(dirpath))
+}
+
+// Open returns a reader for the content of the file
+func (e *Jffs2Parser) Open(filepath string) (io.ReadCloser, error) {
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	in, err := fs.lookup(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if !in.isReg() {
+		return nil, fmt.Errorf("jffs2parser: %s is not a regular file", filepath)
+	}
+	data, err := fs.readData(in)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (e *Jffs2Parser) CopyFile(filepath string, dstdir string) bool {
+	r, err := e.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Supported returns true since no external tools are required
+func (e *Jffs2Parser) Supported() bool {
+	return true
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jffs2parser
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type imageWriter struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+// header fills in the common node header, the node crc covers the header
+func (w *imageWriter) header(n []byte, ntype uint16, totlen int) {
+	w.order.PutUint16(n[0:], jffs2Magic)
+	w.order.PutUint16(n[2:], ntype)
+	w.order.PutUint32(n[4:], uint32(totlen))
+	w.order.PutUint32(n[8:], jffs2CRC(n[:8]))
+}
+
+func (w *imageWriter) node(n []byte, data []byte) {
+	w.buf.Write(n)
+	w.buf.Write(data)
+	for w.buf.Len()%4 != 0 {
+		w.buf.WriteByte(0xFF)
+	}
+}
+
+func (w *imageWriter) inode(ino, version, mode uint32, uid uint16, isize, offset uint32, compr uint8, dsize int, data []byte) {
+	n := make([]byte, jffs2InodeSize)
+	w.header(n, jffs2NodeInode, jffs2InodeSize+len(data))
+	w.order.PutUint32(n[12:], ino)
+	w.order.PutUint32(n[16:], version)
+	w.order.PutUint32(n[20:], mode)
+	w.order.PutUint16(n[24:], uid)
+	w.order.PutUint32(n[28:], isize)
+	w.order.PutUint32(n[44:], offset)
+	w.order.PutUint32(n[48:], uint32(len(data)))
+	w.order.PutUint32(n[52:], uint32(dsize))
+	n[56] = compr
+	w.order.PutUint32(n[60:], jffs2CRC(data))
+	w.order.PutUint32(n[64:], jffs2CRC(n[:60]))
+	w.node(n, data)
+}
+
+func (w *imageWriter) dirent(pino, version, ino uint32, name string) {
+	n := make([]byte, jffs2DirentSize)
+	w.header(n, jffs2NodeDirent, jffs2DirentSize+len(name))
+	w.order.PutUint32(n[12:], pino)
+	w.order.PutUint32(n[16:], version)
+	w.order.PutUint32(n[20:], ino)
+	n[28] = uint8(len(name))
+	w.order.PutUint32(n[32:], jffs2CRC(n[:32]))
+	w.order.PutUint32(n[36:], jffs2CRC([]byte(name)))
+	w.node(n, []byte(name))
+}
+
+func (w *imageWriter) xattr(xid uint32, prefix uint8, name string, value string) {
+	data := append(append([]byte(name), 0), value...)
+	n := make([]byte, jffs2XattrSize)
+	w.header(n, jffs2NodeXattr, jffs2XattrSize+len(data))
+	w.order.PutUint32(n[12:], xid)
+	w.order.PutUint32(n[16:], 1)
+	n[20] = prefix
+	n[21] = uint8(len(name))
+	w.order.PutUint16(n[22:], uint16(len(value)))
+	w.order.PutUint32(n[24:], jffs2CRC(data))
+	w.order.PutUint32(n[28:], jffs2CRC(n[:28]))
+	w.node(n, data)
+}
+
+func (w *imageWriter) xref(ino uint32, xid uint32, seqno uint32) {
+	n := make([]byte, jffs2XrefSize)
+	w.header(n, jffs2NodeXref, jffs2XrefSize)
+	w.order.PutUint32(n[12:], ino)
+	w.order.PutUint32(n[16:], xid)
+	w.order.PutUint32(n[20:], seqno)
+	w.order.PutUint32(n[24:], jffs2CRC(n[:24]))
+	w.node(n, nil)
+}
+
+func writeImage(t *testing.T, order binary.ByteOrder) string {
+	w := &imageWriter{order: order}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("jffs2"))
+	zw.Close()
+
+	w.dirent(1, 1, 2, "bin")
+	w.inode(2, 1, 040755, 0, 0, 0, jffs2ComprNone, 0, nil)
+	w.dirent(2, 2, 3, "busybox")
+	w.inode(3, 1, 0100755, 0, 11, 0, jffs2ComprNone, 11, []byte("hello world"))
+	// erased flash between nodes
+	w.buf.Write(bytes.Repeat([]byte{0xFF}, 64))
+	// newer data overwrites part of the file
+	w.inode(3, 2, 0100755, 0, 11, 6, jffs2ComprZlib, 5, z.Bytes())
+	// metadata only update
+	w.inode(3, 3, 0104755, 1000, 11, 0, jffs2ComprNone, 0, nil)
+	w.dirent(2, 3, 4, "sh")
+	w.inode(4, 1, 0120777, 0, 7, 0, jffs2ComprNone, 7, []byte("busybox"))
+	w.dirent(1, 4, 5, "motd")
+	w.inode(5, 1, 0100644, 0, 9, 0, jffs2ComprRtime, 9, []byte{'a', 0, 'b', 4, 'b', 1, 'x', 0})
+	// deleted file
+	w.dirent(1, 5, 6, "old")
+	w.inode(6, 1, 0100644, 0, 0, 0, jffs2ComprNone, 0, nil)
+	w.dirent(1, 6, 0, "old")
+	w.xattr(1, 2, "selinux", "u:object_r:system_file:s0\x00")
+	w.xref(3, 1, 2)
+	// a corrupted node is skipped
+	w.inode(5, 2, 0100777, 0, 9, 0, jffs2ComprNone, 9, []byte("corrupted"))
+	img := w.buf.Bytes()
+	img[bytes.LastIndex(img, []byte("corrupted"))] ^= 0xFF
+
+	f, err := ioutil.TempFile("", "jffs2parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(img)
+	return f.Name()
+}
+
+func TestJffs2(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		image := writeImage(t, order)
+		defer os.Remove(image)
+		p := New(image, true)
+
+		fi, err := p.GetFileInfo("/")
+		if err != nil || !fi.IsDir() {
+			t.Errorf("%s: / should be dir: %v", order, err)
+		}
+
+		dir, err := p.GetDirInfo("/")
+		if err != nil || len(dir) != 2 {
+			t.Errorf("%s: / should contain 2 entries: %v %v", order, dir, err)
+		}
+
+		fi, err = p.GetFileInfo("/bin/busybox")
+		if err != nil || !fi.IsFile() || !fi.IsSUid() || fi.Uid != 1000 || fi.Size != 11 {
+			t.Errorf("%s: bad /bin/busybox: %v %v", order, fi, err)
+		}
+		if fi.SELinuxLabel != "u:object_r:system_file:s0" {
+			t.Errorf("%s: bad selinux label: %s", order, fi.SELinuxLabel)
+		}
+
+		fi, err = p.GetFileInfo("/bin/sh")
+		if err != nil || !fi.IsLink() || fi.LinkTarget != "busybox" {
+			t.Errorf("%s: bad /bin/sh: %v %v", order, fi, err)
+		}
+
+		if _, err := p.GetFileInfo("/old"); err == nil {
+			t.Errorf("%s: /old was deleted", order)
+		}
+
+		tmpdir, err := ioutil.TempDir("", "jffs2parser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpdir)
+		for file, content := range map[string]string{"/bin/busybox": "hello jffs2", "/motd": "abababbax"} {
+			if !p.CopyFile(file, tmpdir) {
+				t.Errorf("%s: copy of %s failed", order, file)
+				continue
+			}
+			data, err := ioutil.ReadFile(path.Join(tmpdir, path.Base(file)))
+			if err != nil || string(data) != content {
+				t.Errorf("%s: bad content of %s: %q %v", order, file, data, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package payloadparser
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ulikunitz/xz"
+)
+
+/*
+ * Reader for Android A/B OTA update payloads (payload.bin) as consumed by update_engine.
+ * Only full payloads are supported, delta payloads require the source partitions.
+ * see: system/update_engine/update_metadata.proto
+ */
+
+const (
+	payloadMagic      = "CrAU"
+	defaultBlockSize  = 4096
+	maxManifestSize   = 64 << 20
+	maxSignatureSize  = 1 << 20
+	payloadHeaderSize = 24
+)
+
+// install operation types
+const (
+	opReplace   = 0
+	opReplaceBz = 1
+	opZero      = 6
+	opDiscard   = 7
+	opReplaceXz = 8
+)
+
+type extent struct {
+	startBlock uint64
+	numBlocks  uint64
+}
+
+type installOperation struct {
+	opType     uint64
+	dataOffset uint64
+	dataLength uint64
+	dstExtents []extent
+}
+
+type partitionUpdate struct {
+	name       string
+	size       uint64
+	hash       []byte
+	operations []installOperation
+}
+
+type payload struct {
+	file       *os.File
+	blockSize  uint64
+	partitions []*partitionUpdate
+	// offset of the data blobs in the payload
+	dataOffset int64
+}
+
+// IsPayload returns true if the file at imagepath starts with the update payload magic
+func IsPayload(imagepath string) bool {
+	f, err := os.Open(imagepath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(payloadMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == payloadMagic
+}
+
+func openPayload(imagepath string) (*payload, error) {
+	file, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readPayload(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	p.file = file
+	return p, nil
+}
+
+func readPayload(r io.ReaderAt) (*payload, error) {
+	hdr := make([]byte, payloadHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("payload: can't read header: %s", err)
+	}
+	if string(hdr[:4]) != payloadMagic {
+		return nil, fmt.Errorf("payload: bad magic %q", hdr[:4])
+	}
+	version := binary.BigEndian.Uint64(hdr[4:])
+	manifestSize := binary.BigEndian.Uint64(hdr[12:])
+	manifestOffset := int64(payloadHeaderSize)
+	var signatureSize uint32
+	switch version {
+	case 1:
+		// no metadata signature
+		manifestOffset -= 4
+	case 2:
+		signatureSize = binary.BigEndian.Uint32(hdr[20:])
+	default:
+		return nil, fmt.Errorf("payload: unsupported version %d", version)
+	}
+	if manifestSize > maxManifestSize || signatureSize > maxSignatureSize {
+		return nil, fmt.Errorf("payload: bad manifest size %d", manifestSize)
+	}
+
+	manifest := make([]byte, manifestSize)
+	if _, err := r.ReadAt(manifest, manifestOffset); err != nil {
+		return nil, fmt.Errorf("payload: can't read manifest: %s", err)
+	}
+	p, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	p.dataOffset = manifestOffset + int64(manifestSize) + int64(signatureSize)
+	return p, nil
+}
+
+// DeltaArchiveManifest
+func parseManifest(data []byte) (*payload, error) {
+	p := &payload{blockSize: defaultBlockSize}
+	err := parseMessage(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 3:
+			p.blockSize = v
+		case 13:
+			part, err := parsePartition(b)
+			if err != nil {
+				return err
+			}
+			p.partitions = append(p.partitions, part)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.blockSize == 0 {
+		return nil, fmt.Errorf("payload: bad block size")
+	}
+	return p, nil
+}
+
+// PartitionUpdate
+func parsePartition(data []byte) (*partitionUpdate, error) {
+	part := &partitionUpdate{}
+	err := parseMessage(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			part.name = string(b)
+		case 7:
+			// PartitionInfo
+			return parseMessage(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					part.size = v
+				case 2:
+					part.hash = b
+				}
+				return nil
+			})
+		case 8:
+			op, err := parseOperation(b)
+			if err != nil {
+				return err
+			}
+			part.operations = append(part.operations, op)
+		}
+		return nil
+	})
+	return part, err
+}
+
+// InstallOperation
+func parseOperation(data []byte) (installOperation, error) {
+	var op installOperation
+	err := parseMessage(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			op.opType = v
+		case 2:
+			op.dataOffset = v
+		case 3:
+			op.dataLength = v
+		case 6:
+			var e extent
+			err := parseMessage(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					e.startBlock = v
+				case 2:
+					e.numBlocks = v
+				}
+				return nil
+			})
+			op.dstExtents = append(op.dstExtents, e)
+			return err
+		}
+		return nil
+	})
+	return op, err
+}
+
+func (p *payload) partition(name string) *partitionUpdate {
+	for _, part := range p.partitions {
+		if part.name == name {
+			return part
+		}
+	}
+	return nil
+}
+
+// partitionSize returns the size of the partition image
+func (p *payload) partitionSize(part *partitionUpdate) int64 {
+	if part.size > 0 {
+		return int64(part.size)
+	}
+	var blocks uint64
+	for _, op := range part.operations {
+		for _, e := range op.dstExtents {
+			if e.startBlock+e.numBlocks > blocks {
+				blocks = e.startBlock + e.numBlocks
+			}
+		}
+	}
+	return int64(blocks * p.blockSize)
+}
+
+// extentWriter writes data sequentially into a list of extents
+type extentWriter struct {
+	w         io.WriterAt
+	extents   []extent
+	blockSize int64
+	// position in the first extent
+	pos int64
+}
+
+func (e *extentWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if len(e.extents) == 0 {
+			return written, fmt.Errorf("payload: operation data exceeds destination extents")
+		}
+		size := int64(e.extents[0].numBlocks) * e.blockSize
+		n := int64(len(data))
+		if n > size-e.pos {
+			n = size - e.pos
+		}
+		if _, err := e.w.WriteAt(data[:n], int64(e.extents[0].startBlock)*e.blockSize+e.pos); err != nil {
+			return written, err
+		}
+		written += int(n)
+		data = data[n:]
+		e.pos += n
+		if e.pos == size {
+			e.extents = e.extents[1:]
+			e.pos = 0
+		}
+	}
+	return written, nil
+}
+
+func (p *payload) applyOperation(out io.WriterAt, op *installOperation) error {
+	var data io.Reader = io.NewSectionReader(p.file, p.dataOffset+int64(op.dataOffset), int64(op.dataLength))
+	switch op.opType {
+	case opReplace:
+	case opReplaceBz:
+		data = bzip2.NewReader(data)
+	case opReplaceXz:
+		xr, err := xz.NewReader(data)
+		if err != nil {
+			return err
+		}
+		data = xr
+	case opZero, opDiscard:
+		// the destination is a new file, holes read back as zeros
+		return nil
+	default:
+		return fmt.Errorf("payload: unsupported operation type %d (delta payloads are not supported)", op.opType)
+	}
+	_, err := io.Copy(&extentWriter{w: out, extents: op.dstExtents, blockSize: int64(p.blockSize)}, data)
+	return err
+}
+
+// extract writes the image of the partition to dst
+func (p *payload) extract(part *partitionUpdate, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = p.writePartition(part, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func (p *payload) writePartition(part *partitionUpdate, out *os.File) error {
+	for i := range part.operations {
+		if err := p.applyOperation(out, &part.operations[i]); err != nil {
+			return fmt.Errorf("payload: %s: operation %d: %s", part.name, i, err)
+		}
+	}
+	if err := out.Truncate(p.partitionSize(part)); err != nil {
+		return err
+	}
+	if part.hash == nil {
+		return nil
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, out); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), part.hash) {
+		return fmt.Errorf("payload: %s: partition hash mismatch", part.name)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package payloadparser
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+// partitions are exposed as files in the root directory with this extension
+const imageExt = ".img"
+
+type PayloadParser struct {
+	imagepath  string
+	payload    *payload
+	payloadErr error
+}
+
+func New(imagepath string) *PayloadParser {
+	parser := &PayloadParser{
+		imagepath: imagepath,
+	}
+
+	return parser
+}
+
+func (p *PayloadParser) ImageName() string {
+	return p.imagepath
+}
+
+// open the payload on first use
+func (p *PayloadParser) open() (*payload, error) {
+	if p.payload == nil && p.payloadErr == nil {
+		p.payload, p.payloadErr = openPayload(p.imagepath)
+	}
+	return p.payload, p.payloadErr
+}
+
+// ExtractPartition writes the image of the named partition to dst
+func ExtractPartition(imagepath string, name string, dst string) error {
+	pl, err := openPayload(imagepath)
+	if err != nil {
+		return err
+	}
+	defer pl.file.Close()
+	part := pl.partition(name)
+	if part == nil {
+		var names []string
+		for _, part := range pl.partitions {
+			names = append(names, part.name)
+		}
+		return fmt.Errorf("payload: partition %q not found, available partitions: %s", name, strings.Join(names, ", "))
+	}
+	return pl.extract(part, dst)
+}
+
+func (p *PayloadParser) fileInfo(pl *payload, part *partitionUpdate) fsparser.FileInfo {
+	return fsparser.FileInfo{
+		Name:         part.name + imageExt,
+		Size:         pl.partitionSize(part),
+		Mode:         0100644,
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+	}
+}
+
+// lookup returns the partition for the image path
+func (p *PayloadParser) lookup(pl *payload, filepath string) *partitionUpdate {
+	dir, name := path.Split(path.Clean("/" + filepath))
+	if dir != "/" || !strings.HasSuffix(name, imageExt) {
+		return nil
+	}
+	return pl.partition(strings.TrimSuffix(name, imageExt))
+}
+
+func (p *PayloadParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	pl, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	if path.Clean("/"+dirpath) != "/" {
+		return nil, fmt.Errorf("payloadparser: %s is not a directory", dirpath)
+	}
+	var dir []fsparser.FileInfo
+	for _, part := range pl.partitions {
+		dir = append(dir, p.fileInfo(pl, part))
+	}
+	return dir, nil
+}
+
+func (p *PayloadParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	pl, err := p.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	if path.Clean("/"+filepath) == "/" {
+		return fsparser.FileInfo{Name: "/", Mode: 040755, SELinuxLabel: fsparser.SELinuxNoLabel}, nil
+	}
+	part := p.lookup(pl, filepath)
+	if part == nil {
+		return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
+	}
+	return p.fileInfo(pl, part), nil
+}
+
+func (p *PayloadParser) CopyFile(filepath string, dstdir string) bool {
+	pl, err := p.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	part := p.lookup(pl, filepath)
+	if part == nil {
+		fmt.Fprintf(os.Stderr, "payloadparser: can't find file %s\n", filepath)
+		return false
+	}
+	dst := dstdir
+	if st, err := os.Stat(dst); err == nil && st.IsDir() {
+		dst = path.Join(dst, path.Base(filepath))
+	}
+	// partition images are written with holes for zero blocks
+	if err := pl.extract(part, dst); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Supported returns true since no external tools are required
+func (p *PayloadParser) Supported() bool {
+	return true
+}
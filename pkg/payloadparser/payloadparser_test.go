@@ -0,0 +1,220 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package payloadparser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+const testBlockSize = 4096
+
+// protobuf encoding helpers
+func pbVarint(buf *bytes.Buffer, field int, v uint64) {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf.Write(tmp[:binary.PutUvarint(tmp, uint64(field<<3|wireVarint))])
+	buf.Write(tmp[:binary.PutUvarint(tmp, v)])
+}
+
+func pbBytes(buf *bytes.Buffer, field int, data []byte) {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf.Write(tmp[:binary.PutUvarint(tmp, uint64(field<<3|wireBytes))])
+	buf.Write(tmp[:binary.PutUvarint(tmp, uint64(len(data)))])
+	buf.Write(data)
+}
+
+type testOp struct {
+	opType uint64
+	data   []byte
+	// start block and number of blocks
+	extents [][2]uint64
+}
+
+type testPartition struct {
+	name  string
+	image []byte
+	ops   []testOp
+}
+
+// writePayload creates a version 2 payload with a metadata signature placeholder
+func writePayload(t *testing.T, name string, partitions []testPartition) {
+	var manifest, blobs bytes.Buffer
+	pbVarint(&manifest, 3, testBlockSize)
+	for _, part := range partitions {
+		var pu bytes.Buffer
+		pbBytes(&pu, 1, []byte(part.name))
+		for _, op := range part.ops {
+			var iop bytes.Buffer
+			pbVarint(&iop, 1, op.opType)
+			if op.data != nil {
+				pbVarint(&iop, 2, uint64(blobs.Len()))
+				pbVarint(&iop, 3, uint64(len(op.data)))
+				blobs.Write(op.data)
+			}
+			for _, e := range op.extents {
+				var ext bytes.Buffer
+				pbVarint(&ext, 1, e[0])
+				pbVarint(&ext, 2, e[1])
+				pbBytes(&iop, 6, ext.Bytes())
+			}
+			pbBytes(&pu, 8, iop.Bytes())
+		}
+		var info bytes.Buffer
+		pbVarint(&info, 1, uint64(len(part.image)))
+		sum := sha256.Sum256(part.image)
+		pbBytes(&info, 2, sum[:])
+		pbBytes(&pu, 7, info.Bytes())
+		pbBytes(&manifest, 13, pu.Bytes())
+	}
+
+	signature := []byte("metadata signature")
+	var buf bytes.Buffer
+	buf.WriteString(payloadMagic)
+	binary.Write(&buf, binary.BigEndian, uint64(2))
+	binary.Write(&buf, binary.BigEndian, uint64(manifest.Len()))
+	binary.Write(&buf, binary.BigEndian, uint32(len(signature)))
+	buf.Write(manifest.Bytes())
+	buf.Write(signature)
+	buf.Write(blobs.Bytes())
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPartitions() []testPartition {
+	block := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, testBlockSize)
+	}
+	// generated with bzip2
+	bz, _ := hex.DecodeString("425a68393141592653591a7899c400000a4400800410000008200030cc05536a620a03c5dc914e1424069e267100")
+	var xzBuf bytes.Buffer
+	xw, _ := xz.NewWriter(&xzBuf)
+	xw.Write(bytes.Repeat(block('C'), 2))
+	xw.Close()
+
+	system := bytes.Join([][]byte{block('A'), block(0), block('B'), block('C'), block(0), block('C'), block(0)}, nil)
+	boot := []byte("ANDROID! boot image")
+
+	return []testPartition{
+		{"system", system, []testOp{
+			{opReplace, block('A'), [][2]uint64{{0, 1}}},
+			{opZero, nil, [][2]uint64{{1, 1}, {4, 1}}},
+			{opReplaceBz, bz, [][2]uint64{{2, 1}}},
+			// the data is split over two extents
+			{opReplaceXz, xzBuf.Bytes(), [][2]uint64{{3, 1}, {5, 1}}},
+			{opDiscard, nil, [][2]uint64{{6, 1}}},
+		}},
+		{"boot", boot, []testOp{
+			{opReplace, boot, [][2]uint64{{0, 1}}},
+		}},
+	}
+}
+
+func TestPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	partitions := testPartitions()
+	imagepath := path.Join(dir, "payload.bin")
+	writePayload(t, imagepath, partitions)
+	if !IsPayload(imagepath) {
+		t.Errorf("IsPayload should be true")
+	}
+
+	p := New(imagepath)
+	files, err := p.GetDirInfo("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "system.img" || files[1].Name != "boot.img" {
+		t.Errorf("bad root directory: %v", files)
+	}
+	fi, err := p.GetFileInfo("/system.img")
+	if err != nil || fi.Size != 7*testBlockSize || !fi.IsFile() {
+		t.Errorf("bad /system.img: %v %v", fi, err)
+	}
+	if _, err := p.GetFileInfo("/system"); err == nil {
+		t.Errorf("/system should not exist")
+	}
+
+	for _, part := range partitions {
+		if !p.CopyFile("/"+part.name+".img", dir) {
+			t.Errorf("CopyFile %s failed", part.name)
+			continue
+		}
+		data, _ := ioutil.ReadFile(path.Join(dir, part.name+".img"))
+		if !bytes.Equal(data, part.image) {
+			t.Errorf("bad image for %s", part.name)
+		}
+	}
+
+	dst := path.Join(dir, "boot.raw")
+	if err := ExtractPartition(imagepath, "boot", dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != "ANDROID! boot image" {
+		t.Errorf("bad boot partition: %q", data)
+	}
+	err = ExtractPartition(imagepath, "vendor", dst)
+	if err == nil || !strings.Contains(err.Error(), "system, boot") {
+		t.Errorf("unknown partition should list available partitions: %v", err)
+	}
+}
+
+func TestPayloadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		part testPartition
+	}{
+		{"hash", testPartition{"system", []byte("other data"), []testOp{{opReplace, []byte("data"), [][2]uint64{{0, 1}}}}}},
+		{"delta", testPartition{"system", nil, []testOp{{4, nil, [][2]uint64{{0, 1}}}}}},
+		{"extents", testPartition{"system", nil, []testOp{{opReplace, make([]byte, 2*testBlockSize), [][2]uint64{{0, 1}}}}}},
+	}
+	for _, test := range tests {
+		imagepath := path.Join(dir, test.name+".bin")
+		writePayload(t, imagepath, []testPartition{test.part})
+		dst := path.Join(dir, test.name+".img")
+		if err := ExtractPartition(imagepath, "system", dst); err == nil {
+			t.Errorf("%s: ExtractPartition should fail", test.name)
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("%s: output should be removed", test.name)
+		}
+	}
+
+	if IsPayload("payloadparser.go") {
+		t.Errorf("IsPayload should be false")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package payloadparser
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// protobuf wire types
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+	wire32Bit  = 5
+)
+
+// parseMessage calls fn for every field of a protobuf message, v holds the value of
+// varint and fixed size fields and b holds the data of length delimited fields
+func parseMessage(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("payload: bad protobuf key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case wireVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("payload: bad protobuf varint")
+			}
+			data = data[n:]
+		case wire64Bit:
+			if len(data) < 8 {
+				return fmt.Errorf("payload: protobuf message truncated")
+			}
+			v = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wire32Bit:
+			if len(data) < 4 {
+				return fmt.Errorf("payload: protobuf message truncated")
+			}
+			v = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return fmt.Errorf("payload: protobuf message truncated")
+			}
+			b = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return fmt.Errorf("payload: unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(field, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
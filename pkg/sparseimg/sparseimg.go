@@ -0,0 +1,200 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sparseimg expands Android sparse images (as produced by img2simg) into raw images.
+package sparseimg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	sparseMagic = 0xed26ff3a
+
+	fileHeaderSize  = 28
+	chunkHeaderSize = 12
+
+	chunkRaw      = 0xcac1
+	chunkFill     = 0xcac2
+	chunkDontCare = 0xcac3
+	chunkCrc32    = 0xcac4
+)
+
+type fileHeader struct {
+	Magic         uint32
+	MajorVersion  uint16
+	MinorVersion  uint16
+	FileHdrSize   uint16
+	ChunkHdrSize  uint16
+	BlockSize     uint32
+	TotalBlocks   uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+type chunkHeader struct {
+	ChunkType uint16
+	Reserved  uint16
+	ChunkSize uint32
+	TotalSize uint32
+}
+
+// IsSparse returns true if the file at imagepath starts with the Android sparse image magic
+func IsSparse(imagepath string) bool {
+	f, err := os.Open(imagepath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var magic uint32
+	if err := binary.Read(f, binary.LittleEndian, &magic); err != nil {
+		return false
+	}
+	return magic == sparseMagic
+}
+
+// Expand writes the raw image contained in the sparse image src to dst.
+// DONT_CARE chunks are left as holes in dst.
+func Expand(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	err = expand(bufio.NewReader(in), out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func expand(r io.Reader, out *os.File) error {
+	var hdr fileHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("sparseimg: can't read header: %s", err)
+	}
+	if hdr.Magic != sparseMagic {
+		return fmt.Errorf("sparseimg: bad magic 0x%08x", hdr.Magic)
+	}
+	if hdr.MajorVersion != 1 {
+		return fmt.Errorf("sparseimg: unsupported version %d.%d", hdr.MajorVersion, hdr.MinorVersion)
+	}
+	if hdr.FileHdrSize < fileHeaderSize || hdr.ChunkHdrSize < chunkHeaderSize {
+		return fmt.Errorf("sparseimg: bad header sizes %d/%d", hdr.FileHdrSize, hdr.ChunkHdrSize)
+	}
+	if hdr.BlockSize == 0 || hdr.BlockSize%4 != 0 {
+		return fmt.Errorf("sparseimg: bad block size %d", hdr.BlockSize)
+	}
+	// skip header extensions
+	if _, err := io.CopyN(ioutil.Discard, r, int64(hdr.FileHdrSize-fileHeaderSize)); err != nil {
+		return fmt.Errorf("sparseimg: can't read header: %s", err)
+	}
+
+	blockSize := int64(hdr.BlockSize)
+	// crc over the complete raw image, checked against CRC32 chunks
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(out, crc)
+	fill := make([]byte, blockSize)
+	zero := make([]byte, blockSize)
+	var blocks uint32
+
+	for i := uint32(0); i < hdr.TotalChunks; i++ {
+		var ch chunkHeader
+		if err := binary.Read(r, binary.LittleEndian, &ch); err != nil {
+			return fmt.Errorf("sparseimg: can't read chunk %d: %s", i, err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(hdr.ChunkHdrSize-chunkHeaderSize)); err != nil {
+			return fmt.Errorf("sparseimg: can't read chunk %d: %s", i, err)
+		}
+		if uint64(blocks)+uint64(ch.ChunkSize) > uint64(hdr.TotalBlocks) {
+			return fmt.Errorf("sparseimg: chunk %d exceeds image size", i)
+		}
+		dataSize := int64(ch.TotalSize) - int64(hdr.ChunkHdrSize)
+		size := int64(ch.ChunkSize) * blockSize
+
+		switch ch.ChunkType {
+		case chunkRaw:
+			if dataSize != size {
+				return fmt.Errorf("sparseimg: raw chunk %d has bad size %d", i, ch.TotalSize)
+			}
+			if _, err := io.CopyN(w, r, size); err != nil {
+				return fmt.Errorf("sparseimg: can't copy chunk %d: %s", i, err)
+			}
+		case chunkFill:
+			if dataSize != 4 {
+				return fmt.Errorf("sparseimg: fill chunk %d has bad size %d", i, ch.TotalSize)
+			}
+			if _, err := io.ReadFull(r, fill[:4]); err != nil {
+				return fmt.Errorf("sparseimg: can't read chunk %d: %s", i, err)
+			}
+			for n := int64(4); n < blockSize; n *= 2 {
+				copy(fill[n:], fill[:n])
+			}
+			for n := uint32(0); n < ch.ChunkSize; n++ {
+				if _, err := w.Write(fill); err != nil {
+					return err
+				}
+			}
+		case chunkDontCare:
+			if dataSize != 0 {
+				return fmt.Errorf("sparseimg: don't care chunk %d has bad size %d", i, ch.TotalSize)
+			}
+			if _, err := out.Seek(size, io.SeekCurrent); err != nil {
+				return err
+			}
+			// holes read back as zeros
+			for n := uint32(0); n < ch.ChunkSize; n++ {
+				_, _ = crc.Write(zero)
+			}
+		case chunkCrc32:
+			if dataSize != 4 {
+				return fmt.Errorf("sparseimg: crc chunk %d has bad size %d", i, ch.TotalSize)
+			}
+			var sum uint32
+			if err := binary.Read(r, binary.LittleEndian, &sum); err != nil {
+				return fmt.Errorf("sparseimg: can't read chunk %d: %s", i, err)
+			}
+			if sum != crc.Sum32() {
+				return fmt.Errorf("sparseimg: crc mismatch at chunk %d", i)
+			}
+		default:
+			return fmt.Errorf("sparseimg: unknown chunk type 0x%04x", ch.ChunkType)
+		}
+		blocks += ch.ChunkSize
+	}
+
+	if blocks != hdr.TotalBlocks {
+		return fmt.Errorf("sparseimg: image has %d blocks, expected %d", blocks, hdr.TotalBlocks)
+	}
+	// trailing holes don't extend the file
+	return out.Truncate(int64(hdr.TotalBlocks) * blockSize)
+}
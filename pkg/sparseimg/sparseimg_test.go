@@ -0,0 +1,140 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sparseimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const testBlockSize = 4096
+
+type testChunk struct {
+	chunkType uint16
+	blocks    uint32
+	data      []byte
+}
+
+func writeSparse(t *testing.T, name string, chunks []testChunk) {
+	var buf bytes.Buffer
+	var total uint32
+	for _, c := range chunks {
+		if c.chunkType != chunkCrc32 {
+			total += c.blocks
+		}
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, fileHeader{
+		Magic:        sparseMagic,
+		MajorVersion: 1,
+		FileHdrSize:  fileHeaderSize,
+		ChunkHdrSize: chunkHeaderSize,
+		BlockSize:    testBlockSize,
+		TotalBlocks:  total,
+		TotalChunks:  uint32(len(chunks)),
+	})
+	for _, c := range chunks {
+		_ = binary.Write(&buf, binary.LittleEndian, chunkHeader{
+			ChunkType: c.chunkType,
+			ChunkSize: c.blocks,
+			TotalSize: uint32(chunkHeaderSize + len(c.data)),
+		})
+		buf.Write(c.data)
+	}
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparseimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := bytes.Repeat([]byte("fwanalyzer"), 2*testBlockSize/10+1)[:2*testBlockSize]
+	expected := append([]byte{}, raw...)
+	expected = append(expected, bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 3*testBlockSize/4)...)
+	expected = append(expected, make([]byte, testBlockSize)...)
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(expected))
+	expected = append(expected, make([]byte, 2*testBlockSize)...)
+
+	sparse := path.Join(dir, "sparse.img")
+	writeSparse(t, sparse, []testChunk{
+		{chunkRaw, 2, raw},
+		{chunkFill, 3, []byte{0xde, 0xad, 0xbe, 0xef}},
+		{chunkDontCare, 1, nil},
+		{chunkCrc32, 0, sum},
+		{chunkDontCare, 2, nil},
+	})
+	if !IsSparse(sparse) {
+		t.Errorf("IsSparse should be true")
+	}
+
+	out := path.Join(dir, "raw.img")
+	if err := Expand(sparse, out); err != nil {
+		t.Fatal(err)
+	}
+	if IsSparse(out) {
+		t.Errorf("IsSparse should be false for raw image")
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expanded image does not match: size %d expected %d", len(data), len(expected))
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparseimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		chunks []testChunk
+	}{
+		{"crc", []testChunk{{chunkRaw, 1, make([]byte, testBlockSize)}, {chunkCrc32, 0, []byte{1, 2, 3, 4}}}},
+		{"size", []testChunk{{chunkRaw, 2, make([]byte, testBlockSize)}}},
+		{"type", []testChunk{{0xcaff, 1, nil}}},
+	}
+	for _, test := range tests {
+		sparse := path.Join(dir, test.name+".img")
+		out := path.Join(dir, test.name+".raw")
+		writeSparse(t, sparse, test.chunks)
+		if err := Expand(sparse, out); err == nil {
+			t.Errorf("%s: Expand should fail", test.name)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: output should be removed", test.name)
+		}
+	}
+
+	if err := Expand(path.Join(dir, "missing.img"), path.Join(dir, "missing.raw")); err == nil {
+		t.Errorf("Expand should fail for missing image")
+	}
+}
@@ -0,0 +1,786 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package squashfsparser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+/*
+ * Minimal read-only implementation of the SquashFS 4.0 on-disk format.
+ * see: https://dr-emann.github.io/squashfs/
+ */
+
+const (
+	squashfsMagic    = 0x73717368
+	superblockSize   = 96
+	metadataSize     = 8192
+	metadataNoCompr  = 0x8000
+	dataNoCompr      = 1 << 24
+	invalidFragment  = 0xFFFFFFFF
+	invalidXattr     = 0xFFFFFFFF
+	invalidTable     = 0xFFFFFFFFFFFFFFFF
+	xattrValueOOL    = 0x100
+	xattrPrefixMask  = 0xFF
+	fragmentEntrySz  = 16
+	xattrIDEntrySz   = 16
+	dirHeaderSize    = 12
+	dirEntryBaseSize = 8
+)
+
+const (
+	compGzip = 1
+	compLzma = 2
+	compLzo  = 3
+	compXz   = 4
+	compLz4  = 5
+	compZstd = 6
+)
+
+var compressorNames = map[uint16]string{
+	compGzip: "gzip",
+	compLzma: "lzma",
+	compLzo:  "lzo",
+	compXz:   "xz",
+	compLz4:  "lz4",
+	compZstd: "zstd",
+}
+
+const (
+	inodeBasicDir     = 1
+	inodeBasicFile    = 2
+	inodeBasicSymlink = 3
+	inodeBasicBlock   = 4
+	inodeBasicChar    = 5
+	inodeBasicFifo    = 6
+	inodeBasicSocket  = 7
+	inodeExtDir       = 8
+	inodeExtFile      = 9
+	inodeExtSymlink   = 10
+	inodeExtBlock     = 11
+	inodeExtChar      = 12
+	inodeExtFifo      = 13
+	inodeExtSocket    = 14
+)
+
+var inodeTypeMode = map[uint16]uint64{
+	inodeBasicDir:     fsparser.S_IFDIR,
+	inodeBasicFile:    fsparser.S_IFREG,
+	inodeBasicSymlink: fsparser.S_IFLNK,
+	inodeBasicBlock:   fsparser.S_IFBLK,
+	inodeBasicChar:    fsparser.S_IFCHR,
+	inodeBasicFifo:    fsparser.S_IFIFO,
+	inodeBasicSocket:  fsparser.S_IFSOCK,
+	inodeExtDir:       fsparser.S_IFDIR,
+	inodeExtFile:      fsparser.S_IFREG,
+	inodeExtSymlink:   fsparser.S_IFLNK,
+	inodeExtBlock:     fsparser.S_IFBLK,
+	inodeExtChar:      fsparser.S_IFCHR,
+	inodeExtFifo:      fsparser.S_IFIFO,
+	inodeExtSocket:    fsparser.S_IFSOCK,
+}
+
+var xattrPrefix = map[uint16]string{
+	0: "user.",
+	1: "trusted.",
+	2: "security.",
+}
+
+type superblock struct {
+	inodeCount      uint32
+	modTime         uint32
+	blockSize       uint32
+	fragCount       uint32
+	compressor      uint16
+	flags           uint16
+	idCount         uint16
+	rootInode       uint64
+	bytesUsed       uint64
+	idTable         uint64
+	xattrIDTable    uint64
+	inodeTable      uint64
+	directoryTable  uint64
+	fragmentTable   uint64
+	exportTable     uint64
+	xattrTableStart uint64
+	xattrIDCount    uint32
+}
+
+type inode struct {
+	inodeType uint16
+	perm      uint16
+	uid       uint32
+	gid       uint32
+	mtime     uint32
+	number    uint32
+	nlink     uint32
+	size      uint64
+	rdev      uint32
+	xattrIdx  uint32
+
+	// directory
+	dirBlock  uint32
+	dirOffset uint16
+
+	// regular file
+	blocksStart uint64
+	fragIndex   uint32
+	fragOffset  uint32
+	blockSizes  []uint32
+
+	// symlink
+	target string
+}
+
+type dirEntry struct {
+	name     string
+	inodeRef uint64
+}
+
+type metadataBlock struct {
+	data []byte
+	next uint64
+}
+
+type squashFS struct {
+	img           *os.File
+	sb            superblock
+	ids           []uint32
+	fragments     []uint64
+	fragmentSizes []uint32
+	xattrIDs      []byte
+	metadata      map[uint64]*metadataBlock
+	// last decompressed fragment block
+	fragIndex uint32
+	fragData  []byte
+}
+
+func openSquashFS(imagepath string) (*squashFS, error) {
+	img, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	fs := &squashFS{img: img, metadata: make(map[uint64]*metadataBlock)}
+	err = fs.readSuperblock()
+	if err == nil {
+		err = fs.readIDTable()
+	}
+	if err == nil {
+		err = fs.readFragmentTable()
+	}
+	if err == nil {
+		err = fs.readXattrIDTable()
+	}
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *squashFS) readAt(off uint64, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := fs.img.ReadAt(buf, int64(off))
+	if err != nil && !(err == io.EOF && uint64(n) == size) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (fs *squashFS) readSuperblock() error {
+	data, err := fs.readAt(0, superblockSize)
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[0:]) != squashfsMagic {
+		return fmt.Errorf("not a squashfs filesystem")
+	}
+	if major := le.Uint16(data[28:]); major != 4 {
+		return fmt.Errorf("unsupported squashfs version: %d", major)
+	}
+	sb := &fs.sb
+	sb.inodeCount = le.Uint32(data[4:])
+	sb.modTime = le.Uint32(data[8:])
+	sb.blockSize = le.Uint32(data[12:])
+	sb.fragCount = le.Uint32(data[16:])
+	sb.compressor = le.Uint16(data[20:])
+	sb.flags = le.Uint16(data[24:])
+	sb.idCount = le.Uint16(data[26:])
+	sb.rootInode = le.Uint64(data[32:])
+	sb.bytesUsed = le.Uint64(data[40:])
+	sb.idTable = le.Uint64(data[48:])
+	sb.xattrIDTable = le.Uint64(data[56:])
+	sb.inodeTable = le.Uint64(data[64:])
+	sb.directoryTable = le.Uint64(data[72:])
+	sb.fragmentTable = le.Uint64(data[80:])
+	sb.exportTable = le.Uint64(data[88:])
+	if _, ok := compressorNames[sb.compressor]; !ok {
+		return fmt.Errorf("unsupported squashfs compressor: %d", sb.compressor)
+	}
+	if sb.blockSize == 0 || sb.blockSize > 1024*1024 {
+		return fmt.Errorf("bad squashfs block size: %d", sb.blockSize)
+	}
+	return nil
+}
+
+func (fs *squashFS) decompress(data []byte, maxSize int) ([]byte, error) {
+	switch fs.sb.compressor {
+	case compGzip:
+		return decompress.Zlib(data, maxSize)
+	case compLzma:
+		return decompress.Lzma(data, maxSize)
+	case compLzo:
+		return decompress.Lzo1x(data, maxSize)
+	case compXz:
+		return decompress.Xz(data, maxSize)
+	case compLz4:
+		return decompress.Lz4Block(data, maxSize)
+	case compZstd:
+		return decompress.Zstd(data, maxSize)
+	}
+	return nil, fmt.Errorf("unsupported squashfs compressor: %d", fs.sb.compressor)
+}
+
+// readMetadataBlock reads and decompresses the metadata block at pos
+func (fs *squashFS) readMetadataBlock(pos uint64) (*metadataBlock, error) {
+	if mb, ok := fs.metadata[pos]; ok {
+		return mb, nil
+	}
+	hdr, err := fs.readAt(pos, 2)
+	if err != nil {
+		return nil, err
+	}
+	h := binary.LittleEndian.Uint16(hdr)
+	size := uint64(h &^ metadataNoCompr)
+	if size > metadataSize {
+		return nil, fmt.Errorf("bad metadata block at %d", pos)
+	}
+	data, err := fs.readAt(pos+2, size)
+	if err != nil {
+		return nil, err
+	}
+	if h&metadataNoCompr == 0 {
+		data, err = fs.decompress(data, metadataSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mb := &metadataBlock{data: data, next: pos + 2 + size}
+	fs.metadata[pos] = mb
+	return mb, nil
+}
+
+type metadataReader struct {
+	fs   *squashFS
+	next uint64
+	buf  []byte
+}
+
+// newMetadataReader returns a reader for the metadata stream at the given table and reference,
+// the reference contains the block offset (relative to the table) and the offset in the block
+func (fs *squashFS) newMetadataReader(table uint64, ref uint64) (*metadataReader, error) {
+	mb, err := fs.readMetadataBlock(table + ref>>16)
+	if err != nil {
+		return nil, err
+	}
+	offset := ref & 0xFFFF
+	if offset > uint64(len(mb.data)) {
+		return nil, fmt.Errorf("bad metadata reference")
+	}
+	return &metadataReader{fs: fs, next: mb.next, buf: mb.data[offset:]}, nil
+}
+
+func (r *metadataReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		mb, err := r.fs.readMetadataBlock(r.next)
+		if err != nil {
+			return 0, err
+		}
+		if len(mb.data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.next = mb.next
+		r.buf = mb.data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *metadataReader) read(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// readLookupTable reads a table that is stored as a list of metadata blocks
+// referenced by an array of 64bit pointers located at start
+func (fs *squashFS) readLookupTable(start uint64, size uint64) ([]byte, error) {
+	blocks := (size + metadataSize - 1) / metadataSize
+	ptrs, err := fs.readAt(start, blocks*8)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for i := uint64(0); i < blocks; i++ {
+		mb, err := fs.readMetadataBlock(binary.LittleEndian.Uint64(ptrs[i*8:]))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, mb.data...)
+	}
+	if uint64(len(out)) < size {
+		return nil, fmt.Errorf("lookup table too short")
+	}
+	return out[:size], nil
+}
+
+func (fs *squashFS) readIDTable() error {
+	data, err := fs.readLookupTable(fs.sb.idTable, uint64(fs.sb.idCount)*4)
+	if err != nil {
+		return err
+	}
+	fs.ids = make([]uint32, fs.sb.idCount)
+	for i := range fs.ids {
+		fs.ids[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return nil
+}
+
+func (fs *squashFS) readFragmentTable() error {
+	if fs.sb.fragCount == 0 || fs.sb.fragmentTable == invalidTable {
+		return nil
+	}
+	data, err := fs.readLookupTable(fs.sb.fragmentTable, uint64(fs.sb.fragCount)*fragmentEntrySz)
+	if err != nil {
+		return err
+	}
+	fs.fragments = make([]uint64, fs.sb.fragCount)
+	fs.fragmentSizes = make([]uint32, fs.sb.fragCount)
+	for i := range fs.fragments {
+		fs.fragments[i] = binary.LittleEndian.Uint64(data[i*fragmentEntrySz:])
+		fs.fragmentSizes[i] = binary.LittleEndian.Uint32(data[i*fragmentEntrySz+8:])
+	}
+	return nil
+}
+
+func (fs *squashFS) readXattrIDTable() error {
+	if fs.sb.xattrIDTable == invalidTable {
+		return nil
+	}
+	hdr, err := fs.readAt(fs.sb.xattrIDTable, 16)
+	if err != nil {
+		return err
+	}
+	fs.sb.xattrTableStart = binary.LittleEndian.Uint64(hdr[0:])
+	fs.sb.xattrIDCount = binary.LittleEndian.Uint32(hdr[8:])
+	fs.xattrIDs, err = fs.readLookupTable(fs.sb.xattrIDTable+16, uint64(fs.sb.xattrIDCount)*xattrIDEntrySz)
+	return err
+}
+
+func (fs *squashFS) id(idx uint16) (uint32, error) {
+	if int(idx) >= len(fs.ids) {
+		return 0, fmt.Errorf("bad id index: %d", idx)
+	}
+	return fs.ids[idx], nil
+}
+
+func (fs *squashFS) readInode(ref uint64) (*inode, error) {
+	r, err := fs.newMetadataReader(fs.sb.inodeTable, ref)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	hdr, err := r.read(16)
+	if err != nil {
+		return nil, err
+	}
+	in := &inode{xattrIdx: invalidXattr, fragIndex: invalidFragment}
+	in.inodeType = le.Uint16(hdr[0:])
+	in.perm = le.Uint16(hdr[2:])
+	if in.uid, err = fs.id(le.Uint16(hdr[4:])); err != nil {
+		return nil, err
+	}
+	if in.gid, err = fs.id(le.Uint16(hdr[6:])); err != nil {
+		return nil, err
+	}
+	in.mtime = le.Uint32(hdr[8:])
+	in.number = le.Uint32(hdr[12:])
+
+	switch in.inodeType {
+	case inodeBasicDir:
+		d, err := r.read(16)
+		if err != nil {
+			return nil, err
+		}
+		in.dirBlock = le.Uint32(d[0:])
+		in.nlink = le.Uint32(d[4:])
+		in.size = uint64(le.Uint16(d[8:]))
+		in.dirOffset = le.Uint16(d[10:])
+	case inodeExtDir:
+		d, err := r.read(24)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(d[0:])
+		in.size = uint64(le.Uint32(d[4:]))
+		in.dirBlock = le.Uint32(d[8:])
+		in.dirOffset = le.Uint16(d[18:])
+		in.xattrIdx = le.Uint32(d[20:])
+	case inodeBasicFile:
+		d, err := r.read(16)
+		if err != nil {
+			return nil, err
+		}
+		in.blocksStart = uint64(le.Uint32(d[0:]))
+		in.fragIndex = le.Uint32(d[4:])
+		in.fragOffset = le.Uint32(d[8:])
+		in.size = uint64(le.Uint32(d[12:]))
+		in.nlink = 1
+	case inodeExtFile:
+		d, err := r.read(40)
+		if err != nil {
+			return nil, err
+		}
+		in.blocksStart = le.Uint64(d[0:])
+		in.size = le.Uint64(d[8:])
+		in.nlink = le.Uint32(d[24:])
+		in.fragIndex = le.Uint32(d[28:])
+		in.fragOffset = le.Uint32(d[32:])
+		in.xattrIdx = le.Uint32(d[36:])
+	case inodeBasicSymlink, inodeExtSymlink:
+		d, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(d[0:])
+		in.size = uint64(le.Uint32(d[4:]))
+		if in.size > 65535 {
+			return nil, fmt.Errorf("bad symlink size")
+		}
+		target, err := r.read(int(in.size))
+		if err != nil {
+			return nil, err
+		}
+		in.target = string(target)
+		if in.inodeType == inodeExtSymlink {
+			x, err := r.read(4)
+			if err != nil {
+				return nil, err
+			}
+			in.xattrIdx = le.Uint32(x)
+		}
+	case inodeBasicBlock, inodeBasicChar:
+		d, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(d[0:])
+		in.rdev = le.Uint32(d[4:])
+	case inodeExtBlock, inodeExtChar:
+		d, err := r.read(12)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(d[0:])
+		in.rdev = le.Uint32(d[4:])
+		in.xattrIdx = le.Uint32(d[8:])
+	case inodeBasicFifo, inodeBasicSocket:
+		d, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(d[0:])
+	case inodeExtFifo, inodeExtSocket:
+		d, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(d[0:])
+		in.xattrIdx = le.Uint32(d[4:])
+	default:
+		return nil, fmt.Errorf("bad inode type: %d", in.inodeType)
+	}
+
+	if in.isFile() {
+		// the tail end of the file can be stored in a fragment
+		blocks := in.size / uint64(fs.sb.blockSize)
+		if in.fragIndex == invalidFragment && in.size%uint64(fs.sb.blockSize) != 0 {
+			blocks++
+		}
+		sizes, err := r.read(int(blocks) * 4)
+		if err != nil {
+			return nil, err
+		}
+		in.blockSizes = make([]uint32, blocks)
+		for i := range in.blockSizes {
+			in.blockSizes[i] = le.Uint32(sizes[i*4:])
+		}
+	}
+	return in, nil
+}
+
+func (in *inode) mode() uint64 {
+	return inodeTypeMode[in.inodeType] | uint64(in.perm&07777)
+}
+
+func (in *inode) isDir() bool {
+	return in.inodeType == inodeBasicDir || in.inodeType == inodeExtDir
+}
+
+func (in *inode) isFile() bool {
+	return in.inodeType == inodeBasicFile || in.inodeType == inodeExtFile
+}
+
+// readDir returns the directory entries (without "." and "..")
+func (fs *squashFS) readDir(in *inode) ([]dirEntry, error) {
+	if !in.isDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+	// the size includes 3 bytes for the (not stored) "." and ".." entries
+	if in.size <= 3 {
+		return nil, nil
+	}
+	r, err := fs.newMetadataReader(fs.sb.directoryTable, uint64(in.dirBlock)<<16|uint64(in.dirOffset))
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.read(int(in.size - 3))
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	var entries []dirEntry
+	for off := 0; off+dirHeaderSize <= len(data); {
+		count := int(le.Uint32(data[off:])) + 1
+		start := uint64(le.Uint32(data[off+4:]))
+		off += dirHeaderSize
+		for i := 0; i < count; i++ {
+			if off+dirEntryBaseSize > len(data) {
+				return nil, fmt.Errorf("bad directory entry")
+			}
+			offset := uint64(le.Uint16(data[off:]))
+			nameSize := int(le.Uint16(data[off+6:])) + 1
+			off += dirEntryBaseSize
+			if off+nameSize > len(data) {
+				return nil, fmt.Errorf("bad directory entry name")
+			}
+			entries = append(entries, dirEntry{name: string(data[off : off+nameSize]), inodeRef: start<<16 | offset})
+			off += nameSize
+		}
+	}
+	return entries, nil
+}
+
+// lookup resolves the path to an inode, symlinks are not followed
+func (fs *squashFS) lookup(path string) (*inode, error) {
+	in, err := fs.readInode(fs.sb.rootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		entries, err := fs.readDir(in)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		found := false
+		for _, e := range entries {
+			if e.name == name {
+				in, err = fs.readInode(e.inodeRef)
+				if err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Can't find file %s", path)
+		}
+	}
+	return in, nil
+}
+
+// xattrs returns the extended attributes of the inode
+func (fs *squashFS) xattrs(in *inode) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	if in.xattrIdx == invalidXattr || fs.xattrIDs == nil {
+		return out, nil
+	}
+	if in.xattrIdx >= fs.sb.xattrIDCount {
+		return nil, fmt.Errorf("bad xattr index: %d", in.xattrIdx)
+	}
+	le := binary.LittleEndian
+	entry := fs.xattrIDs[in.xattrIdx*xattrIDEntrySz:]
+	ref := le.Uint64(entry[0:])
+	count := le.Uint32(entry[8:])
+
+	r, err := fs.newMetadataReader(fs.sb.xattrTableStart, ref)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count; i++ {
+		key, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		xtype := le.Uint16(key[0:])
+		name, err := r.read(int(le.Uint16(key[2:])))
+		if err != nil {
+			return nil, err
+		}
+		vsize, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.read(int(le.Uint32(vsize)))
+		if err != nil {
+			return nil, err
+		}
+		if xtype&xattrValueOOL != 0 {
+			// value is stored out of line, the value is a reference to the actual value
+			if len(value) != 8 {
+				return nil, fmt.Errorf("bad xattr reference")
+			}
+			vr, err := fs.newMetadataReader(fs.sb.xattrTableStart, le.Uint64(value))
+			if err != nil {
+				return nil, err
+			}
+			vsize, err := vr.read(4)
+			if err != nil {
+				return nil, err
+			}
+			if value, err = vr.read(int(le.Uint32(vsize))); err != nil {
+				return nil, err
+			}
+		}
+		out[xattrPrefix[xtype&xattrPrefixMask]+string(name)] = value
+	}
+	return out, nil
+}
+
+func (fs *squashFS) readDataBlock(pos uint64, size uint32, maxSize uint32) ([]byte, error) {
+	data, err := fs.readAt(pos, uint64(size&^dataNoCompr))
+	if err != nil {
+		return nil, err
+	}
+	if size&dataNoCompr == 0 {
+		return fs.decompress(data, int(maxSize))
+	}
+	return data, nil
+}
+
+// fragment returns the decompressed fragment block, the last block is kept
+// since files that share a fragment block are usually read one after another
+func (fs *squashFS) fragment(index uint32) ([]byte, error) {
+	if fs.fragData != nil && fs.fragIndex == index {
+		return fs.fragData, nil
+	}
+	data, err := fs.readDataBlock(fs.fragments[index], fs.fragmentSizes[index], fs.sb.blockSize)
+	if err != nil {
+		return nil, err
+	}
+	fs.fragIndex = index
+	fs.fragData = data
+	return data, nil
+}
+
+type fileReader struct {
+	fs    *squashFS
+	in    *inode
+	block int
+	pos   uint64
+	left  uint64
+	buf   []byte
+}
+
+// reader returns a reader for the content of a regular file
+func (fs *squashFS) reader(in *inode) (io.Reader, error) {
+	if !in.isFile() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	return &fileReader{fs: fs, in: in, pos: in.blocksStart, left: in.size}, nil
+}
+
+func (r *fileReader) fill() error {
+	bs := r.fs.sb.blockSize
+	if r.block < len(r.in.blockSizes) {
+		size := r.in.blockSizes[r.block]
+		r.block++
+		want := uint64(bs)
+		if want > r.left {
+			want = r.left
+		}
+		if size == 0 {
+			// sparse block
+			r.buf = make([]byte, want)
+			return nil
+		}
+		data, err := r.fs.readDataBlock(r.pos, size, bs)
+		if err != nil {
+			return err
+		}
+		r.pos += uint64(size &^ dataNoCompr)
+		if uint64(len(data)) < want {
+			return fmt.Errorf("short data block")
+		}
+		r.buf = data[:want]
+		return nil
+	}
+
+	// tail end stored in a fragment
+	if r.in.fragIndex == invalidFragment || int(r.in.fragIndex) >= len(r.fs.fragments) {
+		return fmt.Errorf("bad fragment index")
+	}
+	data, err := r.fs.fragment(r.in.fragIndex)
+	if err != nil {
+		return err
+	}
+	end := uint64(r.in.fragOffset) + r.left
+	if end > uint64(len(data)) {
+		return fmt.Errorf("bad fragment")
+	}
+	r.buf = data[r.in.fragOffset:end]
+	return nil
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.left -= uint64(n)
+	return n, nil
+}
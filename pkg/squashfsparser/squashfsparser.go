@@ -18,288 +18,202 @@ package squashfsparser
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"os/user"
 	"path"
-	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/capability"
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
-)
-
-const (
-	unsquashfsCmd = "unsquashfs"
-	cpCmd         = "cp"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
 )
 
 // SquashFSParser parses SquashFS filesystem images.
 type SquashFSParser struct {
-	fileLineRegex *regexp.Regexp
-	imagepath     string
-	files         map[string][]fsparser.FileInfo
-	securityInfo  bool
-}
-
-func uidForUsername(username string) (int, error) {
-	// First check to see if it's an int. If not, look it up by name.
-	uid, err := strconv.Atoi(username)
-	if err == nil {
-		return uid, nil
-	}
-	u, err := user.Lookup(username)
-	if err != nil {
-		return 0, err
-	}
-	return strconv.Atoi(u.Uid)
-}
-
-func gidForGroup(group string) (int, error) {
-	// First check to see if it's an int. If not, look it up by name.
-	gid, err := strconv.Atoi(group)
-	if err == nil {
-		return gid, nil
-	}
-	g, err := user.LookupGroup(group)
-	if err != nil {
-		return 0, err
-	}
-	return strconv.Atoi(g.Gid)
-}
-
-// From table[] in https://github.com/plougher/squashfs-tools/blob/master/squashfs-tools/unsquashfs.c
-var modeFlags = []struct {
-	pos int
-	chr byte
-	val uint64
-}{
-	{0, '-', fsparser.S_IFREG},
-	{0, 's', fsparser.S_IFSOCK},
-	{0, 'l', fsparser.S_IFLNK},
-	{0, 'b', fsparser.S_IFBLK},
-	{0, 'd', fsparser.S_IFDIR},
-	{0, 'c', fsparser.S_IFCHR},
-	{0, 'p', fsparser.S_IFIFO},
-	{1, 'r', fsparser.S_IRUSR},
-	{2, 'w', fsparser.S_IWUSR},
-	{3, 'x', fsparser.S_IXUSR},
-	{3, 's', fsparser.S_IXUSR | fsparser.S_ISUID},
-	{3, 'S', fsparser.S_ISUID},
-	{4, 'r', fsparser.S_IRGRP},
-	{5, 'w', fsparser.S_IWGRP},
-	{6, 'x', fsparser.S_IXGRP},
-	{6, 's', fsparser.S_IXGRP | fsparser.S_ISGID},
-	{6, 'S', fsparser.S_ISGID},
-	{7, 'r', fsparser.S_IROTH},
-	{8, 'w', fsparser.S_IWOTH},
-	{9, 'x', fsparser.S_IXOTH},
-	{9, 't', fsparser.S_IXOTH | fsparser.S_ISVTX},
-	{9, 'T', fsparser.S_ISVTX},
-}
-
-func parseMode(mode string) (uint64, error) {
-	var m uint64
-	if len(mode) != 10 {
-		return 0, fmt.Errorf("parseMode: invalid mode string %s", mode)
-	}
-	for _, f := range modeFlags {
-		if mode[f.pos] == f.chr {
-			m |= f.val
-		}
-	}
-	return m, nil
-}
-
-func getExtractFile(dirpath string) (string, error) {
-	extractFile, err := ioutil.TempFile("", "squashfsparser")
-	if err != nil {
-		return "", err
-	}
-	_, err = extractFile.Write([]byte(dirpath))
-	if err != nil {
-		return "", err
-	}
-	err = extractFile.Close()
-	if err != nil {
-		return "", err
-	}
-	return extractFile.Name(), nil
-}
-
-func (s *SquashFSParser) enableSecurityInfo() {
-	// drwxr-xr-x administrator/administrator 66 2019-04-08 18:49 squashfs-root	- -
-	s.fileLineRegex = regexp.MustCompile(`^([A-Za-z-]+)\s+([\-\.\w]+|\d+)/([\-\.\w]+|\d+)\s+(\d+)\s+(\d+-\d+-\d+)\s+(\d+:\d+)\s+([\S ]+)\t(\S+)\s+(\S)`)
-	s.securityInfo = true
+	imagepath    string
+	securityInfo bool
+	fs           *squashFS
+	fsErr        error
 }
 
 // New returns a new SquashFSParser instance for the given image file.
 func New(imagepath string, securityInfo bool) *SquashFSParser {
 	parser := &SquashFSParser{
-		// drwxr-xr-x administrator/administrator 66 2019-04-08 18:49 squashfs-root
-		fileLineRegex: regexp.MustCompile(`^([A-Za-z-]+)\s+([\-\.\w]+|\d+)/([\-\.\w]+|\d+)\s+(\d+)\s+(\d+-\d+-\d+)\s+(\d+:\d+)\s+(.*)$`),
-		imagepath:     imagepath,
-		securityInfo:  false,
-	}
-
-	if securityInfo && securityInfoSupported() {
-		parser.enableSecurityInfo()
+		imagepath:    imagepath,
+		securityInfo: securityInfo,
 	}
-
 	return parser
 }
 
-func normalizePath(filepath string) (dir string, name string) {
-	// Ensure directory and file names are consistent, with no relative parts
-	// or trailing slash on directory names.
-	dir, name = path.Split(path.Clean(filepath))
-	dir = path.Clean(dir)
-	return
+// open the image on first use
+func (s *SquashFSParser) open() (*squashFS, error) {
+	if s.fs == nil && s.fsErr == nil {
+		s.fs, s.fsErr = openSquashFS(s.imagepath)
+	}
+	return s.fs, s.fsErr
 }
 
-func (s *SquashFSParser) parseFileLine(line string) (string, fsparser.FileInfo, error) {
-	// TODO(jlarimer): add support for reading xattrs. unsquashfs can read
-	// and write xattrs, but it doesn't display them when just listing files.
+// fileInfo returns the file info of the inode, the extended attributes are only required
+// for the security info, otherwise a broken xattr table is reported for the file only
+func (s *SquashFSParser) fileInfo(fs *squashFS, in *inode, filepath string) (fsparser.FileInfo, error) {
 	var fi fsparser.FileInfo
-	dirpath := ""
-	res := s.fileLineRegex.FindStringSubmatch(line)
-	if res == nil {
-		return dirpath, fi, fmt.Errorf("Can't match line %s\n", line)
-	}
-	var err error
-	fi.Mode, err = parseMode(res[1])
-	if err != nil {
-		return dirpath, fi, err
-	}
-	// unsquashfs converts the uid/gid to a username/group on this system, so
-	// we need to convert it back to the numeric values.
-	fi.Uid, err = uidForUsername(res[2])
-	if err != nil {
-		return dirpath, fi, err
-	}
-	fi.Gid, err = gidForGroup(res[3])
-	if err != nil {
-		return dirpath, fi, err
-	}
-	fi.Size, err = strconv.ParseInt(res[4], 10, 64)
+	fi.Name = path.Base(filepath)
+	fi.Size = int64(in.size)
+	fi.Mode = in.mode()
+	fi.Uid = int(in.uid)
+	fi.Gid = int(in.gid)
+	fi.LinkTarget = in.target
+	fi.Mtime = int64(in.mtime)
+	fi.Ino = uint64(in.number)
+	fi.Nlink = in.nlink
+	if fi.IsDevice() {
+		fi.Rdev = fsparser.DecodeDev(in.rdev)
+	}
+
+	xattrs, err := fs.xattrs(in)
 	if err != nil {
-		return dirpath, fi, err
+		if s.securityInfo {
+			return fi, err
+		}
+		fmt.Fprintf(os.Stderr, "squashfs: %s: can't read xattrs: %s\n", filepath, err)
 	}
-	// links show up with a name like "./dir2/file3 -> file1"
-	if fi.Mode&fsparser.S_IFLNK == fsparser.S_IFLNK {
-		parts := strings.Split(res[7], " -> ")
-		dirpath, fi.Name = normalizePath(parts[0])
-		fi.LinkTarget = parts[1]
-	} else {
-		dirpath, fi.Name = normalizePath(res[7])
+	if len(xattrs) > 0 {
+		fi.Xattrs = xattrs
 	}
 
 	if s.securityInfo {
-		if res[8] != "-" {
-			fi.Capabilities, _ = capability.New(res[8])
+		fi.SELinuxLabel = fsparser.SELinuxNoLabel
+		if label, ok := xattrs["security.selinux"]; ok {
+			fi.SELinuxLabel = strings.TrimRight(string(label), "\x00")
+		}
+		if caps, ok := xattrs["security.capability"]; ok {
+			fi.Capabilities, _ = capability.New(caps)
 		}
-		fi.SELinuxLabel = res[9]
 	}
-
-	return dirpath, fi, nil
+	return fi, nil
 }
 
-func (s *SquashFSParser) loadFileList() error {
-	if s.files != nil {
-		return nil
+// GetDirInfo returns information on the specified directory.
+func (s *SquashFSParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	fs, err := s.open()
+	if err != nil {
+		return nil, err
 	}
-	s.files = make(map[string][]fsparser.FileInfo)
-
-	// we want to use -lln (numeric output) but that is only available in 4.4 and later
-	args := []string{"-d", "", "-lls", s.imagepath}
-	if s.securityInfo {
-		// -llS is only available in our patched version
-		args = append([]string{"-llS"}, args...)
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return nil, err
 	}
-
-	out, err := exec.Command(unsquashfsCmd, args...).CombinedOutput()
+	entries, err := fs.readDir(in)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "getDirList: %s", err)
-		return err
+		return nil, err
 	}
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		path, fi, err := s.parseFileLine(line)
-		if err == nil {
-			dirfiles := s.files[path]
-			dirfiles = append(dirfiles, fi)
-			s.files[path] = dirfiles
+	var dir []fsparser.FileInfo
+	for _, entry := range entries {
+		ein, err := fs.readInode(entry.inodeRef)
+		if err != nil {
+			return nil, err
 		}
+		fi, err := s.fileInfo(fs, ein, path.Join(dirpath, entry.name))
+		if err != nil {
+			return nil, err
+		}
+		dir = append(dir, fi)
 	}
-	return nil
-}
-
-// GetDirInfo returns information on the specified directory.
-func (s *SquashFSParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
-	if err := s.loadFileList(); err != nil {
-		return nil, err
-	}
-
-	return s.files[path.Clean(dirpath)], nil
+	return dir, nil
 }
 
 // GetFileInfo returns information on the specified file.
 func (s *SquashFSParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
-	if err := s.loadFileList(); err != nil {
+	fs, err := s.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
+	}
+	in, err := fs.lookup(filepath)
+	if err != nil {
 		return fsparser.FileInfo{}, err
 	}
+	return s.fileInfo(fs, in, filepath)
+}
 
-	dirpath, name := normalizePath(filepath)
-	// the root is stored as "."
-	if dirpath == "/" && name == "" {
-		dirpath = "."
-		name = "."
+// Open returns a reader for the content of the file
+func (s *SquashFSParser) Open(filepath string) (io.ReadCloser, error) {
+	fs, err := s.open()
+	if err != nil {
+		return nil, err
 	}
-	dir := s.files[dirpath]
-	for _, fi := range dir {
-		if fi.Name == name {
-			return fi, nil
-		}
+	in, err := fs.lookup(filepath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.reader(in)
+	if err != nil {
+		return nil, fmt.Errorf("squashfsparser: %s: %s", filepath, err)
 	}
-	return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
+	return ioutil.NopCloser(r), nil
 }
 
 // CopyFile copies the specified file to the specified destination.
 func (s *SquashFSParser) CopyFile(filepath string, dstdir string) bool {
-	// The list of files/directories to extract needs to be in a file...
-	extractFile, err := getExtractFile(filepath)
+	r, err := s.Open(filepath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create temporary file: %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
 		return false
 	}
-	defer os.Remove(extractFile)
-
-	// The -d argument to unsquashfs specifies a directory to unsquash to, but
-	// the directory can't exist. It also extracts the full path. To fit the
-	// semantics of CopyFile, we need to extract to a new temporary directly and
-	// then copy the file to the specified destination.
-	tmpdir, err := ioutil.TempDir("", "squashfsparser")
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create temporary directory: %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
 		return false
 	}
-	defer os.RemoveAll(tmpdir)
-	tmpdir = path.Join(tmpdir, "files")
+	return true
+}
 
-	out, err := exec.Command(unsquashfsCmd, "-d", tmpdir, "-e", extractFile, s.imagepath).CombinedOutput()
+// ExtractFiles extracts the regular files into dstdir, the files are extracted in
+// the order of their data in the image so fragment blocks are only decompressed once
+func (s *SquashFSParser) ExtractFiles(filepaths []string, dstdir string) (map[string]string, error) {
+	fs, err := s.open()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unsquashfs failed: %v: %s\n", err, out)
-		return false
+		return nil, err
 	}
 
-	err = exec.Command(cpCmd, "-a", path.Join(tmpdir, filepath), dstdir).Run()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s -a %s %s: failed", cpCmd, path.Join(tmpdir, filepath), dstdir)
-		return false
+	type file struct {
+		filepath string
+		in       *inode
 	}
-	return true
+	var files []file
+	for _, fp := range filepaths {
+		in, err := fs.lookup(fp)
+		if err != nil || !in.isFile() {
+			continue
+		}
+		files = append(files, file{fp, in})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].in.fragIndex != files[j].in.fragIndex {
+			return files[i].in.fragIndex < files[j].in.fragIndex
+		}
+		return files[i].in.blocksStart < files[j].in.blocksStart
+	})
+
+	extracted := make(map[string]string)
+	for _, f := range files {
+		dst := path.Join(dstdir, path.Clean("/"+f.filepath))
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			return extracted, err
+		}
+		r, err := fs.reader(f.in)
+		if err == nil {
+			err = util.WriteFileToDest(r, dst, f.filepath)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "squashfsparser: %s: %s\n", f.filepath, err)
+			continue
+		}
+		extracted[f.filepath] = dst
+	}
+	return extracted, nil
 }
 
 // ImageName returns the name of the filesystem image.
@@ -307,21 +221,7 @@ func (s *SquashFSParser) ImageName() string {
 	return s.imagepath
 }
 
-func (f *SquashFSParser) Supported() bool {
-	_, err := exec.LookPath(unsquashfsCmd)
-	if err != nil {
-		return false
-	}
-	_, err = exec.LookPath(cpCmd)
-	return err == nil
-}
-
-func securityInfoSupported() bool {
-	out, _ := exec.Command(unsquashfsCmd).CombinedOutput()
-	// look for -ll[S] (securityInfo support) in output
-	if strings.Contains(string(out), "-ll[S]") {
-		return true
-	}
-	fmt.Fprintln(os.Stderr, "squashfsparser: security info (selinux + capabilities) not supported by your version of unsquashfs")
-	return false
+// Supported returns true since no external tools are required
+func (s *SquashFSParser) Supported() bool {
+	return true
 }
@@ -17,8 +17,11 @@ limitations under the License.
 package squashfsparser
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
 	"testing"
 
@@ -27,154 +30,6 @@ import (
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
 )
 
-// This could be considered environment-specific...
-func TestUidForUsername(t *testing.T) {
-	uid, err := uidForUsername("root")
-	if err != nil {
-		t.Errorf("uidForUsername(\"root\") returned error: %v", err)
-		return
-	}
-	if uid != 0 {
-		t.Errorf("uidForUsername(\"root\") returned %d, should be 0", uid)
-	}
-
-	_, err = uidForUsername("asdfASDFxxx999")
-	if err == nil {
-		t.Errorf("uidForUsername(\"asdfASDFxxx\") did not return error")
-		return
-	}
-}
-
-// This could be considered environment-specific...
-func TestGidForGroup(t *testing.T) {
-	uid, err := gidForGroup("root")
-	if err != nil {
-		t.Errorf("gidForGroup(\"root\") returned error: %v", err)
-		return
-	}
-	if uid != 0 {
-		t.Errorf("gidForGroup(\"root\") returned %d, should be 0", uid)
-	}
-
-	_, err = gidForGroup("asdfASDFxxx999")
-	if err == nil {
-		t.Errorf("gidForGroup(\"asdfASDFxxx999\") did not return error")
-	}
-}
-
-func TestParseMode(t *testing.T) {
-	tests := []struct {
-		mode   string
-		result uint64
-		err    bool
-	}{
-		{
-			mode: "drwxr-xr-x",
-			result: fsparser.S_IFDIR | fsparser.S_IRWXU | fsparser.S_IRGRP |
-				fsparser.S_IXGRP | fsparser.S_IROTH | fsparser.S_IXOTH,
-			err: false,
-		},
-		{
-			mode: "-rw-r--r--",
-			result: fsparser.S_IFREG | fsparser.S_IRUSR | fsparser.S_IWUSR |
-				fsparser.S_IRGRP | fsparser.S_IROTH,
-			err: false,
-		},
-		{
-			mode: "lrwxrwxrwx",
-			result: fsparser.S_IFLNK | fsparser.S_IRWXU | fsparser.S_IRWXG |
-				fsparser.S_IRWXO,
-			err: false,
-		},
-		{
-			mode: "drwxrwxrwt",
-			result: fsparser.S_IFDIR | fsparser.S_IRWXU | fsparser.S_IRWXG |
-				fsparser.S_IRWXO | fsparser.S_ISVTX,
-			err: false,
-		},
-		{
-			// too short
-			mode:   "blahblah",
-			result: 0,
-			err:    true,
-		},
-		{
-			// too long
-			mode:   "blahblahblah",
-			result: 0,
-			err:    true,
-		},
-	}
-
-	for _, test := range tests {
-		result, err := parseMode(test.mode)
-		if err != nil && !test.err {
-			t.Errorf("parseMode(\"%s\") returned error but shouldn't have: %s", test.mode, err)
-			continue
-		}
-		if result != test.result {
-			t.Errorf("parseMode(\"%s\") should be %#o, is %#o", test.mode, test.result, result)
-		}
-	}
-}
-
-func TestParseFileLine(t *testing.T) {
-	tests := []struct {
-		line    string
-		dirpath string
-		fi      fsparser.FileInfo
-		err     bool
-	}{
-		{
-			line:    "-rw-r--r-- root/root         32 2019-04-10 14:41 /Filey McFileFace",
-			dirpath: "/",
-			fi: fsparser.FileInfo{
-				Size: 32,
-				Mode: 0100644,
-				Uid:  0,
-				Gid:  0,
-				Name: "Filey McFileFace",
-			},
-			err: false,
-		},
-		{
-			line:    "lrwxrwxrwx 1010/2020         5 2019-04-10 14:36 /dir2/file3 -> file1",
-			dirpath: "/dir2",
-			fi: fsparser.FileInfo{
-				Size:       5,
-				Mode:       0120777,
-				Uid:        1010,
-				Gid:        2020,
-				Name:       "file3",
-				LinkTarget: "file1",
-			},
-			err: false,
-		},
-		{
-			line:    "blah blah blah!",
-			dirpath: "",
-			fi:      fsparser.FileInfo{},
-			err:     true,
-		},
-	}
-
-	s := New("", false)
-
-	for _, test := range tests {
-		dirpath, fi, err := s.parseFileLine(test.line)
-		if err != nil && !test.err {
-			t.Errorf("parseFileLine(\"%s\") returned error but shouldn't have: %s", test.line, err)
-			continue
-		}
-		if dirpath != test.dirpath {
-			t.Errorf("parseFileLine(\"%s\") dirpath got \"%s\", wanted \"%s\"", test.line, dirpath, test.dirpath)
-		}
-		if diff := cmp.Diff(fi, test.fi); diff != "" {
-			t.Errorf("parseFileLine(\"%s\") result mismatch (-got, +want):\n%s", test.line, diff)
-		}
-	}
-}
-
 func TestImageName(t *testing.T) {
 	testImage := "../../test/squashfs.img"
 	f := New(testImage, false)
@@ -208,41 +63,56 @@ func TestDirInfoRoot(t *testing.T) {
 	tests := map[string]map[string]fsparser.FileInfo{
 		"/": {
 			"Filey McFileFace": fsparser.FileInfo{
-				Name: "Filey McFileFace",
-				Mode: 0100644,
-				Uid:  0,
-				Gid:  1001,
-				Size: 0,
+				Name:  "Filey McFileFace",
+				Mode:  0100644,
+				Uid:   0,
+				Gid:   1001,
+				Size:  0,
+				Mtime: 1554921696,
+				Ino:   1,
+				Nlink: 1,
 			},
 			"dir1": fsparser.FileInfo{
-				Name: "dir1",
-				Mode: 0040750,
-				Uid:  1007,
-				Gid:  1008,
-				Size: 3,
+				Name:  "dir1",
+				Mode:  0040750,
+				Uid:   1007,
+				Gid:   1008,
+				Size:  3,
+				Mtime: 1554921361,
+				Ino:   2,
+				Nlink: 2,
 			},
 			"dir2": fsparser.FileInfo{
-				Name: "dir2",
-				Mode: 0040755,
-				Uid:  1001,
-				Gid:  1001,
-				Size: 69,
+				Name:  "dir2",
+				Mode:  0040755,
+				Uid:   1001,
+				Gid:   1001,
+				Size:  69,
+				Mtime: 1554921645,
+				Ino:   3,
+				Nlink: 3,
 			},
 		},
 		"/dir2": {
 			"file1": fsparser.FileInfo{
-				Name: "file1",
-				Mode: 0100000,
-				Uid:  1001,
-				Gid:  1001,
-				Size: 7,
+				Name:  "file1",
+				Mode:  0100000,
+				Uid:   1001,
+				Gid:   1001,
+				Size:  7,
+				Mtime: 1554921378,
+				Ino:   4,
+				Nlink: 1,
 			},
 			"file2": fsparser.FileInfo{
-				Name: "file2",
-				Mode: 0104755,
-				Uid:  1001,
-				Gid:  1001,
-				Size: 5,
+				Name:  "file2",
+				Mode:  0104755,
+				Uid:   1001,
+				Gid:   1001,
+				Size:  5,
+				Mtime: 1554921383,
+				Ino:   5,
+				Nlink: 1,
 			},
 			"file3": fsparser.FileInfo{
 				Name:       "file3",
@@ -251,22 +121,31 @@ func TestDirInfoRoot(t *testing.T) {
 				Gid:        1001,
 				Size:       5,
 				LinkTarget: "file1",
+				Mtime:      1554921406,
+				Ino:        6,
+				Nlink:      1,
 			},
 			"subdir2": fsparser.FileInfo{
-				Name: "subdir2",
-				Mode: 0040700,
-				Uid:  1005,
-				Gid:  1005,
-				Size: 28,
+				Name:  "subdir2",
+				Mode:  0040700,
+				Uid:   1005,
+				Gid:   1005,
+				Size:  28,
+				Mtime: 1554921645,
+				Ino:   7,
+				Nlink: 2,
 			},
 		},
 		"/dir2/subdir2": {
 			"file4": fsparser.FileInfo{
-				Name: "file4",
-				Mode: 0100644,
-				Uid:  1001,
-				Gid:  1001,
-				Size: 20,
+				Name:  "file4",
+				Mode:  0100644,
+				Uid:   1001,
+				Gid:   1001,
+				Size:  20,
+				Mtime: 1554921639,
+				Ino:   8,
+				Nlink: 1,
 			},
 		},
 	}
@@ -329,6 +208,9 @@ func TestGetFileInfo(t *testing.T) {
 		Gid:        1001,
 		Size:       5,
 		LinkTarget: "file1",
+		Mtime:      1554921406,
+		Ino:        6,
+		Nlink:      1,
 	}
 
 	if diff := cmp.Diff(fi, tfi); diff != "" {
@@ -376,3 +258,123 @@ func TestSecurityInfo(t *testing.T) {
 	}
 
 }
+
+func TestBrokenXattrs(t *testing.T) {
+	testImage := "../../test/squashfs_cap.img"
+	f := New(testImage, false)
+	fs, err := f.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every xattr index is out of range
+	fs.sb.xattrIDCount = 0
+
+	dir, err := f.GetDirInfo("/")
+	if err != nil || len(dir) == 0 {
+		t.Errorf("broken xattrs should not fail the directory listing: %v", err)
+	}
+	fi, err := f.GetFileInfo("/ifconfig")
+	if err != nil || fi.Xattrs != nil || fi.Size == 0 {
+		t.Errorf("bad file info: %v %v", fi, err)
+	}
+
+	f = New(testImage, true)
+	fs, err = f.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.sb.xattrIDCount = 0
+	if _, err = f.GetFileInfo("/ifconfig"); err == nil {
+		t.Errorf("broken xattrs should fail with security info")
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	// images contain: /bin.seq (seq 1 6000, multiple blocks), /dir1/sub/tiny (fragment),
+	// /link -> dir1/sub/tiny and /tty6 (char device)
+	for _, testImage := range []string{"../../test/squashfs_xz.img", "../../test/squashfs_zstd.img"} {
+		f := New(testImage, false)
+
+		fi, err := f.GetFileInfo("/bin.seq")
+		if err != nil {
+			t.Errorf("%s: %v", testImage, err)
+			continue
+		}
+		if fi.Size != 28893 || fi.Mode != 0100755 {
+			t.Errorf("%s: bad file info for /bin.seq: %v", testImage, fi)
+		}
+
+		fi, err = f.GetFileInfo("/link")
+		if err != nil || fi.LinkTarget != "dir1/sub/tiny" {
+			t.Errorf("%s: bad link: %v %v", testImage, fi, err)
+		}
+
+		fi, err = f.GetFileInfo("/tty6")
+		if err != nil || fi.Mode != fsparser.S_IFCHR|0600 {
+			t.Errorf("%s: /tty6 should be a char device: %v %v", testImage, fi, err)
+		}
+
+		if !f.CopyFile("/bin.seq", "bin.seq") {
+			t.Errorf("%s: CopyFile() returned false", testImage)
+			continue
+		}
+		data, err := ioutil.ReadFile("bin.seq")
+		os.Remove("bin.seq")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(data)) != "3d2fde2943fc7a53ac1df5e2aee11acf55f0b126e410057ce039aa962c22c7c8" {
+			t.Errorf("%s: bad content for /bin.seq", testImage)
+		}
+
+		if !f.CopyFile("/dir1/sub/tiny", "tiny") {
+			t.Errorf("%s: CopyFile() returned false", testImage)
+			continue
+		}
+		data, _ = ioutil.ReadFile("tiny")
+		os.Remove("tiny")
+		if string(data) != "tiny file\n" {
+			t.Errorf("%s: bad content for /dir1/sub/tiny: %q", testImage, data)
+		}
+
+		if f.CopyFile("/dir1", ".") {
+			t.Errorf("%s: CopyFile() of a directory should fail", testImage)
+		}
+	}
+}
+
+func TestExtractFiles(t *testing.T) {
+	for _, testImage := range []string{"../../test/squashfs.img", "../../test/squashfs_xz.img"} {
+		f := New(testImage, false)
+		tmpdir, err := ioutil.TempDir("", "squashfsparser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpdir)
+
+		files := []string{"/dir2/subdir2/file4", "/dir2/file1", "/dir2/file3", "/dir1/sub/tiny", "/bin.seq", "/link", "/tty6"}
+		extracted, err := f.ExtractFiles(files, tmpdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			expected := ""
+			fi, err := f.GetFileInfo(file)
+			if err == nil && fi.IsFile() && !fi.IsLink() {
+				expected = path.Join(tmpdir, file)
+			}
+			if extracted[file] != expected {
+				t.Errorf("%s: bad extracted path for %s: %q", testImage, file, extracted[file])
+				continue
+			}
+			if expected == "" {
+				continue
+			}
+			data, err := ioutil.ReadFile(expected)
+			if err != nil || int64(len(data)) != fi.Size {
+				t.Errorf("%s: bad extracted content of %s: %d %v", testImage, file, len(data), err)
+			}
+		}
+	}
+}
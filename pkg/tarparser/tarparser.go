@@ -0,0 +1,499 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tarparser
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/capability"
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+const (
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+type tarEntry struct {
+	hdr *tar.Header
+	// position of the entry in the archive
+	index int
+	// entry that holds the data (differs from the entry itself for hardlinks)
+	data *tarEntry
+	// number of entries sharing the data (hardlinks) or subdirectories + 2 for directories
+	nlink uint32
+	// position of the data in an uncompressed archive, -1 if the data can't be read directly
+	offset int64
+}
+
+type TarParser struct {
+	imagepath string
+	fixDirs   bool
+	// directory -> entries
+	files map[string][]fsparser.FileInfo
+	// full path -> archive entry
+	entries map[string]*tarEntry
+}
+
+func New(imagepath string, fixDirs bool) *TarParser {
+	parser := &TarParser{
+		imagepath: imagepath,
+		fixDirs:   fixDirs,
+	}
+
+	return parser
+}
+
+func (p *TarParser) ImageName() string {
+	return p.imagepath
+}
+
+// Ensure directory and file names are consistent, with no relative parts
+// or trailing slash on directory names.
+func normalizePath(filepath string) (dir string, name string) {
+	dir, name = path.Split(path.Clean("/" + filepath))
+	dir = path.Clean(dir)
+	return
+}
+
+// fileMode combines the permission bits from the header with the file type
+func fileMode(hdr *tar.Header) uint64 {
+	mode := uint64(hdr.Mode) & 07777
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mode |= fsparser.S_IFDIR
+	case tar.TypeSymlink:
+		mode |= fsparser.S_IFLNK
+	case tar.TypeChar:
+		mode |= fsparser.S_IFCHR
+	case tar.TypeBlock:
+		mode |= fsparser.S_IFBLK
+	case tar.TypeFifo:
+		mode |= fsparser.S_IFIFO
+	default:
+		// regular files and hardlinks
+		mode |= fsparser.S_IFREG
+	}
+	return mode
+}
+
+// xattrs returns the extended attributes stored in the PAX records of the entry
+func xattrs(hdr *tar.Header) map[string][]byte {
+	out := make(map[string][]byte)
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			out[strings.TrimPrefix(key, paxXattrPrefix)] = []byte(value)
+		}
+	}
+	return out
+}
+
+func entryFileInfo(e *tarEntry, name string) fsparser.FileInfo {
+	// hardlinks share the inode of the entry holding the data, the mode and owner
+	// in the header of the hardlink are not used when the archive is extracted
+	if e.data != e {
+		return entryFileInfo(e.data, name)
+	}
+	fi := fsparser.FileInfo{
+		Name:         name,
+		Mode:         fileMode(e.hdr),
+		Uid:          e.hdr.Uid,
+		Gid:          e.hdr.Gid,
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+		Mtime:        e.hdr.ModTime.Unix(),
+		Nlink:        e.data.nlink,
+	}
+	// tar has no inode numbers, the position of the entry holding the data is used instead
+	if e.data.index >= 0 {
+		fi.Ino = uint64(e.data.index) + 1
+	}
+	switch e.hdr.Typeflag {
+	case tar.TypeSymlink:
+		fi.LinkTarget = e.hdr.Linkname
+		fi.Size = int64(len(e.hdr.Linkname))
+	case tar.TypeChar, tar.TypeBlock:
+		fi.Rdev = fsparser.Mkdev(uint32(e.hdr.Devmajor), uint32(e.hdr.Devminor))
+	case tar.TypeDir, tar.TypeFifo:
+	default:
+		fi.Size = e.data.hdr.Size
+	}
+
+	xattrs := xattrs(e.hdr)
+	if len(xattrs) > 0 {
+		fi.Xattrs = xattrs
+	}
+	if label, ok := xattrs["security.selinux"]; ok {
+		fi.SELinuxLabel = strings.TrimRight(string(label), "\x00")
+	}
+	if caps, ok := xattrs["security.capability"]; ok {
+		fi.Capabilities, _ = capability.New(caps)
+	}
+	return fi
+}
+
+// GetDirInfo returns information on the specified directory.
+func (p *TarParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	if err := p.loadFileList(); err != nil {
+		return nil, err
+	}
+
+	return p.files[path.Clean(dirpath)], nil
+}
+
+// GetFileInfo returns information on the specified file.
+func (p *TarParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	if err := p.loadFileList(); err != nil {
+		return fsparser.FileInfo{}, err
+	}
+
+	dirpath, name := normalizePath(filepath)
+	if dirpath == "/" && name == "" {
+		return entryFileInfo(p.entries["/"], "/"), nil
+	}
+	for _, fi := range p.files[dirpath] {
+		if fi.Name == name {
+			return fi, nil
+		}
+	}
+	return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
+}
+
+// countingReader counts the bytes read from the archive, tar.Reader does not read ahead
+// so the count is the position of the data after Next returned
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// isPlain returns true if the data of the entry is stored as is in the archive
+func isPlain(hdr *tar.Header) bool {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return false
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return false
+		}
+	}
+	return true
+}
+
+// open returns a tar reader for the (decompressed) archive, close needs to be called when done
+func (p *TarParser) open() (tr *tar.Reader, close func(), err error) {
+	img, err := os.Open(p.imagepath)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, _, err := decompress.NewReader(img)
+	if err != nil {
+		img.Close()
+		return nil, nil, err
+	}
+	close = func() {
+		r.Close()
+		img.Close()
+	}
+	return tar.NewReader(r), close, nil
+}
+
+func (p *TarParser) loadFileList() error {
+	if p.files != nil {
+		return nil
+	}
+
+	// the data of an uncompressed archive is read directly, see Open
+	var tr *tar.Reader
+	var counter *countingReader
+	if decompress.IsCompressed(p.imagepath) {
+		var close func()
+		var err error
+		tr, close, err = p.open()
+		if err != nil {
+			return err
+		}
+		defer close()
+	} else {
+		img, err := os.Open(p.imagepath)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		counter = &countingReader{r: img}
+		tr = tar.NewReader(counter)
+	}
+
+	var headers []*tar.Header
+	var offsets []int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		headers = append(headers, hdr)
+		offset := int64(-1)
+		if counter != nil && isPlain(hdr) {
+			offset = counter.n
+		}
+		offsets = append(offsets, offset)
+	}
+	return p.loadEntries(headers, offsets)
+}
+
+func (p *TarParser) loadEntries(headers []*tar.Header, offsets []int64) error {
+	p.files = make(map[string][]fsparser.FileInfo)
+	p.entries = make(map[string]*tarEntry)
+
+	for i, hdr := range headers {
+		e := &tarEntry{hdr: hdr, index: i, offset: offsets[i]}
+		e.data = e
+		if hdr.Typeflag == tar.TypeLink {
+			target, ok := p.entries[path.Clean("/"+hdr.Linkname)]
+			if !ok {
+				return fmt.Errorf("tarparser: hardlink target %s of %s not found", hdr.Linkname, hdr.Name)
+			}
+			e.data = target.data
+		}
+
+		dirpath, name := normalizePath(hdr.Name)
+		// root directory ("./" or "/")
+		if name == "" {
+			p.entries["/"] = e
+			continue
+		}
+		fullpath := path.Join(dirpath, name)
+		fi := entryFileInfo(e, name)
+		// the last entry for a path wins
+		if _, exists := p.entries[fullpath]; exists {
+			for i := range p.files[dirpath] {
+				if p.files[dirpath][i].Name == name {
+					p.files[dirpath][i] = fi
+				}
+			}
+		} else {
+			p.files[dirpath] = append(p.files[dirpath], fi)
+		}
+		p.entries[fullpath] = e
+
+		if p.fixDirs {
+			p.fixDir(dirpath, name)
+		}
+	}
+
+	// the archive does not need to contain an entry for the root directory
+	if _, ok := p.entries["/"]; !ok {
+		p.entries["/"] = newDirEntry("/")
+	}
+	p.countLinks()
+	return nil
+}
+
+// countLinks sets the link count of all entries and updates the file infos
+func (p *TarParser) countLinks() {
+	for fullpath, e := range p.entries {
+		if e.hdr.Typeflag == tar.TypeDir {
+			e.nlink += 2
+			if fullpath == "/" {
+				continue
+			}
+		} else {
+			e.data.nlink++
+		}
+		if parent, ok := p.entries[path.Dir(fullpath)]; ok && e.hdr.Typeflag == tar.TypeDir {
+			parent.nlink++
+		}
+	}
+	for dirpath, files := range p.files {
+		for i, fi := range files {
+			files[i] = entryFileInfo(p.entries[path.Join(dirpath, fi.Name)], fi.Name)
+		}
+	}
+}
+
+func newDirEntry(name string) *tarEntry {
+	e := &tarEntry{hdr: &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}, index: -1, offset: -1}
+	e.data = e
+	return e
+}
+
+// fixDir creates missing directories, a tarball can contain "dev/tty6" without an entry for "dev"
+func (p *TarParser) fixDir(dir string, name string) {
+	if dir == "/" {
+		return
+	}
+	basename := path.Base(dir)
+	dirname := path.Dir(dir)
+
+	// check that all dirname parts exist
+	if strings.Contains(dirname, "/") {
+		p.fixDir(dirname, basename)
+	}
+
+	if _, exists := p.entries[dir]; !exists {
+		e := newDirEntry(dir)
+		p.entries[dir] = e
+		p.files[dirname] = append(p.files[dirname], entryFileInfo(e, basename))
+	}
+}
+
+// Open returns a reader for the content of the file
+func (p *TarParser) Open(filepath string) (io.ReadCloser, error) {
+	if err := p.loadFileList(); err != nil {
+		return nil, err
+	}
+	e, ok := p.entries[path.Clean("/"+filepath)]
+	if !ok {
+		return nil, fmt.Errorf("tarparser: can't find file %s", filepath)
+	}
+	if fileMode(e.hdr)&fsparser.S_IFMT != fsparser.S_IFREG {
+		return nil, fmt.Errorf("tarparser: %s is not a regular file", filepath)
+	}
+
+	// the data of an uncompressed archive is read directly
+	if e.data.offset >= 0 {
+		img, err := os.Open(p.imagepath)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{io.NewSectionReader(img, e.data.offset, e.data.hdr.Size), func() { img.Close() }}, nil
+	}
+
+	// compressed archives can only be read sequentially, skip to the entry holding the data
+	tr, close, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i <= e.data.index; i++ {
+		if _, err := tr.Next(); err != nil {
+			close()
+			return nil, err
+		}
+	}
+	return readCloser{tr, close}, nil
+}
+
+// CopyFile copies the specified file to the specified destination.
+func (p *TarParser) CopyFile(filepath string, dstdir string) bool {
+	r, err := p.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// ExtractFiles extracts the regular files into dstdir reading the archive only once
+func (p *TarParser) ExtractFiles(filepaths []string, dstdir string) (map[string]string, error) {
+	if err := p.loadFileList(); err != nil {
+		return nil, err
+	}
+
+	// index of the entry holding the data -> files using the data (hardlinks share the data)
+	wanted := make(map[int][]string)
+	last := -1
+	for _, fp := range filepaths {
+		e, ok := p.entries[path.Clean("/"+fp)]
+		if !ok || fileMode(e.hdr)&fsparser.S_IFMT != fsparser.S_IFREG {
+			continue
+		}
+		wanted[e.data.index] = append(wanted[e.data.index], fp)
+		if e.data.index > last {
+			last = e.data.index
+		}
+	}
+
+	tr, close, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	extracted := make(map[string]string)
+	for i := 0; i <= last; i++ {
+		if _, err := tr.Next(); err != nil {
+			return extracted, err
+		}
+		files, ok := wanted[i]
+		if !ok {
+			continue
+		}
+		err := extractEntry(tr, files, dstdir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tarparser: %s: %s\n", files[0], err)
+			continue
+		}
+		for _, fp := range files {
+			extracted[fp] = path.Join(dstdir, path.Clean("/"+fp))
+		}
+	}
+	return extracted, nil
+}
+
+// extractEntry writes the data of the current entry to all files
+func extractEntry(tr io.Reader, files []string, dstdir string) error {
+	var writers []io.Writer
+	for _, fp := range files {
+		dst := path.Join(dstdir, path.Clean("/"+fp))
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		writers = append(writers, out)
+	}
+	_, err := io.Copy(io.MultiWriter(writers...), tr)
+	return err
+}
+
+// Supported returns true since no external tools are required
+func (p *TarParser) Supported() bool {
+	return true
+}
+
+// readCloser calls close when the reader is closed
+type readCloser struct {
+	io.Reader
+	close func()
+}
+
+func (r readCloser) Close() error {
+	r.close()
+	return nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tarparser
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+// cap_net_admin+ep
+var testCaps = string([]byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+
+var testMtime = time.Unix(1565000000, 0)
+
+func writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	entries := []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "./bin/busybox", Typeflag: tar.TypeReg, Mode: 04755, Uid: 1000, Gid: 1001, ModTime: testMtime,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.security.selinux":    "u:object_r:system_file:s0\x00",
+				"SCHILY.xattr.security.capability": testCaps,
+				"SCHILY.xattr.security.ima":        "\x03\x02\x04",
+			}}, "hello world"},
+		{tar.Header{Name: "./bin/su", Typeflag: tar.TypeLink, Linkname: "./bin/busybox", Mode: 0755}, ""},
+		{tar.Header{Name: "./bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox", Mode: 0777}, ""},
+		{tar.Header{Name: "./dev/tty6", Typeflag: tar.TypeChar, Mode: 0620, Devmajor: 4, Devminor: 6}, ""},
+	}
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func TestCompression(t *testing.T) {
+	compressors := map[string]func(io.Writer) (io.WriteCloser, error){
+		"none": func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		"xz":   func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		"zstd": func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	}
+
+	for name, compressor := range compressors {
+		f, err := ioutil.TempFile("", "tarparser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		cw, err := compressor(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeTar(cw); err != nil {
+			t.Fatal(err)
+		}
+		cw.Close()
+		f.Close()
+
+		p := New(f.Name(), true)
+		testArchive(t, name, p)
+		// the data of an uncompressed archive is read directly
+		if off := p.entries["/bin/busybox"].offset; (name == "none") != (off >= 0) {
+			t.Errorf("%s: bad data offset of /bin/busybox: %d", name, off)
+		}
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func testArchive(t *testing.T, name string, p *TarParser) {
+	fi, err := p.GetFileInfo("/")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("%s: / should be dir: %v", name, err)
+	}
+
+	dir, err := p.GetDirInfo("/bin")
+	if err != nil || len(dir) != 3 {
+		t.Errorf("%s: /bin should contain 3 entries: %v %v", name, dir, err)
+	}
+
+	fi, err = p.GetFileInfo("/bin/busybox")
+	if err != nil || !fi.IsFile() || !fi.IsSUid() || fi.Size != 11 || fi.Uid != 1000 || fi.Gid != 1001 {
+		t.Errorf("%s: bad /bin/busybox: %v %v", name, fi, err)
+	}
+	if fi.SELinuxLabel != "u:object_r:system_file:s0" {
+		t.Errorf("%s: bad selinux label: %s", name, fi.SELinuxLabel)
+	}
+	if len(fi.Capabilities) != 1 || fi.Capabilities[0] != "cap_net_admin+p" {
+		t.Errorf("%s: bad capabilities: %v", name, fi.Capabilities)
+	}
+	if len(fi.Xattrs) != 3 || fsparser.XattrString(fi.Xattrs["security.ima"]) != "030204" {
+		t.Errorf("%s: bad xattrs: %v", name, fi.Xattrs)
+	}
+
+	// hardlinks report the data of the target
+	fi, err = p.GetFileInfo("/bin/su")
+	if err != nil || !fi.IsFile() || fi.Size != 11 {
+		t.Errorf("%s: bad /bin/su: %v %v", name, fi, err)
+	}
+	busybox, _ := p.GetFileInfo("/bin/busybox")
+	if fi.Nlink != 2 || busybox.Nlink != 2 || fi.Ino != busybox.Ino || fi.Ino == 0 {
+		t.Errorf("%s: /bin/su and /bin/busybox should share the inode: %v %v", name, fi, busybox)
+	}
+	// the mode and owner of the hardlink header are ignored
+	if !fi.IsHardlink() || !fi.IsSUid() || fi.HardlinkKey() != busybox.HardlinkKey() {
+		t.Errorf("%s: /bin/su should be a SUID hardlink of /bin/busybox: %v %v", name, fi, busybox)
+	}
+	if busybox.Mtime != testMtime.Unix() {
+		t.Errorf("%s: bad mtime of /bin/busybox: %d", name, busybox.Mtime)
+	}
+	fi, err = p.GetFileInfo("/bin")
+	if err != nil || fi.Nlink != 2 {
+		t.Errorf("%s: bad link count of /bin: %v %v", name, fi, err)
+	}
+
+	fi, err = p.GetFileInfo("/bin/sh")
+	if err != nil || !fi.IsLink() || fi.LinkTarget != "busybox" {
+		t.Errorf("%s: bad /bin/sh: %v %v", name, fi, err)
+	}
+
+	fi, err = p.GetFileInfo("/dev/tty6")
+	if err != nil || fi.Mode != 020620 || fi.DevMajor() != 4 || fi.DevMinor() != 6 {
+		t.Errorf("%s: bad /dev/tty6: %v %v", name, fi, err)
+	}
+
+	// /dev has no entry in the archive and is created by fixdirs
+	fi, err = p.GetFileInfo("/dev")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("%s: /dev should have been created: %v %v", name, fi, err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "tarparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	for _, file := range []string{"/bin/busybox", "/bin/su"} {
+		if !p.CopyFile(file, tmpdir) {
+			t.Errorf("%s: copy of %s failed", name, file)
+			continue
+		}
+		data, err := ioutil.ReadFile(tmpdir + "/" + file[5:])
+		if err != nil || !bytes.Equal(data, []byte("hello world")) {
+			t.Errorf("%s: bad content of %s: %q %v", name, file, data, err)
+		}
+	}
+	if p.CopyFile("/bin/sh", tmpdir) {
+		t.Errorf("%s: copy of a symlink should fail", name)
+	}
+
+	extracted, err := p.ExtractFiles([]string{"/bin/busybox", "/bin/su", "/bin/sh", "/dev/tty6", "/missing"}, tmpdir+"/bulk")
+	if err != nil || len(extracted) != 2 {
+		t.Errorf("%s: only the regular files should be extracted: %v %v", name, extracted, err)
+	}
+	for _, file := range []string{"/bin/busybox", "/bin/su"} {
+		if extracted[file] != tmpdir+"/bulk"+file {
+			t.Errorf("%s: bad extracted path for %s: %s", name, file, extracted[file])
+		}
+		data, err := ioutil.ReadFile(extracted[file])
+		if err != nil || !bytes.Equal(data, []byte("hello world")) {
+			t.Errorf("%s: bad extracted content of %s: %q %v", name, file, data, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubifsparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+/*
+ * Reader for UBI images (the format written by ubinize), provides access
+ * to the logical erase blocks (LEBs) of a volume.
+ * see: linux/drivers/mtd/ubi/ubi-media.h
+ */
+
+const (
+	ubiECMagic        = 0x55424923 // "UBI#"
+	ubiVIDMagic       = 0x55424921 // "UBI!"
+	ubiHeaderSize     = 64
+	ubiLayoutVolumeID = 0x7FFFEFFF
+	ubiVtblRecordSize = 172
+	ubiVolNameMax     = 127
+	ubiMinPEBSize     = 16 * 1024
+	ubiMaxPEBSize     = 16 * 1024 * 1024
+)
+
+// lebReader provides access to the logical erase blocks of a volume
+type lebReader interface {
+	readLEB(lnum int, offs int, size int) ([]byte, error)
+}
+
+// ubiCRC is the crc32 used by UBI and UBIFS (initial value 0xFFFFFFFF, no final xor)
+func ubiCRC(data []byte) uint32 {
+	return ^crc32.ChecksumIEEE(data)
+}
+
+type ubiVolume struct {
+	id      uint32
+	name    string
+	dataOff int64
+	pebSize int64
+	img     io.ReaderAt
+	// lnum -> physical erase block
+	lebs map[uint32]int64
+}
+
+func (v *ubiVolume) readLEB(lnum int, offs int, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	peb, ok := v.lebs[uint32(lnum)]
+	if !ok {
+		// unmapped LEBs read as erased flash
+		for i := range buf {
+			buf[i] = 0xFF
+		}
+		return buf, nil
+	}
+	if int64(offs+size) > v.pebSize-v.dataOff {
+		return nil, fmt.Errorf("ubi: read beyond LEB size")
+	}
+	_, err := v.img.ReadAt(buf, peb*v.pebSize+v.dataOff+int64(offs))
+	return buf, err
+}
+
+// isUBI returns true if the image starts with an UBI erase counter header
+func isUBI(img io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	if _, err := img.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(magic) == ubiECMagic
+}
+
+// ubiPEBSize determines the physical erase block size: the smallest power of two
+// at which every block starts with an erase counter header or is erased
+func ubiPEBSize(img io.ReaderAt, imgSize int64) (int64, error) {
+	magic := make([]byte, 4)
+	for size := int64(ubiMinPEBSize); size <= ubiMaxPEBSize && size < imgSize; size *= 2 {
+		ok := true
+		for off := size; off < imgSize && ok; off += size {
+			if _, err := img.ReadAt(magic, off); err != nil {
+				return 0, err
+			}
+			v := binary.BigEndian.Uint32(magic)
+			ok = v == ubiECMagic || v == 0xFFFFFFFF
+		}
+		if ok {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("ubi: can't determine erase block size")
+}
+
+type ubiVIDHeader struct {
+	volID uint32
+	lnum  uint32
+	sqnum uint64
+}
+
+// readUBIHeaders reads and validates the EC and VID headers of a physical erase block,
+// ok is false if the block does not contain volume data
+func readUBIHeaders(img io.ReaderAt, off int64) (vid ubiVIDHeader, dataOff int64, ok bool, err error) {
+	ec := make([]byte, ubiHeaderSize)
+	if _, err = img.ReadAt(ec, off); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(ec) != ubiECMagic || ubiCRC(ec[:60]) != binary.BigEndian.Uint32(ec[60:]) {
+		return
+	}
+	vidOff := int64(binary.BigEndian.Uint32(ec[16:]))
+	dataOff = int64(binary.BigEndian.Uint32(ec[20:]))
+	vh := make([]byte, ubiHeaderSize)
+	if _, err = img.ReadAt(vh, off+vidOff); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(vh) != ubiVIDMagic || ubiCRC(vh[:60]) != binary.BigEndian.Uint32(vh[60:]) {
+		return
+	}
+	vid.volID = binary.BigEndian.Uint32(vh[8:])
+	vid.lnum = binary.BigEndian.Uint32(vh[12:])
+	vid.sqnum = binary.BigEndian.Uint64(vh[40:])
+	ok = true
+	return
+}
+
+// openUBIVolumes scans all erase blocks and returns the volumes listed in the volume table
+func openUBIVolumes(img io.ReaderAt, imgSize int64) ([]*ubiVolume, error) {
+	pebSize, err := ubiPEBSize(img, imgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	type mapping struct {
+		peb   int64
+		sqnum uint64
+	}
+	lebs := make(map[uint32]map[uint32]mapping)
+	var dataOff int64
+	for peb := int64(0); (peb+1)*pebSize <= imgSize; peb++ {
+		vid, off, ok, err := readUBIHeaders(img, peb*pebSize)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		dataOff = off
+		if lebs[vid.volID] == nil {
+			lebs[vid.volID] = make(map[uint32]mapping)
+		}
+		// the most recent copy of a LEB wins
+		if m, exists := lebs[vid.volID][vid.lnum]; !exists || m.sqnum < vid.sqnum {
+			lebs[vid.volID][vid.lnum] = mapping{peb, vid.sqnum}
+		}
+	}
+
+	newVolume := func(id uint32, name string) *ubiVolume {
+		v := &ubiVolume{id: id, name: name, dataOff: dataOff, pebSize: pebSize, img: img, lebs: make(map[uint32]int64)}
+		for lnum, m := range lebs[id] {
+			v.lebs[lnum] = m.peb
+		}
+		return v
+	}
+
+	layout, ok := lebs[ubiLayoutVolumeID]
+	if !ok {
+		return nil, fmt.Errorf("ubi: volume table not found")
+	}
+	if _, ok := layout[0]; !ok {
+		return nil, fmt.Errorf("ubi: volume table not found")
+	}
+	vtbl, err := newVolume(ubiLayoutVolumeID, "layout").readLEB(0, 0, int(pebSize-dataOff))
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*ubiVolume
+	for i := 0; (i+1)*ubiVtblRecordSize <= len(vtbl); i++ {
+		rec := vtbl[i*ubiVtblRecordSize : (i+1)*ubiVtblRecordSize]
+		if ubiCRC(rec[:168]) != binary.BigEndian.Uint32(rec[168:]) {
+			break
+		}
+		reservedPEBs := binary.BigEndian.Uint32(rec[0:])
+		nameLen := int(binary.BigEndian.Uint16(rec[14:]))
+		if reservedPEBs == 0 || nameLen == 0 || nameLen > ubiVolNameMax {
+			continue
+		}
+		volumes = append(volumes, newVolume(uint32(i), string(rec[16:16+nameLen])))
+	}
+	if len(volumes) == 0 {
+		return nil, fmt.Errorf("ubi: no volumes found")
+	}
+	return volumes, nil
+}
+
+// selectUBIVolume returns the volume with the given name, if name is empty the image
+// needs to contain exactly one volume
+func selectUBIVolume(volumes []*ubiVolume, name string) (*ubiVolume, error) {
+	var names []string
+	for _, v := range volumes {
+		if v.name == name || (name == "" && len(volumes) == 1) {
+			return v, nil
+		}
+		names = append(names, v.name)
+	}
+	sort.Strings(names)
+	if name == "" {
+		return nil, fmt.Errorf("ubi: image contains multiple volumes, select one using volume=<name>: %s", strings.Join(names, ", "))
+	}
+	return nil, fmt.Errorf("ubi: volume %s not found, available volumes: %s", name, strings.Join(names, ", "))
+}
+
+// rawVolume provides LEB access to a plain UBIFS image (no UBI headers)
+type rawVolume struct {
+	img     io.ReaderAt
+	lebSize int64
+}
+
+func (r *rawVolume) readLEB(lnum int, offs int, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := r.img.ReadAt(buf, int64(lnum)*r.lebSize+int64(offs))
+	if err == io.EOF {
+		// the image can be shorter than the filesystem, missing data reads as erased flash
+		copy(buf[n:], bytes.Repeat([]byte{0xFF}, size-n))
+		err = nil
+	}
+	return buf, err
+}
@@ -0,0 +1,667 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ubifsparser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/decompress"
+)
+
+/*
+ * Minimal read-only implementation of UBIFS. The index (TNC) is read once
+ * and the journal is replayed on top of it.
+ * see: linux/fs/ubifs/ubifs-media.h
+ */
+
+const (
+	ubifsNodeMagic   = 0x06101831
+	ubifsCHSize      = 24
+	ubifsBlockSize   = 4096
+	ubifsRootInode   = 1
+	ubifsLogLnum     = 3
+	ubifsMinLEBSize  = 15 * 1024
+	ubifsKeyLen      = 8
+	ubifsFlagAuth    = 0x10
+	ubifsXattrFlag   = 0x20
+	ubifsPaddingByte = 0xCE
+)
+
+// node types
+const (
+	ubifsInoNode  = 0
+	ubifsDataNode = 1
+	ubifsDentNode = 2
+	ubifsXentNode = 3
+	ubifsTrunNode = 4
+	ubifsPadNode  = 5
+	ubifsSBNode   = 6
+	ubifsMstNode  = 7
+	ubifsRefNode  = 8
+	ubifsIdxNode  = 9
+	ubifsCSNode   = 10
+)
+
+// key types
+const (
+	ubifsInoKey  = 0
+	ubifsDataKey = 1
+	ubifsDentKey = 2
+	ubifsXentKey = 3
+)
+
+// compression types
+const (
+	ubifsComprNone = 0
+	ubifsComprLzo  = 1
+	ubifsComprZlib = 2
+	ubifsComprZstd = 3
+)
+
+type ubifsInode struct {
+	inum     uint64
+	size     uint64
+	mtime    uint64
+	nlink    uint32
+	uid      uint32
+	gid      uint32
+	mode     uint32
+	flags    uint32
+	data     []byte
+	xattrCnt uint32
+	sqnum    uint64
+}
+
+type ubifsDent struct {
+	name  string
+	inum  uint64
+	dtype uint8
+}
+
+type ubifsNodeRef struct {
+	lnum int
+	offs int
+	len  int
+}
+
+type ubifsFS struct {
+	img     *os.File
+	vol     lebReader
+	lebSize int
+	inodes  map[uint64]*ubifsInode
+	dents   map[uint64]map[string]ubifsDent
+	xents   map[uint64]map[string]uint64
+	data    map[uint64]map[uint32]ubifsNodeRef
+	log     struct{ lebs, lnum, cmtNo uint64 }
+	csSqnum uint64
+}
+
+func openUbifsFS(imagepath string, volume string) (*ubifsFS, error) {
+	img, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	fs := &ubifsFS{
+		img:    img,
+		inodes: make(map[uint64]*ubifsInode),
+		dents:  make(map[uint64]map[string]ubifsDent),
+		xents:  make(map[uint64]map[string]uint64),
+		data:   make(map[uint64]map[uint32]ubifsNodeRef),
+	}
+	err = fs.open(volume)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *ubifsFS) open(volume string) error {
+	st, err := fs.img.Stat()
+	if err != nil {
+		return err
+	}
+	if isUBI(fs.img) {
+		volumes, err := openUBIVolumes(fs.img, st.Size())
+		if err != nil {
+			return err
+		}
+		fs.vol, err = selectUBIVolume(volumes, volume)
+		if err != nil {
+			return err
+		}
+	} else {
+		if volume != "" {
+			return fmt.Errorf("ubifs: volume selected but image is not an UBI image")
+		}
+		fs.vol = &rawVolume{img: fs.img}
+	}
+
+	if err := fs.readSuperblock(); err != nil {
+		return err
+	}
+	root, err := fs.readMaster()
+	if err != nil {
+		return err
+	}
+	if err := fs.readIndex(root, 0); err != nil {
+		return err
+	}
+	if err := fs.replay(); err != nil {
+		return err
+	}
+	if _, ok := fs.inodes[ubifsRootInode]; !ok {
+		return fmt.Errorf("ubifs: root inode not found")
+	}
+	return nil
+}
+
+// readNode reads the node at the given position and validates the common header
+func (fs *ubifsFS) readNode(ref ubifsNodeRef) ([]byte, uint8, error) {
+	if ref.len < ubifsCHSize || ref.len > fs.lebSize || ref.offs+ref.len > fs.lebSize {
+		return nil, 0, fmt.Errorf("ubifs: bad node reference %d:%d", ref.lnum, ref.offs)
+	}
+	node, err := fs.vol.readLEB(ref.lnum, ref.offs, ref.len)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkNode(node); err != nil {
+		return nil, 0, fmt.Errorf("ubifs: %s at %d:%d", err, ref.lnum, ref.offs)
+	}
+	return node, node[20], nil
+}
+
+func checkNode(node []byte) error {
+	le := binary.LittleEndian
+	if le.Uint32(node) != ubifsNodeMagic {
+		return fmt.Errorf("bad node magic")
+	}
+	nodeLen := int(le.Uint32(node[16:]))
+	if nodeLen < ubifsCHSize || nodeLen > len(node) {
+		return fmt.Errorf("bad node length")
+	}
+	if ubiCRC(node[8:nodeLen]) != le.Uint32(node[4:]) {
+		return fmt.Errorf("bad node crc")
+	}
+	return nil
+}
+
+func (fs *ubifsFS) readSuperblock() error {
+	// the LEB size is not known yet, read enough for the superblock node
+	sb, err := fs.vol.readLEB(0, 0, 4096)
+	if err != nil {
+		return err
+	}
+	if err := checkNode(sb); err != nil || sb[20] != ubifsSBNode {
+		return fmt.Errorf("ubifs: superblock not found")
+	}
+	le := binary.LittleEndian
+	flags := le.Uint32(sb[28:])
+	fs.lebSize = int(le.Uint32(sb[36:]))
+	fs.log.lebs = uint64(le.Uint32(sb[56:]))
+	if flags&ubifsFlagAuth != 0 {
+		return fmt.Errorf("ubifs: authenticated filesystems are not supported")
+	}
+	if fs.lebSize < ubifsMinLEBSize || fs.lebSize > ubiMaxPEBSize {
+		return fmt.Errorf("ubifs: bad LEB size %d", fs.lebSize)
+	}
+	if raw, ok := fs.vol.(*rawVolume); ok {
+		raw.lebSize = int64(fs.lebSize)
+	}
+	return nil
+}
+
+// readMaster returns the location of the root index node, the master node
+// is stored in LEB 1 and 2, the last node in the LEB is the current one
+func (fs *ubifsFS) readMaster() (ubifsNodeRef, error) {
+	var best []byte
+	for lnum := 1; lnum <= 2; lnum++ {
+		leb, err := fs.vol.readLEB(lnum, 0, fs.lebSize)
+		if err != nil {
+			return ubifsNodeRef{}, err
+		}
+		for _, n := range scanNodes(leb, 0) {
+			if n.ntype != ubifsMstNode {
+				continue
+			}
+			if best == nil || sqnum(n.data) > sqnum(best) {
+				best = n.data
+			}
+		}
+	}
+	if best == nil {
+		return ubifsNodeRef{}, fmt.Errorf("ubifs: master node not found")
+	}
+	le := binary.LittleEndian
+	fs.log.cmtNo = le.Uint64(best[32:])
+	fs.log.lnum = uint64(le.Uint32(best[44:]))
+	root := ubifsNodeRef{
+		lnum: int(le.Uint32(best[48:])),
+		offs: int(le.Uint32(best[52:])),
+		len:  int(le.Uint32(best[56:])),
+	}
+	return root, nil
+}
+
+func sqnum(node []byte) uint64 {
+	return binary.LittleEndian.Uint64(node[8:])
+}
+
+type scannedNode struct {
+	offs  int
+	ntype uint8
+	data  []byte
+}
+
+// scanNodes returns the valid nodes in a LEB starting at offs, scanning stops
+// at the first corrupted or empty space
+func scanNodes(leb []byte, offs int) []scannedNode {
+	var nodes []scannedNode
+	le := binary.LittleEndian
+	for offs+ubifsCHSize <= len(leb) {
+		// small gaps are filled with padding bytes instead of a pad node
+		if leb[offs] == ubifsPaddingByte {
+			for offs < len(leb) && leb[offs] == ubifsPaddingByte {
+				offs++
+			}
+			offs = (offs + 7) &^ 7
+			continue
+		}
+		if le.Uint32(leb[offs:]) != ubifsNodeMagic {
+			break
+		}
+		nodeLen := int(le.Uint32(leb[offs+16:]))
+		if nodeLen < ubifsCHSize || offs+nodeLen > len(leb) || checkNode(leb[offs:offs+nodeLen]) != nil {
+			break
+		}
+		node := leb[offs : offs+nodeLen]
+		ntype := node[20]
+		next := offs + nodeLen
+		if ntype == ubifsPadNode && nodeLen >= ubifsCHSize+4 {
+			next += int(le.Uint32(node[24:]))
+		}
+		nodes = append(nodes, scannedNode{offs: offs, ntype: ntype, data: node})
+		// nodes are 8 byte aligned
+		offs = (next + 7) &^ 7
+	}
+	return nodes
+}
+
+func keyInum(key []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(key))
+}
+
+func keyType(key []byte) uint32 {
+	return binary.LittleEndian.Uint32(key[4:]) >> 29
+}
+
+func keyBlock(key []byte) uint32 {
+	return binary.LittleEndian.Uint32(key[4:]) & 0x1FFFFFFF
+}
+
+// readIndex walks the index tree and loads all inode and directory entry nodes,
+// data nodes are only recorded and read on demand
+func (fs *ubifsFS) readIndex(ref ubifsNodeRef, depth int) error {
+	// the index tree is not very deep, protect against loops
+	if depth > 64 {
+		return fmt.Errorf("ubifs: index too deep")
+	}
+	node, ntype, err := fs.readNode(ref)
+	if err != nil {
+		return err
+	}
+	if ntype != ubifsIdxNode {
+		return fmt.Errorf("ubifs: expected index node at %d:%d", ref.lnum, ref.offs)
+	}
+	le := binary.LittleEndian
+	childCnt := int(le.Uint16(node[24:]))
+	level := le.Uint16(node[26:])
+	const branchSize = 12 + ubifsKeyLen
+	if 28+childCnt*branchSize > len(node) {
+		return fmt.Errorf("ubifs: bad index node at %d:%d", ref.lnum, ref.offs)
+	}
+	for i := 0; i < childCnt; i++ {
+		br := node[28+i*branchSize:]
+		child := ubifsNodeRef{
+			lnum: int(le.Uint32(br[0:])),
+			offs: int(le.Uint32(br[4:])),
+			len:  int(le.Uint32(br[8:])),
+		}
+		key := br[12 : 12+ubifsKeyLen]
+		if level > 0 {
+			if err := fs.readIndex(child, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if keyType(key) == ubifsDataKey {
+			fs.addData(keyInum(key), keyBlock(key), child)
+			continue
+		}
+		leaf, _, err := fs.readNode(child)
+		if err != nil {
+			return err
+		}
+		if err := fs.applyNode(leaf, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *ubifsFS) addData(inum uint64, block uint32, ref ubifsNodeRef) {
+	if fs.data[inum] == nil {
+		fs.data[inum] = make(map[uint32]ubifsNodeRef)
+	}
+	fs.data[inum][block] = ref
+}
+
+// applyNode adds the node to the in memory index, nodes need to be applied in sqnum order
+func (fs *ubifsFS) applyNode(node []byte, ref ubifsNodeRef) error {
+	le := binary.LittleEndian
+	switch node[20] {
+	case ubifsInoNode:
+		if len(node) < 160 {
+			return fmt.Errorf("ubifs: short inode node")
+		}
+		in := &ubifsInode{
+			inum:     keyInum(node[24:]),
+			size:     le.Uint64(node[48:]),
+			mtime:    le.Uint64(node[72:]),
+			nlink:    le.Uint32(node[92:]),
+			uid:      le.Uint32(node[96:]),
+			gid:      le.Uint32(node[100:]),
+			mode:     le.Uint32(node[104:]),
+			flags:    le.Uint32(node[108:]),
+			xattrCnt: le.Uint32(node[116:]),
+			sqnum:    sqnum(node),
+		}
+		dataLen := int(le.Uint32(node[112:]))
+		if 160+dataLen > len(node) {
+			return fmt.Errorf("ubifs: bad inode data length")
+		}
+		in.data = append([]byte{}, node[160:160+dataLen]...)
+		if in.nlink == 0 {
+			// deleted inode
+			delete(fs.inodes, in.inum)
+			delete(fs.data, in.inum)
+			delete(fs.xents, in.inum)
+			return nil
+		}
+		fs.inodes[in.inum] = in
+	case ubifsDataNode:
+		fs.addData(keyInum(node[24:]), keyBlock(node[24:]), ref)
+	case ubifsDentNode, ubifsXentNode:
+		if len(node) < 56 {
+			return fmt.Errorf("ubifs: short directory entry node")
+		}
+		host := keyInum(node[24:])
+		inum := le.Uint64(node[40:])
+		nlen := int(le.Uint16(node[50:]))
+		if 56+nlen > len(node) {
+			return fmt.Errorf("ubifs: bad directory entry name length")
+		}
+		name := string(node[56 : 56+nlen])
+		if node[20] == ubifsXentNode {
+			if fs.xents[host] == nil {
+				fs.xents[host] = make(map[string]uint64)
+			}
+			if inum == 0 {
+				delete(fs.xents[host], name)
+			} else {
+				fs.xents[host][name] = inum
+			}
+			return nil
+		}
+		if fs.dents[host] == nil {
+			fs.dents[host] = make(map[string]ubifsDent)
+		}
+		// a directory entry pointing to inode 0 is a deletion
+		if inum == 0 {
+			delete(fs.dents[host], name)
+		} else {
+			fs.dents[host][name] = ubifsDent{name: name, inum: inum, dtype: node[49]}
+		}
+	case ubifsTrunNode:
+		if len(node) < 56 {
+			return fmt.Errorf("ubifs: short truncation node")
+		}
+		inum := uint64(le.Uint32(node[24:]))
+		newSize := le.Uint64(node[48:])
+		for block := range fs.data[inum] {
+			if uint64(block)*ubifsBlockSize >= newSize {
+				delete(fs.data[inum], block)
+			}
+		}
+	}
+	return nil
+}
+
+// replay applies the nodes written to the journal after the last commit
+func (fs *ubifsFS) replay() error {
+	type bud struct{ lnum, offs int }
+	var buds []bud
+	le := binary.LittleEndian
+
+	// the log starts with a commit start node followed by references to the buds
+	for i := uint64(0); i < fs.log.lebs; i++ {
+		lnum := ubifsLogLnum + int((fs.log.lnum-ubifsLogLnum+i)%fs.log.lebs)
+		leb, err := fs.vol.readLEB(lnum, 0, fs.lebSize)
+		if err != nil {
+			return err
+		}
+		nodes := scanNodes(leb, 0)
+		if len(nodes) == 0 {
+			break
+		}
+		if i == 0 {
+			if nodes[0].ntype != ubifsCSNode || le.Uint64(nodes[0].data[24:]) != fs.log.cmtNo {
+				return fmt.Errorf("ubifs: commit start node not found")
+			}
+			fs.csSqnum = sqnum(nodes[0].data)
+		} else if sqnum(nodes[0].data) < fs.csSqnum {
+			// log LEB from a previous commit
+			break
+		}
+		for _, n := range nodes {
+			if n.ntype == ubifsRefNode && len(n.data) >= 36 {
+				buds = append(buds, bud{int(le.Uint32(n.data[24:])), int(le.Uint32(n.data[28:]))})
+			}
+		}
+	}
+
+	var nodes []scannedNode
+	var lnums []int
+	for _, b := range buds {
+		if b.offs >= fs.lebSize {
+			continue
+		}
+		leb, err := fs.vol.readLEB(b.lnum, 0, fs.lebSize)
+		if err != nil {
+			return err
+		}
+		for _, n := range scanNodes(leb, b.offs) {
+			if sqnum(n.data) > fs.csSqnum {
+				nodes = append(nodes, n)
+				lnums = append(lnums, b.lnum)
+			}
+		}
+	}
+	idx := make([]int, len(nodes))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return sqnum(nodes[idx[a]].data) < sqnum(nodes[idx[b]].data) })
+	for _, i := range idx {
+		ref := ubifsNodeRef{lnum: lnums[i], offs: nodes[i].offs, len: len(nodes[i].data)}
+		if err := fs.applyNode(nodes[i].data, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *ubifsInode) isDir() bool {
+	return in.mode&0170000 == 0040000
+}
+
+func (in *ubifsInode) isReg() bool {
+	return in.mode&0170000 == 0100000
+}
+
+func (in *ubifsInode) isLink() bool {
+	return in.mode&0170000 == 0120000
+}
+
+// readDir returns the entries of the directory sorted by name
+func (fs *ubifsFS) readDir(in *ubifsInode) ([]ubifsDent, error) {
+	if !in.isDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+	var entries []ubifsDent
+	for _, d := range fs.dents[in.inum] {
+		if _, ok := fs.inodes[d.inum]; ok {
+			entries = append(entries, d)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+func (fs *ubifsFS) inode(inum uint64) (*ubifsInode, error) {
+	in, ok := fs.inodes[inum]
+	if !ok {
+		return nil, fmt.Errorf("ubifs: inode %d not found", inum)
+	}
+	return in, nil
+}
+
+// lookup resolves the path to an inode, symlinks are not followed
+func (fs *ubifsFS) lookup(path string) (*ubifsInode, error) {
+	in, err := fs.inode(ubifsRootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !in.isDir() {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+		d, ok := fs.dents[in.inum][name]
+		if !ok {
+			return nil, fmt.Errorf("file not found: %s", path)
+		}
+		if in, err = fs.inode(d.inum); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// xattrs returns the extended attributes of the inode, the values are stored in xattr inodes
+func (fs *ubifsFS) xattrs(in *ubifsInode) map[string][]byte {
+	out := make(map[string][]byte)
+	for name, inum := range fs.xents[in.inum] {
+		if xin, ok := fs.inodes[inum]; ok && xin.flags&ubifsXattrFlag != 0 {
+			out[name] = xin.data
+		}
+	}
+	return out
+}
+
+func (fs *ubifsFS) readBlock(ref ubifsNodeRef) ([]byte, error) {
+	node, ntype, err := fs.readNode(ref)
+	if err != nil {
+		return nil, err
+	}
+	if ntype != ubifsDataNode || len(node) < 48 {
+		return nil, fmt.Errorf("ubifs: expected data node at %d:%d", ref.lnum, ref.offs)
+	}
+	le := binary.LittleEndian
+	size := int(le.Uint32(node[40:]))
+	if size > ubifsBlockSize {
+		return nil, fmt.Errorf("ubifs: bad data node size")
+	}
+	data := node[48:]
+	switch le.Uint16(node[44:]) {
+	case ubifsComprNone:
+	case ubifsComprLzo:
+		data, err = decompress.Lzo1x(data, size)
+	case ubifsComprZlib:
+		data, err = decompress.Deflate(data, size)
+	case ubifsComprZstd:
+		data, err = decompress.Zstd(data, size)
+	default:
+		return nil, fmt.Errorf("ubifs: unsupported compression %d", le.Uint16(node[44:]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("ubifs: short data block")
+	}
+	return data[:size], nil
+}
+
+type ubifsFileReader struct {
+	fs     *ubifsFS
+	blocks map[uint32]ubifsNodeRef
+	size   uint64
+	pos    uint64
+	buf    []byte
+}
+
+// reader returns a reader for the content of a regular file
+func (fs *ubifsFS) reader(in *ubifsInode) (io.Reader, error) {
+	if !in.isReg() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	return &ubifsFileReader{fs: fs, blocks: fs.data[in.inum], size: in.size}, nil
+}
+
+func (r *ubifsFileReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		block := uint32(r.pos / ubifsBlockSize)
+		want := r.size - r.pos
+		if want > ubifsBlockSize {
+			want = ubifsBlockSize
+		}
+		r.buf = make([]byte, want)
+		// missing blocks are holes
+		if ref, ok := r.blocks[block]; ok {
+			data, err := r.fs.readBlock(ref)
+			if err != nil {
+				return 0, err
+			}
+			copy(r.buf, data)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += uint64(n)
+	return n, nil
+}
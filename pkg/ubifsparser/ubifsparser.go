@@ -17,35 +17,34 @@ limitations under the License.
 package ubifsparser
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
-	"regexp"
-	"strconv"
 	"strings"
 
+	"github.com/cruise-automation/fwanalyzer/pkg/capability"
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
 )
 
 type UbifsParser struct {
-	fileinfoReg *regexp.Regexp
-	fileLinkReg *regexp.Regexp
-	imagepath   string
+	imagepath    string
+	volume       string
+	securityInfo bool
+	fs           *ubifsFS
+	fsErr        error
 }
 
-const (
-	ubifsReaderCmd = "ubireader_list_files"
-)
-
-func New(imagepath string) *UbifsParser {
+// New returns a parser for an UBIFS image or an UBI image containing UBIFS volumes,
+// volume selects the UBI volume by name and can be empty if the image has only one volume
+func New(imagepath string, volume string, securityInfo bool) *UbifsParser {
 	parser := &UbifsParser{
-		// 120777  1 0 0       0 Mar 13 08:53 tmp -> /var/tmp
-		fileinfoReg: regexp.MustCompile(
-			`^\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\S+\s+\d+)\s+(\d+:\d+)\s+(.+)$`),
-		fileLinkReg: regexp.MustCompile(
-			`(\S+)\s->\s(\S+)`),
-		imagepath: imagepath,
+		imagepath:    imagepath,
+		volume:       volume,
+		securityInfo: securityInfo,
 	}
 
 	return parser
@@ -55,84 +54,110 @@ func (e *UbifsParser) ImageName() string {
 	return e.imagepath
 }
 
-func (e *UbifsParser) parseFileLine(line string) (fsparser.FileInfo, error) {
-	res := e.fileinfoReg.FindAllStringSubmatch(line, -1)
-	var fi fsparser.FileInfo
-	if res == nil {
-		return fi, fmt.Errorf("can't parse: %s", line)
-	}
-	size, _ := strconv.Atoi(res[0][5])
-	fi.Size = int64(size)
-	fi.Mode, _ = strconv.ParseUint(res[0][1], 8, 32)
-	fi.Uid, _ = strconv.Atoi(res[0][3])
-	fi.Gid, _ = strconv.Atoi(res[0][4])
-	fi.Name = res[0][8]
-
-	fi.SELinuxLabel = fsparser.SELinuxNoLabel
-
-	// fill in linktarget
-	if fi.IsLink() && strings.Contains(fi.Name, "->") {
-		rlnk := e.fileLinkReg.FindAllStringSubmatch(fi.Name, -1)
-		if rlnk == nil {
-			return fsparser.FileInfo{}, fmt.Errorf("can't parse LinkTarget from %s", fi.Name)
-		}
-		fi.Name = rlnk[0][1]
-		fi.LinkTarget = rlnk[0][2]
+// open the image on first use, the index is only built once
+func (e *UbifsParser) open() (*ubifsFS, error) {
+	if e.fs == nil && e.fsErr == nil {
+		e.fs, e.fsErr = openUbifsFS(e.imagepath, e.volume)
 	}
+	return e.fs, e.fsErr
+}
 
-	return fi, nil
+func (e *UbifsParser) fileInfo(fs *ubifsFS, in *ubifsInode, name string) fsparser.FileInfo {
+	fi := fsparser.FileInfo{
+		Name:         name,
+		Size:         int64(in.size),
+		Mode:         uint64(in.mode),
+		Uid:          int(in.uid),
+		Gid:          int(in.gid),
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+		Mtime:        int64(in.mtime),
+		Ino:          in.inum,
+		Nlink:        in.nlink,
+	}
+	// the link target is stored as inode data
+	if in.isLink() {
+		fi.LinkTarget = string(in.data)
+	}
+	// the device number is stored as inode data (ubifs_dev_desc)
+	if fi.IsDevice() && len(in.data) >= 4 {
+		fi.Rdev = fsparser.DecodeDev(binary.LittleEndian.Uint32(in.data))
+	}
+	xattrs := fs.xattrs(in)
+	if len(xattrs) > 0 {
+		fi.Xattrs = xattrs
+	}
+	if e.securityInfo {
+		if label, ok := xattrs["security.selinux"]; ok {
+			fi.SELinuxLabel = strings.TrimRight(string(label), "\x00")
+		}
+		if caps, ok := xattrs["security.capability"]; ok {
+			fi.Capabilities, _ = capability.New(caps)
+		}
+	}
+	return fi
 }
 
-func (e *UbifsParser) getDirList(dirpath string) ([]fsparser.FileInfo, error) {
-	out, err := exec.Command(ubifsReaderCmd, "-P", dirpath, e.imagepath).CombinedOutput()
+func (e *UbifsParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	in, err := fs.lookup(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.readDir(in)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
 	var dir []fsparser.FileInfo
-	lines := strings.Split(string(out), "\n")
-	for _, fline := range lines {
-		if fline == "" {
-			continue
-		}
-		fi, err := e.parseFileLine(fline)
+	for _, entry := range entries {
+		ein, err := fs.inode(entry.inum)
 		if err != nil {
 			return nil, err
 		}
-		dir = append(dir, fi)
+		dir = append(dir, e.fileInfo(fs, ein, entry.name))
 	}
 	return dir, nil
 }
 
-func (e *UbifsParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
-	dir, err := e.getDirList(dirpath)
-	return dir, err
-}
-
 func (e *UbifsParser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
-	// return fake entry for root (/)
-	if dirpath == "/" {
-		return fsparser.FileInfo{Name: "/", Mode: fsparser.S_IFDIR}, nil
+	fs, err := e.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
 	}
-
-	listpath := path.Dir(dirpath)
-	listfile := path.Base(dirpath)
-	var fi fsparser.FileInfo
-	dir, err := e.getDirList(listpath)
+	in, err := fs.lookup(dirpath)
 	if err != nil {
-		return fi, err
+		return fsparser.FileInfo{}, err
 	}
+	return e.fileInfo(fs, in, path.Base(dirpath)), nil
+}
 
-	for _, info := range dir {
-		if info.Name == listfile {
-			return info, nil
-		}
+// Open returns a reader for the content of the file
+func (e *UbifsParser) Open(filepath string) (io.ReadCloser, error) {
+	fs, err := e.open()
+	if err != nil {
+		return nil, err
 	}
-	return fi, fmt.Errorf("file not found: %s", dirpath)
+	in, err := fs.lookup(filepath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.reader(in)
+	if err != nil {
+		return nil, fmt.Errorf("ubifsparser: %s: %s", filepath, err)
+	}
+	return ioutil.NopCloser(r), nil
 }
 
 func (e *UbifsParser) CopyFile(filepath string, dstdir string) bool {
-	err := exec.Command(ubifsReaderCmd, "--copy", filepath, "--copy-dest", dstdir, e.imagepath).Run()
+	r, err := e.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return false
@@ -140,7 +165,7 @@ func (e *UbifsParser) CopyFile(filepath string, dstdir string) bool {
 	return true
 }
 
-func (f *UbifsParser) Supported() bool {
-	_, err := exec.LookPath(ubifsReaderCmd)
-	return err == nil
+// Supported returns true since no external tools are required
+func (e *UbifsParser) Supported() bool {
+	return true
 }
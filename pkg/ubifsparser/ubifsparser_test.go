@@ -17,14 +17,88 @@ limitations under the License.
 package ubifsparser
 
 import (
+	"encoding/binary"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
+const (
+	testPEBSize = 256 * 1024
+	testDataOff = 4096
+)
+
+// writeUBI creates an UBI image (like ubinize) containing the given volumes
+func writeUBI(t *testing.T, names []string, volumes [][]byte) string {
+	lebSize := testPEBSize - testDataOff
+	var img []byte
+	sqnum := uint64(0)
+	addPEB := func(volID uint32, lnum uint32, data []byte) {
+		peb := make([]byte, testPEBSize)
+		for i := 2 * ubiHeaderSize; i < len(peb); i++ {
+			peb[i] = 0xFF
+		}
+		ec := peb[0:ubiHeaderSize]
+		binary.BigEndian.PutUint32(ec[0:], ubiECMagic)
+		ec[4] = 1
+		binary.BigEndian.PutUint32(ec[16:], ubiHeaderSize)
+		binary.BigEndian.PutUint32(ec[20:], testDataOff)
+		binary.BigEndian.PutUint32(ec[60:], ubiCRC(ec[:60]))
+		vid := make([]byte, ubiHeaderSize)
+		binary.BigEndian.PutUint32(vid[0:], ubiVIDMagic)
+		vid[4] = 1
+		vid[5] = 1
+		binary.BigEndian.PutUint32(vid[8:], volID)
+		binary.BigEndian.PutUint32(vid[12:], lnum)
+		sqnum++
+		binary.BigEndian.PutUint64(vid[40:], sqnum)
+		binary.BigEndian.PutUint32(vid[60:], ubiCRC(vid[:60]))
+		copy(peb[ubiHeaderSize:], vid)
+		copy(peb[testDataOff:], data)
+		img = append(img, peb...)
+	}
+
+	vtbl := make([]byte, 128*ubiVtblRecordSize)
+	for i := 0; i < 128; i++ {
+		rec := vtbl[i*ubiVtblRecordSize : (i+1)*ubiVtblRecordSize]
+		if i < len(names) {
+			binary.BigEndian.PutUint32(rec[0:], uint32(len(volumes[i])/lebSize+1))
+			binary.BigEndian.PutUint32(rec[4:], 1)
+			rec[12] = 1
+			binary.BigEndian.PutUint16(rec[14:], uint16(len(names[i])))
+			copy(rec[16:], names[i])
+		}
+		binary.BigEndian.PutUint32(rec[168:], ubiCRC(rec[:168]))
+	}
+	addPEB(ubiLayoutVolumeID, 0, vtbl)
+	addPEB(ubiLayoutVolumeID, 1, vtbl)
+
+	for id, data := range volumes {
+		for lnum := 0; lnum*lebSize < len(data); lnum++ {
+			leb := data[lnum*lebSize:]
+			if len(leb) > lebSize {
+				leb = leb[:lebSize]
+			}
+			addPEB(uint32(id), uint32(lnum), leb)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "ubi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(img); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
 func TestCleanup(t *testing.T) {
 	testImage := "../../test/ubifs.img"
 
-	e := New(testImage)
+	e := New(testImage, "", false)
 
 	if e.ImageName() != testImage {
 		t.Errorf("ImageName returned bad name")
@@ -70,7 +144,7 @@ func TestCleanup(t *testing.T) {
 	if fi.IsDir() {
 		t.Errorf("GetFileInfo failed, not a dir")
 	}
-	if fi.Size != 3740436 {
+	if fi.Size != 1917716 {
 		t.Errorf("file size does not match: %s", fi.Name)
 	}
 
@@ -114,3 +188,53 @@ func TestCleanup(t *testing.T) {
 		os.Remove("xxx-test-xxx")
 	}
 }
+
+func TestUBIVolumes(t *testing.T) {
+	ubifsLEBSize := 128 * 1024
+	raw, err := ioutil.ReadFile("../../test/ubifs.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// re-pack the UBIFS LEBs into the (larger) UBI LEBs
+	var rootfs []byte
+	for off := 0; off < len(raw); off += ubifsLEBSize {
+		leb := make([]byte, testPEBSize-testDataOff)
+		for i := range leb {
+			leb[i] = 0xFF
+		}
+		copy(leb, raw[off:])
+		rootfs = append(rootfs, leb...)
+	}
+	image := writeUBI(t, []string{"config", "rootfs"}, [][]byte{[]byte("config data"), rootfs})
+	defer os.Remove(image)
+
+	e := New(image, "rootfs", false)
+	fi, err := e.GetFileInfo("/dateX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.LinkTarget != "date1.txt" {
+		t.Errorf("link does not match: %s", fi.LinkTarget)
+	}
+	if !e.CopyFile("/date1.txt", "xxx-test-xxx") {
+		t.Errorf("copyfile returned false")
+	}
+	os.Remove("xxx-test-xxx")
+
+	// the image contains two volumes, a volume needs to be selected
+	_, err = New(image, "", false).GetFileInfo("/")
+	if err == nil || !strings.Contains(err.Error(), "config, rootfs") {
+		t.Errorf("expected error listing the volumes: %v", err)
+	}
+
+	_, err = New(image, "data", false).GetFileInfo("/")
+	if err == nil {
+		t.Errorf("volume data does not exist")
+	}
+
+	// the config volume does not contain UBIFS
+	_, err = New(image, "config", false).GetFileInfo("/")
+	if err == nil {
+		t.Errorf("config volume should not be readable as UBIFS")
+	}
+}
@@ -108,3 +108,20 @@ func CleanPathDir(pathName string) string {
 	}
 	return cleaned
 }
+
+// WriteFileToDest writes the content of r to dst. If dst is an existing directory
+// the file is created inside of it using name as the filename.
+func WriteFileToDest(r io.Reader, dst string, name string) error {
+	if st, err := os.Stat(dst); err == nil && st.IsDir() {
+		dst = path.Join(dst, path.Base(name))
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vfatparser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+)
+
+/*
+ * Minimal read-only implementation of FAT12/16/32 with VFAT long file names.
+ * see: Microsoft FAT Specification (fatgen103)
+ */
+
+const (
+	dirEntrySize     = 32
+	lfnCharsPerEntry = 13
+	lfnLastEntry     = 0x40
+	entryFree        = 0xE5
+	entryEnd         = 0x00
+	// long name entries have the attributes read-only, hidden, system, and volume set
+	attrLongName     = 0x0F
+	attrLongNameMask = 0x3F
+	// NT reserved byte: lower case base name and extension
+	ntLowerBase = 0x08
+	ntLowerExt  = 0x10
+	// first cluster number that refers to the data region
+	firstDataCluster = 2
+)
+
+type fatType int
+
+const (
+	fat12 fatType = iota
+	fat16
+	fat32
+)
+
+type fatFS struct {
+	img               *os.File
+	fatType           fatType
+	bytesPerSector    uint32
+	sectorsPerCluster uint32
+	clusterSize       uint32
+	fatOffset         int64
+	// FAT12/16 fixed root directory
+	rootDirOffset  int64
+	rootDirEntries uint32
+	// FAT32 root directory cluster
+	rootCluster  uint32
+	dataOffset   int64
+	clusterCount uint32
+	fat          []byte
+}
+
+type fatEntry struct {
+	name      string
+	shortName string
+	attr      uint8
+	cluster   uint32
+	size      uint32
+	mtime     time.Time
+}
+
+func (e *fatEntry) isDir() bool {
+	return e.attr&fsparser.DosAttrDirectory != 0
+}
+
+func openFatFS(imagepath string) (*fatFS, error) {
+	img, err := os.Open(imagepath)
+	if err != nil {
+		return nil, err
+	}
+	fs := &fatFS{img: img}
+	err = fs.readBootSector()
+	if err == nil {
+		fs.fat = make([]byte, fs.fatSize())
+		_, err = img.ReadAt(fs.fat, fs.fatOffset)
+	}
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fatFS) readBootSector() error {
+	bs := make([]byte, 512)
+	if _, err := fs.img.ReadAt(bs, 0); err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	if bs[510] != 0x55 || bs[511] != 0xAA {
+		return fmt.Errorf("not a FAT filesystem")
+	}
+	fs.bytesPerSector = uint32(le.Uint16(bs[11:]))
+	fs.sectorsPerCluster = uint32(bs[13])
+	reservedSectors := uint32(le.Uint16(bs[14:]))
+	numFATs := uint32(bs[16])
+	fs.rootDirEntries = uint32(le.Uint16(bs[17:]))
+	totalSectors := uint32(le.Uint16(bs[19:]))
+	fatSectors := uint32(le.Uint16(bs[22:]))
+	if totalSectors == 0 {
+		totalSectors = le.Uint32(bs[32:])
+	}
+	if fatSectors == 0 {
+		fatSectors = le.Uint32(bs[36:])
+		fs.rootCluster = le.Uint32(bs[44:])
+	}
+
+	switch fs.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("bad FAT sector size: %d", fs.bytesPerSector)
+	}
+	if fs.sectorsPerCluster == 0 || fs.sectorsPerCluster&(fs.sectorsPerCluster-1) != 0 || numFATs == 0 || fatSectors == 0 {
+		return fmt.Errorf("bad FAT boot sector")
+	}
+	fs.clusterSize = fs.bytesPerSector * fs.sectorsPerCluster
+
+	rootDirSectors := (fs.rootDirEntries*dirEntrySize + fs.bytesPerSector - 1) / fs.bytesPerSector
+	firstDataSector := reservedSectors + numFATs*fatSectors + rootDirSectors
+	if totalSectors <= firstDataSector {
+		return fmt.Errorf("bad FAT boot sector")
+	}
+	fs.clusterCount = (totalSectors - firstDataSector) / fs.sectorsPerCluster
+
+	// the FAT type is determined by the number of clusters only
+	switch {
+	case fs.clusterCount < 4085:
+		fs.fatType = fat12
+	case fs.clusterCount < 65525:
+		fs.fatType = fat16
+	default:
+		fs.fatType = fat32
+	}
+	if fs.fatType == fat32 && fs.rootCluster < firstDataCluster {
+		return fmt.Errorf("bad FAT32 root cluster: %d", fs.rootCluster)
+	}
+	if fs.fatType != fat32 && fs.rootDirEntries == 0 {
+		return fmt.Errorf("bad FAT root directory size")
+	}
+
+	fs.fatOffset = int64(reservedSectors) * int64(fs.bytesPerSector)
+	fs.rootDirOffset = int64(reservedSectors+numFATs*fatSectors) * int64(fs.bytesPerSector)
+	fs.dataOffset = int64(firstDataSector) * int64(fs.bytesPerSector)
+	return nil
+}
+
+// fatSize returns the number of bytes of the FAT that are used
+func (fs *fatFS) fatSize() int {
+	entries := int(fs.clusterCount) + firstDataCluster
+	switch fs.fatType {
+	case fat12:
+		// FAT12 entries are read 16bit at a time
+		return (entries*3+1)/2 + 1
+	case fat16:
+		return entries * 2
+	}
+	return entries * 4
+}
+
+// next returns the next cluster in the chain, ok is false at the end of the chain
+func (fs *fatFS) next(cluster uint32) (uint32, bool) {
+	var next, eoc uint32
+	switch fs.fatType {
+	case fat12:
+		off := cluster + cluster/2
+		v := uint32(binary.LittleEndian.Uint16(fs.fat[off:]))
+		if cluster&1 == 1 {
+			next = v >> 4
+		} else {
+			next = v & 0xFFF
+		}
+		eoc = 0xFF7
+	case fat16:
+		next = uint32(binary.LittleEndian.Uint16(fs.fat[cluster*2:]))
+		eoc = 0xFFF7
+	default:
+		next = binary.LittleEndian.Uint32(fs.fat[cluster*4:]) & 0x0FFFFFFF
+		eoc = 0x0FFFFFF7
+	}
+	// end of chain and bad cluster markers
+	if next >= eoc || !fs.validCluster(next) {
+		return 0, false
+	}
+	return next, true
+}
+
+func (fs *fatFS) validCluster(cluster uint32) bool {
+	return cluster >= firstDataCluster && cluster < fs.clusterCount+firstDataCluster
+}
+
+// chain returns the cluster chain starting at cluster
+func (fs *fatFS) chain(cluster uint32) ([]uint32, error) {
+	var clusters []uint32
+	if !fs.validCluster(cluster) {
+		return nil, fmt.Errorf("bad cluster: %d", cluster)
+	}
+	for ok := true; ok; cluster, ok = fs.next(cluster) {
+		if uint32(len(clusters)) > fs.clusterCount {
+			return nil, fmt.Errorf("loop in cluster chain")
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+func (fs *fatFS) clusterOffset(cluster uint32) int64 {
+	return fs.dataOffset + int64(cluster-firstDataCluster)*int64(fs.clusterSize)
+}
+
+// readDirData returns the raw directory entries of the directory starting at cluster,
+// cluster 0 refers to the root directory
+func (fs *fatFS) readDirData(cluster uint32) ([]byte, error) {
+	if cluster == 0 {
+		if fs.fatType == fat32 {
+			cluster = fs.rootCluster
+		} else {
+			data := make([]byte, fs.rootDirEntries*dirEntrySize)
+			_, err := fs.img.ReadAt(data, fs.rootDirOffset)
+			return data, err
+		}
+	}
+	clusters, err := fs.chain(cluster)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(clusters)*int(fs.clusterSize))
+	for i, c := range clusters {
+		if _, err := fs.img.ReadAt(data[i*int(fs.clusterSize):(i+1)*int(fs.clusterSize)], fs.clusterOffset(c)); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func shortName(raw []byte, ntres uint8) string {
+	base := strings.TrimRight(string(raw[0:8]), " ")
+	ext := strings.TrimRight(string(raw[8:11]), " ")
+	if len(base) > 0 && base[0] == 0x05 {
+		base = "\xE5" + base[1:]
+	}
+	if ntres&ntLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if ntres&ntLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func shortNameChecksum(raw []byte) uint8 {
+	var sum uint8
+	for _, b := range raw[0:11] {
+		sum = (sum>>1 | sum<<7) + b
+	}
+	return sum
+}
+
+func lfnChars(e []byte) []uint16 {
+	var chars []uint16
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			chars = append(chars, binary.LittleEndian.Uint16(e[i:]))
+		}
+	}
+	return chars
+}
+
+func fatTime(date uint16, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xF), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2, 0, time.UTC)
+}
+
+// readDir returns the entries of the directory (including "." and ".." if present),
+// volume labels and deleted entries are skipped
+func (fs *fatFS) readDir(cluster uint32) ([]fatEntry, error) {
+	data, err := fs.readDirData(cluster)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	var entries []fatEntry
+	var lfn []uint16
+	var lfnSum uint8
+	lfnNext := 0
+	for off := 0; off+dirEntrySize <= len(data); off += dirEntrySize {
+		e := data[off : off+dirEntrySize]
+		if e[0] == entryEnd {
+			break
+		}
+		if e[0] == entryFree {
+			lfn = nil
+			continue
+		}
+		attr := e[11]
+		if attr&attrLongNameMask == attrLongName {
+			// long name entries are stored in reverse order before the short entry
+			seq := int(e[0] &^ lfnLastEntry)
+			if e[0]&lfnLastEntry != 0 {
+				lfn = make([]uint16, seq*lfnCharsPerEntry)
+				lfnSum = e[13]
+				lfnNext = seq
+			}
+			if lfn == nil || seq != lfnNext || seq == 0 || e[13] != lfnSum {
+				lfn = nil
+				continue
+			}
+			copy(lfn[(seq-1)*lfnCharsPerEntry:], lfnChars(e))
+			lfnNext--
+			continue
+		}
+		if attr&fsparser.DosAttrVolumeID != 0 {
+			lfn = nil
+			continue
+		}
+
+		entry := fatEntry{
+			shortName: shortName(e[0:11], e[12]),
+			attr:      attr,
+			cluster:   uint32(le.Uint16(e[20:]))<<16 | uint32(le.Uint16(e[26:])),
+			size:      le.Uint32(e[28:]),
+			mtime:     fatTime(le.Uint16(e[24:]), le.Uint16(e[22:])),
+		}
+		if fs.fatType != fat32 {
+			entry.cluster &= 0xFFFF
+		}
+		entry.name = entry.shortName
+		if lfn != nil && lfnNext == 0 && lfnSum == shortNameChecksum(e) {
+			// long name is terminated by 0x0000 and padded with 0xFFFF
+			for i, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			entry.name = string(utf16.Decode(lfn))
+		}
+		lfn = nil
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// lookup resolves the path to a directory entry, names are matched case-insensitive
+// against the long and the short name. The root directory is returned as a
+// directory entry with cluster 0.
+func (fs *fatFS) lookup(path string) (fatEntry, error) {
+	entry := fatEntry{name: "/", attr: fsparser.DosAttrDirectory}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !entry.isDir() {
+			return fatEntry{}, fmt.Errorf("file not found: %s", path)
+		}
+		entries, err := fs.readDir(entry.cluster)
+		if err != nil {
+			return fatEntry{}, err
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.name, name) || strings.EqualFold(e.shortName, name) {
+				entry = e
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fatEntry{}, fmt.Errorf("file not found: %s", path)
+		}
+	}
+	return entry, nil
+}
+
+type fatFileReader struct {
+	fs       *fatFS
+	clusters []uint32
+	left     int64
+	pos      int64
+}
+
+// reader returns a reader for the content of a file
+func (fs *fatFS) reader(e fatEntry) (io.Reader, error) {
+	if e.isDir() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	r := &fatFileReader{fs: fs, left: int64(e.size)}
+	if e.size == 0 {
+		return r, nil
+	}
+	clusters, err := fs.chain(e.cluster)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(clusters))*int64(fs.clusterSize) < int64(e.size) {
+		return nil, fmt.Errorf("cluster chain too short for file size")
+	}
+	r.clusters = clusters
+	return r, nil
+}
+
+func (r *fatFileReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	cs := int64(r.fs.clusterSize)
+	cluster := r.clusters[r.pos/cs]
+	inCluster := r.pos % cs
+	n := cs - inCluster
+	if n > r.left {
+		n = r.left
+	}
+	if n > int64(len(p)) {
+		n = int64(len(p))
+	}
+	read, err := r.fs.img.ReadAt(p[:n], r.fs.clusterOffset(cluster)+inCluster)
+	r.pos += int64(read)
+	r.left -= int64(read)
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return read, err
+}
@@ -18,50 +18,24 @@ package vfatparser
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
 
 	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
 )
 
-type mDirReg struct {
-	rx     *regexp.Regexp
-	hasExt bool
-}
-
 type VFatParser struct {
-	mDirRegex []mDirReg
 	imagepath string
+	fs        *fatFS
+	fsErr     error
 }
 
-const (
-	vFatLsCmd string = "mdir"
-	vFatCpCmd string = "mcopy"
-)
-
 func New(imagepath string) *VFatParser {
-	var regs []mDirReg
-	// BZIMAGE        5853744 2018-11-12  10:04  bzImage
-	regs = append(regs, mDirReg{regexp.MustCompile(`^([~\w]+)\s+(\d+)\s\d+-\d+-\d+\s+\d+:\d+\s+(\w+)$`), false})
-	// BZIMAGE  SIG       287 2018-11-12  10:04  bzImage.sig
-	regs = append(regs, mDirReg{regexp.MustCompile(`^([~\w]+)\s+(\w+)\s+(\d+)\s\d+-\d+-\d+\s+\d+:\d+\s+(.+).*`), true})
-	// EFI          <DIR>     2018-11-12  10:04
-	regs = append(regs, mDirReg{regexp.MustCompile(`^([~\.\w]+)\s+<DIR>.*`), false})
-	// startup  nsh        12 2018-11-12  10:04
-	regs = append(regs, mDirReg{regexp.MustCompile(`^([~\w]+)\s+(\w+)\s+(\d+).*`), true})
-	// grubenv           1024 2018-11-12  10:04
-	regs = append(regs, mDirReg{regexp.MustCompile(`^([~\w]+)\s+(\d+).*`), false})
-
 	parser := &VFatParser{
-		mDirRegex: regs,
 		imagepath: imagepath,
 	}
-	// configure mtools to skip size checks on VFAT images
-	os.Setenv("MTOOLS_SKIP_CHECK", "1")
 	return parser
 }
 
@@ -69,100 +43,119 @@ func (f *VFatParser) ImageName() string {
 	return f.imagepath
 }
 
-func (f *VFatParser) parseFileLine(line string) (fsparser.FileInfo, error) {
+// open the image on first use
+func (f *VFatParser) open() (*fatFS, error) {
+	if f.fs == nil && f.fsErr == nil {
+		f.fs, f.fsErr = openFatFS(f.imagepath)
+	}
+	return f.fs, f.fsErr
+}
+
+/*
+ * FAT has no owner and no permissions, the DOS attributes are mapped as follows:
+ *  - all files and directories are owned by 0:0
+ *  - the mode is 0777, the read-only attribute removes the write permissions (0555)
+ *  - the attributes are available unmodified in FileInfo.DosAttributes
+ *  - the modification time is stored as local time, it is reported as UTC
+ */
+func fileInfo(e fatEntry) fsparser.FileInfo {
 	var fi fsparser.FileInfo
-	for _, reg := range f.mDirRegex {
-		res := reg.rx.FindAllStringSubmatch(line, -1)
-		if res != nil {
-			size := 0
-			if len(res[0]) == 2 {
-				fi.Mode = fsparser.S_IFDIR
-			} else {
-				fi.Mode = fsparser.S_IFREG
-				if reg.hasExt {
-					size, _ = strconv.Atoi(res[0][3])
-				} else {
-					size, _ = strconv.Atoi(res[0][2])
-				}
-			}
-			fi.Mode |= fsparser.S_IRWXU | fsparser.S_IRWXG | fsparser.S_IRWXO
-			fi.Size = int64(size)
-			fi.Uid = 0
-			fi.Gid = 0
-			fi.SELinuxLabel = fsparser.SELinuxNoLabel
-			fi.Name = res[0][1]
-			if reg.hasExt {
-				fi.Name = fmt.Sprintf("%s.%s", res[0][1], res[0][2])
-			}
-			// use long name
-			if (!reg.hasExt && len(res[0]) > 3) || (reg.hasExt && len(res[0]) > 4) {
-				fi.Name = res[0][len(res[0])-1]
-			}
-			return fi, nil
-		}
+	fi.Name = e.name
+	if e.isDir() {
+		fi.Mode = fsparser.S_IFDIR
+	} else {
+		fi.Mode = fsparser.S_IFREG
+		fi.Size = int64(e.size)
+	}
+	fi.Mode |= fsparser.S_IRWXU | fsparser.S_IRWXG | fsparser.S_IRWXO
+	if e.attr&fsparser.DosAttrReadOnly != 0 {
+		fi.Mode &^= fsparser.S_IWUSR | fsparser.S_IWGRP | fsparser.S_IWOTH
+	}
+	fi.Uid = 0
+	fi.Gid = 0
+	fi.SELinuxLabel = fsparser.SELinuxNoLabel
+	fi.DosAttributes = e.attr
+	if !e.mtime.IsZero() {
+		fi.Mtime = e.mtime.Unix()
 	}
-	return fi, fmt.Errorf("not a file/dir")
+	return fi
 }
 
+// ignoreDot=true: will filter out "." and ".." files from the directory listing
 func (f *VFatParser) getDirList(dirpath string, ignoreDot bool) ([]fsparser.FileInfo, error) {
-	var dir []fsparser.FileInfo
-	out, err := exec.Command(vFatLsCmd, "-i", f.imagepath, dirpath).CombinedOutput()
+	fs, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := fs.lookup(dirpath)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.isDir() {
+		return nil, fmt.Errorf("not a directory: %s", dirpath)
+	}
+	entries, err := fs.readDir(entry.cluster)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
-	lines := strings.Split(string(out), "\n")
-	for _, fline := range lines {
-		if len(fline) > 1 {
-			fi, err := f.parseFileLine(fline)
-			if err == nil {
-				// filter: . and ..
-				if !ignoreDot || (fi.Name != "." && fi.Name != "..") {
-					dir = append(dir, fi)
-				}
-			}
+	var dir []fsparser.FileInfo
+	for _, e := range entries {
+		// filter: . and ..
+		if ignoreDot && (e.name == "." || e.name == "..") {
+			continue
 		}
+		dir = append(dir, fileInfo(e))
 	}
 	return dir, nil
 }
 
 func (f *VFatParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
-	if dirpath == "" {
-		dirpath = "/"
-	}
 	return f.getDirList(dirpath, true)
 }
 
 func (f *VFatParser) GetFileInfo(dirpath string) (fsparser.FileInfo, error) {
-	// return fake entry for root (/)
-	if dirpath == "/" {
-		return fsparser.FileInfo{Name: "/", Mode: fsparser.S_IFDIR}, nil
+	fs, err := f.open()
+	if err != nil {
+		return fsparser.FileInfo{}, err
 	}
-
-	var fifake fsparser.FileInfo
-	dir, err := f.getDirList(dirpath, false)
+	entry, err := fs.lookup(dirpath)
 	if err != nil {
-		return fifake, err
+		return fsparser.FileInfo{}, err
 	}
+	return fileInfo(entry), nil
+}
 
-	// GetFileInfo was called on non directory
-	if len(dir) == 1 {
-		return dir[0], nil
+// Open returns a reader for the content of the file
+func (f *VFatParser) Open(filepath string) (io.ReadCloser, error) {
+	fs, err := f.open()
+	if err != nil {
+		return nil, err
 	}
-
-	for _, info := range dir {
-		if info.Name == "." {
-			info.Name = filepath.Base(dirpath)
-			return info, nil
-		}
+	entry, err := fs.lookup(filepath)
+	if err != nil {
+		return nil, err
 	}
-
-	return fifake, fmt.Errorf("file not found: %s", dirpath)
+	r, err := fs.reader(entry)
+	if err != nil {
+		return nil, fmt.Errorf("vfatparser: %s: %s", filepath, err)
+	}
+	return ioutil.NopCloser(r), nil
 }
 
 func (f *VFatParser) CopyFile(filepath string, dstdir string) bool {
-	src := fmt.Sprintf("::%s", filepath)
-	_, err := exec.Command(vFatCpCmd, "-bni", f.imagepath, src, dstdir).Output()
+	r, err := f.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	// lookups are case insensitive, use the name as stored in the image
+	fi, err := f.GetFileInfo(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	err = util.WriteFileToDest(r, dstdir, fi.Name)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return false
@@ -170,11 +163,7 @@ func (f *VFatParser) CopyFile(filepath string, dstdir string) bool {
 	return true
 }
 
+// Supported returns true since no external tools are required
 func (f *VFatParser) Supported() bool {
-	_, err := exec.LookPath(vFatCpCmd)
-	if err != nil {
-		return false
-	}
-	_, err = exec.LookPath(vFatLsCmd)
-	return err == nil
+	return true
 }
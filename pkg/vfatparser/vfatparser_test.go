@@ -17,9 +17,13 @@ limitations under the License.
 package vfatparser
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
 )
 
 var f *VFatParser
@@ -95,3 +99,50 @@ func TestGetFileInfo(t *testing.T) {
 		t.Errorf("/ should be dir")
 	}
 }
+
+func TestFat32(t *testing.T) {
+	p := New("../../test/fat32.img")
+
+	dir, err := p.GetDirInfo("/a long directory name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir) != 1 || dir[0].Name != "Long File Name With Spaces.txt" {
+		t.Errorf("bad long file name: %v", dir)
+	}
+
+	tests := []struct {
+		path  string
+		mode  uint64
+		attrs uint8
+	}{
+		{"/HIDDEN.TXT", 0100777, fsparser.DosAttrHidden | fsparser.DosAttrArchive},
+		{"/SYSTEM.BIN", 0100777, fsparser.DosAttrSystem | fsparser.DosAttrArchive},
+		{"/READONLY.TXT", 0100555, fsparser.DosAttrReadOnly | fsparser.DosAttrArchive},
+		{"/EFI/BOOT", 0040777, fsparser.DosAttrDirectory},
+	}
+	for _, test := range tests {
+		fi, err := p.GetFileInfo(test.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Mode != test.mode || fi.DosAttributes != test.attrs {
+			t.Errorf("%s: bad mode/attributes: %o %x", test.path, fi.Mode, fi.DosAttributes)
+		}
+	}
+
+	// lookup is case insensitive
+	if !p.CopyFile("/efi/boot/bootx64.efi", "bootx64.efi") {
+		t.Fatal("CopyFile returned false")
+	}
+	defer os.Remove("bootx64.efi")
+	data, err := ioutil.ReadFile("bootx64.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// seq 1 20000
+	if fmt.Sprintf("%x", sha256.Sum256(data)) != "f6351f5ead9a700e34275480b3856ea738122a7c57bdeb744a631251c069587a" {
+		t.Errorf("bad content for /EFI/BOOT/BOOTX64.EFI")
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zipparser
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cruise-automation/fwanalyzer/pkg/fsparser"
+	"github.com/cruise-automation/fwanalyzer/pkg/util"
+)
+
+const (
+	creatorUnix = 3
+	// Info-ZIP "new unix" extra field (uid/gid)
+	extraUnixN = 0x7875
+	// MS-DOS attributes stored in the low byte of the external attributes
+	msdosReadOnly = 0x01
+	msdosDir      = 0x10
+)
+
+type zipEntry struct {
+	file *zip.File
+	mode uint64
+	uid  int
+	gid  int
+	// symlink target (stored as file content)
+	linkTarget string
+}
+
+type ZipParser struct {
+	imagepath string
+	zr        *zip.ReadCloser
+	// directory -> entries
+	files map[string][]fsparser.FileInfo
+	// full path -> archive entry
+	entries map[string]*zipEntry
+}
+
+func New(imagepath string) *ZipParser {
+	parser := &ZipParser{
+		imagepath: imagepath,
+	}
+
+	return parser
+}
+
+func (p *ZipParser) ImageName() string {
+	return p.imagepath
+}
+
+// Ensure directory and file names are consistent, with no relative parts
+// or trailing slash on directory names.
+func normalizePath(filepath string) (dir string, name string) {
+	dir, name = path.Split(path.Clean("/" + filepath))
+	dir = path.Clean(dir)
+	return
+}
+
+// fileMode returns the unix mode of the entry, archives not created on unix only
+// carry MS-DOS attributes and get default permissions
+func fileMode(f *zip.File) uint64 {
+	if f.CreatorVersion>>8 == creatorUnix && f.ExternalAttrs>>16 != 0 {
+		return uint64(f.ExternalAttrs >> 16)
+	}
+	if f.ExternalAttrs&msdosDir != 0 || strings.HasSuffix(f.Name, "/") {
+		return fsparser.S_IFDIR | 0755
+	}
+	if f.ExternalAttrs&msdosReadOnly != 0 {
+		return fsparser.S_IFREG | 0444
+	}
+	return fsparser.S_IFREG | 0644
+}
+
+// owner returns uid and gid from the Info-ZIP unix extra field
+func owner(extra []byte) (uid int, gid int) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != extraUnixN || len(field) < 2 || field[0] != 1 {
+			continue
+		}
+		// version, uid size, uid, gid size, gid
+		uidSize := int(field[1])
+		if 2+uidSize+1 > len(field) {
+			continue
+		}
+		gidSize := int(field[2+uidSize])
+		if 3+uidSize+gidSize > len(field) {
+			continue
+		}
+		uid = int(readUint(field[2 : 2+uidSize]))
+		gid = int(readUint(field[3+uidSize : 3+uidSize+gidSize]))
+	}
+	return
+}
+
+// read a little endian unsigned integer of variable size
+func readUint(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+func entryFileInfo(e *zipEntry, name string) fsparser.FileInfo {
+	fi := fsparser.FileInfo{
+		Name:         name,
+		Mode:         e.mode,
+		Uid:          e.uid,
+		Gid:          e.gid,
+		SELinuxLabel: fsparser.SELinuxNoLabel,
+		LinkTarget:   e.linkTarget,
+	}
+	if e.file != nil && !fi.IsDir() {
+		fi.Size = int64(e.file.UncompressedSize64)
+	}
+	if e.file != nil && !e.file.Modified.IsZero() {
+		fi.Mtime = e.file.Modified.Unix()
+	}
+	return fi
+}
+
+// GetDirInfo returns information on the specified directory.
+func (p *ZipParser) GetDirInfo(dirpath string) ([]fsparser.FileInfo, error) {
+	if err := p.loadFileList(); err != nil {
+		return nil, err
+	}
+
+	return p.files[path.Clean(dirpath)], nil
+}
+
+// GetFileInfo returns information on the specified file.
+func (p *ZipParser) GetFileInfo(filepath string) (fsparser.FileInfo, error) {
+	if err := p.loadFileList(); err != nil {
+		return fsparser.FileInfo{}, err
+	}
+
+	dirpath, name := normalizePath(filepath)
+	if dirpath == "/" && name == "" {
+		return entryFileInfo(p.entries["/"], "/"), nil
+	}
+	for _, fi := range p.files[dirpath] {
+		if fi.Name == name {
+			return fi, nil
+		}
+	}
+	return fsparser.FileInfo{}, fmt.Errorf("Can't find file %s", filepath)
+}
+
+func (p *ZipParser) loadFileList() error {
+	if p.files != nil {
+		return nil
+	}
+
+	zr, err := zip.OpenReader(p.imagepath)
+	if err != nil {
+		return err
+	}
+	p.zr = zr
+	return p.loadEntries(zr.File)
+}
+
+func (p *ZipParser) loadEntries(files []*zip.File) error {
+	p.files = make(map[string][]fsparser.FileInfo)
+	p.entries = make(map[string]*zipEntry)
+	p.entries["/"] = &zipEntry{mode: fsparser.S_IFDIR | 0755}
+
+	for _, f := range files {
+		e := &zipEntry{file: f, mode: fileMode(f)}
+		e.uid, e.gid = owner(f.Extra)
+		if e.mode&fsparser.S_IFMT == fsparser.S_IFLNK {
+			target, err := readLink(f)
+			if err != nil {
+				return err
+			}
+			e.linkTarget = target
+		}
+
+		dirpath, name := normalizePath(f.Name)
+		if name == "" {
+			p.entries["/"] = e
+			continue
+		}
+		// zip archives usually do not contain entries for directories
+		p.fixDir(dirpath)
+
+		fullpath := path.Join(dirpath, name)
+		fi := entryFileInfo(e, name)
+		// the last entry for a path wins
+		if _, exists := p.entries[fullpath]; exists {
+			for i := range p.files[dirpath] {
+				if p.files[dirpath][i].Name == name {
+					p.files[dirpath][i] = fi
+				}
+			}
+		} else {
+			p.files[dirpath] = append(p.files[dirpath], fi)
+		}
+		p.entries[fullpath] = e
+	}
+	return nil
+}
+
+func readLink(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	target, err := ioutil.ReadAll(r)
+	return string(target), err
+}
+
+// fixDir creates the directory (and its parents) if the archive has no entry for it
+func (p *ZipParser) fixDir(dir string) {
+	if _, exists := p.entries[dir]; exists {
+		return
+	}
+	dirname, basename := normalizePath(dir)
+	p.fixDir(dirname)
+
+	e := &zipEntry{mode: fsparser.S_IFDIR | 0755}
+	p.entries[dir] = e
+	p.files[dirname] = append(p.files[dirname], entryFileInfo(e, basename))
+}
+
+// Open returns a reader for the content of the file
+func (p *ZipParser) Open(filepath string) (io.ReadCloser, error) {
+	if err := p.loadFileList(); err != nil {
+		return nil, err
+	}
+	e, ok := p.entries[path.Clean("/"+filepath)]
+	if !ok {
+		return nil, fmt.Errorf("zipparser: can't find file %s", filepath)
+	}
+	if e.file == nil || e.mode&fsparser.S_IFMT != fsparser.S_IFREG {
+		return nil, fmt.Errorf("zipparser: %s is not a regular file", filepath)
+	}
+	return e.file.Open()
+}
+
+// CopyFile copies the specified file to the specified destination.
+func (p *ZipParser) CopyFile(filepath string, dstdir string) bool {
+	r, err := p.Open(filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer r.Close()
+	err = util.WriteFileToDest(r, dstdir, filepath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Supported returns true since no external tools are required
+func (p *ZipParser) Supported() bool {
+	return true
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019-present, Cruise LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zipparser
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeZip(t *testing.T) string {
+	f, err := ioutil.TempFile("", "zipparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+
+	// uid 1000, gid 1001 in the Info-ZIP unix extra field
+	uxExtra := []byte{0x75, 0x78, 11, 0, 1, 4, 0xe8, 0x03, 0, 0, 4, 0xe9, 0x03, 0, 0}
+	entries := []struct {
+		hdr  zip.FileHeader
+		mode os.FileMode
+		data string
+	}{
+		{zip.FileHeader{Name: "META-INF/com/android/metadata", Method: zip.Deflate}, 0644, "ota-type=AB\n"},
+		{zip.FileHeader{Name: "bin/su", Extra: uxExtra}, 0755 | os.ModeSetuid, "hello world"},
+		{zip.FileHeader{Name: "bin/sh"}, 0777 | os.ModeSymlink, "su"},
+		// created on MS-DOS: no unix mode, read-only attribute
+		{zip.FileHeader{Name: "README.TXT", ExternalAttrs: msdosReadOnly}, 0, "readme"},
+	}
+	for _, e := range entries {
+		hdr := e.hdr
+		if e.mode != 0 {
+			hdr.SetMode(e.mode)
+		}
+		w, err := zw.CreateHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestZip(t *testing.T) {
+	image := writeZip(t)
+	defer os.Remove(image)
+	p := New(image)
+
+	fi, err := p.GetFileInfo("/")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("/ should be dir: %v", err)
+	}
+
+	// directories without entries are created
+	dir, err := p.GetDirInfo("/")
+	if err != nil || len(dir) != 3 {
+		t.Errorf("/ should contain 3 entries: %v %v", dir, err)
+	}
+	fi, err = p.GetFileInfo("/META-INF/com/android")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("bad /META-INF/com/android: %v %v", fi, err)
+	}
+
+	fi, err = p.GetFileInfo("/META-INF/com/android/metadata")
+	if err != nil || fi.Mode != 0100644 || fi.Size != 12 {
+		t.Errorf("bad metadata: %v %v", fi, err)
+	}
+
+	fi, err = p.GetFileInfo("/bin/su")
+	if err != nil || !fi.IsFile() || !fi.IsSUid() || fi.Uid != 1000 || fi.Gid != 1001 {
+		t.Errorf("bad /bin/su: %v %v", fi, err)
+	}
+
+	fi, err = p.GetFileInfo("/bin/sh")
+	if err != nil || !fi.IsLink() || fi.LinkTarget != "su" {
+		t.Errorf("bad /bin/sh: %v %v", fi, err)
+	}
+
+	fi, err = p.GetFileInfo("/README.TXT")
+	if err != nil || fi.Mode != 0100444 {
+		t.Errorf("bad /README.TXT: %v %v", fi, err)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "zipparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if !p.CopyFile("/META-INF/com/android/metadata", tmpdir) {
+		t.Errorf("copy failed")
+	}
+	data, err := ioutil.ReadFile(path.Join(tmpdir, "metadata"))
+	if err != nil || string(data) != "ota-type=AB\n" {
+		t.Errorf("bad content: %q %v", data, err)
+	}
+	if p.CopyFile("/bin/sh", tmpdir) {
+		t.Errorf("copy of a symlink should fail")
+	}
+}
@@ -107,7 +107,6 @@ if __name__ == "__main__":
        os.system("cat test/test_out.json")
        sys.exit(error)
 
-    # disable if your e2ls version does not support selinux (-Z) option
     test("test/test_cfg_selinux.toml")
 
     if error: